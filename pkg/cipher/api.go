@@ -101,6 +101,10 @@ type BlockCipher interface {
 // BlockContext contains optional context associated to a cipher block.
 type BlockContext struct {
 	UserName string
+
+	// Values are additional attributes of the user, e.g. tenant or region.
+	// It is nil if not set. The map must not be modified after it is set.
+	Values map[string]string
 }
 
 // HashPassword generates a hashed password from
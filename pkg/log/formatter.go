@@ -2,6 +2,7 @@ package log
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"sort"
 	"strings"
@@ -121,6 +122,43 @@ func (f *DaemonFormatter) Format(entry *Entry) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// JSONFormatter is a log formatter that prints each entry as a JSON object
+// in a single line. It is suitable for log aggregation pipelines.
+type JSONFormatter struct {
+	NoTimestamp bool
+}
+
+func (f *JSONFormatter) Format(entry *Entry) ([]byte, error) {
+	data := make(Fields, len(entry.Data)+5)
+	for k, v := range entry.Data {
+		if err, ok := v.(error); ok {
+			// Errors are not serialized by encoding/json.
+			v = err.Error()
+		}
+		data[k] = v
+	}
+	if !f.NoTimestamp {
+		data[FieldKeyTime] = entry.Time.Format(time.RFC3339)
+	}
+	data[FieldKeyLevel] = entry.Level.String()
+	data[FieldKeyMsg] = entry.Message
+	if entry.HasCaller() {
+		data[FieldKeyFile] = fmt.Sprintf("%s:%d", entry.Caller.File, entry.Caller.Line)
+		data[FieldKeyFunc] = entry.Caller.Function
+	}
+
+	var buf *bytes.Buffer
+	if entry.Buffer != nil {
+		buf = entry.Buffer
+	} else {
+		buf = &bytes.Buffer{}
+	}
+	if err := json.NewEncoder(buf).Encode(data); err != nil {
+		return nil, fmt.Errorf("failed to marshal fields to JSON: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
 // NilFormatter prints no log. It disables logging.
 type NilFormatter struct{}
 
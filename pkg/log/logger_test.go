@@ -2,6 +2,8 @@ package log
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -35,3 +37,30 @@ func TestLoggerSetBufferPool(t *testing.T) {
 		t.Errorf("Logger.SetBufferPool(): The BufferPool.Put() must be called")
 	}
 }
+
+func TestJSONFormatter(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := New()
+	l.SetOutput(out)
+	l.SetFormatter(&JSONFormatter{NoTimestamp: true})
+
+	l.WithFields(Fields{"session": 42, "error": errors.New("broken pipe")}).Infof("session %s", "closed")
+	var got map[string]any
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal() failed: %v", err)
+	}
+	want := map[string]any{
+		FieldKeyLevel: "info",
+		FieldKeyMsg:   "session closed",
+		"session":     float64(42),
+		"error":       "broken pipe",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d fields, want %d: %v", len(got), len(want), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("field %q = %v, want %v", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// acceptRateLimiter is a token bucket that limits the rate of new
+// underlays accepted by the server.
+type acceptRateLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // tokens added per second
+	burst    float64 // maximum number of tokens
+	tokens   float64
+	lastTime time.Time
+}
+
+func newAcceptRateLimiter(perSecond, burst int) *acceptRateLimiter {
+	return &acceptRateLimiter{
+		rate:     float64(perSecond),
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		lastTime: time.Now(),
+	}
+}
+
+// allow returns true if a new underlay can be accepted now.
+func (l *acceptRateLimiter) allow() bool {
+	return l.allowAt(time.Now())
+}
+
+func (l *acceptRateLimiter) allowAt(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elapsed := now.Sub(l.lastTime); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+		l.lastTime = now
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func (m *Mux) SetAcceptRateLimit(perSecond int, burst int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set accept rate limit in client mux")
+	}
+	if m.used {
+		panic("Can't set accept rate limit after mux is used")
+	}
+	if perSecond <= 0 || burst <= 0 {
+		panic(fmt.Sprintf("Accept rate limit %d per second with burst %d is not positive", perSecond, burst))
+	}
+	m.accepts = newAcceptRateLimiter(perSecond, burst)
+	m.logf(log.InfoLevel, "Mux accept rate limit is set to %d per second with burst %d", perSecond, burst)
+	return m
+}
+
+// dropRateLimited closes the raw connection and returns true
+// if it exceeds the accept rate limit. It runs before any cipher or
+// underlay is created, so the connections over the limit are cheap.
+func (m *Mux) dropRateLimited(rawConn net.Conn) bool {
+	if m.accepts == nil || m.accepts.allow() {
+		return false
+	}
+	UnderlayRateLimited.Add(1)
+	m.logf(log.DebugLevel, "Mux dropped connection from %v: accept rate limit exceeded", rawConn.RemoteAddr())
+	rawConn.Close()
+	return true
+}
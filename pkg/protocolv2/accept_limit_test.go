@@ -0,0 +1,85 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestAcceptRateLimiter(t *testing.T) {
+	l := newAcceptRateLimiter(2, 3)
+	now := l.lastTime
+	for i := 0; i < 3; i++ {
+		if !l.allowAt(now) {
+			t.Fatalf("allowAt() = false within burst")
+		}
+	}
+	if l.allowAt(now) {
+		t.Errorf("allowAt() = true after burst is used")
+	}
+	if !l.allowAt(now.Add(500 * time.Millisecond)) {
+		t.Errorf("allowAt() = false after a token is added")
+	}
+	if l.allowAt(now.Add(500 * time.Millisecond)) {
+		t.Errorf("allowAt() = true before the next token is added")
+	}
+	// Tokens don't exceed the burst after a long time.
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.allowAt(later) {
+			t.Fatalf("allowAt() = false within burst")
+		}
+	}
+	if l.allowAt(later) {
+		t.Errorf("allowAt() = true after burst is used")
+	}
+}
+
+func TestAcceptRateLimit(t *testing.T) {
+	serverMux, endpoint := startTestMux(t, util.TCPTransport, func(m *Mux) {
+		m.SetAcceptRateLimit(1, 2)
+	})
+	before := UnderlayRateLimited.Load()
+	conns := make([]net.Conn, 0)
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", endpoint.RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("net.Dial() failed: %v", err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	// The server accepts the connections in order. The ones over the limit
+	// are closed, after the ones before them are added to the mux.
+	for _, conn := range conns[2:] {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Read() error = %v, want %v", err, io.EOF)
+		}
+	}
+	if got := UnderlayRateLimited.Load() - before; got != 3 {
+		t.Errorf("UnderlayRateLimited increased by %d, want 3", got)
+	}
+	if _, total := serverMux.UnderlayCount(); total != 2 {
+		t.Errorf("server has %d underlays, want 2", total)
+	}
+}
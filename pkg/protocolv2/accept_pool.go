@@ -0,0 +1,110 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// readySessionSharer is implemented by underlays that can deliver the
+// accepted sessions to a channel shared with other underlays.
+type readySessionSharer interface {
+	shareReadySessions(ch chan *Session)
+}
+
+// startAcceptWorkers starts the worker pool that forwards the sessions
+// accepted by all the server underlays, if the pool is enabled.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) startAcceptWorkers() {
+	if m.acceptWorkers <= 0 || m.readySessions != nil {
+		return
+	}
+	m.readySessions = make(chan *Session, sessionChanCapacity)
+	for i := 0; i < m.acceptWorkers; i++ {
+		go m.runAcceptWorker()
+	}
+	m.logf(log.InfoLevel, "Mux started %d accept workers", m.acceptWorkers)
+}
+
+// runAcceptWorker forwards the sessions from the shared channel to the mux
+// until the mux is closed.
+func (m *Mux) runAcceptWorker() {
+	for {
+		select {
+		case session := <-m.readySessions:
+			m.acceptPooledSession(session)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// acceptPooledSession forwards a session accepted by the worker pool.
+// A panic closes the underlay of the session, like the accept goroutine
+// of the underlay would.
+func (m *Mux) acceptPooledSession(session *Session) {
+	underlay := session.underlay()
+	defer func() {
+		if r := recover(); r != nil {
+			m.onUnderlayPanic(underlay, "Accept", r)
+			underlay.Close()
+		}
+	}()
+	m.forwardAccepted(session)
+}
+
+// forwardAccepted passes a session accepted by a server underlay to
+// the consumer of the mux, unless the mux is draining or under memory
+// pressure.
+func (m *Mux) forwardAccepted(conn net.Conn) {
+	if m.isStopped() {
+		m.logf(log.DebugLevel, "Mux is draining, rejecting %v", conn)
+		conn.Close()
+		return
+	}
+	if m.underMemoryPressure() {
+		m.logf(log.DebugLevel, "Mux is under memory pressure, rejecting %v", conn)
+		rejectOverloaded(conn)
+		return
+	}
+	if session, ok := conn.(*Session); ok {
+		if m.writeBuffer > 0 {
+			session.setWriteBuffer(m.writeBuffer)
+		}
+		m.onSessionOpen(session)
+	}
+	m.enqueueAccept(conn)
+}
+
+func (m *Mux) SetAcceptWorkers(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set accept workers in client mux")
+	}
+	if n < 0 {
+		panic(fmt.Sprintf("Accept workers %d is negative", n))
+	}
+	if m.used {
+		panic("Can't set accept workers after mux is used")
+	}
+	m.acceptWorkers = n
+	m.logf(log.InfoLevel, "Mux accept workers is set to %d", n)
+	return m
+}
@@ -0,0 +1,117 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// OverflowPolicy determines what the server does with a new session
+// when the accept queue is full.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock waits until there is space in the accept queue.
+	// No session is lost, but a slow consumer stops the underlay from reading
+	// new data, which also delays the existing sessions of the underlay.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest closes the new session. The memory used by the
+	// queue is bounded, and the sessions already queued are kept.
+	OverflowDropNewest
+
+	// OverflowDropOldest closes the session that has waited longest in the
+	// queue and queues the new one. The memory used by the queue is bounded,
+	// and the consumer always sees the most recent sessions, but sessions
+	// may be lost even after they are queued.
+	OverflowDropOldest
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "BLOCK"
+	case OverflowDropNewest:
+		return "DROP_NEWEST"
+	case OverflowDropOldest:
+		return "DROP_OLDEST"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func (m *Mux) SetAcceptQueueSize(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n <= 0 {
+		panic(fmt.Sprintf("Accept queue size %d is not positive", n))
+	}
+	if m.used {
+		panic("Can't set accept queue size after mux is used")
+	}
+	m.chAccept = make(chan net.Conn, n)
+	return m
+}
+
+func (m *Mux) SetAcceptOverflowPolicy(policy OverflowPolicy) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set accept overflow policy in client mux")
+	}
+	if policy != OverflowBlock && policy != OverflowDropNewest && policy != OverflowDropOldest {
+		panic(fmt.Sprintf("Accept overflow policy %d is invalid", policy))
+	}
+	if m.used {
+		panic("Can't set accept overflow policy after mux is used")
+	}
+	m.overflow = policy
+	m.logf(log.InfoLevel, "Mux accept overflow policy is set to %v", policy)
+	return m
+}
+
+// enqueueAccept puts the accepted connection to the accept queue,
+// following the overflow policy.
+func (m *Mux) enqueueAccept(conn net.Conn) {
+	switch m.overflow {
+	case OverflowDropNewest:
+		select {
+		case m.chAccept <- conn:
+		default:
+			m.logf(log.DebugLevel, "Mux accept queue is full, dropping new %v", conn)
+			rejectOverloaded(conn)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case m.chAccept <- conn:
+				return
+			default:
+			}
+			select {
+			case oldest := <-m.chAccept:
+				m.logf(log.DebugLevel, "Mux accept queue is full, dropping oldest %v", oldest)
+				rejectOverloaded(oldest)
+			default:
+			}
+		}
+	default:
+		m.chAccept <- conn
+	}
+}
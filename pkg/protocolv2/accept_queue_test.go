@@ -0,0 +1,110 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSetAcceptQueueSize(t *testing.T) {
+	mux := NewMux(false).SetAcceptQueueSize(3)
+	defer mux.Close()
+	if got := cap(mux.chAccept); got != 3 {
+		t.Errorf("accept queue size = %d, want 3", got)
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("SetAcceptQueueSize(0) didn't panic")
+		}
+	}()
+	mux.SetAcceptQueueSize(0)
+}
+
+func TestAcceptOverflowPolicy(t *testing.T) {
+	isClosed := func(c net.Conn) bool {
+		_, err := c.Write([]byte{0})
+		return errors.Is(err, io.ErrClosedPipe)
+	}
+
+	testCases := []struct {
+		policy      OverflowPolicy
+		wantQueued  int // index of the connection left in the queue
+		wantDropped int // index of the connection closed
+	}{
+		{OverflowDropNewest, 0, 1},
+		{OverflowDropOldest, 1, 0},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			mux := NewMux(false).SetAcceptQueueSize(1).SetAcceptOverflowPolicy(tc.policy)
+			defer mux.Close()
+			var conns [2]net.Conn
+			for i := range conns {
+				var peer net.Conn
+				conns[i], peer = net.Pipe()
+				defer peer.Close()
+				go io.Copy(io.Discard, peer)
+				mux.enqueueAccept(conns[i])
+			}
+			if got := <-mux.chAccept; got != conns[tc.wantQueued] {
+				t.Errorf("connection %d is not queued", tc.wantQueued)
+			}
+			if !isClosed(conns[tc.wantDropped]) {
+				t.Errorf("connection %d is not closed", tc.wantDropped)
+			}
+			if isClosed(conns[tc.wantQueued]) {
+				t.Errorf("connection %d is closed", tc.wantQueued)
+			}
+		})
+	}
+
+	t.Run(OverflowBlock.String(), func(t *testing.T) {
+		mux := NewMux(false).SetAcceptQueueSize(1)
+		defer mux.Close()
+		a, _ := net.Pipe()
+		b, _ := net.Pipe()
+		mux.enqueueAccept(a)
+		enqueued := make(chan struct{})
+		go func() {
+			mux.enqueueAccept(b)
+			close(enqueued)
+		}()
+		select {
+		case <-enqueued:
+			t.Fatalf("enqueueAccept() didn't block when the queue is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+		if got := <-mux.chAccept; got != a {
+			t.Errorf("first connection is not accepted first")
+		}
+		<-enqueued
+		if got := <-mux.chAccept; got != b {
+			t.Errorf("second connection is not accepted")
+		}
+	})
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("SetAcceptOverflowPolicy(7) didn't panic")
+		}
+	}()
+	NewMux(false).SetAcceptOverflowPolicy(OverflowPolicy(7))
+}
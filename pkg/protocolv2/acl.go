@@ -0,0 +1,159 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+)
+
+// addressACL decides if the server accepts traffic from a source address.
+// An address in a blocked network is always rejected. If allowed networks
+// are set, an address must be in one of them. Addresses without an IP,
+// e.g. of Unix domain sockets, are always accepted.
+// A nil addressACL accepts all addresses.
+type addressACL struct {
+	allowed []*net.IPNet
+	blocked []*net.IPNet
+}
+
+// parseCIDRs parses the networks in CIDR notation. A single IP address is
+// taken as a network with only that address.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q: %w", cidr, stderror.ErrInvalidArgument)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, stderror.ErrInvalidArgument)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// permits returns true if the traffic from the address is accepted.
+func (a *addressACL) permits(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+	for _, n := range a.blocked {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allowed) == 0 {
+		return true
+	}
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of the network address, or nil if it doesn't
+// have one.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func (m *Mux) SetAllowedCIDRs(cidrs []string) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set allowed CIDRs in client mux")
+	}
+	if m.used {
+		panic("Can't set allowed CIDRs after mux is used")
+	}
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err.Error())
+	}
+	if m.acl == nil {
+		m.acl = &addressACL{}
+	}
+	m.acl.allowed = nets
+	m.logf(log.InfoLevel, "Mux allowed CIDRs are set to %v", cidrs)
+	return m
+}
+
+func (m *Mux) SetBlockedCIDRs(cidrs []string) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set blocked CIDRs in client mux")
+	}
+	if m.used {
+		panic("Can't set blocked CIDRs after mux is used")
+	}
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err.Error())
+	}
+	if m.acl == nil {
+		m.acl = &addressACL{}
+	}
+	m.acl.blocked = nets
+	m.logf(log.InfoLevel, "Mux blocked CIDRs are set to %v", cidrs)
+	return m
+}
+
+// dropBlockedByACL closes the raw connection and returns true
+// if the source address is not allowed.
+func (m *Mux) dropBlockedByACL(rawConn net.Conn) bool {
+	if m.acl.permits(rawConn.RemoteAddr()) {
+		return false
+	}
+	UnderlayBlockedByACL.Add(1)
+	m.logf(log.DebugLevel, "Mux dropped connection from %v: blocked by ACL", rawConn.RemoteAddr())
+	rawConn.Close()
+	return true
+}
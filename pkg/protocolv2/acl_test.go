@@ -0,0 +1,141 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestAddressACL(t *testing.T) {
+	allowed, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("parseCIDRs() failed: %v", err)
+	}
+	blocked, err := parseCIDRs([]string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatalf("parseCIDRs() failed: %v", err)
+	}
+	acl := &addressACL{allowed: allowed, blocked: blocked}
+	testcases := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.2.3.4"), Port: 1}, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.1.3.4"), Port: 1}, false},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.2"), Port: 1}, false},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}, true},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db9::1"), Port: 1}, false},
+		{&net.UnixAddr{Name: "/tmp/mieru.sock", Net: "unix"}, true},
+	}
+	for _, tc := range testcases {
+		if got := acl.permits(tc.addr); got != tc.want {
+			t.Errorf("permits(%v) = %v, want %v", tc.addr, got, tc.want)
+		}
+	}
+	var none *addressACL
+	if !none.permits(testcases[1].addr) {
+		t.Errorf("nil addressACL doesn't permit %v", testcases[1].addr)
+	}
+	if _, err := parseCIDRs([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("parseCIDRs() succeeded with an invalid CIDR")
+	}
+}
+
+func TestBlockedCIDRs(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestServer(t, transport, func(m *Mux) {
+				m.SetAllowedCIDRs([]string{"127.0.0.0/8"}).SetBlockedCIDRs([]string{"127.0.0.1"})
+			})
+			before := UnderlayBlockedByACL.Load()
+
+			if transport == util.TCPTransport {
+				// The connection is closed before the server does any
+				// handshake, so it never becomes a underlay.
+				conn, err := net.Dial("tcp", endpoint.RemoteAddr().String())
+				if err != nil {
+					t.Fatalf("net.Dial() failed: %v", err)
+				}
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+					t.Errorf("Read() got %v, want the connection closed by server", err)
+				}
+				if stats := serverMux.Stats(); len(stats) != 0 {
+					t.Errorf("server has %d underlays, want 0", len(stats))
+				}
+			} else {
+				clientMux := newTestClient(endpoint)
+				defer clientMux.Close()
+				conn, err := clientMux.DialContext(context.Background())
+				if err != nil {
+					t.Fatalf("DialContext() failed: %v", err)
+				}
+				defer conn.Close()
+				if _, err := conn.Write([]byte("blocked")); err != nil {
+					t.Fatalf("Write() failed: %v", err)
+				}
+				conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					t.Errorf("Read() succeeded from a blocked source address")
+				}
+				if sessions := serverMux.Sessions(); len(sessions) != 0 {
+					t.Errorf("server has %d sessions, want 0", len(sessions))
+				}
+			}
+			if UnderlayBlockedByACL.Load() == before {
+				t.Errorf("UnderlayBlockedByACL is not increased")
+			}
+		})
+	}
+}
+
+func TestAllowedCIDRs(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, tc := range []struct {
+		cidr      string
+		underlays int
+	}{
+		{"127.0.0.1/32", 1},
+		{"10.0.0.0/8", 0},
+	} {
+		serverMux, endpoint := startTestMux(t, util.TCPTransport, func(m *Mux) {
+			m.SetAllowedCIDRs([]string{tc.cidr})
+		})
+		before := UnderlayBlockedByACL.Load()
+		conn, err := net.Dial("tcp", endpoint.RemoteAddr().String())
+		if err != nil {
+			t.Fatalf("net.Dial() failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+		if n := len(serverMux.Stats()); n != tc.underlays {
+			t.Errorf("allowed %s: server has %d underlays, want %d", tc.cidr, n, tc.underlays)
+		}
+		if blocked := UnderlayBlockedByACL.Load() - before; blocked != int64(1-tc.underlays) {
+			t.Errorf("allowed %s: UnderlayBlockedByACL is increased by %d, want %d", tc.cidr, blocked, 1-tc.underlays)
+		}
+		conn.Close()
+	}
+}
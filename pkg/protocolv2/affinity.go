@@ -0,0 +1,66 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+// maxRoutingKeys is the maximum number of routing keys remembered by
+// a client mux. New keys are not remembered when the limit is reached.
+const maxRoutingKeys = 4096
+
+// affinityUnderlay returns the underlay used by the last session with the
+// routing key, if it is one of the candidates. Otherwise it returns nil.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) affinityUnderlay(key string, candidates []Underlay) Underlay {
+	if key == "" {
+		return nil
+	}
+	last, ok := m.affinity[key]
+	if !ok {
+		return nil
+	}
+	for _, underlay := range candidates {
+		if underlay == last {
+			return underlay
+		}
+	}
+	return nil
+}
+
+// recordAffinity remembers the underlay of a session with the routing key.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) recordAffinity(key string, underlay Underlay) {
+	if key == "" {
+		return
+	}
+	if m.affinity == nil {
+		m.affinity = make(map[string]Underlay)
+	}
+	if _, ok := m.affinity[key]; !ok && len(m.affinity) >= maxRoutingKeys {
+		return
+	}
+	m.affinity[key] = underlay
+}
+
+// cleanAffinity forgets the routing keys of closed underlays.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) cleanAffinity() {
+	for key, underlay := range m.affinity {
+		select {
+		case <-underlay.Done():
+			delete(m.affinity, key)
+		default:
+		}
+	}
+}
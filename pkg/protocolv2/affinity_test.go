@@ -0,0 +1,58 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestRoutingKeyAffinity(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint).SetMaxUnderlays(3)
+	defer clientMux.Close()
+	if err := clientMux.Warmup(context.Background(), 3); err != nil {
+		t.Fatalf("Warmup() failed: %v", err)
+	}
+
+	var first Underlay
+	for i := 0; i < 10; i++ {
+		conn, err := clientMux.DialContextWithRoutingKey(context.Background(), "example.com:443")
+		if err != nil {
+			t.Fatalf("DialContextWithRoutingKey() failed: %v", err)
+		}
+		defer conn.Close()
+		underlay := conn.(*Session).underlay()
+		if first == nil {
+			first = underlay
+		} else if underlay != first {
+			t.Fatalf("session %d with the same routing key uses a different underlay", i)
+		}
+	}
+
+	// The affinity is forgotten after the underlay is closed.
+	first.Close()
+	conn, err := clientMux.DialContextWithRoutingKey(context.Background(), "example.com:443")
+	if err != nil {
+		t.Fatalf("DialContextWithRoutingKey() failed: %v", err)
+	}
+	defer conn.Close()
+	if conn.(*Session).underlay() == first {
+		t.Errorf("session uses the closed underlay")
+	}
+}
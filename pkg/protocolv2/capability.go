@@ -0,0 +1,69 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+// capability is a protocol feature that a session uses only if both the
+// client and the server support it. The client offers its capabilities in
+// byte 1 of the open session request, and the server answers the offered
+// capabilities that it also supports in byte 1 of the open session
+// response. Peers that don't know about capabilities write zero to the
+// byte and ignore it, so a session with such a peer never uses them.
+type capability uint8
+
+const (
+	// capZstd compresses the payload of data segments with zstd.
+	capZstd capability = 1 << 0
+
+	// capHalfClose closes one direction of the session with CloseWrite.
+	capHalfClose capability = 1 << 1
+
+	// capPathValidation moves a UDP session to a new client address after
+	// the client answers a path challenge from there.
+	capPathValidation capability = 1 << 2
+
+	// capResume migrates a TCP session that has sent data to another
+	// underlay, after the client presents the resume token of the session.
+	capResume capability = 1 << 3
+)
+
+// capabilities returns the capabilities of new sessions.
+func (m *Mux) capabilities() capability {
+	caps := capHalfClose
+	if m.compression == CompressionZstd {
+		caps |= capZstd
+	}
+	if m.migration {
+		caps |= capPathValidation
+	}
+	if m.migrationBuffer > 0 {
+		caps |= capResume
+	}
+	return caps
+}
+
+// hasCapability returns true if the capability is negotiated with the peer.
+func (s *Session) hasCapability(c capability) bool {
+	negotiated := s.negotiated.Load()
+	return negotiated != nil && *negotiated&c != 0
+}
+
+// negotiate records the capabilities that are accepted by both peers,
+// from the capabilities offered or answered by the peer.
+func (s *Session) negotiate(peer capability) capability {
+	accepted := s.capabilities & peer
+	s.negotiated.Store(&accepted)
+	return accepted
+}
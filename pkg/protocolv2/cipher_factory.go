@@ -0,0 +1,111 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/enfein/mieru/pkg/appctl/appctlpb"
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// CipherFactory creates the block ciphers used by underlays.
+type CipherFactory interface {
+	// BlockCipherFromPassword creates the block cipher of a client underlay.
+	BlockCipherFromPassword(password []byte, stateless bool) (cipher.BlockCipher, error)
+
+	// BlockCipherListFromPassword creates the block ciphers that a server
+	// underlay uses to identify and decrypt the data from a user.
+	BlockCipherListFromPassword(password []byte, stateless bool) ([]cipher.BlockCipher, error)
+}
+
+// DefaultCipherFactory creates block ciphers from the password
+// with the default settings.
+type DefaultCipherFactory struct{}
+
+var _ CipherFactory = DefaultCipherFactory{}
+
+func (DefaultCipherFactory) BlockCipherFromPassword(password []byte, stateless bool) (cipher.BlockCipher, error) {
+	return cipher.BlockCipherFromPassword(password, stateless)
+}
+
+func (DefaultCipherFactory) BlockCipherListFromPassword(password []byte, stateless bool) ([]cipher.BlockCipher, error) {
+	return cipher.BlockCipherListFromPassword(password, stateless)
+}
+
+func (m *Mux) SetCipherFactory(factory CipherFactory) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set cipher factory after mux is used")
+	}
+	if factory == nil {
+		factory = DefaultCipherFactory{}
+	}
+	m.ciphers = factory
+	return m
+}
+
+// BlockContextFunc creates the block context of a user, e.g. to attach
+// the tenant or region for downstream policy. The user name of the returned
+// context is always replaced by the name of the user.
+type BlockContextFunc func(user *appctlpb.User) cipher.BlockContext
+
+func (m *Mux) SetBlockContextFunc(f BlockContextFunc) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set block context function in client mux")
+	}
+	if m.used {
+		panic("Can't set block context function after mux is used")
+	}
+	m.blockContext = f
+	m.logf(log.InfoLevel, "Mux block context function is set")
+	return m
+}
+
+// userBlockCiphers creates the block ciphers that a server uses to decrypt
+// the data of the user. Stateless block ciphers may be shared by a cache,
+// so the caller must not change them.
+func userBlockCiphers(factory CipherFactory, user *appctlpb.User, stateless bool) ([]cipher.BlockCipher, error) {
+	password, err := hex.DecodeString(user.GetHashedPassword())
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode hashed password %q from user %q", user.GetHashedPassword(), user.GetName())
+	}
+	if len(password) == 0 {
+		password = cipher.HashPassword([]byte(user.GetPassword()), []byte(user.GetName()))
+	}
+	blocks, err := factory.BlockCipherListFromPassword(password, stateless)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create block cipher of user %q", user.GetName())
+	}
+	return blocks, nil
+}
+
+// userBlockContext returns the block context of the user, which is created
+// by contextFunc if it is not nil.
+func userBlockContext(user *appctlpb.User, contextFunc BlockContextFunc) cipher.BlockContext {
+	bc := cipher.BlockContext{}
+	if contextFunc != nil {
+		bc = contextFunc(user)
+	}
+	// The user name identifies the user of the session, e.g. for quotas.
+	bc.UserName = user.GetName()
+	return bc
+}
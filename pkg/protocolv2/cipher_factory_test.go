@@ -0,0 +1,123 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+
+	"github.com/enfein/mieru/pkg/appctl/appctlpb"
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// countingCipherFactory counts the calls to DefaultCipherFactory.
+type countingCipherFactory struct {
+	DefaultCipherFactory
+	single atomic.Int32
+	list   atomic.Int32
+}
+
+func (f *countingCipherFactory) BlockCipherFromPassword(password []byte, stateless bool) (cipher.BlockCipher, error) {
+	f.single.Add(1)
+	return f.DefaultCipherFactory.BlockCipherFromPassword(password, stateless)
+}
+
+func (f *countingCipherFactory) BlockCipherListFromPassword(password []byte, stateless bool) ([]cipher.BlockCipher, error) {
+	f.list.Add(1)
+	return f.DefaultCipherFactory.BlockCipherListFromPassword(password, stateless)
+}
+
+func TestCipherFactory(t *testing.T) {
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		serverFactory := &countingCipherFactory{}
+		serverMux, endpoint := startTestMux(t, transport, func(m *Mux) { m.SetCipherFactory(serverFactory) })
+		clientFactory := &countingCipherFactory{}
+		clientMux := newTestClient(endpoint).SetCipherFactory(clientFactory)
+
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		acceptTestSession(t, serverMux, conn)
+		conn.Close()
+		clientMux.Close()
+
+		if clientFactory.single.Load() == 0 {
+			t.Errorf("client underlay doesn't use the cipher factory with transport %v", transport)
+		}
+		if serverFactory.list.Load() == 0 {
+			t.Errorf("server underlay doesn't use the cipher factory with transport %v", transport)
+		}
+	}
+}
+
+// failingCipherFactory fails to create any block cipher.
+type failingCipherFactory struct {
+	DefaultCipherFactory
+}
+
+func (failingCipherFactory) BlockCipherFromPassword(password []byte, stateless bool) (cipher.BlockCipher, error) {
+	return nil, fmt.Errorf("cipher is broken")
+}
+
+func TestBlockContextFunc(t *testing.T) {
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport, func(m *Mux) {
+				m.SetBlockContextFunc(func(user *appctlpb.User) cipher.BlockContext {
+					return cipher.BlockContext{
+						UserName: "ignored",
+						Values:   map[string]string{"tenant": user.GetName() + "-tenant"},
+					}
+				})
+			})
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+
+			accepted, err := serverMux.Accept()
+			if err != nil {
+				t.Fatalf("Accept() failed: %v", err)
+			}
+			defer accepted.Close()
+			buf := make([]byte, 5)
+			if _, err := io.ReadFull(accepted, buf); err != nil {
+				t.Fatalf("ReadFull() failed: %v", err)
+			}
+			bc := accepted.(*Session).BlockContext()
+			if bc.UserName != "xiaochitang" {
+				t.Errorf("block context user name is %q, want %q", bc.UserName, "xiaochitang")
+			}
+			if got := bc.Values["tenant"]; got != "xiaochitang-tenant" {
+				t.Errorf("block context tenant is %q, want %q", got, "xiaochitang-tenant")
+			}
+			if bc := conn.(*Session).BlockContext(); bc.Values != nil {
+				t.Errorf("client session has block context values %v", bc.Values)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	mrand "math/rand"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/mathext"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// cleanerInterval returns the time to wait before the next run of the idle
+// underlay cleaner, which is uniformly distributed within
+// [idleUnderlayTickerInterval - jitter, idleUnderlayTickerInterval + jitter].
+func cleanerInterval(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return idleUnderlayTickerInterval
+	}
+	return idleUnderlayTickerInterval - jitter + time.Duration(mrand.Int63n(int64(2*jitter)+1))
+}
+
+func (m *Mux) SetCleanerJitter(jitter time.Duration) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.jitter = mathext.Min(mathext.Max(jitter, 0), idleUnderlayTickerInterval/2)
+	return m
+}
+
+func (m *Mux) SetIdleCleanupEnabled(enable bool) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set idle cleanup after mux is used")
+	}
+	m.noCleaner = !enable
+	m.logf(log.InfoLevel, "Mux idle cleanup is set to %v", enable)
+	return m
+}
+
+// CloseUnderlay closes the underlay with the remote address, as reported by
+// Stats(), and terminates all its sessions. The server UDP underlay is shared
+// by all the clients and doesn't have a remote address, so it can't be closed
+// with this method.
+func (m *Mux) CloseUnderlay(remoteAddr string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, underlay := range m.underlays {
+		if underlay.RemoteAddr().String() != remoteAddr {
+			continue
+		}
+		m.underlays = append(m.underlays[:i], m.underlays[i+1:]...)
+		delete(m.underlayEndpoints, underlay)
+		m.logEvent(log.InfoLevel, EventUnderlayClose, withFields(underlayFields(underlay), log.Fields{"reason": "requested"}), "Mux is closing underlay %v", underlay)
+		if err := underlay.Close(); err != nil {
+			return fmt.Errorf("close %v failed: %w", underlay, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("underlay with remote address %q: %w", remoteAddr, stderror.ErrNotFound)
+}
+
+// CloseIdleUnderlays closes the underlays that have had no session for
+// longer than olderThan, without waiting for the idle underlay cleaner.
+// Client underlays with a session being scheduled are kept. The server UDP
+// underlay is shared by all the clients, so it is never closed. It returns
+// the number of closed underlays. This is a manual lever to release file
+// descriptors, e.g. during an fd exhaustion incident.
+func (m *Mux) CloseIdleUnderlays(olderThan time.Duration) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	remaining := make([]Underlay, 0, len(m.underlays))
+	cnt := 0
+	for _, underlay := range m.underlays {
+		if !m.isCloseableIdle(underlay, olderThan) {
+			remaining = append(remaining, underlay)
+			continue
+		}
+		m.logEvent(log.DebugLevel, EventUnderlayClose, withFields(underlayFields(underlay), log.Fields{"reason": "idle"}), "Mux is closing idle underlay %v", underlay)
+		underlay.Close()
+		delete(m.underlayEndpoints, underlay)
+		cnt++
+	}
+	m.underlays = remaining
+	if cnt > 0 {
+		m.logf(log.InfoLevel, "Mux closed %d underlays idle for more than %v", cnt, olderThan)
+	}
+	return cnt
+}
+
+// isCloseableIdle returns true if CloseIdleUnderlays can close the underlay.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) isCloseableIdle(underlay Underlay, olderThan time.Duration) bool {
+	select {
+	case <-underlay.Done():
+		return false
+	default:
+	}
+	if !m.isClient && underlay.TransportProtocol() == util.UDPTransport {
+		return false
+	}
+	if m.isClient && underlay.Scheduler().Pending() > 0 {
+		return false
+	}
+	tracker, ok := underlay.(idleTracker)
+	if !ok {
+		return false
+	}
+	idle := tracker.idleTime()
+	return idle > 0 && idle > olderThan
+}
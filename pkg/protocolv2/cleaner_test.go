@@ -0,0 +1,168 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestCloseUnderlay(t *testing.T) {
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	serverSession := acceptTestSession(t, serverMux, conn)
+
+	var stats []UnderlayStats
+	for i := 0; i < 50; i++ {
+		if stats = serverMux.Stats(); len(stats) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got %d server underlays, want 1", len(stats))
+	}
+	if err := serverMux.CloseUnderlay(stats[0].RemoteAddr.String()); err != nil {
+		t.Fatalf("CloseUnderlay() failed: %v", err)
+	}
+	if got := serverMux.Stats(); len(got) != 0 {
+		t.Errorf("got %d server underlays after CloseUnderlay(), want 0", len(got))
+	}
+
+	// Both ends of the session are terminated.
+	select {
+	case <-serverSession.done:
+	default:
+		t.Errorf("server session is not closed with its underlay")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() returned %v, want the session to be closed", err)
+	}
+
+	if err := serverMux.CloseUnderlay("127.0.0.1:1"); !errors.Is(err, stderror.ErrNotFound) {
+		t.Errorf("CloseUnderlay() returned %v, want %v", err, stderror.ErrNotFound)
+	}
+}
+
+func TestCleanerJitter(t *testing.T) {
+	if got := cleanerInterval(0); got != idleUnderlayTickerInterval {
+		t.Errorf("cleanerInterval(0) = %v, want %v", got, idleUnderlayTickerInterval)
+	}
+	jitter := time.Second
+	min, max := idleUnderlayTickerInterval-jitter, idleUnderlayTickerInterval+jitter
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 1000; i++ {
+		got := cleanerInterval(jitter)
+		if got < min || got > max {
+			t.Fatalf("cleanerInterval(%v) = %v, want within [%v, %v]", jitter, got, min, max)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("cleanerInterval(%v) is not randomized", jitter)
+	}
+
+	mux := NewMux(true).SetCleanerJitter(time.Hour)
+	defer mux.Close()
+	if mux.jitter != idleUnderlayTickerInterval/2 {
+		t.Errorf("jitter = %v, want it capped at %v", mux.jitter, idleUnderlayTickerInterval/2)
+	}
+}
+
+func TestIdleCleanupDisabled(t *testing.T) {
+	before := runtime.NumGoroutine()
+	mux := NewMux(true).SetIdleCleanupEnabled(false)
+	mux.mu.Lock()
+	mux.markUsed()
+	mux.mu.Unlock()
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("number of goroutines increased from %d to %d", before, n)
+	}
+	if err := mux.Close(); err != nil {
+		t.Errorf("Close() failed: %v", err)
+	}
+
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	for _, enabled := range []bool{true, false} {
+		clientMux := newTestClient(endpoint).SetIdleCleanupEnabled(enabled)
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		clientMux.mu.Lock()
+		started := clientMux.cleaner != nil
+		clientMux.mu.Unlock()
+		if started != enabled {
+			t.Errorf("cleaner started = %v, want %v", started, enabled)
+		}
+		conn.Close()
+		clientMux.Close()
+	}
+}
+
+func TestCloseIdleUnderlays(t *testing.T) {
+	mux := NewMux(true)
+	defer mux.Close()
+	old := time.Now().Add(-time.Hour).UnixNano()
+	idle, recent, busy, pending := newFakeUnderlay(true), newFakeUnderlay(true), newFakeUnderlay(true), newFakeUnderlay(true)
+	idle.lastActive.Store(old)
+	busy.lastActive.Store(old)
+	busy.sessionMap.Store(uint32(1), NewSession(1, true, 1500))
+	pending.lastActive.Store(old)
+	pending.Scheduler().IncPending()
+	mux.underlays = []Underlay{idle, recent, busy, pending}
+	UnderlayCurrEstablished.Add(4)
+
+	if got := mux.CloseIdleUnderlays(time.Minute); got != 1 {
+		t.Errorf("CloseIdleUnderlays() closed %d underlays, want 1", got)
+	}
+	select {
+	case <-idle.Done():
+	default:
+		t.Errorf("idle underlay is not closed")
+	}
+	for _, underlay := range []*fakeUnderlay{recent, busy, pending} {
+		select {
+		case <-underlay.Done():
+			t.Errorf("%v is closed", underlay)
+		default:
+		}
+	}
+	if _, total := mux.UnderlayCount(); total != 3 {
+		t.Errorf("mux has %d underlays, want 3", total)
+	}
+
+	// The recent underlay is closed with a shorter threshold.
+	time.Sleep(10 * time.Millisecond)
+	if got := mux.CloseIdleUnderlays(5 * time.Millisecond); got != 1 {
+		t.Errorf("CloseIdleUnderlays() closed %d underlays, want the recent one", got)
+	}
+}
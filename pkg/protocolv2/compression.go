@@ -0,0 +1,135 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used to compress the payload of data
+// segments. It is negotiated per session as a capability: the client
+// offers it in the open session request, and the server accepts it only
+// if the server is configured with the same algorithm. Otherwise the
+// session is not compressed. Each data segment is compressed on its own,
+// and it is sent uncompressed if that doesn't make it smaller.
+//
+// Payload is compressed before it is encrypted. When an attacker can
+// inject chosen plaintext into a session that also carries secrets,
+// the size of the encrypted segments may reveal the secrets, as in the
+// CRIME and BREACH attacks. Compression is disabled by default, and it
+// should only be enabled when the traffic is known to be safe to
+// compress.
+type Compression uint8
+
+const (
+	// CompressionNone disables compression.
+	CompressionNone Compression = 0
+
+	// CompressionZstd compresses the payload with zstd (RFC 8878).
+	CompressionZstd Compression = 1
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "NONE"
+	case CompressionZstd:
+		return "ZSTD"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// isValid returns true if c is one of the supported algorithms.
+func (c Compression) isValid() bool {
+	return c == CompressionNone || c == CompressionZstd
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// initZstd creates the zstd encoder and decoder shared by all sessions.
+// They are safe for concurrent use by EncodeAll and DecodeAll.
+func initZstd() {
+	zstdOnce.Do(func() {
+		var err error
+		zstdEncoder, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true))
+		if err != nil {
+			panic(err)
+		}
+		zstdDecoder, err = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxPDU))
+		if err != nil {
+			panic(err)
+		}
+	})
+}
+
+// compress returns the compressed payload. It returns false if the
+// payload is not compressed, because the algorithm is not supported or
+// the compressed payload is not smaller than the original one.
+func compress(c Compression, b []byte) ([]byte, bool) {
+	if c != CompressionZstd || len(b) == 0 {
+		return nil, false
+	}
+	initZstd()
+	out := zstdEncoder.EncodeAll(b, nil)
+	if len(out) >= len(b) {
+		return nil, false
+	}
+	return out, true
+}
+
+// decompress returns the decompressed payload. To prevent decompression
+// bombs, it returns an error if the decompressed payload is larger than
+// the maximum PDU.
+func decompress(c Compression, b []byte) ([]byte, error) {
+	if c != CompressionZstd {
+		return nil, fmt.Errorf("compression %v: %w", c, stderror.ErrUnsupported)
+	}
+	initZstd()
+	out, err := zstdDecoder.DecodeAll(b, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decompress payload failed: %w", err)
+	}
+	if len(out) > maxPDU {
+		return nil, fmt.Errorf("decompressed payload exceeds %d bytes: %w", maxPDU, stderror.ErrOutOfRange)
+	}
+	return out, nil
+}
+
+// SetCompression should only be used when the size of the encrypted traffic
+// can't leak secrets mixed with chosen data, as in the CRIME attack.
+func (m *Mux) SetCompression(c Compression) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !c.isValid() {
+		panic(fmt.Sprintf("Compression %d is not supported", c))
+	}
+	if m.used {
+		panic("Can't set compression after mux is used")
+	}
+	m.compression = c
+	m.logf(log.InfoLevel, "Mux compression is set to %v", c)
+	return m
+}
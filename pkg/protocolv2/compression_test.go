@@ -0,0 +1,125 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/testtool"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestCompress(t *testing.T) {
+	b := bytes.Repeat([]byte("CompressiblePayload"), 1024)
+	cb, ok := compress(CompressionZstd, b)
+	if !ok {
+		t.Fatalf("compress() didn't compress %d bytes", len(b))
+	}
+	out, err := decompress(CompressionZstd, cb)
+	if err != nil {
+		t.Fatalf("decompress() failed: %v", err)
+	}
+	if !bytes.Equal(b, out) {
+		t.Errorf("decompressed payload doesn't match the original one")
+	}
+
+	if _, ok := compress(CompressionNone, b); ok {
+		t.Errorf("compress() compressed with %v", CompressionNone)
+	}
+	if _, ok := compress(CompressionZstd, []byte{0x01}); ok {
+		t.Errorf("compress() returned a payload that is not smaller")
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	cb, ok := compress(CompressionZstd, make([]byte, maxPDU+1))
+	if !ok {
+		t.Fatalf("compress() didn't compress %d bytes", maxPDU+1)
+	}
+	if _, err := decompress(CompressionZstd, cb); err == nil {
+		t.Errorf("decompress() succeeded with a payload larger than %d bytes", maxPDU)
+	}
+	if _, err := decompress(CompressionZstd, []byte("not zstd")); err == nil {
+		t.Errorf("decompress() succeeded with invalid data")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	log.SetOutputToTest(t)
+	payload := bytes.Repeat([]byte("CompressiblePayload"), 4096)
+
+	// roundTrip returns the number of bytes the client sends to the server
+	// with the payload and the compression that is negotiated. Data sent
+	// before the open session response is received is not compressed, so
+	// the payload is sent after a small round trip.
+	roundTrip := func(t *testing.T, transport util.TransportProtocol, client, server Compression) (int64, Compression) {
+		_, endpoint := startTestServer(t, transport, func(m *Mux) {
+			m.SetCompression(server)
+		})
+		clientMux := newTestClient(endpoint).SetCompression(client)
+		defer clientMux.Close()
+
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		defer conn.Close()
+		rot13RoundTrip(t, conn, 16)
+		before := clientMux.Stats()[0].OutBytes
+		if _, err := conn.Write(payload); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		resp := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatalf("io.ReadFull() failed: %v", err)
+		}
+		rot13, err := testtool.TestHelperRot13(resp)
+		if err != nil {
+			t.Fatalf("TestHelperRot13() failed: %v", err)
+		}
+		if !bytes.Equal(payload, rot13) {
+			t.Fatalf("Received unexpected response")
+		}
+		stats := clientMux.Stats()
+		if len(stats) != 1 {
+			t.Fatalf("got %d underlay stats, want 1", len(stats))
+		}
+		return stats[0].OutBytes - before, conn.(*Session).Compression()
+	}
+
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			plain, c := roundTrip(t, transport, CompressionNone, CompressionNone)
+			if c != CompressionNone {
+				t.Errorf("Compression() = %v, want %v", c, CompressionNone)
+			}
+			compressed, c := roundTrip(t, transport, CompressionZstd, CompressionZstd)
+			if c != CompressionZstd {
+				t.Errorf("Compression() = %v, want %v", c, CompressionZstd)
+			}
+			if compressed >= plain/2 {
+				t.Errorf("sent %d bytes with compression, want less than half of %d bytes without compression", compressed, plain)
+			}
+			if _, c := roundTrip(t, transport, CompressionZstd, CompressionNone); c != CompressionNone {
+				t.Errorf("Compression() = %v when server doesn't support it, want %v", c, CompressionNone)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// datagramHeaderSize is the number of bytes before each datagram
+	// to store the datagram length.
+	datagramHeaderSize = 2
+
+	// MaxDatagramSize is the maximum size of a datagram sent
+	// by DatagramConn.
+	MaxDatagramSize = math.MaxUint16
+)
+
+// DatagramConn sends and receives datagrams over a session, e.g. to
+// relay SOCKS5 UDP associate traffic. Message boundaries are preserved:
+// the data of a single WriteTo is returned by a single ReadFrom of the peer.
+// Both peers must wrap the session with DatagramConn.
+//
+// Datagrams are delivered reliably and in order, with any underlay.
+// A datagram up to MaxDatagramSize bytes can be sent. A datagram bigger
+// than the fragment size of the underlay, which is MaxFragmentSize(mtu,
+// ipVersion, transport) minus the 2 bytes datagram header, is split into
+// multiple segments and reassembled by the peer.
+//
+// After a WriteTo error, the DatagramConn should be closed, because the
+// peer may have received part of a datagram.
+type DatagramConn struct {
+	conn net.Conn
+
+	rLock   sync.Mutex
+	rHeader [datagramHeaderSize]byte
+	rHeadN  int    // number of header bytes received
+	rBuf    []byte // payload of the datagram being received
+
+	wLock sync.Mutex
+}
+
+var _ net.PacketConn = &DatagramConn{}
+
+// NewDatagramConn returns a DatagramConn that uses the session conn.
+func NewDatagramConn(conn net.Conn) *DatagramConn {
+	return &DatagramConn{conn: conn}
+}
+
+// ReadFrom reads one datagram. The address is the remote address of
+// the session. If b is smaller than the datagram, the rest of the
+// datagram is discarded and io.ErrShortBuffer is returned.
+// A datagram that is partially received when an error is returned,
+// e.g. read deadline is exceeded, is kept for the next ReadFrom.
+func (d *DatagramConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	d.rLock.Lock()
+	defer d.rLock.Unlock()
+	for d.rHeadN < datagramHeaderSize {
+		n, err := d.conn.Read(d.rHeader[d.rHeadN:])
+		d.rHeadN += n
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	size := int(binary.BigEndian.Uint16(d.rHeader[:]))
+	if d.rBuf == nil {
+		d.rBuf = make([]byte, 0, size)
+	}
+	for len(d.rBuf) < size {
+		n, err := d.conn.Read(d.rBuf[len(d.rBuf):size])
+		d.rBuf = d.rBuf[:len(d.rBuf)+n]
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	n = copy(b, d.rBuf)
+	d.rHeadN = 0
+	d.rBuf = nil
+	if n < size {
+		return n, d.conn.RemoteAddr(), io.ErrShortBuffer
+	}
+	return n, d.conn.RemoteAddr(), nil
+}
+
+// WriteTo sends b as one datagram. addr is ignored, because the
+// destination is the peer of the session.
+func (d *DatagramConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	if len(b) > MaxDatagramSize {
+		return 0, fmt.Errorf("datagram size %d is bigger than the maximum size %d", len(b), MaxDatagramSize)
+	}
+	frame := make([]byte, datagramHeaderSize+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[datagramHeaderSize:], b)
+
+	d.wLock.Lock()
+	defer d.wLock.Unlock()
+	if _, err := d.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the session.
+func (d *DatagramConn) Close() error {
+	return d.conn.Close()
+}
+
+// LocalAddr returns the local address of the session.
+func (d *DatagramConn) LocalAddr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the session.
+func (d *DatagramConn) SetDeadline(t time.Time) error {
+	return d.conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the session.
+func (d *DatagramConn) SetReadDeadline(t time.Time) error {
+	return d.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the session.
+func (d *DatagramConn) SetWriteDeadline(t time.Time) error {
+	return d.conn.SetWriteDeadline(t)
+}
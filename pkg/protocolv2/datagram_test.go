@@ -0,0 +1,115 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestDatagramConn(t *testing.T) {
+	port, err := util.UnusedUDPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedUDPPort() failed: %v", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, addr, nil)})
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer serverMux.Close()
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		conn, err := serverMux.Accept()
+		if err != nil {
+			return
+		}
+		// Echo every datagram.
+		d := NewDatagramConn(conn)
+		defer d.Close()
+		buf := make([]byte, MaxDatagramSize)
+		for {
+			n, from, err := d.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if _, err := d.WriteTo(buf[:n], from); err != nil {
+				return
+			}
+		}
+	}()
+
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, nil, addr))
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	d := NewDatagramConn(conn)
+	defer d.Close()
+
+	// Send all the datagrams before reading, so they may be coalesced
+	// by the session.
+	sizes := []int{1, 100, 0, 5000, 3, MaxDatagramSize}
+	for i, size := range sizes {
+		datagram := bytes.Repeat([]byte{byte(i + 1)}, size)
+		if n, err := d.WriteTo(datagram, nil); err != nil || n != size {
+			t.Fatalf("WriteTo() = %d, %v, want %d, nil", n, err, size)
+		}
+	}
+	d.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, MaxDatagramSize)
+	for i, size := range sizes {
+		n, _, err := d.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom() failed: %v", err)
+		}
+		if n != size {
+			t.Fatalf("datagram %d has %d bytes, want %d", i, n, size)
+		}
+		if !bytes.Equal(buf[:n], bytes.Repeat([]byte{byte(i + 1)}, size)) {
+			t.Errorf("datagram %d content mismatch", i)
+		}
+	}
+
+	// A short buffer truncates the datagram.
+	if _, err := d.WriteTo([]byte("datagram"), nil); err != nil {
+		t.Fatalf("WriteTo() failed: %v", err)
+	}
+	if _, err := d.WriteTo([]byte("next"), nil); err != nil {
+		t.Fatalf("WriteTo() failed: %v", err)
+	}
+	short := make([]byte, 4)
+	if n, _, err := d.ReadFrom(short); !errors.Is(err, io.ErrShortBuffer) || n != 4 || string(short) != "data" {
+		t.Errorf("ReadFrom() = %d, %v, want 4, %v", n, err, io.ErrShortBuffer)
+	}
+	if n, _, err := d.ReadFrom(buf); err != nil || string(buf[:n]) != "next" {
+		t.Errorf("ReadFrom() = %q, %v, want %q", buf[:n], err, "next")
+	}
+
+	if _, err := d.WriteTo(make([]byte, MaxDatagramSize+1), nil); err == nil {
+		t.Errorf("WriteTo() with oversized datagram succeeded")
+	}
+}
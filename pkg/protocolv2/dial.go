@@ -0,0 +1,740 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/mathext"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+	"github.com/enfein/mieru/pkg/util/sockopts"
+)
+
+// happyEyeballsDelay is the time to wait before the next address is dialed,
+// if the previous one is not connected yet. The value is recommended by
+// RFC 8305.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// DialFunc creates the network connection of a client underlay.
+// localAddr is empty if an automatic address should be used.
+//
+// For TCP underlays, the returned connection is connected to remoteAddr.
+// For UDP underlays, the returned connection must be a *net.UDPConn that
+// is not connected, because the underlay sends packets with WriteToUDP.
+type DialFunc func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error)
+
+// validateLocalAddr checks if addr can be used as the local address
+// of client underlays, and returns it in the host:port format.
+func validateLocalAddr(addr string) (string, error) {
+	host, port := addr, "0"
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		host, port = h, p
+	}
+	ipStr, zone := util.SplitIPZone(host)
+	ip := net.ParseIP(ipStr)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address", host)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if !ip.IsUnspecified() {
+		ifAddrs, err := zoneInterfaceAddrs(zone)
+		if err != nil {
+			return "", err
+		}
+		found := false
+		for _, ifAddr := range ifAddrs {
+			if ipNet, ok := ifAddr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("IP address %v is not assigned to any network interface", ip)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// UnderlayDialError is returned when the client fails to create
+// a underlay to a server endpoint.
+type UnderlayDialError struct {
+	// Endpoint is the server endpoint that was dialed.
+	Endpoint UnderlayProperties
+
+	// Err is the cause of the failure.
+	Err error
+}
+
+func (e *UnderlayDialError) Error() string {
+	return fmt.Sprintf("dial %s underlay to %v failed: %v", transportName(e.Endpoint.TransportProtocol()), e.Endpoint.RemoteAddr(), e.Err)
+}
+
+func (e *UnderlayDialError) Unwrap() error {
+	return e.Err
+}
+
+// defaultDial creates the network connection with the default network stack.
+func defaultDial(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		dialer := net.Dialer{
+			Control: sockopts.ReuseAddrPort(),
+		}
+		if localAddr != "" {
+			tcpLocalAddr, err := net.ResolveTCPAddr(network, localAddr)
+			if err != nil {
+				return nil, fmt.Errorf("net.ResolveTCPAddr() failed: %w", err)
+			}
+			dialer.LocalAddr = tcpLocalAddr
+		}
+		return dialer.DialContext(ctx, network, remoteAddr)
+	case "unix":
+		var dialer net.Dialer
+		if localAddr != "" {
+			unixLocalAddr, err := net.ResolveUnixAddr(network, localAddr)
+			if err != nil {
+				return nil, fmt.Errorf("net.ResolveUnixAddr() failed: %w", err)
+			}
+			dialer.LocalAddr = unixLocalAddr
+		}
+		return dialer.DialContext(ctx, network, remoteAddr)
+	case MemoryNetwork:
+		return dialMemory(ctx, remoteAddr)
+	case "udp", "udp4", "udp6":
+		var udpLocalAddr *net.UDPAddr
+		if localAddr != "" {
+			var err error
+			udpLocalAddr, err = net.ResolveUDPAddr("udp", localAddr)
+			if err != nil {
+				return nil, fmt.Errorf("net.ResolveUDPAddr() failed: %w", err)
+			}
+		}
+		conn, err := net.ListenUDP(network, udpLocalAddr)
+		if err != nil {
+			return nil, fmt.Errorf("net.ListenUDP() failed: %w", err)
+		}
+		rawConn, err := conn.SyscallConn()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("SyscallConn() failed: %w", err)
+		}
+		rawConn.Control(sockopts.ReuseAddrPortRaw())
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("network %s is not supported", network)
+	}
+}
+
+// zoneInterfaceAddrs returns the addresses of the network interface of the
+// IPv6 zone, which is either an interface name or an index. If the zone is
+// empty, the addresses of all the interfaces are returned.
+func zoneInterfaceAddrs(zone string) ([]net.Addr, error) {
+	if zone == "" {
+		ifAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return nil, fmt.Errorf("net.InterfaceAddrs() failed: %w", err)
+		}
+		return ifAddrs, nil
+	}
+	var iface *net.Interface
+	var err error
+	if index, convErr := strconv.Atoi(zone); convErr == nil {
+		iface, err = net.InterfaceByIndex(index)
+	} else {
+		iface, err = net.InterfaceByName(zone)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("network interface of zone %q is not found: %w", zone, err)
+	}
+	ifAddrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Addrs() of %s failed: %w", iface.Name, err)
+	}
+	return ifAddrs, nil
+}
+
+// isIPNetwork returns true if the addresses of the network are IP addresses.
+func isIPNetwork(network string) bool {
+	return network != "unix" && network != MemoryNetwork
+}
+
+// resolveEndpointAddrs returns the addresses to dial for the endpoint.
+// If the host of the endpoint is an IP address, it is returned as is.
+// Otherwise the host is resolved, and the IP addresses are sorted
+// by RFC 8305 rules: the address families are interleaved, starting from
+// the IP version preferred by the endpoint. IPv6 is preferred by default.
+func resolveEndpointAddrs(ctx context.Context, endpoint UnderlayProperties, lookup lookupIPAddrFunc) ([]string, error) {
+	addr := endpoint.RemoteAddr().String()
+	if !isIPNetwork(endpoint.RemoteAddr().Network()) {
+		// The address is a socket path or an in-memory address.
+		return []string{addr}, nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("net.SplitHostPort() failed: %w", err)
+	}
+	if ip, _ := util.SplitIPZone(host); net.ParseIP(ip) != nil {
+		return []string{addr}, nil
+	}
+	ipAddrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("LookupIPAddr() failed: %w", err)
+	}
+	ips := make([]net.IP, 0, len(ipAddrs))
+	zones := make(map[string]string) // zones of link-local addresses
+	for _, ipAddr := range ipAddrs {
+		ips = append(ips, ipAddr.IP)
+		if ipAddr.Zone != "" {
+			zones[ipAddr.IP.String()] = ipAddr.Zone
+		}
+	}
+	ips = interleaveIPs(ips, endpoint.IPVersion() != util.IPVersion4)
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no IP address found for %s", host)
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		h := ip.String()
+		if zone := zones[h]; zone != "" {
+			h += "%" + zone
+		}
+		addrs = append(addrs, net.JoinHostPort(h, port))
+	}
+	return addrs, nil
+}
+
+// interleaveIPs sorts the IP addresses by alternating IPv6 and IPv4.
+// The relative order within the same family is kept.
+func interleaveIPs(ips []net.IP, preferIPv6 bool) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v6, v4
+	if !preferIPv6 {
+		first, second = v4, v6
+	}
+	res := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	return res
+}
+
+type dialResult[T any] struct {
+	conn T
+	err  error
+}
+
+// dialHappyEyeballs dials the addresses in order. The next address is dialed
+// when the previous one fails, or when it is not connected after delay.
+// The first established connection is returned, and the other attempts are
+// cancelled. Connections established after the winner are discarded.
+func dialHappyEyeballs[T any](ctx context.Context, addrs []string, delay time.Duration, dial func(context.Context, string) (T, error), discard func(T)) (T, error) {
+	var zero T
+	if len(addrs) == 0 {
+		return zero, fmt.Errorf("no address to dial")
+	}
+	if len(addrs) == 1 {
+		return dial(ctx, addrs[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult[T], len(addrs))
+	next := 0
+	pending := 0
+	var timerC <-chan time.Time
+	startNext := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			if err != nil {
+				err = fmt.Errorf("dial %s failed: %w", addr, err)
+			}
+			results <- dialResult[T]{conn: conn, err: err}
+		}()
+		if next < len(addrs) {
+			timerC = time.After(delay)
+		} else {
+			timerC = nil
+		}
+	}
+
+	startNext()
+	var errs []error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.err == nil {
+							discard(late.conn)
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			errs = append(errs, r.err)
+			if next < len(addrs) {
+				startNext()
+			}
+		case <-timerC:
+			startNext()
+		}
+	}
+	return zero, errors.Join(errs...)
+}
+
+// endpointKey identifies a server endpoint.
+func endpointKey(endpoint UnderlayProperties) string {
+	return fmt.Sprintf("%d/%s", endpoint.TransportProtocol(), endpoint.RemoteAddr().String())
+}
+
+// endpointHost returns the host of the server endpoint. It is the address
+// itself if there is no port, e.g. an unix domain socket path.
+func endpointHost(endpoint UnderlayProperties) string {
+	addr := endpoint.RemoteAddr().String()
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+func (m *Mux) SetDialRetry(attempts int, backoff time.Duration) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set dial retry in server mux")
+	}
+	if m.used {
+		panic("Can't set dial retry after mux is used")
+	}
+	m.dialAttempts = mathext.Max(attempts, 1)
+	m.dialBackoff = backoff
+	if m.dialBackoff < 0 {
+		m.dialBackoff = 0
+	}
+	m.logf(log.InfoLevel, "Mux dial retry is set to %d attempts with %v backoff", m.dialAttempts, m.dialBackoff)
+	return m
+}
+
+func (m *Mux) SetDialTimeout(d time.Duration) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set dial timeout in server mux")
+	}
+	if m.used {
+		panic("Can't set dial timeout after mux is used")
+	}
+	m.dialTimeout = mathext.Max(d, 0)
+	m.logf(log.InfoLevel, "Mux dial timeout is set to %v", m.dialTimeout)
+	return m
+}
+
+func (m *Mux) SetDialer(dialer DialFunc) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set dialer in server mux")
+	}
+	if m.used {
+		panic("Can't set dialer after mux is used")
+	}
+	m.dialer = dialer
+	return m
+}
+
+func (m *Mux) SetClientLocalAddr(addr string) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set client local address in server mux")
+	}
+	if m.used {
+		panic("Can't set client local address after mux is used")
+	}
+	localAddr, err := validateLocalAddr(addr)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid client local address: %v", err))
+	}
+	m.localAddr = localAddr
+	m.logf(log.InfoLevel, "Mux client local address is set to %s", localAddr)
+	return m
+}
+
+// resolveEndpointAddrs returns the addresses to dial for the endpoint,
+// using the DNS cache if it is enabled.
+func (m *Mux) resolveEndpointAddrs(ctx context.Context, p UnderlayProperties) ([]string, error) {
+	if m.dnsCache == nil {
+		return resolveEndpointAddrs(ctx, p, m.lookupIPAddr)
+	}
+	addrs, err := resolveEndpointAddrs(ctx, p, func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return m.dnsCache.lookup(ctx, host, m.lookupIPAddr)
+	})
+	if err != nil {
+		m.logf(log.DebugLevel, "Dial %v directly: %v", p.RemoteAddr(), err)
+		return []string{p.RemoteAddr().String()}, nil
+	}
+	return addrs, nil
+}
+
+// lifetimeContext returns a context that is canceled after the timeout,
+// or when the mux is closed.
+func (m *Mux) lifetimeContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	go func() {
+		select {
+		case <-m.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// dialedUnderlay is a client underlay that is connected to the server,
+// but not added to the mux yet.
+type dialedUnderlay struct {
+	underlay Underlay
+	endpoint int                // index of the server endpoint
+	props    UnderlayProperties // the server endpoint
+	key      string             // endpointKey of the server endpoint
+	loopCtx  context.Context    // context of the event loop
+	start    time.Time          // time the dial is started
+}
+
+// dialUnderlay connects a new underlay to a server endpoint with the
+// password. Dial failures are recorded to the endpoint health.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) dialUnderlay(ctx context.Context, opts *dialOptions, password []byte) (*dialedUnderlay, error) {
+	start := time.Now()
+	i := opts.endpoint
+	if i < 0 {
+		i = m.pickFallbackEndpoint(opts)
+	}
+	if i < 0 {
+		i = m.pickEndpoint(opts.failedEndpoints)
+	}
+	if i >= len(m.endpoints) {
+		// The endpoints are updated while dialing.
+		UnderlayDialNoEndpoint.Add(1)
+		return nil, fmt.Errorf("endpoint index %d is out of range [0, %d)", i, len(m.endpoints))
+	}
+	p := m.endpoints[i]
+	// The dial timeout only limits the connection and the handshake.
+	// The event loop runs with the original context.
+	loopCtx := ctx
+	if opts.loopCtx != nil {
+		loopCtx = opts.loopCtx
+	}
+	if m.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.dialTimeout)
+		defer cancel()
+	}
+	laddr := m.localAddr
+	if !isIPNetwork(p.RemoteAddr().Network()) {
+		// The client local address is an IP address.
+		laddr = ""
+	}
+	dial := m.dialFunc()
+	m.logEvent(log.DebugLevel, EventEndpointSelected, log.Fields{
+		"endpoint":    i,
+		"transport":   transportName(p.TransportProtocol()),
+		"remote_addr": p.RemoteAddr().String(),
+	}, "")
+	key := endpointKey(p)
+	if opts.unlocked {
+		// Don't block the mux while connecting to the server.
+		m.mu.Unlock()
+	}
+	underlay, unreachable, err := m.connectEndpoint(ctx, p, password, laddr, dial)
+	if opts.unlocked {
+		m.mu.Lock()
+	}
+	if err != nil {
+		if unreachable && i < len(m.endpoints) && endpointKey(m.endpoints[i]) == key {
+			m.onDialFailure(i, opts)
+		}
+		return nil, err
+	}
+	if opts.unlocked {
+		// The mux may be changed while connecting.
+		if m.isStopped() {
+			underlay.Close()
+			return nil, fmt.Errorf("mux is closed: %w", io.ErrClosedPipe)
+		}
+		if m.isMaxUnderlaysReached() {
+			underlay.Close()
+			return nil, fmt.Errorf("reached the maximum number of %d underlays: %w", m.maxUnderlays, ErrNoAvailableUnderlay)
+		}
+	}
+	return &dialedUnderlay{
+		underlay: underlay,
+		endpoint: i,
+		props:    p,
+		key:      key,
+		loopCtx:  loopCtx,
+		start:    start,
+	}, nil
+}
+
+// connectEndpoint connects a new underlay to the server endpoint p with the
+// password. It returns true if the endpoint is not reachable. It doesn't
+// change the mux, so the caller doesn't need to hold the mu lock.
+func (m *Mux) connectEndpoint(ctx context.Context, p UnderlayProperties, password []byte, laddr string, dial DialFunc) (Underlay, bool, error) {
+	dialError := func(err error) error {
+		return &UnderlayDialError{Endpoint: p, Err: err}
+	}
+	cipherError := func(err error) error {
+		UnderlayDialCipherError.Add(1)
+		return dialError(err)
+	}
+	networkError := func(err error) error {
+		UnderlayDialNetworkError.Add(1)
+		return dialError(err)
+	}
+	switch p.TransportProtocol() {
+	case util.TCPTransport:
+		block, err := m.ciphers.BlockCipherFromPassword(password, false)
+		if err != nil {
+			return nil, false, cipherError(fmt.Errorf("BlockCipherFromPassword() failed: %w", err))
+		}
+		addrs, err := m.resolveEndpointAddrs(ctx, p)
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("resolveEndpointAddrs() failed: %w", err))
+		}
+		tcpUnderlay, err := dialHappyEyeballs(ctx, addrs, happyEyeballsDelay, func(ctx context.Context, addr string) (*TCPUnderlay, error) {
+			return newTCPUnderlay(ctx, dial, p.RemoteAddr().Network(), laddr, addr, p.MTU(), block.Clone())
+		}, func(t *TCPUnderlay) {
+			t.conn.Close()
+		})
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("NewTCPUnderlay() failed: %w", err))
+		}
+		if err := tcpUnderlay.applyOptions(underlayOptions(p)); err != nil {
+			tcpUnderlay.conn.Close()
+			return nil, false, networkError(fmt.Errorf("applyOptions() failed: %w", err))
+		}
+		return tcpUnderlay, false, nil
+	case util.WebSocketTransport:
+		block, err := m.ciphers.BlockCipherFromPassword(password, false)
+		if err != nil {
+			return nil, false, cipherError(fmt.Errorf("BlockCipherFromPassword() failed: %w", err))
+		}
+		addrs, err := m.resolveEndpointAddrs(ctx, p)
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("resolveEndpointAddrs() failed: %w", err))
+		}
+		options := underlayOptions(p)
+		if options.WebSocket.Host == "" {
+			// Send the host name rather than the resolved IP address.
+			options.WebSocket.Host = p.RemoteAddr().String()
+			if !isIPNetwork(p.RemoteAddr().Network()) {
+				options.WebSocket.Host = "localhost"
+			}
+		}
+		wsUnderlay, err := dialHappyEyeballs(ctx, addrs, happyEyeballsDelay, func(ctx context.Context, addr string) (*WebSocketUnderlay, error) {
+			return newWebSocketUnderlay(ctx, dial, p.RemoteAddr().Network(), laddr, addr, p.MTU(), block.Clone(), options)
+		}, func(w *WebSocketUnderlay) {
+			w.conn.Close()
+		})
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("NewWebSocketUnderlay() failed: %w", err))
+		}
+		return wsUnderlay, false, nil
+	case util.TLSTransport:
+		block, err := m.ciphers.BlockCipherFromPassword(password, false)
+		if err != nil {
+			return nil, false, cipherError(fmt.Errorf("BlockCipherFromPassword() failed: %w", err))
+		}
+		addrs, err := m.resolveEndpointAddrs(ctx, p)
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("resolveEndpointAddrs() failed: %w", err))
+		}
+		// Verify the host name rather than the resolved IP address.
+		serverName := p.RemoteAddr().String()
+		if !isIPNetwork(p.RemoteAddr().Network()) {
+			serverName = "localhost"
+		}
+		tlsUnderlay, err := dialHappyEyeballs(ctx, addrs, happyEyeballsDelay, func(ctx context.Context, addr string) (*TLSUnderlay, error) {
+			return newTLSUnderlay(ctx, dial, p.RemoteAddr().Network(), laddr, addr, serverName, p.MTU(), block.Clone(), m.tlsConfig, underlayOptions(p))
+		}, func(t *TLSUnderlay) {
+			t.conn.Close()
+		})
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("newTLSUnderlay() failed: %w", err))
+		}
+		return tlsUnderlay, false, nil
+	case util.UDPTransport:
+		block, err := m.ciphers.BlockCipherFromPassword(password, true)
+		if err != nil {
+			return nil, false, cipherError(fmt.Errorf("BlockCipherFromPassword() failed: %w", err))
+		}
+		addrs, err := m.resolveEndpointAddrs(ctx, p)
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("resolveEndpointAddrs() failed: %w", err))
+		}
+		// UDP has no handshake to race. Use the most preferred address.
+		udpUnderlay, err := newUDPUnderlay(ctx, dial, p.RemoteAddr().Network(), laddr, addrs[0], p.MTU(), block)
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("NewUDPUnderlay() failed: %w", err))
+		}
+		if err := udpUnderlay.applyOptions(underlayOptions(p)); err != nil {
+			udpUnderlay.idleSessionTicker.Stop()
+			udpUnderlay.conn.Close()
+			return nil, false, networkError(fmt.Errorf("applyOptions() failed: %w", err))
+		}
+		udpUnderlay.sessionBuffer = m.udpSessionBuffer
+		udpUnderlay.bufferPolicy = m.udpBufferPolicy
+		if m.migration {
+			network, raddr := p.RemoteAddr().Network(), addrs[0]
+			redial := dial
+			if redial == nil {
+				redial = defaultDial
+			}
+			udpUnderlay.redial = func() (*net.UDPConn, error) {
+				// The old local address may be gone. Use an automatic one.
+				rawConn, err := redial(context.Background(), network, "", raddr)
+				if err != nil {
+					return nil, err
+				}
+				conn, ok := rawConn.(*net.UDPConn)
+				if !ok {
+					rawConn.Close()
+					return nil, fmt.Errorf("dialer returned %T, want *net.UDPConn", rawConn)
+				}
+				return conn, nil
+			}
+		}
+		return udpUnderlay, false, nil
+	case util.QUICTransport:
+		block, err := m.ciphers.BlockCipherFromPassword(password, false)
+		if err != nil {
+			return nil, false, cipherError(fmt.Errorf("BlockCipherFromPassword() failed: %w", err))
+		}
+		if m.dialer != nil {
+			return nil, false, dialError(fmt.Errorf("QUIC transport doesn't support a custom dialer"))
+		}
+		addrs, err := m.resolveEndpointAddrs(ctx, p)
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("resolveEndpointAddrs() failed: %w", err))
+		}
+		// Verify the host name rather than the resolved IP address.
+		serverName := p.RemoteAddr().String()
+		quicUnderlay, err := dialHappyEyeballs(ctx, addrs, happyEyeballsDelay, func(ctx context.Context, addr string) (*QUICUnderlay, error) {
+			conn, err := listenUDPClient(p.RemoteAddr().Network(), laddr)
+			if err != nil {
+				return nil, fmt.Errorf("ListenUDP() failed: %w", err)
+			}
+			m.markDSCP(conn)
+			m.applySocketBuffers(conn)
+			return newQUICUnderlay(ctx, conn, addr, serverName, p.MTU(), block.Clone(), m.tlsConfig, underlayOptions(p))
+		}, func(q *QUICUnderlay) {
+			q.conn.Close()
+		})
+		if err != nil {
+			return nil, true, networkError(fmt.Errorf("newQUICUnderlay() failed: %w", err))
+		}
+		return quicUnderlay, false, nil
+	default:
+		return nil, false, dialError(fmt.Errorf("unsupport transport protocol %v", p.TransportProtocol()))
+	}
+}
+
+// goEventLoop runs the event loop of a underlay that is not added to
+// the mux yet, e.g. to probe a password. The error of the event loop
+// is sent to the returned channel.
+func (m *Mux) goEventLoop(d *dialedUnderlay) <-chan error {
+	loopErr := make(chan error, 1)
+	go func() {
+		loopErr <- m.runEventLoop(d.loopCtx, d.underlay)
+	}()
+	return loopErr
+}
+
+// openUnderlay adds a dialed underlay to the mux and records the
+// handshake. If loopErr is nil, the event loop of the underlay is
+// started, otherwise it is already started by goEventLoop.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) openUnderlay(d *dialedUnderlay, loopErr <-chan error) Underlay {
+	underlay := d.underlay
+	m.handshakes.record(time.Since(d.start))
+	if m.isDialedEndpoint(d) {
+		m.endpointHealth[d.endpoint].onDialSuccess()
+	}
+	m.underlays = append(m.underlays, underlay)
+	if m.underlayEndpoints == nil {
+		m.underlayEndpoints = make(map[Underlay]string)
+	}
+	m.underlayEndpoints[underlay] = d.key
+	underlay.Scheduler().SetOnDisable(func() {
+		m.logEvent(log.DebugLevel, EventUnderlayDisabled, underlayFields(underlay), "Scheduling new sessions to %v is disabled", underlay)
+	})
+	onUnderlayOpen(underlay.TransportProtocol(), true)
+	go func() {
+		// The observer is notified here because the caller holds the mu lock.
+		if m.uObserver != nil {
+			m.uObserver.OnUnderlayOpen(underlay)
+		}
+		var err error
+		if loopErr != nil {
+			err = <-loopErr
+		} else {
+			err = m.runEventLoop(d.loopCtx, underlay)
+		}
+		if err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
+			m.logf(log.DebugLevel, "%v RunEventLoop(): %v", underlay, err)
+		}
+		if err != nil && !stderror.IsClosed(err) {
+			// The underlay is broken. Save the sessions that can be saved.
+			m.migrateSessions(underlay)
+		}
+		m.onUnderlayExit(underlay, err)
+		underlay.Close()
+		if m.uObserver != nil {
+			m.uObserver.OnUnderlayClose(underlay)
+		}
+		m.wakeWarmKeeper()
+	}()
+	return underlay
+}
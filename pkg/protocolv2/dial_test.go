@@ -0,0 +1,660 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/metrics"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestInterleaveIPs(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+		net.ParseIP("192.0.2.3"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3"}
+	got := interleaveIPs(ips, true)
+	if len(got) != len(want) {
+		t.Fatalf("interleaveIPs() returned %d addresses, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Errorf("interleaveIPs()[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if got := interleaveIPs(ips, false); got[0].String() != "192.0.2.1" || got[1].String() != "2001:db8::1" {
+		t.Errorf("interleaveIPs() doesn't start from IPv4 when IPv4 is preferred")
+	}
+}
+
+func TestResolveEndpointAddrsIPLiteral(t *testing.T) {
+	endpoint := NewUnderlayProperties(1500, util.IPVersion6, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8964})
+	addrs, err := resolveEndpointAddrs(context.Background(), endpoint, net.DefaultResolver.LookupIPAddr)
+	if err != nil {
+		t.Fatalf("resolveEndpointAddrs() failed: %v", err)
+	}
+	if len(addrs) != 1 || addrs[0] != "[2001:db8::1]:8964" {
+		t.Errorf("resolveEndpointAddrs() = %v, want [[2001:db8::1]:8964]", addrs)
+	}
+}
+
+func TestDialHappyEyeballsFallback(t *testing.T) {
+	var discarded atomic.Int32
+	dial := func(ctx context.Context, addr string) (string, error) {
+		if addr == "broken" {
+			// Never connects until it is cancelled.
+			<-ctx.Done()
+			return "", ctx.Err()
+		}
+		return addr, nil
+	}
+	start := time.Now()
+	got, err := dialHappyEyeballs(context.Background(), []string{"broken", "working"}, 50*time.Millisecond, dial, func(string) { discarded.Add(1) })
+	if err != nil {
+		t.Fatalf("dialHappyEyeballs() failed: %v", err)
+	}
+	if got != "working" {
+		t.Errorf("dialHappyEyeballs() = %q, want %q", got, "working")
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("dialHappyEyeballs() took %v, want about 50ms", elapsed)
+	}
+	if discarded.Load() != 0 {
+		t.Errorf("%d connections are discarded, want 0", discarded.Load())
+	}
+}
+
+func TestDialHappyEyeballsFastFailure(t *testing.T) {
+	dial := func(ctx context.Context, addr string) (string, error) {
+		if addr == "refused" {
+			return "", errors.New("connection refused")
+		}
+		return addr, nil
+	}
+	start := time.Now()
+	got, err := dialHappyEyeballs(context.Background(), []string{"refused", "working"}, time.Minute, dial, func(string) {})
+	if err != nil {
+		t.Fatalf("dialHappyEyeballs() failed: %v", err)
+	}
+	if got != "working" {
+		t.Errorf("dialHappyEyeballs() = %q, want %q", got, "working")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("dialHappyEyeballs() waited %v after a fast failure", elapsed)
+	}
+}
+
+func TestDialHappyEyeballsAllFailed(t *testing.T) {
+	errA := errors.New("a failed")
+	errB := errors.New("b failed")
+	dial := func(ctx context.Context, addr string) (string, error) {
+		if addr == "a" {
+			return "", errA
+		}
+		return "", errB
+	}
+	_, err := dialHappyEyeballs(context.Background(), []string{"a", "b"}, 10*time.Millisecond, dial, func(string) {})
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Errorf("dialHappyEyeballs() returned %v, want both errors", err)
+	}
+}
+
+func TestDialHappyEyeballsContextCancel(t *testing.T) {
+	dial := func(ctx context.Context, addr string) (string, error) {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := dialHappyEyeballs(ctx, []string{"a", "b", "c"}, 10*time.Millisecond, dial, func(string) {})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("dialHappyEyeballs() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+// closedTCPAddr returns a local TCP address that refuses connections.
+func closedTCPAddr(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	addr := l.Addr().(*net.TCPAddr)
+	l.Close()
+	return addr
+}
+
+func TestUnderlayDialError(t *testing.T) {
+	addr := closedTCPAddr(t)
+	endpoint := NewUnderlayProperties(1400, util.IPVersion4, util.TCPTransport, nil, addr)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+	_, err := clientMux.DialContext(context.Background())
+	if err == nil {
+		t.Fatalf("DialContext() succeeded, want error")
+	}
+	var dialErr *UnderlayDialError
+	if !errors.As(err, &dialErr) {
+		t.Fatalf("DialContext() returned %v, want UnderlayDialError", err)
+	}
+	if got := dialErr.Endpoint.RemoteAddr().String(); got != addr.String() {
+		t.Errorf("UnderlayDialError endpoint = %s, want %s", got, addr.String())
+	}
+	if dialErr.Endpoint.TransportProtocol() != util.TCPTransport {
+		t.Errorf("UnderlayDialError transport = %v, want %v", dialErr.Endpoint.TransportProtocol(), util.TCPTransport)
+	}
+	if !strings.Contains(err.Error(), addr.String()) {
+		t.Errorf("error %q doesn't contain the endpoint address %s", err.Error(), addr.String())
+	}
+}
+
+func TestValidateLocalAddr(t *testing.T) {
+	testCases := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "127.0.0.1", want: "127.0.0.1:0"},
+		{addr: "127.0.0.1:12345", want: "127.0.0.1:12345"},
+		{addr: "0.0.0.0", want: "0.0.0.0:0"},
+		{addr: "localhost", wantErr: true},
+		{addr: "127.0.0.1:http", wantErr: true},
+		{addr: "192.0.2.1", wantErr: true},
+		{addr: "127.0.0.1%no-such-interface", wantErr: true},
+	}
+	for _, tc := range testCases {
+		got, err := validateLocalAddr(tc.addr)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("validateLocalAddr(%q) returned error %v, want error %v", tc.addr, err, tc.wantErr)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("validateLocalAddr(%q) = %q, want %q", tc.addr, got, tc.want)
+		}
+	}
+}
+
+func TestClientLocalAddr(t *testing.T) {
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		_, endpoint := startTestMux(t, transport)
+		clientMux := newTestClient(endpoint).SetClientLocalAddr("127.0.0.1")
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		local := conn.(*Session).underlay().LocalAddr()
+		host, _, err := net.SplitHostPort(local.String())
+		if err != nil {
+			t.Fatalf("net.SplitHostPort() failed: %v", err)
+		}
+		if host != "127.0.0.1" {
+			t.Errorf("%v underlay local address is %v, want 127.0.0.1", transport, local)
+		}
+		conn.Close()
+		clientMux.Close()
+	}
+}
+
+func TestDialAllEndpointsFailed(t *testing.T) {
+	var endpoints []UnderlayProperties
+	for i := 0; i < 3; i++ {
+		endpoints = append(endpoints, NewUnderlayProperties(1400, util.IPVersion4, util.TCPTransport, nil, closedTCPAddr(t)))
+	}
+	clientMux := newTestClient(endpoints[0]).SetEndpoints(endpoints)
+	defer clientMux.Close()
+	_, err := clientMux.DialContext(context.Background())
+	if err == nil {
+		t.Fatalf("DialContext() succeeded, want error")
+	}
+	if !strings.Contains(err.Error(), "all 3 endpoints are unreachable") {
+		t.Errorf("error %q doesn't report all the endpoints are unreachable", err.Error())
+	}
+	for _, endpoint := range endpoints {
+		if !strings.Contains(err.Error(), endpoint.RemoteAddr().String()) {
+			t.Errorf("error %q doesn't contain endpoint %v", err.Error(), endpoint.RemoteAddr())
+		}
+	}
+}
+
+func TestDialSkipsFailedEndpoints(t *testing.T) {
+	_, healthy := startTestMux(t, util.TCPTransport)
+	endpoints := []UnderlayProperties{
+		NewUnderlayProperties(1400, util.IPVersion4, util.TCPTransport, nil, closedTCPAddr(t)),
+		NewUnderlayProperties(1400, util.IPVersion4, util.TCPTransport, nil, closedTCPAddr(t)),
+		healthy,
+	}
+	for i := 0; i < 5; i++ {
+		clientMux := newTestClient(healthy).SetEndpoints(endpoints)
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		if got, want := conn.RemoteAddr().String(), healthy.RemoteAddr().String(); got != want {
+			t.Errorf("RemoteAddr() = %s, want %s", got, want)
+		}
+		conn.Close()
+		clientMux.Close()
+	}
+}
+
+func TestTransportFallback(t *testing.T) {
+	_, tcpEndpoint := startTestMux(t, util.TCPTransport)
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: tcpEndpoint.RemoteAddr().(*net.TCPAddr).Port}
+	endpoints := []UnderlayProperties{
+		NewUnderlayProperties(1400, util.IPVersion4, util.UDPTransport, nil, udpAddr),
+		tcpEndpoint,
+		NewUnderlayProperties(1400, util.IPVersion4, util.UDPTransport, nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.2"), Port: udpAddr.Port}),
+	}
+	var mu sync.Mutex
+	var networks []string
+	clientMux := newTestClient(tcpEndpoint).
+		SetEndpoints(endpoints).
+		SetEndpointSelection(RoundRobin).
+		SetTransportFallback(true).
+		SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+			mu.Lock()
+			networks = append(networks, network)
+			mu.Unlock()
+			if strings.HasPrefix(network, "udp") {
+				return nil, errors.New("UDP is blocked")
+			}
+			return defaultDial(ctx, network, localAddr, remoteAddr)
+		})
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if got, want := conn.RemoteAddr().String(), tcpEndpoint.RemoteAddr().String(); got != want {
+		t.Errorf("RemoteAddr() = %s, want %s", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// The TCP endpoint of the same host is tried right after UDP failed.
+	want := []string{"udp", "tcp"}
+	if strings.Join(networks, ",") != strings.Join(want, ",") {
+		t.Errorf("dialed networks = %v, want %v", networks, want)
+	}
+}
+
+func TestTransportFallbackBlackHole(t *testing.T) {
+	_, tcpEndpoint := startTestMux(t, util.TCPTransport)
+	// The packets sent to this UDP socket are never answered.
+	blackHole, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("ListenUDP() failed: %v", err)
+	}
+	defer blackHole.Close()
+	endpoints := []UnderlayProperties{
+		NewUnderlayProperties(1400, util.IPVersion4, util.UDPTransport, nil, blackHole.LocalAddr()),
+		tcpEndpoint,
+	}
+	clientMux := newTestClient(tcpEndpoint).
+		SetEndpoints(endpoints).
+		SetEndpointSelection(RoundRobin).
+		SetTransportFallback(true)
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if got := conn.(*Session).underlay().TransportProtocol(); got != util.TCPTransport {
+		t.Errorf("session uses %v transport, want TCP", transportName(got))
+	}
+	if _, total := clientMux.UnderlayCount(); total != 1 {
+		t.Errorf("got %d underlays, want 1", total)
+	}
+	if health := clientMux.EndpointHealth(); health[0].ConsecutiveFailures != 1 {
+		t.Errorf("UDP endpoint has %d failures, want 1", health[0].ConsecutiveFailures)
+	}
+}
+
+// linkLocalIPv6Addr returns a link-local IPv6 address of a network interface
+// and the interface name. The test is skipped if there is none.
+func linkLocalIPv6Addr(t *testing.T) (net.IP, string) {
+	t.Helper()
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("net.Interfaces() failed: %v", err)
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast() {
+				return ipNet.IP, iface.Name
+			}
+		}
+	}
+	t.Skip("no link-local IPv6 address found")
+	return nil, ""
+}
+
+func TestIPv6ZoneEndpoint(t *testing.T) {
+	ip, zone := linkLocalIPv6Addr(t)
+	host := ip.String() + "%" + zone
+
+	if got, err := validateLocalAddr(host); err != nil || got != net.JoinHostPort(host, "0") {
+		t.Errorf("validateLocalAddr(%q) = %q, %v, want %q", host, got, err, net.JoinHostPort(host, "0"))
+	}
+
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		var port int
+		var err error
+		network := "tcp"
+		if transport == util.UDPTransport {
+			port, err = util.UnusedUDPPort()
+			network = "udp"
+		} else {
+			port, err = util.UnusedTCPPort()
+		}
+		if err != nil {
+			t.Fatalf("get unused port failed: %v", err)
+		}
+		// Addresses as strings are parsed by the mux, and must keep the zone.
+		addr := util.NetAddr{Net: network, Str: net.JoinHostPort(host, strconv.Itoa(port))}
+		serverMux := NewMux(false).
+			SetServerUsers(users).
+			SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1400, util.IPVersion6, transport, addr, nil)})
+		if err := serverMux.Start(); err != nil {
+			t.Fatalf("Start() failed: %v", err)
+		}
+		clientMux := newTestClient(NewUnderlayProperties(1400, util.IPVersion6, transport, nil, addr))
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() with %s endpoint %v failed: %v", network, addr, err)
+		}
+		acceptTestSession(t, serverMux, conn)
+		conn.Close()
+		clientMux.Close()
+		serverMux.Close()
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// The server accepts the connections but never completes the handshake.
+	rawListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	defer rawListener.Close()
+	var mu sync.Mutex
+	var conns []net.Conn
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	go func() {
+		for {
+			c, err := rawListener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+
+	const timeout = 200 * time.Millisecond
+	endpoint := NewUnderlayPropertiesWithOptions(1500, util.IPVersion4, util.WebSocketTransport, nil, rawListener.Addr(), UnderlayOptions{WebSocket: WebSocketConfig{}})
+	clientMux := newTestClient(endpoint).SetDialTimeout(timeout)
+	defer clientMux.Close()
+	start := time.Now()
+	if _, err := clientMux.DialContext(context.Background()); err == nil {
+		t.Fatalf("DialContext() succeeded without a handshake")
+	}
+	if elapsed := time.Since(start); elapsed < timeout || elapsed > 5*timeout {
+		t.Errorf("DialContext() returned after %v, want about %v", elapsed, timeout)
+	}
+
+	// The timeout doesn't close the underlay after the handshake.
+	serverMux, serverEndpoint := startTestMux(t, util.TCPTransport)
+	timeoutMux := newTestClient(serverEndpoint).SetDialTimeout(timeout)
+	defer timeoutMux.Close()
+	conn, err := timeoutMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(2 * timeout)
+	if isDone(conn.(*Session).underlay().Done()) {
+		t.Errorf("underlay is closed by the dial timeout")
+	}
+	acceptTestSession(t, serverMux, conn)
+}
+
+func TestDNSCache(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	port := endpoint.RemoteAddr().(*net.TCPAddr).Port
+	addr := util.NetAddr{Net: "tcp", Str: net.JoinHostPort("mieru.test", strconv.Itoa(port))}
+	var lookups atomic.Int32
+	lookup := func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		lookups.Add(1)
+		if host != "mieru.test" {
+			t.Errorf("lookup host = %q, want %q", host, "mieru.test")
+		}
+		return []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}, nil
+	}
+
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, addr)).
+		SetDNSCacheTTL(300 * time.Millisecond)
+	clientMux.lookupIPAddr = lookup
+	defer clientMux.Close()
+	if err := clientMux.Warmup(context.Background(), 3); err != nil {
+		t.Fatalf("Warmup() failed: %v", err)
+	}
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("host is resolved %d times within the TTL, want 1", got)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if err := clientMux.Warmup(context.Background(), 4); err != nil {
+		t.Fatalf("Warmup() failed: %v", err)
+	}
+	if got := lookups.Load(); got != 2 {
+		t.Errorf("host is resolved %d times after the TTL, want 2", got)
+	}
+}
+
+func TestDNSCacheLookupFailure(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	port := endpoint.RemoteAddr().(*net.TCPAddr).Port
+	addr := util.NetAddr{Net: "tcp", Str: net.JoinHostPort("mieru.test", strconv.Itoa(port))}
+	var dialed string
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, addr)).
+		SetDNSCacheTTL(time.Minute).
+		SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+			dialed = remoteAddr
+			return defaultDial(ctx, network, localAddr, endpoint.RemoteAddr().String())
+		})
+	clientMux.lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, errors.New("DNS server is down")
+	}
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if dialed != addr.Str {
+		t.Errorf("dialed %q, want the host name %q", dialed, addr.Str)
+	}
+}
+
+func TestSetDialer(t *testing.T) {
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		_, endpoint := startTestMux(t, transport)
+		var calls atomic.Int32
+		var gotNetwork, gotRemote string
+		clientMux := newTestClient(endpoint).SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+			calls.Add(1)
+			gotNetwork, gotRemote = network, remoteAddr
+			return defaultDial(ctx, network, localAddr, remoteAddr)
+		})
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		conn.Close()
+		clientMux.Close()
+		if calls.Load() != 1 {
+			t.Errorf("dialer is called %d times, want 1", calls.Load())
+		}
+		if gotNetwork != endpoint.RemoteAddr().Network() || gotRemote != endpoint.RemoteAddr().String() {
+			t.Errorf("dialer is called with %s %s, want %s %s", gotNetwork, gotRemote, endpoint.RemoteAddr().Network(), endpoint.RemoteAddr().String())
+		}
+	}
+
+	// The error of the dialer is returned.
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint).SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+		return nil, fmt.Errorf("proxy is unreachable")
+	})
+	defer clientMux.Close()
+	if _, err := clientMux.DialContext(context.Background()); err == nil || !strings.Contains(err.Error(), "proxy is unreachable") {
+		t.Errorf("DialContext() returned %v, want the dialer error", err)
+	}
+}
+
+func TestDialFailureMetrics(t *testing.T) {
+	unreachable := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})
+	testCases := []struct {
+		name   string
+		metric metrics.Metric
+		mux    func() *Mux
+	}{
+		{
+			name:   "NoEndpoint",
+			metric: UnderlayDialNoEndpoint,
+			mux: func() *Mux {
+				return NewMux(true).SetClientPassword(cipher.HashPassword([]byte("kuiranbudong"), []byte("xiaochitang")))
+			},
+		},
+		{
+			name:   "CipherError",
+			metric: UnderlayDialCipherError,
+			mux: func() *Mux {
+				return newTestClient(unreachable).SetCipherFactory(failingCipherFactory{})
+			},
+		},
+		{
+			name:   "NetworkError",
+			metric: UnderlayDialNetworkError,
+			mux: func() *Mux {
+				return newTestClient(unreachable)
+			},
+		},
+		{
+			name:   "AddSessionError",
+			metric: UnderlayAddSessionError,
+			mux: func() *Mux {
+				// A client session can't be added to a server underlay.
+				m := newTestClient(unreachable).SetMaxUnderlays(1)
+				m.underlays = append(m.underlays, newFakeUnderlay(false))
+				return m
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before := tc.metric.Load()
+			m := tc.mux()
+			defer m.Close()
+			if _, err := m.DialContext(context.Background()); err == nil {
+				t.Fatalf("DialContext() succeeded, want an error")
+			}
+			if got := tc.metric.Load() - before; got != 1 {
+				t.Errorf("%s increased by %d, want 1", tc.metric.Name(), got)
+			}
+		})
+	}
+}
+
+func TestDialRetry(t *testing.T) {
+	_, goodEndpoint := startTestMux(t, util.TCPTransport)
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	badEndpoint := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+
+	// Round robin tries the bad endpoint first, then retries the good one.
+	mux := newTestClient(badEndpoint).
+		SetEndpoints([]UnderlayProperties{badEndpoint, goodEndpoint}).
+		SetEndpointSelection(RoundRobin).
+		SetDialRetry(2, 10*time.Millisecond)
+	defer mux.Close()
+	conn, err := mux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if got, want := conn.RemoteAddr().String(), goodEndpoint.RemoteAddr().String(); got != want {
+		t.Errorf("RemoteAddr() = %s, want %s", got, want)
+	}
+	if states := mux.EndpointHealth(); states[0].ConsecutiveFailures != 1 || states[1].ConsecutiveFailures != 0 {
+		t.Errorf("EndpointHealth() = %+v, want 1 failure of the bad endpoint", states)
+	}
+}
+
+func TestDialRetryContextCancel(t *testing.T) {
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	endpoint := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	mux := newTestClient(endpoint).SetDialRetry(10, time.Minute)
+	defer mux.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := mux.DialContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DialContext() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("DialContext() returned after %v, want it to honor the context", elapsed)
+	}
+}
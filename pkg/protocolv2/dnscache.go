@@ -0,0 +1,90 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// lookupIPAddrFunc resolves the IP addresses of a host name.
+type lookupIPAddrFunc func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+// dnsCacheEntry is the resolved IP addresses of a host name.
+type dnsCacheEntry struct {
+	ipAddrs []net.IPAddr
+	expire  time.Time
+}
+
+// dnsCache keeps the IP addresses of endpoint host names for a fixed TTL,
+// so new underlays don't resolve the same host again. Failed lookups
+// are not cached. It is safe for concurrent use.
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsCacheEntry
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		entries: make(map[string]dnsCacheEntry),
+	}
+}
+
+// lookup returns the cached IP addresses of the host, or resolves the host
+// with the lookup function if the cache entry doesn't exist or is expired.
+func (c *dnsCache) lookup(ctx context.Context, host string, lookup lookupIPAddrFunc) ([]net.IPAddr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expire) {
+		return entry.ipAddrs, nil
+	}
+	ipAddrs, err := lookup(ctx, host)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		delete(c.entries, host)
+		return nil, err
+	}
+	c.entries[host] = dnsCacheEntry{ipAddrs: ipAddrs, expire: now.Add(c.ttl)}
+	return ipAddrs, nil
+}
+
+func (m *Mux) SetDNSCacheTTL(d time.Duration) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set DNS cache TTL in server mux")
+	}
+	if m.used {
+		panic("Can't set DNS cache TTL after mux is used")
+	}
+	if d > 0 {
+		m.dnsCache = newDNSCache(d)
+		m.logf(log.InfoLevel, "Mux DNS cache TTL is set to %v", d)
+	} else {
+		m.dnsCache = nil
+		m.logf(log.InfoLevel, "Mux DNS cache is disabled")
+	}
+	return m
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+)
+
+// drainPollInterval is the interval to check if the sessions are finished
+// when the mux is draining.
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain stops accepting new underlays and sessions, and waits for the
+// existing sessions to finish. When all the sessions are finished, or the
+// context is done, the mux is closed. This method is only used by server.
+func (m *Mux) Drain(ctx context.Context) error {
+	if m.isClient {
+		return stderror.ErrInvalidOperation
+	}
+	m.stopAccepting()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		if m.sessionCount() == 0 {
+			return m.Close()
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), m.Close())
+		case <-m.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// CloseWithTimeout stops accepting new underlays and sessions, and waits up
+// to timeout for the underlays to become idle, i.e. they have no session or
+// their scheduling has been disabled long enough. After that, the remaining
+// underlays are closed as with Close. Unlike Drain, it can be used by both
+// client and server, and the grace period is bounded.
+func (m *Mux) CloseWithTimeout(timeout time.Duration) error {
+	m.stopAccepting()
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		n := m.busyUnderlayCount()
+		if n == 0 {
+			return m.Close()
+		}
+		if !time.Now().Before(deadline) {
+			m.logf(log.InfoLevel, "Force closing %d busy underlays after %v", n, timeout)
+			return m.Close()
+		}
+		select {
+		case <-m.done:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopAccepting closes the listeners, and rejects new underlays and
+// sessions. It doesn't close the existing underlays.
+func (m *Mux) stopAccepting() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	select {
+	case <-m.draining:
+	default:
+		if m.isClient {
+			m.logf(log.InfoLevel, "Draining client multiplexer")
+		} else {
+			m.logf(log.InfoLevel, "Draining server multiplexer")
+		}
+		close(m.draining)
+	}
+	m.closeListeners()
+}
+
+// busyUnderlayCount returns the number of live underlays that have sessions
+// and are not idle.
+func (m *Mux) busyUnderlayCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, underlay := range m.underlays {
+		select {
+		case <-underlay.Done():
+		default:
+			if sessionCount(underlay) > 0 && !underlay.Scheduler().Idle() {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// sessionCount returns the number of sessions in all the live underlays.
+func (m *Mux) sessionCount() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, underlay := range m.underlays {
+		select {
+		case <-underlay.Done():
+		default:
+			n += sessionCount(underlay)
+		}
+	}
+	return n
+}
+
+// isStopped returns true if the mux doesn't accept new connections,
+// because it is draining or closed.
+func (m *Mux) isStopped() bool {
+	select {
+	case <-m.draining:
+		return true
+	case <-m.done:
+		return true
+	default:
+		return false
+	}
+}
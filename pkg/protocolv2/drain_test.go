@@ -0,0 +1,176 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestServerDrain(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestServer(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	rot13RoundTrip(t, conn, 64)
+
+	drainErr := make(chan error, 1)
+	go func() {
+		drainErr <- serverMux.Drain(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	// New underlay is not accepted.
+	newClientMux := newTestClient(endpoint)
+	defer newClientMux.Close()
+	if _, err := newClientMux.DialContext(context.Background()); err == nil {
+		t.Errorf("DialContext() succeeded while server is draining")
+	}
+
+	// Existing session still works.
+	rot13RoundTrip(t, conn, 64)
+	select {
+	case err := <-drainErr:
+		t.Fatalf("Drain() returned %v before sessions finish", err)
+	default:
+	}
+
+	conn.Close()
+	select {
+	case err := <-drainErr:
+		if err != nil {
+			t.Errorf("Drain() failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Drain() is not finished after all sessions are closed")
+	}
+	select {
+	case <-serverMux.done:
+	default:
+		t.Errorf("server mux is not closed after Drain()")
+	}
+}
+
+func TestServerDrainTimeout(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	serverSession := acceptTestSession(t, serverMux, conn)
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancelFunc()
+	if err := serverMux.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Drain() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// The unfinished session is closed with the mux.
+	if !isDone(serverMux.Done()) {
+		t.Errorf("server mux is not closed after Drain() times out")
+	}
+	select {
+	case <-serverSession.done:
+	case <-time.After(time.Second):
+		t.Errorf("server session is not closed after Drain() times out")
+	}
+}
+
+// busyUnderlay always has a session. It becomes idle at idleTime.
+type busyUnderlay struct {
+	*fakeUnderlay
+}
+
+func newBusyUnderlay(idleTime time.Time) *busyUnderlay {
+	u := &busyUnderlay{fakeUnderlay: newFakeUnderlay(true)}
+	u.scheduler.disable = true
+	u.scheduler.disableTime = idleTime.Add(-scheduleIdleTime)
+	return u
+}
+
+func (u *busyUnderlay) SessionCount() int {
+	return 1
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	u := newBusyUnderlay(time.Now().Add(500 * time.Millisecond))
+	UnderlayCurrEstablished.Add(1)
+	mux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}))
+	mux.underlays = append(mux.underlays, u)
+
+	closeErr := make(chan error, 1)
+	go func() {
+		closeErr <- mux.CloseWithTimeout(10 * time.Second)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case <-u.Done():
+		t.Fatalf("underlay is closed before it is idle")
+	default:
+	}
+	if _, err := mux.DialContext(context.Background()); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("DialContext() error = %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	select {
+	case err := <-closeErr:
+		if err != nil {
+			t.Errorf("CloseWithTimeout() failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("CloseWithTimeout() is not finished after the underlay is idle")
+	}
+	select {
+	case <-u.Done():
+	default:
+		t.Errorf("underlay is not closed")
+	}
+}
+
+func TestCloseWithTimeoutForceClose(t *testing.T) {
+	u := newBusyUnderlay(time.Now().Add(time.Hour))
+	UnderlayCurrEstablished.Add(1)
+	mux := NewMux(true)
+	mux.underlays = append(mux.underlays, u)
+
+	start := time.Now()
+	if err := mux.CloseWithTimeout(300 * time.Millisecond); err != nil {
+		t.Errorf("CloseWithTimeout() failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("CloseWithTimeout() returned after %v, want at least %v", elapsed, 300*time.Millisecond)
+	}
+	select {
+	case <-u.Done():
+	default:
+		t.Errorf("underlay is not force closed")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util/sockopts"
+)
+
+// maxDSCP is the largest differentiated services code point.
+const maxDSCP = 63
+
+// setDSCP marks the outgoing packets of the IP connection with the DSCP value.
+func setDSCP(conn net.Conn, dscp int) error {
+	// DSCP is the upper 6 bits of the IPv4 TOS byte and IPv6 traffic class.
+	return controlConn(conn, sockopts.TrafficClassRawErr(dscp<<2))
+}
+
+// controlConn runs f with the socket of the connection.
+func controlConn(conn net.Conn, f sockopts.RawControlErr) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("%T has no socket: %w", conn, stderror.ErrUnsupported)
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("SyscallConn() failed: %w", err)
+	}
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = f(fd)
+	}); err != nil {
+		return fmt.Errorf("Control() failed: %w", err)
+	}
+	return sockErr
+}
+
+// markDSCP applies the DSCP value of the mux to the connection.
+// The connection is still used if the value can't be set, e.g. the
+// platform doesn't support it or the connection is not an IP socket.
+func (m *Mux) markDSCP(conn net.Conn) {
+	if m.dscp == 0 {
+		return
+	}
+	if err := setDSCP(conn, m.dscp); err != nil {
+		m.logf(log.DebugLevel, "Unable to set DSCP %d on connection to %v: %v", m.dscp, conn.RemoteAddr(), err)
+	}
+}
+
+// dialFunc returns the function to create client connections, which
+// applies the DSCP value and the socket buffer sizes of the mux.
+func (m *Mux) dialFunc() DialFunc {
+	if m.dscp == 0 && m.sockReadBuffer == 0 && m.sockWriteBuffer == 0 {
+		return m.dialer
+	}
+	dial := m.dialer
+	if dial == nil {
+		dial = defaultDial
+	}
+	return func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, localAddr, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		m.markDSCP(conn)
+		m.applySocketBuffers(conn)
+		return conn, nil
+	}
+}
+
+func (m *Mux) SetDSCP(value int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if value < 0 || value > maxDSCP {
+		panic(fmt.Sprintf("DSCP %d is out of range [0, %d]", value, maxDSCP))
+	}
+	if m.used {
+		panic("Can't set DSCP after mux is used")
+	}
+	m.dscp = value
+	m.logf(log.InfoLevel, "Mux DSCP is set to %d", value)
+	return m
+}
@@ -0,0 +1,42 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/enfein/mieru/pkg/stderror"
+)
+
+func TestDSCPUnsupported(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if err := setDSCP(c1, 46); !errors.Is(err, stderror.ErrUnsupported) {
+		t.Errorf("setDSCP() on a pipe returned %v, want %v", err, stderror.ErrUnsupported)
+	}
+	// The connection is kept when it can't be marked.
+	NewMux(true).SetDSCP(46).markDSCP(c1)
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("SetDSCP(64) didn't panic")
+		}
+	}()
+	NewMux(true).SetDSCP(64)
+}
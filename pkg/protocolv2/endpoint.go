@@ -0,0 +1,373 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/mathext"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+const (
+	// maxEndpointDialFailures is the number of consecutive dial failures
+	// before an endpoint is considered down.
+	maxEndpointDialFailures = 3
+
+	// minEndpointDownTime is the initial time an endpoint is removed from
+	// selection after it is considered down.
+	minEndpointDownTime = 5 * time.Second
+
+	// maxEndpointDownTime is the maximum time an endpoint is removed from
+	// selection after it is considered down.
+	maxEndpointDownTime = 5 * time.Minute
+)
+
+// EndpointSelection determines how the client picks a server endpoint
+// to create a new underlay.
+type EndpointSelection uint8
+
+const (
+	// RandomSelection picks a random endpoint, weighted by the endpoint
+	// weights if they are set.
+	RandomSelection EndpointSelection = iota
+
+	// RoundRobin cycles through the endpoints in order. Endpoint weights
+	// are not used.
+	RoundRobin
+)
+
+func (s EndpointSelection) String() string {
+	switch s {
+	case RandomSelection:
+		return "RANDOM"
+	case RoundRobin:
+		return "ROUND_ROBIN"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// EndpointHealth is a snapshot of the health state of a server endpoint.
+type EndpointHealth struct {
+	Endpoint            UnderlayProperties
+	Healthy             bool
+	ConsecutiveFailures int
+	DownUntil           time.Time // zero if the endpoint is healthy
+}
+
+// endpointHealth tracks the dial results of a server endpoint.
+// The caller must hold the mux lock to use it.
+type endpointHealth struct {
+	consecutiveFailures int
+	downTime            time.Duration
+	downUntil           time.Time
+}
+
+// isHealthy returns true if the endpoint can be selected.
+func (h *endpointHealth) isHealthy() bool {
+	return time.Now().After(h.downUntil)
+}
+
+// onDialSuccess resets the health state.
+func (h *endpointHealth) onDialSuccess() {
+	h.consecutiveFailures = 0
+	h.downTime = 0
+	h.downUntil = time.Time{}
+}
+
+// onDialFailure records a dial failure. After too many consecutive
+// failures, the endpoint is removed from selection with exponential backoff.
+func (h *endpointHealth) onDialFailure() {
+	h.consecutiveFailures++
+	if h.consecutiveFailures < maxEndpointDialFailures {
+		return
+	}
+	if h.downTime == 0 {
+		h.downTime = minEndpointDownTime
+	} else {
+		h.downTime *= 2
+		if h.downTime > maxEndpointDownTime {
+			h.downTime = maxEndpointDownTime
+		}
+	}
+	h.downUntil = time.Now().Add(h.downTime)
+}
+
+func newEndpointHealthList(n int) []*endpointHealth {
+	list := make([]*endpointHealth, n)
+	for i := range list {
+		list[i] = &endpointHealth{}
+	}
+	return list
+}
+
+// UpdateEndpoints replaces the server endpoints of a client mux, even if
+// the mux is already used. Existing underlays continue to serve their
+// sessions, and new underlays are created with the new endpoints.
+// The health state of an endpoint that is kept is preserved. The endpoint
+// weights are cleared, as with SetEndpoints.
+func (m *Mux) UpdateEndpoints(endpoints []UnderlayProperties) error {
+	if !m.isClient {
+		return stderror.ErrInvalidOperation
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no server listening endpoint found")
+	}
+	for _, p := range endpoints {
+		if util.IsNilNetAddr(p.RemoteAddr()) {
+			return fmt.Errorf("endpoint remote address is not set")
+		}
+	}
+	if _, err := validateEndpointMTUs(endpoints); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldHealth := make(map[string]*endpointHealth, len(m.endpoints))
+	for i, p := range m.endpoints {
+		oldHealth[endpointKey(p)] = m.endpointHealth[i]
+	}
+	health := newEndpointHealthList(len(endpoints))
+	for i, p := range endpoints {
+		if h, ok := oldHealth[endpointKey(p)]; ok {
+			health[i] = h
+		}
+	}
+	m.endpoints = endpoints
+	m.endpointHealth = health
+	m.endpointWeights = nil
+	m.logf(log.InfoLevel, "Mux endpoints are updated to %d endpoints", len(endpoints))
+	return nil
+}
+
+// SetEndpointWeights must be called after SetEndpoints.
+func (m *Mux) SetEndpointWeights(weights []int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set endpoint weights in server mux")
+	}
+	if m.used {
+		panic("Can't set endpoint weights after mux is used")
+	}
+	if len(weights) != len(m.endpoints) {
+		panic(fmt.Sprintf("Number of endpoint weights %d doesn't match number of endpoints %d", len(weights), len(m.endpoints)))
+	}
+	m.endpointWeights = make([]int, len(weights))
+	for i, w := range weights {
+		m.endpointWeights[i] = mathext.Max(w, 0)
+	}
+	return m
+}
+
+func (m *Mux) SetEndpointSelection(selection EndpointSelection) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set endpoint selection in server mux")
+	}
+	if m.used {
+		panic("Can't set endpoint selection after mux is used")
+	}
+	m.endpointSelection = selection
+	m.logf(log.InfoLevel, "Mux endpoint selection is set to %v", selection)
+	return m
+}
+
+func (m *Mux) SetTransportFallback(enable bool) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set transport fallback in server mux")
+	}
+	if m.used {
+		panic("Can't set transport fallback after mux is used")
+	}
+	m.transportFallback = enable
+	m.logf(log.InfoLevel, "Mux transport fallback is set to %v", enable)
+	return m
+}
+
+// EndpointHealth returns the health state of each server endpoint.
+// An endpoint is considered down after a few consecutive dial failures,
+// and it is not selected to create new underlays until the backoff expires.
+func (m *Mux) EndpointHealth() []EndpointHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	states := make([]EndpointHealth, 0, len(m.endpoints))
+	for i, p := range m.endpoints {
+		h := m.endpointHealth[i]
+		state := EndpointHealth{
+			Endpoint:            p,
+			Healthy:             h.isHealthy(),
+			ConsecutiveFailures: h.consecutiveFailures,
+		}
+		if !state.Healthy {
+			state.DownUntil = h.downUntil
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+// pickEndpoint returns the index of the endpoint to create a new underlay.
+// Endpoints that are considered down are skipped, unless all of them are down.
+// Endpoints in excluded are skipped, unless all of them are excluded.
+// With RandomSelection, the selection is weighted random if endpoint
+// weights are set. With RoundRobin, the selection cycles through the
+// candidate endpoints.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) pickEndpoint(excluded map[int]bool) int {
+	// Endpoints with weight 0 are never candidates, even if all the
+	// endpoints with a weight are down.
+	weighted := false
+	if m.endpointSelection != RoundRobin && len(m.endpointWeights) == len(m.endpoints) {
+		for _, w := range m.endpointWeights {
+			if w > 0 {
+				weighted = true
+				break
+			}
+		}
+	}
+	isCandidate := func(i int) bool {
+		return !weighted || m.endpointWeights[i] > 0
+	}
+
+	healthy := make([]int, 0, len(m.endpoints))
+	for i, h := range m.endpointHealth {
+		if h.isHealthy() && !excluded[i] && isCandidate(i) {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		for i := range m.endpoints {
+			if !excluded[i] && isCandidate(i) {
+				healthy = append(healthy, i)
+			}
+		}
+	}
+	if len(healthy) == 0 {
+		for i := range m.endpoints {
+			if isCandidate(i) {
+				healthy = append(healthy, i)
+			}
+		}
+	}
+	if m.endpointSelection == RoundRobin {
+		return healthy[(m.nextEndpoint.Add(1)-1)%uint64(len(healthy))]
+	}
+	if weighted {
+		total := 0
+		for _, i := range healthy {
+			total += m.endpointWeights[i]
+		}
+		n := m.rand.Intn(total)
+		for _, i := range healthy {
+			n -= m.endpointWeights[i]
+			if n < 0 {
+				return i
+			}
+		}
+	}
+	return healthy[m.rand.Intn(len(healthy))]
+}
+
+// onDialFailure records a failed attempt to create a underlay
+// to the endpoint i. This method MUST be called only when holding the mu lock.
+func (m *Mux) onDialFailure(i int, opts *dialOptions) {
+	m.endpointHealth[i].onDialFailure()
+	opts.failedEndpoints[i] = true
+	if m.transportFallback && opts.endpoint < 0 && isUDPCarried(m.endpoints[i].TransportProtocol()) {
+		opts.fallbackEndpoints = append(opts.fallbackEndpoints, m.streamEndpointsOfHost(i)...)
+	}
+}
+
+// isDialedEndpoint returns true if the endpoint of the dialed underlay
+// is not changed by SetEndpoints since the dial.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) isDialedEndpoint(d *dialedUnderlay) bool {
+	return d.endpoint < len(m.endpoints) && endpointKey(m.endpoints[d.endpoint]) == d.key
+}
+
+// needsFallbackProbe returns true if the dialed UDP underlay must answer
+// a probe before it is used, because transport fallback is enabled and
+// there is a stream endpoint to fall back to. Creating a UDP underlay
+// doesn't talk to the server, so this finds the servers that can't be
+// reached by UDP, e.g. when a firewall drops the packets.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) needsFallbackProbe(d *dialedUnderlay, opts *dialOptions) bool {
+	if !m.transportFallback || opts.endpoint >= 0 || d.props.TransportProtocol() != util.UDPTransport {
+		return false
+	}
+	return m.isDialedEndpoint(d) && len(m.streamEndpointsOfHost(d.endpoint)) > 0
+}
+
+// onProbeFailure records that the server of a dialed UDP underlay doesn't
+// answer the probe, like a failed dial, so the next underlay falls back to
+// a stream endpoint of the same host.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) onProbeFailure(d *dialedUnderlay, opts *dialOptions, err error) error {
+	m.logf(log.DebugLevel, "%v is not reachable: %v", d.underlay, err)
+	if m.isDialedEndpoint(d) {
+		m.onDialFailure(d.endpoint, opts)
+	}
+	UnderlayDialNetworkError.Add(1)
+	return &UnderlayDialError{Endpoint: d.props, Err: err}
+}
+
+// streamEndpointsOfHost returns the endpoints that are not carried by UDP
+// and have the same host as the endpoint i.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) streamEndpointsOfHost(i int) []int {
+	host := endpointHost(m.endpoints[i])
+	var res []int
+	for j, p := range m.endpoints {
+		if j != i && !isUDPCarried(p.TransportProtocol()) && endpointHost(p) == host {
+			res = append(res, j)
+		}
+	}
+	return res
+}
+
+// pickFallbackEndpoint returns the next fallback endpoint that has not
+// failed, or -1 if there is none.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) pickFallbackEndpoint(opts *dialOptions) int {
+	for len(opts.fallbackEndpoints) > 0 {
+		i := opts.fallbackEndpoints[0]
+		opts.fallbackEndpoints = opts.fallbackEndpoints[1:]
+		if i < len(m.endpoints) && !opts.failedEndpoints[i] {
+			m.logf(log.DebugLevel, "Falling back to endpoint %d %v", i, m.endpoints[i].RemoteAddr())
+			return i
+		}
+	}
+	return -1
+}
+
+// isUnderlayOfEndpoint returns true if the underlay is connected to the endpoint.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) isUnderlayOfEndpoint(underlay Underlay, endpoint UnderlayProperties) bool {
+	if key, ok := m.underlayEndpoints[underlay]; ok {
+		return key == endpointKey(endpoint)
+	}
+	return underlay.TransportProtocol() == endpoint.TransportProtocol() &&
+		underlay.RemoteAddr().String() == endpoint.RemoteAddr().String()
+}
@@ -0,0 +1,260 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestRoundRobinEndpointSelection(t *testing.T) {
+	_, endpoint0 := startTestMux(t, util.TCPTransport)
+	_, endpoint1 := startTestMux(t, util.TCPTransport)
+	endpoints := []UnderlayProperties{endpoint0, endpoint1}
+	clientMux := newTestClient(endpoint0).
+		SetEndpoints(endpoints).
+		SetClientMultiplexFactor(0).
+		SetEndpointSelection(RoundRobin)
+	defer clientMux.Close()
+
+	const n = 10
+	for i := 0; i < n; i++ {
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		defer conn.Close()
+	}
+	counts := make(map[string]int)
+	clientMux.mu.Lock()
+	for _, underlay := range clientMux.underlays {
+		counts[underlay.RemoteAddr().String()]++
+	}
+	clientMux.mu.Unlock()
+	for _, endpoint := range endpoints {
+		if got := counts[endpoint.RemoteAddr().String()]; got != n/len(endpoints) {
+			t.Errorf("got %d underlays to endpoint %v, want %d", got, endpoint.RemoteAddr(), n/len(endpoints))
+		}
+	}
+}
+
+func TestEndpointHealth(t *testing.T) {
+	endpoints := []UnderlayProperties{
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}),
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}),
+	}
+	mux := NewMux(true).SetEndpoints(endpoints)
+	defer mux.Close()
+
+	for i := 0; i < maxEndpointDialFailures; i++ {
+		mux.endpointHealth[0].onDialFailure()
+	}
+	states := mux.EndpointHealth()
+	if states[0].Healthy || states[0].ConsecutiveFailures != maxEndpointDialFailures {
+		t.Errorf("endpoint 0 state = %+v, want unhealthy with %d failures", states[0], maxEndpointDialFailures)
+	}
+	if !states[1].Healthy {
+		t.Errorf("endpoint 1 state = %+v, want healthy", states[1])
+	}
+	for i := 0; i < 100; i++ {
+		if idx := mux.pickEndpoint(nil); idx != 1 {
+			t.Fatalf("pickEndpoint() returned down endpoint %d", idx)
+		}
+	}
+
+	// The endpoint is selected again after the backoff expires.
+	mux.endpointHealth[0].downUntil = time.Now().Add(-time.Second)
+	picked := map[int]bool{}
+	for i := 0; i < 100; i++ {
+		picked[mux.pickEndpoint(nil)] = true
+	}
+	if !picked[0] {
+		t.Errorf("endpoint 0 is not selected after backoff")
+	}
+}
+
+func TestEndpointHealthDialFailure(t *testing.T) {
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	endpoint := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	mux := newTestClient(endpoint)
+	defer mux.Close()
+	for i := 0; i < maxEndpointDialFailures; i++ {
+		if _, err := mux.DialContext(context.Background()); err == nil {
+			t.Fatalf("DialContext() succeeded, want error")
+		}
+	}
+	if states := mux.EndpointHealth(); states[0].Healthy {
+		t.Errorf("endpoint is healthy after %d dial failures", maxEndpointDialFailures)
+	}
+}
+
+func TestDialContextWithEndpoint(t *testing.T) {
+	_, endpoint0 := startTestMux(t, util.TCPTransport)
+	_, endpoint1 := startTestMux(t, util.TCPTransport)
+	mux := newTestClient(endpoint0).SetEndpoints([]UnderlayProperties{endpoint0, endpoint1})
+	defer mux.Close()
+
+	for i := 0; i < 5; i++ {
+		conn, err := mux.DialContextWithEndpoint(context.Background(), 1)
+		if err != nil {
+			t.Fatalf("DialContextWithEndpoint() failed: %v", err)
+		}
+		defer conn.Close()
+	}
+	mux.mu.Lock()
+	for _, underlay := range mux.underlays {
+		if !mux.isUnderlayOfEndpoint(underlay, endpoint1) {
+			t.Errorf("%v is not connected to endpoint 1", underlay)
+		}
+	}
+	mux.mu.Unlock()
+
+	// Underlays of endpoint 1 are not reused.
+	conn, err := mux.DialContextWithEndpoint(context.Background(), 0)
+	if err != nil {
+		t.Fatalf("DialContextWithEndpoint() failed: %v", err)
+	}
+	defer conn.Close()
+	mux.mu.Lock()
+	if got := conn.(*Session).underlay(); !mux.isUnderlayOfEndpoint(got, endpoint0) {
+		t.Errorf("session is attached to %v, want endpoint 0", got)
+	}
+	mux.mu.Unlock()
+
+	if _, err := mux.DialContextWithEndpoint(context.Background(), 2); err == nil {
+		t.Errorf("DialContextWithEndpoint() with out of range index succeeded")
+	}
+	if _, err := mux.DialContextWithEndpoint(context.Background(), -1); err == nil {
+		t.Errorf("DialContextWithEndpoint() with negative index succeeded")
+	}
+}
+
+func TestDialContextWithUnavailableEndpoint(t *testing.T) {
+	_, goodEndpoint := startTestMux(t, util.TCPTransport)
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	badEndpoint := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	mux := newTestClient(goodEndpoint).SetEndpoints([]UnderlayProperties{goodEndpoint, badEndpoint})
+	defer mux.Close()
+	if _, err := mux.DialContextWithEndpoint(context.Background(), 1); err == nil {
+		t.Errorf("DialContextWithEndpoint() with unavailable endpoint succeeded")
+	}
+}
+
+func TestEndpointWeights(t *testing.T) {
+	endpoints := make([]UnderlayProperties, 0)
+	for i := 1; i <= 3; i++ {
+		endpoints = append(endpoints, NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: i}))
+	}
+	mux := NewMux(true).SetEndpoints(endpoints).SetEndpointWeights([]int{1, 3, 0})
+	defer mux.Close()
+
+	const total = 20000
+	counts := make([]int, 3)
+	for i := 0; i < total; i++ {
+		counts[mux.pickEndpoint(nil)]++
+	}
+	if counts[2] != 0 {
+		t.Errorf("endpoint with weight 0 is selected %d times", counts[2])
+	}
+	if ratio := float64(counts[1]) / float64(total); ratio < 0.72 || ratio > 0.78 {
+		t.Errorf("endpoint with weight 3 is selected with ratio %v, want about 0.75", ratio)
+	}
+
+	// The endpoint with weight 0 is not selected when the others are down.
+	for i := 0; i < 2; i++ {
+		for j := 0; j < maxEndpointDialFailures; j++ {
+			mux.endpointHealth[i].onDialFailure()
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if got := mux.pickEndpoint(nil); got == 2 {
+			t.Fatalf("endpoint with weight 0 is selected when the others are down")
+		}
+	}
+
+	// Fall back to uniform selection if all weights are 0.
+	mux = NewMux(true).SetEndpoints(endpoints).SetEndpointWeights([]int{0, 0, 0})
+	defer mux.Close()
+	counts = make([]int, 3)
+	for i := 0; i < total; i++ {
+		counts[mux.pickEndpoint(nil)]++
+	}
+	for i, c := range counts {
+		if ratio := float64(c) / float64(total); ratio < 0.3 || ratio > 0.37 {
+			t.Errorf("endpoint %d is selected with ratio %v, want about 0.33", i, ratio)
+		}
+	}
+}
+
+func TestUpdateEndpoints(t *testing.T) {
+	oldServerMux, oldEndpoint := startTestMux(t, util.TCPTransport)
+	newServerMux, newEndpoint := startTestMux(t, util.TCPTransport)
+	// Each session uses a new underlay.
+	clientMux := newTestClient(oldEndpoint).SetMaxSessionsPerUnderlay(1)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	oldSession := acceptTestSession(t, oldServerMux, conn)
+
+	if err := clientMux.UpdateEndpoints(nil); err == nil {
+		t.Errorf("UpdateEndpoints() with no endpoint succeeded")
+	}
+	if err := clientMux.UpdateEndpoints([]UnderlayProperties{newEndpoint}); err != nil {
+		t.Fatalf("UpdateEndpoints() failed: %v", err)
+	}
+	newConn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer newConn.Close()
+	acceptTestSession(t, newServerMux, newConn)
+	if len(newServerMux.Stats()) != 1 {
+		t.Errorf("new server has %d underlays, want 1", len(newServerMux.Stats()))
+	}
+
+	// The session of the old endpoint still works.
+	if _, err := io.ReadFull(oldSession, make([]byte, 5)); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v", err)
+	}
+	if _, err := conn.Write([]byte("again")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(oldSession, buf); err != nil || string(buf) != "again" {
+		t.Errorf("old server session read %q, %v, want %q", buf, err, "again")
+	}
+
+	serverMux := NewMux(false)
+	if err := serverMux.UpdateEndpoints([]UnderlayProperties{newEndpoint}); !errors.Is(err, stderror.ErrInvalidOperation) {
+		t.Errorf("server UpdateEndpoints() error = %v, want %v", err, stderror.ErrInvalidOperation)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"sync"
+	"time"
+)
+
+// handshakeBuckets are the upper bounds of the handshake duration histogram.
+var handshakeBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// HandshakeDurationSnapshot is a snapshot of the time used to set up
+// underlays. For a client, it is the time from the start of dialing to
+// the underlay being usable, including the name resolution and the TLS or
+// WebSocket handshakes. For a server, it is the time from accepting the
+// connection to the underlay being usable. The shared server UDP underlay
+// is not counted.
+type HandshakeDurationSnapshot struct {
+	Count int64
+	Sum   time.Duration
+	Max   time.Duration
+
+	// Buckets[i] is the number of handshakes that took longer than
+	// BucketBounds[i-1], and no longer than BucketBounds[i]. The last
+	// element of Buckets counts the handshakes longer than all the bounds.
+	BucketBounds []time.Duration
+	Buckets      []int64
+}
+
+// Mean returns the average handshake duration.
+func (s HandshakeDurationSnapshot) Mean() time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / time.Duration(s.Count)
+}
+
+// Percentile returns the upper bound of the bucket that contains the
+// p-th percentile, where 0 < p <= 100. The maximum duration is returned
+// if the percentile is beyond the last bound.
+func (s HandshakeDurationSnapshot) Percentile(p float64) time.Duration {
+	if s.Count == 0 {
+		return 0
+	}
+	target := int64(float64(s.Count)*p/100 + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	var n int64
+	for i, c := range s.Buckets {
+		n += c
+		if n >= target {
+			if i < len(s.BucketBounds) && s.BucketBounds[i] < s.Max {
+				return s.BucketBounds[i]
+			}
+			return s.Max
+		}
+	}
+	return s.Max
+}
+
+// durationHistogram records durations in the handshake buckets.
+// The zero value is ready to use.
+type durationHistogram struct {
+	mu      sync.Mutex
+	count   int64
+	sum     time.Duration
+	max     time.Duration
+	buckets []int64
+}
+
+func (h *durationHistogram) record(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(handshakeBuckets)+1)
+	}
+	i := len(handshakeBuckets)
+	for j, bound := range handshakeBuckets {
+		if d <= bound {
+			i = j
+			break
+		}
+	}
+	h.buckets[i]++
+	h.count++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *durationHistogram) snapshot() HandshakeDurationSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HandshakeDurationSnapshot{
+		Count:        h.count,
+		Sum:          h.sum,
+		Max:          h.max,
+		BucketBounds: append([]time.Duration(nil), handshakeBuckets...),
+		Buckets:      make([]int64, len(handshakeBuckets)+1),
+	}
+	copy(s.Buckets, h.buckets)
+	return s
+}
+
+// HandshakeDuration returns a snapshot of the time used to set up the
+// underlays of the mux, e.g. to tell the network latency from the
+// cipher overhead.
+func (m *Mux) HandshakeDuration() HandshakeDurationSnapshot {
+	return m.handshakes.snapshot()
+}
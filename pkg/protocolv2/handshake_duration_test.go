@@ -0,0 +1,55 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestHandshakeDuration(t *testing.T) {
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+	delay := 50 * time.Millisecond
+	clientMux := newTestClient(endpoint).SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+		time.Sleep(delay)
+		return defaultDial(ctx, network, localAddr, remoteAddr)
+	})
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	acceptTestSession(t, serverMux, conn)
+
+	s := clientMux.HandshakeDuration()
+	if s.Count != 1 {
+		t.Fatalf("client handshake count = %d, want 1", s.Count)
+	}
+	if s.Max < delay || s.Mean() < delay {
+		t.Errorf("client handshake max = %v, mean = %v, want at least %v", s.Max, s.Mean(), delay)
+	}
+	if p := s.Percentile(50); p < delay || p > s.Max {
+		t.Errorf("client handshake median = %v, want between %v and %v", p, delay, s.Max)
+	}
+	if s := serverMux.HandshakeDuration(); s.Count != 1 {
+		t.Errorf("server handshake count = %d, want 1", s.Count)
+	}
+}
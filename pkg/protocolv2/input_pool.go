@@ -0,0 +1,182 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// inputBatchSize is the maximum number of segments that a worker of the
+// input pool processes for a session before it moves to other sessions.
+const inputBatchSize = 64
+
+// inputPoolSharer is implemented by underlays that can process the
+// segments of their sessions with an input pool.
+type inputPoolSharer interface {
+	shareInputPool(p *inputPool)
+}
+
+// inputPool processes the segments that the event loops of the underlays
+// deliver to the sessions, with a fixed number of goroutines instead of
+// one input goroutine per session. A session is processed by one worker
+// at a time, so its segments are processed in order.
+type inputPool struct {
+	ready chan *Session // sessions that have segments to process or are closed
+	done  <-chan struct{}
+}
+
+func newInputPool(done <-chan struct{}) *inputPool {
+	return &inputPool{
+		ready: make(chan *Session, segmentChanCapacity),
+		done:  done,
+	}
+}
+
+// run processes the ready sessions until done is closed.
+func (p *inputPool) run() {
+	for {
+		select {
+		case s := <-p.ready:
+			p.process(s)
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// attach processes the segments of the session with the pool.
+// It must be called before any segment is delivered to the session.
+func (p *inputPool) attach(s *Session) {
+	s.inputPool = p
+	if len(s.recvChan) > 0 {
+		p.wake(s)
+	}
+}
+
+// wake schedules the session to be processed, unless it is already.
+func (p *inputPool) wake(s *Session) {
+	if s.inputScheduled.CompareAndSwap(false, true) {
+		p.schedule(s)
+	}
+}
+
+// schedule adds the session to the ready queue. It never blocks, because
+// it is called by the event loops and by the workers themselves.
+func (p *inputPool) schedule(s *Session) {
+	select {
+	case p.ready <- s:
+	default:
+		go func() {
+			select {
+			case p.ready <- s:
+			case <-p.done:
+			}
+		}()
+	}
+}
+
+// process runs the input of the segments delivered to the session,
+// up to inputBatchSize segments.
+func (p *inputPool) process(s *Session) {
+	for n := 0; n < inputBatchSize; n++ {
+		select {
+		case <-s.done:
+			s.finishInput()
+			return
+		default:
+		}
+		if s.inputFull() {
+			p.stall(s)
+			return
+		}
+		select {
+		case seg := <-s.recvChan:
+			if err := s.handleInput(seg); err != nil {
+				s.finishInput()
+				return
+			}
+			continue
+		default:
+		}
+		// Segments delivered after the flag is cleared wake the session
+		// again, so only the segments delivered before need a recheck.
+		s.inputScheduled.Store(false)
+		if len(s.recvChan) == 0 && !isDone(s.done) {
+			return
+		}
+		if !s.inputScheduled.CompareAndSwap(false, true) {
+			return
+		}
+	}
+	// Let the other sessions run.
+	p.schedule(s)
+}
+
+// stall stops processing the session until the application reads
+// recvQueue, so the worker is not blocked by a session that is not read.
+func (p *inputPool) stall(s *Session) {
+	s.inputStalled.Store(true)
+	s.inputScheduled.Store(false)
+	// The application may have read recvQueue before the flag is set.
+	if !s.inputFull() || isDone(s.done) {
+		p.wake(s)
+	}
+}
+
+// isDone returns true if the channel is closed.
+func isDone(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetSessionInputWorkers only pools the input of the sessions. The event
+// loop of each underlay keeps its goroutine, because it blocks on reading.
+func (m *Mux) SetSessionInputWorkers(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set session input workers in client mux")
+	}
+	if n < 0 {
+		panic(fmt.Sprintf("Event loop workers %d is negative", n))
+	}
+	if m.used {
+		panic("Can't set session input workers after mux is used")
+	}
+	m.inputWorkers = n
+	m.logf(log.InfoLevel, "Mux session input workers is set to %d", n)
+	return m
+}
+
+// startSessionInputWorkers starts the input pool shared by all the server
+// underlays, if the pool is enabled.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) startSessionInputWorkers() {
+	if m.inputWorkers <= 0 || m.inputPool != nil {
+		return
+	}
+	m.inputPool = newInputPool(m.done)
+	for i := 0; i < m.inputWorkers; i++ {
+		go m.inputPool.run()
+	}
+	m.logf(log.InfoLevel, "Mux started %d session input workers", m.inputWorkers)
+}
@@ -0,0 +1,246 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+	"github.com/enfein/mieru/pkg/util/sockopts"
+)
+
+func (m *Mux) SetListenerShards(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set listener shards in client mux")
+	}
+	if n <= 0 {
+		panic(fmt.Sprintf("Listener shards %d is not positive", n))
+	}
+	if m.used {
+		panic("Can't set listener shards after mux is used")
+	}
+	m.shards = n
+	m.logf(log.InfoLevel, "Mux listener shards is set to %d", n)
+	return m
+}
+
+func (m *Mux) SetPreBoundListeners(listeners map[string]net.Listener) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set pre-bound listeners in client mux")
+	}
+	if m.used {
+		panic("Can't set pre-bound listeners after mux is used")
+	}
+	m.preBound = make(map[string]net.Listener, len(listeners))
+	for addr, l := range listeners {
+		m.preBound[addr] = l
+		m.logf(log.InfoLevel, "Mux uses pre-bound listener %v for endpoint %s", l.Addr(), addr)
+	}
+	return m
+}
+
+// ListeningAddrs returns the addresses the server is listening to, in the
+// order of the endpoints. An endpoint with port 0 is bound to a port
+// chosen by the system, which is reported here. It returns nil before
+// Start returns successfully.
+func (m *Mux) ListeningAddrs() []net.Addr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.listenAddrs == nil {
+		return nil
+	}
+	return append([]net.Addr(nil), m.listenAddrs...)
+}
+
+// Ready returns true if the server is listening to all the endpoints and
+// accepting underlays from them. It is false before Start returns
+// successfully, after an accept loop fails, and after the mux is drained
+// or closed. It can be used as a readiness probe. It is always false
+// for a client mux.
+func (m *Mux) Ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ready && !m.isStopped()
+}
+
+// boundEndpoint is a server endpoint with its listening socket.
+type boundEndpoint struct {
+	properties UnderlayProperties
+	listener   net.Listener // nil if the endpoint uses UDP
+	udpConn    *net.UDPConn // nil if the endpoint doesn't use UDP
+}
+
+// addr returns the address of the listening socket.
+func (b boundEndpoint) addr() net.Addr {
+	if b.udpConn != nil {
+		return b.udpConn.LocalAddr()
+	}
+	return b.listener.Addr()
+}
+
+// close closes the listening socket.
+func (b boundEndpoint) close() {
+	if b.listener != nil {
+		b.listener.Close()
+	}
+	if b.udpConn != nil {
+		b.udpConn.Close()
+	}
+}
+
+// checkPreBoundListeners returns an error if a pre-bound listener can't be
+// used by any server endpoint.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) checkPreBoundListeners() error {
+	for addr := range m.preBound {
+		found := false
+		for _, p := range m.endpoints {
+			if p.LocalAddr().String() == addr && !isUDPCarried(p.TransportProtocol()) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("pre-bound listener of %s doesn't match any TCP, TLS or WebSocket endpoint", addr)
+		}
+	}
+	return nil
+}
+
+// bindEndpoint creates the listening socket of a server endpoint.
+func bindEndpoint(properties UnderlayProperties) (boundEndpoint, error) {
+	b := boundEndpoint{properties: properties}
+	laddr := properties.LocalAddr().String()
+	if laddr == "" {
+		return b, fmt.Errorf("underlay local address is empty")
+	}
+
+	network := properties.LocalAddr().Network()
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix", MemoryNetwork:
+		var err error
+		if network == MemoryNetwork {
+			if properties.TransportProtocol() == util.UDPTransport {
+				return b, fmt.Errorf("UDP transport is not supported by %s network", network)
+			}
+			var l *memListener
+			if l, err = listenMemory(laddr); err == nil {
+				b.listener = l
+			}
+		} else {
+			b.listener, err = listenStream(network, laddr)
+		}
+		if err != nil {
+			return b, fmt.Errorf("Listen() failed: %w", err)
+		}
+	case "udp", "udp4", "udp6":
+		udpAddr, ok := properties.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			// Resolve the address string, which keeps the IPv6 zone.
+			var err error
+			udpAddr, err = net.ResolveUDPAddr(network, laddr)
+			if err != nil {
+				return b, fmt.Errorf("ResolveUDPAddr() failed: %w", err)
+			}
+		}
+		conn, err := net.ListenUDP(network, udpAddr)
+		if err != nil {
+			return b, fmt.Errorf("ListenUDP() failed: %w", err)
+		}
+		rawConn, err := conn.SyscallConn()
+		if err != nil {
+			conn.Close()
+			return b, fmt.Errorf("SyscallConn() failed: %w", err)
+		}
+		rawConn.Control(sockopts.ReuseAddrPortRaw())
+		b.udpConn = conn
+	default:
+		return b, fmt.Errorf("unsupported underlay network type %q", network)
+	}
+	log.Infof("Mux is listening to endpoint %s %s", network, laddr)
+	return b, nil
+}
+
+// bindEndpointShards creates n listening sockets of a server endpoint that
+// share the same address. Only TCP networks support more than one socket.
+// The first socket decides the port if the endpoint uses port 0.
+func bindEndpointShards(properties UnderlayProperties, n int) ([]boundEndpoint, error) {
+	first, err := bindEndpoint(properties)
+	if err != nil {
+		return nil, err
+	}
+	shards := []boundEndpoint{first}
+	network := properties.LocalAddr().Network()
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return shards, nil
+	}
+	laddr := first.addr().String()
+	for i := 1; i < n; i++ {
+		l, err := listenStream(network, laddr)
+		if err != nil {
+			for _, b := range shards {
+				b.close()
+			}
+			return nil, fmt.Errorf("Listen() of shard %d failed: %w", i, err)
+		}
+		shards = append(shards, boundEndpoint{properties: properties, listener: l})
+	}
+	if n > 1 {
+		log.Infof("Mux is listening to endpoint %s %s with %d shards", network, laddr, n)
+	}
+	return shards, nil
+}
+
+// listenStream creates a stream listening socket. SO_REUSEADDR and
+// SO_REUSEPORT are set except for unix sockets.
+func listenStream(network, laddr string) (net.Listener, error) {
+	var listenConfig net.ListenConfig
+	if network != "unix" {
+		listenConfig.Control = sockopts.ReuseAddrPort()
+	}
+	return listenConfig.Listen(context.Background(), network, laddr)
+}
+
+// addListener registers a listener to the mux. It returns false and closes
+// the listener if the mux is already draining or closed.
+func (m *Mux) addListener(l net.Listener) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isStopped() {
+		l.Close()
+		return false
+	}
+	m.listeners = append(m.listeners, l)
+	return true
+}
+
+// closeListeners closes all the registered listeners.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) closeListeners() {
+	for _, l := range m.listeners {
+		l.Close()
+	}
+	m.listeners = nil
+}
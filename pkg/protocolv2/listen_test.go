@@ -0,0 +1,223 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestMuxReady(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, _ := startTestMux(t, util.TCPTransport)
+	if !serverMux.Ready() {
+		t.Errorf("Ready() = false after Start()")
+	}
+
+	// The port is used by a listener without SO_REUSEPORT.
+	rawListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	defer rawListener.Close()
+	busy := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{
+			NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, rawListener.Addr(), nil),
+		})
+	defer busy.Close()
+	if busy.Ready() {
+		t.Errorf("Ready() = true before Start()")
+	}
+	if err := busy.Start(); err == nil {
+		t.Errorf("Start() succeeded with a port in use")
+	}
+	if busy.Ready() {
+		t.Errorf("Ready() = true when a port is in use")
+	}
+
+	serverMux.Close()
+	if serverMux.Ready() {
+		t.Errorf("Ready() = true after Close()")
+	}
+}
+
+func TestListeningAddrs(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{
+			NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil),
+			NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, nil),
+		})
+	defer serverMux.Close()
+	if addrs := serverMux.ListeningAddrs(); addrs != nil {
+		t.Errorf("ListeningAddrs() = %v before Start()", addrs)
+	}
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	addrs := serverMux.ListeningAddrs()
+	if len(addrs) != 2 {
+		t.Fatalf("got %d listening addresses, want 2", len(addrs))
+	}
+	tcpAddr, ok := addrs[0].(*net.TCPAddr)
+	if !ok || tcpAddr.Port == 0 {
+		t.Errorf("TCP listening address is %v, want a nonzero port", addrs[0])
+	}
+	if udpAddr, ok := addrs[1].(*net.UDPAddr); !ok || udpAddr.Port == 0 {
+		t.Errorf("UDP listening address is %v, want a nonzero port", addrs[1])
+	}
+
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, tcpAddr))
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	acceptTestSession(t, serverMux, conn)
+}
+
+func TestPreBoundListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	// The endpoint address is not bound by the mux, so a different port
+	// is used if the pre-bound listener is ignored.
+	laddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, laddr, nil)}).
+		SetPreBoundListeners(map[string]net.Listener{laddr.String(): l})
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	if addrs := serverMux.ListeningAddrs(); len(addrs) != 1 || addrs[0].String() != l.Addr().String() {
+		t.Fatalf("ListeningAddrs() = %v, want [%v]", addrs, l.Addr())
+	}
+
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, l.Addr()))
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	acceptTestSession(t, serverMux, conn)
+	conn.Close()
+
+	serverMux.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Errorf("pre-bound listener is not closed with the mux")
+	}
+}
+
+func TestPreBoundListenersMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	defer l.Close()
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil)}).
+		SetPreBoundListeners(map[string]net.Listener{"127.0.0.1:1": l})
+	defer serverMux.Close()
+	if err := serverMux.Start(); err == nil {
+		t.Errorf("Start() succeeded with a pre-bound listener of no endpoint")
+	}
+}
+
+func TestListenerShards(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "android" {
+		t.Skipf("SO_REUSEPORT is not set on %s", runtime.GOOS)
+	}
+	log.SetOutputToTest(t)
+	const shards = 4
+
+	// All the shards are in the same SO_REUSEPORT group and receive
+	// connections.
+	properties := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+	bound, err := bindEndpointShards(properties, shards)
+	if err != nil {
+		t.Fatalf("bindEndpointShards() failed: %v", err)
+	}
+	if len(bound) != shards {
+		t.Fatalf("got %d shards, want %d", len(bound), shards)
+	}
+	counts := make([]atomic.Int32, shards)
+	for i, b := range bound {
+		defer b.close()
+		if b.addr().String() != bound[0].addr().String() {
+			t.Errorf("shard %d is bound to %v, want %v", i, b.addr(), bound[0].addr())
+		}
+		go func(i int, l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				counts[i].Add(1)
+				conn.Close()
+			}
+		}(i, b.listener)
+	}
+	for i := 0; i < 64; i++ {
+		conn, err := net.Dial("tcp", bound[0].addr().String())
+		if err != nil {
+			t.Fatalf("net.Dial() failed: %v", err)
+		}
+		conn.Close()
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i := range counts {
+		if counts[i].Load() == 0 {
+			t.Errorf("shard %d received no connection", i)
+		}
+	}
+
+	// The server accepts underlays from all the shards.
+	serverMux, endpoint := startTestMux(t, util.TCPTransport, func(m *Mux) {
+		m.SetListenerShards(shards)
+	})
+	serverMux.mu.Lock()
+	nListeners := len(serverMux.listeners)
+	serverMux.mu.Unlock()
+	if nListeners != shards {
+		t.Errorf("server has %d listeners, want %d", nListeners, shards)
+	}
+	if addrs := serverMux.ListeningAddrs(); len(addrs) != 1 {
+		t.Errorf("ListeningAddrs() returned %v, want one address", addrs)
+	}
+	for i := 0; i < 16; i++ {
+		clientMux := newTestClient(endpoint)
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		acceptTestSession(t, serverMux, conn)
+		conn.Close()
+		clientMux.Close()
+	}
+}
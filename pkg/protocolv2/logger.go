@@ -0,0 +1,153 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// Names of the lifecycle events reported to the Logger.
+const (
+	EventUnderlayOpen     = "underlay_open"
+	EventUnderlayClose    = "underlay_close"
+	EventSessionOpen      = "session_open"
+	EventEndpointSelected = "endpoint_selected"
+	EventUnderlayDisabled = "underlay_disabled"
+	EventUnderlayPanic    = "underlay_panic"
+)
+
+// Logger receives the lifecycle events of a mux as key-value fields,
+// so they can be consumed by log aggregation pipelines.
+type Logger interface {
+	// LogEvent records an event at the given log level.
+	LogEvent(level log.Level, event string, fields log.Fields)
+}
+
+// NewLogger returns a Logger that writes the events to l.
+// Use a log.JSONFormatter with l to print one JSON object per event.
+func NewLogger(l *log.Logger) Logger {
+	return &stdLogger{l: l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s *stdLogger) LogEvent(level log.Level, event string, fields log.Fields) {
+	s.l.WithFields(fields).Log(level, event)
+}
+
+// underlayFields returns the fields that identify a underlay.
+func underlayFields(underlay Underlay) log.Fields {
+	return log.Fields{
+		"transport":   transportName(underlay.TransportProtocol()),
+		"local_addr":  underlay.LocalAddr().String(),
+		"remote_addr": underlay.RemoteAddr().String(),
+	}
+}
+
+// transportName returns the name of the transport protocol.
+func transportName(transport util.TransportProtocol) string {
+	switch transport {
+	case util.TCPTransport:
+		return "tcp"
+	case util.UDPTransport:
+		return "udp"
+	case util.WebSocketTransport:
+		return "websocket"
+	case util.TLSTransport:
+		return "tls"
+	case util.QUICTransport:
+		return "quic"
+	default:
+		return "unknown"
+	}
+}
+
+// withFields adds the extra fields to fields and returns it.
+func withFields(fields, extra log.Fields) log.Fields {
+	for k, v := range extra {
+		fields[k] = v
+	}
+	return fields
+}
+
+// logEvent reports a lifecycle event to the structured logger if it is set.
+// Otherwise, the event is printed by the default logger as formatted text,
+// unless format is empty. Events above the log level of the mux are dropped.
+func (m *Mux) logEvent(level log.Level, event string, fields log.Fields, format string, args ...any) {
+	if !m.isMuxLevelEnabled(level) {
+		return
+	}
+	if m.logger != nil {
+		m.logger.LogEvent(level, event, fields)
+		return
+	}
+	if format != "" && log.IsLevelEnabled(level) {
+		log.StandardLogger().Logf(level, format, args...)
+	}
+}
+
+// logf prints a message by the default logger if the level is enabled by
+// both the mux and the global log level.
+func (m *Mux) logf(level log.Level, format string, args ...any) {
+	if m.isMuxLevelEnabled(level) && log.IsLevelEnabled(level) {
+		log.StandardLogger().Logf(level, format, args...)
+	}
+}
+
+// isMuxLevelEnabled returns true if the level is enabled by the log level
+// of the mux. It is always true if the mux log level is not set.
+func (m *Mux) isMuxLevelEnabled(level log.Level) bool {
+	l := m.logLevel.Load()
+	return l == nil || level <= *l
+}
+
+// onUnderlayExit reports the close of a underlay after its event loop exits.
+func (m *Mux) onUnderlayExit(underlay Underlay, err error) {
+	if m.logger == nil || !m.isMuxLevelEnabled(log.DebugLevel) {
+		return
+	}
+	select {
+	case <-underlay.Done():
+		// The close is already reported or requested by the mux.
+		return
+	default:
+	}
+	fields := withFields(underlayFields(underlay), log.Fields{"reason": "closed"})
+	if err != nil {
+		fields["reason"] = "broken"
+		fields["error"] = err
+	}
+	m.logger.LogEvent(log.DebugLevel, EventUnderlayClose, fields)
+}
+
+func (m *Mux) SetLogger(logger Logger) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set logger after mux is used")
+	}
+	m.logger = logger
+	return m
+}
+
+// SetLogLevel can be called at any time.
+func (m *Mux) SetLogLevel(level log.Level) *Mux {
+	m.logLevel.Store(&level)
+	return m
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// recordingLogger records the names and fields of events.
+type recordingLogger struct {
+	mu     sync.Mutex
+	events map[string][]log.Fields
+}
+
+func newRecordingLogger() *recordingLogger {
+	return &recordingLogger{events: make(map[string][]log.Fields)}
+}
+
+func (l *recordingLogger) LogEvent(level log.Level, event string, fields log.Fields) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[event] = append(l.events[event], fields)
+}
+
+func (l *recordingLogger) get(event string) []log.Fields {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.events[event]
+}
+
+func TestLogger(t *testing.T) {
+	serverLogger := newRecordingLogger()
+	serverMux, endpoint := startTestMux(t, util.TCPTransport, func(m *Mux) {
+		m.SetLogger(serverLogger)
+	})
+	clientLogger := newRecordingLogger()
+	clientMux := newTestClient(endpoint).SetLogger(clientLogger)
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	acceptTestSession(t, serverMux, conn)
+
+	if got := clientLogger.get(EventEndpointSelected); len(got) != 1 || got[0]["endpoint"] != 0 {
+		t.Errorf("got %v events %v, want 1 event of endpoint 0", EventEndpointSelected, got)
+	}
+	if got := clientLogger.get(EventUnderlayOpen); len(got) != 1 || got[0]["remote_addr"] != endpoint.RemoteAddr().String() || got[0]["transport"] != "tcp" {
+		t.Errorf("got %v events %v, want 1 event of remote address %v", EventUnderlayOpen, got, endpoint.RemoteAddr())
+	}
+	if got := clientLogger.get(EventSessionOpen); len(got) != 1 || got[0]["session_id"] != conn.(*Session).ID() {
+		t.Errorf("got %v events %v, want 1 event of session %d", EventSessionOpen, got, conn.(*Session).ID())
+	}
+	if got := serverLogger.get(EventUnderlayOpen); len(got) != 1 {
+		t.Errorf("got %d server %v events, want 1", len(got), EventUnderlayOpen)
+	}
+	if got := serverLogger.get(EventSessionOpen); len(got) != 1 || got[0]["client"] != false {
+		t.Errorf("got server %v events %v, want 1 event of server session", EventSessionOpen, got)
+	}
+
+	// Close the underlay from the server side.
+	stats := serverMux.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("got %d server underlays, want 1", len(stats))
+	}
+	if err := serverMux.CloseUnderlay(stats[0].RemoteAddr.String()); err != nil {
+		t.Fatalf("CloseUnderlay() failed: %v", err)
+	}
+	if got := serverLogger.get(EventUnderlayClose); len(got) != 1 || got[0]["reason"] != "requested" {
+		t.Errorf("got server %v events %v, want 1 requested close", EventUnderlayClose, got)
+	}
+	var got []log.Fields
+	for i := 0; i < 100; i++ {
+		if got = clientLogger.get(EventUnderlayClose); len(got) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(got) != 1 || got[0]["reason"] != "broken" {
+		t.Errorf("got client %v events %v, want 1 broken close", EventUnderlayClose, got)
+	}
+}
+
+func TestUnderlayDisabledEvent(t *testing.T) {
+	log.SetOutputToTest(t)
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientLogger := newRecordingLogger()
+	clientMux := newTestClient(endpoint).SetLogger(clientLogger)
+	defer clientMux.Close()
+	if err := clientMux.Warmup(context.Background(), 1); err != nil {
+		t.Fatalf("Warmup() failed: %v", err)
+	}
+	clientMux.mu.Lock()
+	underlay := clientMux.underlays[0]
+	clientMux.mu.Unlock()
+	if got := clientLogger.get(EventUnderlayDisabled); len(got) != 0 {
+		t.Fatalf("got %v events %v before the underlay is idle", EventUnderlayDisabled, got)
+	}
+
+	underlay.Scheduler().mu.Lock()
+	underlay.Scheduler().lastScheduleTime = time.Now().Add(-scheduleIdleTime - time.Second)
+	underlay.Scheduler().mu.Unlock()
+	clientMux.mu.Lock()
+	clientMux.cleanUnderlay()
+	clientMux.mu.Unlock()
+	if !underlay.Scheduler().TryDisable() {
+		t.Fatalf("TryDisable() = false after the underlay is disabled")
+	}
+	got := clientLogger.get(EventUnderlayDisabled)
+	if len(got) != 1 || got[0]["remote_addr"] != endpoint.RemoteAddr().String() {
+		t.Errorf("got %v events %v, want 1 event of remote address %v", EventUnderlayDisabled, got, endpoint.RemoteAddr())
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	noisyLogger := newRecordingLogger()
+	noisyMux := newTestClient(endpoint).SetLogger(noisyLogger)
+	defer noisyMux.Close()
+	quietLogger := newRecordingLogger()
+	quietMux := newTestClient(endpoint).SetLogger(quietLogger).SetLogLevel(log.WarnLevel)
+	defer quietMux.Close()
+
+	for _, m := range []*Mux{noisyMux, quietMux} {
+		conn, err := m.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		conn.Close()
+	}
+	if got := noisyLogger.get(EventUnderlayOpen); len(got) != 1 {
+		t.Errorf("got %d %v events from noisy mux, want 1", len(got), EventUnderlayOpen)
+	}
+	if got := quietLogger.get(EventUnderlayOpen); len(got) != 0 {
+		t.Errorf("got %d %v events from quiet mux, want 0", len(got), EventUnderlayOpen)
+	}
+
+	// Messages printed by the default logger are gated by the mux level.
+	var buf bytes.Buffer
+	level := log.GetLevel()
+	log.SetOutput(&buf)
+	log.SetLevel("DEBUG")
+	defer func() {
+		log.SetLevel(level.String())
+		log.SetOutputToTest(t)
+	}()
+	noisyMux.logf(log.DebugLevel, "message from noisy mux")
+	quietMux.logf(log.DebugLevel, "message from quiet mux")
+	quietMux.logf(log.WarnLevel, "warning from quiet mux")
+	out := buf.String()
+	if !strings.Contains(out, "message from noisy mux") {
+		t.Errorf("debug message from noisy mux is not printed")
+	}
+	if strings.Contains(out, "message from quiet mux") {
+		t.Errorf("debug message from quiet mux is printed")
+	}
+	if !strings.Contains(out, "warning from quiet mux") {
+		t.Errorf("warning from quiet mux is not printed")
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"net"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+func (m *Mux) SetMemoryPressureFunc(f func() bool) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set memory pressure function after mux is used")
+	}
+	m.memoryPressure = f
+	return m
+}
+
+// underMemoryPressure returns true if the memory pressure function
+// reports the process is short of memory.
+func (m *Mux) underMemoryPressure() bool {
+	return m.memoryPressure != nil && m.memoryPressure()
+}
+
+// dropUnderMemoryPressure closes the raw connection and returns true
+// if the process is short of memory.
+func (m *Mux) dropUnderMemoryPressure(rawConn net.Conn) bool {
+	if !m.underMemoryPressure() {
+		return false
+	}
+	UnderlayMemoryPressure.Add(1)
+	m.logf(log.DebugLevel, "Mux dropped connection from %v: under memory pressure", rawConn.RemoteAddr())
+	rawConn.Close()
+	return true
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestMemoryPressure(t *testing.T) {
+	log.SetOutputToTest(t)
+	var pressure atomic.Bool
+	serverMux, endpoint := startTestMux(t, util.TCPTransport, func(m *Mux) {
+		m.SetMemoryPressureFunc(pressure.Load)
+	})
+
+	// The server drops new connections under memory pressure.
+	pressure.Store(true)
+	before := UnderlayMemoryPressure.Load()
+	dropped := newTestClient(endpoint)
+	defer dropped.Close()
+	conn, err := dropped.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	conn.Write([]byte("hello"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 16)); err == nil || os.IsTimeout(err) {
+		t.Errorf("Read() got %v, want the connection closed by server", err)
+	}
+	conn.Close()
+	if got := UnderlayMemoryPressure.Load() - before; got != 1 {
+		t.Errorf("UnderlayMemoryPressure increased by %d, want 1", got)
+	}
+
+	// The server accepts again after the pressure is gone.
+	pressure.Store(false)
+	clientMux := newTestClient(endpoint).
+		SetClientMultiplexFactor(0).
+		SetMemoryPressureFunc(func() bool { return true })
+	defer clientMux.Close()
+	for i := 0; i < 3; i++ {
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		defer conn.Close()
+		acceptTestSession(t, serverMux, conn)
+	}
+	// The client never creates a new underlay under memory pressure,
+	// even though the multiplex factor is 0.
+	if _, total := clientMux.UnderlayCount(); total != 1 {
+		t.Errorf("client has %d underlays under memory pressure, want 1", total)
+	}
+}
@@ -72,8 +72,10 @@ func (p protocolType) String() string {
 type statusCode byte
 
 const (
-	statusOK             statusCode = 0
-	statusQuotaExhausted statusCode = 1
+	statusOK               statusCode = 0
+	statusQuotaExhausted   statusCode = 1
+	statusConnLimitReached statusCode = 2
+	statusOverloaded       statusCode = 3
 )
 
 func (c statusCode) String() string {
@@ -82,6 +84,10 @@ func (c statusCode) String() string {
 		return "OK"
 	case statusQuotaExhausted:
 		return "quotaExhausted"
+	case statusConnLimitReached:
+		return "connLimitReached"
+	case statusOverloaded:
+		return "overloaded"
 	default:
 		return "UNKNOWN"
 	}
@@ -93,6 +99,9 @@ const (
 
 	// Maximum payload that cat be attached to open session request and open session response.
 	MaxSessionOpenPayload = 1024
+
+	// Maximum length of the label of a session, carried by open session request.
+	MaxSessionLabelLength = 13
 )
 
 // metadata defines the methods supported by all metadata.
@@ -118,9 +127,9 @@ var (
 
 // baseStruct is shared by all metadata struct.
 type baseStruct struct {
-	protocol  uint8  // byte 0: protocol type
-	reserved  uint8  // byte 1: reserved
-	timestamp uint32 // byte 2 - 5: timestamp, number of minutes after UNIX epoch
+	protocol     uint8  // byte 0: protocol type
+	capabilities uint8  // byte 1: capabilities of open session request and response, reserved otherwise
+	timestamp    uint32 // byte 2 - 5: timestamp, number of minutes after UNIX epoch
 }
 
 // sessionStruct is used to open or close a session.
@@ -131,6 +140,9 @@ type sessionStruct struct {
 	statusCode uint8  // byte 14: status of opening or closing session
 	payloadLen uint16 // byte 15 - 16: length of encapsulated payload, not including auth tag
 	suffixLen  uint8  // byte 17: length of suffix padding
+	labelLen   uint8  // byte 18: length of session label
+	label      []byte // byte 19 - 31: session label of open session request
+	token      uint64 // byte 19 - 26: resume token of open session response
 }
 
 func (ss *sessionStruct) Protocol() protocolType {
@@ -140,6 +152,7 @@ func (ss *sessionStruct) Protocol() protocolType {
 func (ss *sessionStruct) Marshal() []byte {
 	b := make([]byte, MetadataLength)
 	b[0] = ss.baseStruct.protocol
+	b[1] = ss.baseStruct.capabilities
 	ss.baseStruct.timestamp = uint32(time.Now().Unix() / 60)
 	binary.BigEndian.PutUint32(b[2:], ss.baseStruct.timestamp)
 	binary.BigEndian.PutUint32(b[6:], ss.sessionID)
@@ -147,6 +160,12 @@ func (ss *sessionStruct) Marshal() []byte {
 	b[14] = ss.statusCode
 	binary.BigEndian.PutUint16(b[15:], ss.payloadLen)
 	b[17] = ss.suffixLen
+	b[18] = ss.labelLen
+	if ss.Protocol() == openSessionResponse {
+		binary.BigEndian.PutUint64(b[19:], ss.token)
+	} else {
+		copy(b[19:], ss.label)
+	}
 	return b
 }
 
@@ -166,20 +185,33 @@ func (ss *sessionStruct) Unmarshal(b []byte) error {
 	if ss.payloadLen > MaxSessionOpenPayload {
 		return fmt.Errorf("payload size %d exceed maximum value %d", ss.payloadLen, MaxSessionOpenPayload)
 	}
+	if b[18] > MaxSessionLabelLength {
+		return fmt.Errorf("label size %d exceed maximum value %d", b[18], MaxSessionLabelLength)
+	}
 
 	// Do unmarshal.
 	ss.baseStruct.protocol = b[0]
+	ss.baseStruct.capabilities = b[1]
 	ss.baseStruct.timestamp = originalTimestamp
 	ss.sessionID = binary.BigEndian.Uint32(b[6:])
 	ss.seq = binary.BigEndian.Uint32(b[10:])
 	ss.statusCode = b[14]
 	ss.payloadLen = binary.BigEndian.Uint16(b[15:])
 	ss.suffixLen = b[17]
+	ss.labelLen = b[18]
+	ss.label = nil
+	ss.token = 0
+	if openSessionResponse.Equals(b[0]) {
+		ss.token = binary.BigEndian.Uint64(b[19:])
+	} else if ss.labelLen > 0 {
+		ss.label = make([]byte, ss.labelLen)
+		copy(ss.label, b[19:])
+	}
 	return nil
 }
 
 func (ss *sessionStruct) String() string {
-	return fmt.Sprintf("sessionStruct{protocol=%v, sessionID=%v, seq=%v, statusCode=%v, payloadLen=%v, suffixLen=%v}", protocolType(ss.protocol), ss.sessionID, ss.seq, ss.statusCode, ss.payloadLen, ss.suffixLen)
+	return fmt.Sprintf("sessionStruct{protocol=%v, sessionID=%v, seq=%v, statusCode=%v, capabilities=%v, payloadLen=%v, suffixLen=%v}", protocolType(ss.protocol), ss.sessionID, ss.seq, ss.statusCode, ss.capabilities, ss.payloadLen, ss.suffixLen)
 }
 
 func isSessionProtocol(p protocolType) bool {
@@ -204,8 +236,31 @@ type dataAckStruct struct {
 	prefixLen  uint8  // byte 21: length of prefix padding
 	payloadLen uint16 // byte 22 - 23: length of encapsulated payload, not including auth tag
 	suffixLen  uint8  // byte 24: length of suffix padding
+	flags      uint8  // byte 25: data flags
 }
 
+const (
+	// dataFlagFIN means the sender of the data segment has closed the
+	// write side of the session. The segment has no payload.
+	dataFlagFIN uint8 = 1 << 0
+
+	// dataFlagPathChallenge means the ack segment asks the client to echo
+	// the payload, to prove that it receives packets at the address.
+	dataFlagPathChallenge uint8 = 1 << 1
+
+	// dataFlagPathResponse means the ack segment echoes the payload of
+	// a path challenge.
+	dataFlagPathResponse uint8 = 1 << 2
+
+	// dataFlagCompressed means the payload of the data segment is
+	// compressed with the negotiated algorithm.
+	dataFlagCompressed uint8 = 1 << 3
+
+	// dataFlagResume means the ack segment carries the resume token of
+	// the session in the payload, to migrate it to the TCP underlay.
+	dataFlagResume uint8 = 1 << 4
+)
+
 func (das *dataAckStruct) Protocol() protocolType {
 	return protocolType(das.baseStruct.protocol)
 }
@@ -223,6 +278,7 @@ func (das *dataAckStruct) Marshal() []byte {
 	b[21] = das.prefixLen
 	binary.BigEndian.PutUint16(b[22:], das.payloadLen)
 	b[24] = das.suffixLen
+	b[25] = das.flags
 	return b
 }
 
@@ -251,11 +307,12 @@ func (das *dataAckStruct) Unmarshal(b []byte) error {
 	das.prefixLen = b[21]
 	das.payloadLen = binary.BigEndian.Uint16(b[22:])
 	das.suffixLen = b[24]
+	das.flags = b[25]
 	return nil
 }
 
 func (das *dataAckStruct) String() string {
-	return fmt.Sprintf("dataAckStruct{protocol=%v, sessionID=%v, seq=%v, unAckSeq=%v, windowSize=%v, fragment=%v, prefixLen=%v, payloadLen=%v, suffixLen=%v}", protocolType(das.protocol), das.sessionID, das.seq, das.unAckSeq, das.windowSize, das.fragment, das.prefixLen, das.payloadLen, das.suffixLen)
+	return fmt.Sprintf("dataAckStruct{protocol=%v, sessionID=%v, seq=%v, unAckSeq=%v, windowSize=%v, fragment=%v, prefixLen=%v, payloadLen=%v, suffixLen=%v, flags=%v}", protocolType(das.protocol), das.sessionID, das.seq, das.unAckSeq, das.windowSize, das.fragment, das.prefixLen, das.payloadLen, das.suffixLen, das.flags)
 }
 
 func isDataAckProtocol(p protocolType) bool {
@@ -24,7 +24,8 @@ import (
 func TestSessionStruct(t *testing.T) {
 	s := &sessionStruct{
 		baseStruct: baseStruct{
-			protocol: uint8(closeSessionRequest),
+			protocol:     uint8(closeSessionRequest),
+			capabilities: uint8(mrand.Uint32()),
 		},
 		sessionID:  mrand.Uint32(),
 		statusCode: uint8(mrand.Uint32()),
@@ -45,6 +46,58 @@ func TestSessionStruct(t *testing.T) {
 	}
 }
 
+func TestSessionStructLabel(t *testing.T) {
+	s := &sessionStruct{
+		baseStruct: baseStruct{
+			protocol: uint8(openSessionRequest),
+		},
+		sessionID: mrand.Uint32(),
+		labelLen:  MaxSessionLabelLength,
+		label:     []byte("tenant-000042"),
+	}
+	b := s.Marshal()
+	s2 := &sessionStruct{}
+	if err := s2.Unmarshal(b); err != nil {
+		t.Fatalf("Unmarshal() failed: %v", err)
+	}
+	if !reflect.DeepEqual(s, s2) {
+		t.Errorf("Not equal:\n%v\n====\n%v", s, s2)
+	}
+
+	b[18] = MaxSessionLabelLength + 1
+	if err := s2.Unmarshal(b); err == nil {
+		t.Errorf("Unmarshal() succeeded with a label of %d bytes", b[18])
+	}
+}
+
+func TestSessionStructToken(t *testing.T) {
+	s := &sessionStruct{
+		baseStruct: baseStruct{
+			protocol:     uint8(openSessionResponse),
+			capabilities: uint8(capResume),
+		},
+		sessionID: mrand.Uint32(),
+		token:     mrand.Uint64(),
+	}
+	b := s.Marshal()
+	s2 := &sessionStruct{}
+	if err := s2.Unmarshal(b); err != nil {
+		t.Fatalf("Unmarshal() failed: %v", err)
+	}
+	if !reflect.DeepEqual(s, s2) {
+		t.Errorf("Not equal:\n%v\n====\n%v", s, s2)
+	}
+
+	// The token is not sent with other session protocols.
+	s.protocol = uint8(closeSessionRequest)
+	if err := s2.Unmarshal(s.Marshal()); err != nil {
+		t.Fatalf("Unmarshal() failed: %v", err)
+	}
+	if s2.token != 0 {
+		t.Errorf("token = %d, want 0", s2.token)
+	}
+}
+
 func TestDataAckStruct(t *testing.T) {
 	s := &dataAckStruct{
 		baseStruct: baseStruct{
@@ -58,6 +111,7 @@ func TestDataAckStruct(t *testing.T) {
 		prefixLen:  uint8(mrand.Uint32()),
 		payloadLen: uint16(mrand.Uint32()),
 		suffixLen:  uint8(mrand.Uint32()),
+		flags:      uint8(mrand.Uint32()),
 	}
 	b := s.Marshal()
 	s2 := &dataAckStruct{}
@@ -71,3 +125,53 @@ func TestDataAckStruct(t *testing.T) {
 		t.Errorf("Not equal:\n%s\n====\n%s", s.String(), s2.String())
 	}
 }
+
+// oldPeerView clears the bytes of the metadata that peers without
+// capabilities ignore, which is what such a peer reads from it.
+func oldPeerView(b []byte) []byte {
+	old := make([]byte, len(b))
+	copy(old, b)
+	old[1] = 0
+	if isDataAckProtocol(protocolType(old[0])) {
+		old[25] = 0
+	}
+	return old
+}
+
+func TestMetadataWithOldPeer(t *testing.T) {
+	// A FIN is an empty data segment to an old peer.
+	fin := &dataAckStruct{
+		baseStruct: baseStruct{
+			protocol: uint8(dataClientToServer),
+		},
+		sessionID: mrand.Uint32(),
+		seq:       mrand.Uint32(),
+		unAckSeq:  mrand.Uint32(),
+		flags:     dataFlagFIN,
+	}
+	old := &dataAckStruct{}
+	if err := old.Unmarshal(oldPeerView(fin.Marshal())); err != nil {
+		t.Fatalf("Unmarshal() failed: %v", err)
+	}
+	if old.flags != 0 || old.payloadLen != 0 || old.sessionID != fin.sessionID || old.seq != fin.seq || old.unAckSeq != fin.unAckSeq {
+		t.Errorf("old peer reads %v from %v, want an empty data segment", old, fin)
+	}
+
+	// An old peer offers and accepts no capabilities.
+	for _, protocol := range []protocolType{openSessionRequest, openSessionResponse} {
+		s := &sessionStruct{
+			baseStruct: baseStruct{
+				protocol:     uint8(protocol),
+				capabilities: uint8(capZstd | capHalfClose),
+			},
+			sessionID: mrand.Uint32(),
+		}
+		s2 := &sessionStruct{}
+		if err := s2.Unmarshal(oldPeerView(s.Marshal())); err != nil {
+			t.Fatalf("Unmarshal() failed: %v", err)
+		}
+		if s2.capabilities != 0 || s2.sessionID != s.sessionID {
+			t.Errorf("old peer metadata is %v, want %v without capabilities", s2, s)
+		}
+	}
+}
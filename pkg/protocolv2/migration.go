@@ -0,0 +1,350 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+)
+
+func (m *Mux) SetConnectionMigration(enable bool) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set connection migration after mux is used")
+	}
+	m.migration = enable
+	m.logf(log.InfoLevel, "Mux connection migration is set to %v", enable)
+	return m
+}
+
+// udpConn returns the current network connection of the underlay.
+func (u *UDPUnderlay) udpConn() *net.UDPConn {
+	u.connMu.RLock()
+	defer u.connMu.RUnlock()
+	return u.conn
+}
+
+// rebind replaces the network connection of a client underlay with a new
+// socket, if the connection is still old. The sessions of the underlay
+// are not changed.
+func (u *UDPUnderlay) rebind(old *net.UDPConn) error {
+	if u.redial == nil {
+		return fmt.Errorf("connection migration is disabled")
+	}
+	u.connMu.Lock()
+	if u.conn != old {
+		// Another writer has done it.
+		u.connMu.Unlock()
+		return nil
+	}
+	conn, err := u.redial()
+	if err != nil {
+		u.connMu.Unlock()
+		return fmt.Errorf("create new UDP socket failed: %w", err)
+	}
+	if u.pmtud != nil {
+		if err := setDontFragment(conn); err != nil {
+			log.Debugf("Can't set don't fragment bit to UDP socket %v: %v", conn.LocalAddr(), err)
+		}
+	}
+	u.conn = conn
+	u.connMu.Unlock()
+
+	// The read loop moves to the new socket after the old one is closed.
+	old.Close()
+	UDPUnderlayMigrations.Add(1)
+	log.Debugf("%v migrated from local address %v", u, old.LocalAddr())
+	return nil
+}
+
+// pathChallengeInterval is the minimum time between two path challenges
+// sent to the same candidate address.
+const pathChallengeInterval = time.Second
+
+// pathValidation tracks the client address of a server UDP session.
+type pathValidation struct {
+	mu        sync.Mutex
+	seqSeen   bool         // true if maxSeq is valid
+	maxSeq    uint32       // highest data sequence number received
+	candidate *net.UDPAddr // new address being validated, nil if none
+	token     [8]byte      // payload of the path challenge sent to candidate
+	sentTime  time.Time    // time the path challenge is sent
+}
+
+// maybeMigrate checks a data or ack segment of a server session that is
+// sent by the session user from an address, if connection migration is
+// negotiated with the client. A data segment from a new address with a sequence number higher
+// than any received so far makes that address a candidate, and the server
+// sends a path challenge to it. The session moves to the candidate address
+// once the client echoes the challenge from there. Delayed or replayed
+// segments from an old address can't move the session.
+// It returns true if the segment is consumed and must not be delivered
+// to the session.
+func (u *UDPUnderlay) maybeMigrate(s *Session, seg *segment, addr *net.UDPAddr) bool {
+	if !u.migration || u.isClient || seg.block == nil || !s.hasCapability(capPathValidation) {
+		return false
+	}
+	name := s.userName.Load()
+	if name == nil || *name != seg.block.BlockContext().UserName {
+		// The user of a new session is not known yet, or the segment
+		// is sent by another user.
+		return false
+	}
+	das, ok := toDataAckStruct(seg.metadata)
+	if !ok {
+		return false
+	}
+	isData := das.Protocol() == dataClientToServer
+
+	p := &s.path
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	newer := isData && (!p.seqSeen || seqBefore(p.maxSeq, das.seq))
+	if newer {
+		p.seqSeen = true
+		p.maxSeq = das.seq
+	}
+	if das.flags&dataFlagPathResponse != 0 {
+		if p.candidate != nil && p.candidate.String() == addr.String() && bytes.Equal(seg.payload, p.token[:]) {
+			p.candidate = nil
+			s.movedAddr.Store(addr)
+			UDPUnderlayMigrations.Add(1)
+			log.Debugf("%v is migrated to remote address %v", s, addr)
+		}
+		return true
+	}
+	if !newer || s.RemoteAddr().String() == addr.String() {
+		return false
+	}
+	if p.candidate != nil && p.candidate.String() == addr.String() && time.Since(p.sentTime) < pathChallengeInterval {
+		return false
+	}
+	if _, err := crand.Read(p.token[:]); err != nil {
+		log.Debugf("%v can't create path challenge: %v", s, err)
+		return false
+	}
+	p.candidate = addr
+	p.sentTime = time.Now()
+	challenge := &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{
+				protocol: uint8(ackServerToClient),
+			},
+			sessionID:  das.sessionID,
+			flags:      dataFlagPathChallenge,
+			payloadLen: uint16(len(p.token)),
+		},
+		payload:   append([]byte{}, p.token[:]...),
+		transport: u.TransportProtocol(),
+		block:     seg.block,
+	}
+	if err := u.writeOneSegment(challenge, addr); err != nil {
+		log.Debugf("%v can't send path challenge to %v: %v", s, addr, err)
+	}
+	return false
+}
+
+// answerPathChallenge echoes a path challenge received by a client underlay.
+func (u *UDPUnderlay) answerPathChallenge(das *dataAckStruct, seg *segment, addr *net.UDPAddr) error {
+	if u.redial == nil {
+		// Connection migration is disabled.
+		return nil
+	}
+	response := &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{
+				protocol: uint8(ackClientToServer),
+			},
+			sessionID:  das.sessionID,
+			flags:      dataFlagPathResponse,
+			payloadLen: uint16(len(seg.payload)),
+		},
+		payload:   seg.payload,
+		transport: u.TransportProtocol(),
+	}
+	return u.writeOneSegment(response, addr)
+}
+
+// MigrateSession moves a client session to another underlay of the mux,
+// which can be obtained from Underlays.
+// A session that hasn't sent any data can always be migrated. A TCP session
+// that has sent data can be migrated if SetMigrationBuffer is set, and the
+// buffer still has all the data the server may not have received. Other
+// sessions can't be migrated, because the data in flight of the old
+// underlay can't be recovered. The mux also migrates the sessions that can
+// be migrated automatically when their underlay is broken.
+func (m *Mux) MigrateSession(s *Session, newUnderlay Underlay) error {
+	if !m.isClient {
+		return stderror.ErrInvalidOperation
+	}
+	if s == nil || newUnderlay == nil {
+		return stderror.ErrNullPointer
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.migrateSession(s, newUnderlay)
+}
+
+// migratableUnderlay is a underlay that supports session migration.
+type migratableUnderlay interface {
+	Underlay
+	sessions() []*Session
+	adoptSession(*Session) error
+	detachSession(*Session)
+}
+
+// sessionUnderlay returns the underlay that the sessions of u are attached
+// to. TLS and WebSocket underlays attach their sessions to the TCP underlay
+// they wrap.
+func sessionUnderlay(u Underlay) Underlay {
+	switch w := u.(type) {
+	case *TLSUnderlay:
+		return w.TCPUnderlay
+	case *WebSocketUnderlay:
+		return w.TCPUnderlay
+	}
+	return u
+}
+
+// migrateSession moves the session to the new underlay.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) migrateSession(s *Session, newUnderlay Underlay) error {
+	found := false
+	for _, underlay := range m.underlays {
+		if underlay == newUnderlay {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%v is not a underlay of the mux", newUnderlay)
+	}
+	select {
+	case <-newUnderlay.Done():
+		return fmt.Errorf("%v is closed", newUnderlay)
+	default:
+	}
+	dst, ok := newUnderlay.(migratableUnderlay)
+	if !ok {
+		return fmt.Errorf("%v doesn't support session migration", newUnderlay)
+	}
+	if !dst.Scheduler().IncPending() {
+		return fmt.Errorf("%v can't accept new sessions", newUnderlay)
+	}
+	defer dst.Scheduler().DecPending()
+
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	if !s.canMigrate() {
+		return fmt.Errorf("%v can't be migrated without losing the data in flight", s)
+	}
+	src := s.underlay()
+	target := sessionUnderlay(newUnderlay)
+	if src == target {
+		return nil
+	}
+	if underlayTransport(src) != underlayTransport(target) {
+		return fmt.Errorf("can't migrate %v from %v to %v", s, underlayTransport(src), underlayTransport(target))
+	}
+	if err := dst.adoptSession(s); err != nil {
+		return fmt.Errorf("adoptSession() failed: %w", err)
+	}
+	if old, ok := src.(migratableUnderlay); ok {
+		old.detachSession(s)
+	}
+	s.setUnderlay(target)
+	m.logf(log.DebugLevel, "Migrated %v from %v to %v", s, src, newUnderlay)
+	return nil
+}
+
+// migrateSessions moves the sessions that can be migrated from a broken
+// underlay to other underlays of the same endpoint, so they don't fail
+// together with the broken underlay. The mu lock is released while a new
+// underlay is connected, which is given up after migrationTimeout or when
+// the mux is closed.
+func (m *Mux) migrateSessions(broken Underlay) {
+	src, ok := broken.(migratableUnderlay)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isStopped() {
+		return
+	}
+
+	// Don't pick the broken underlay for the migrated sessions.
+	remaining := make([]Underlay, 0, len(m.underlays))
+	for _, underlay := range m.underlays {
+		if underlay != broken {
+			remaining = append(remaining, underlay)
+		}
+	}
+	m.underlays = remaining
+	ctx, cancel := m.lifetimeContext(migrationTimeout)
+	defer cancel()
+	opts := &dialOptions{
+		endpoint:        -1,
+		failedEndpoints: make(map[int]bool),
+		loopCtx:         context.Background(),
+		unlocked:        true,
+	}
+	if key, ok := m.underlayEndpoints[broken]; ok {
+		for i, p := range m.endpoints {
+			if endpointKey(p) == key {
+				opts.endpoint = i
+				break
+			}
+		}
+	}
+
+	for _, s := range src.sessions() {
+		if m.isStopped() {
+			return
+		}
+		s.wLock.Lock()
+		ok := s.canMigrate()
+		s.wLock.Unlock()
+		if !ok {
+			continue
+		}
+		underlay := m.maybePickExistingUnderlay(opts)
+		if underlay == nil {
+			if m.isMaxUnderlaysReached() {
+				m.logf(log.DebugLevel, "Can't migrate %v: reached the maximum number of %d underlays", s, m.maxUnderlays)
+				continue
+			}
+			var err error
+			underlay, err = m.newUnderlay(ctx, opts)
+			if err != nil {
+				m.logf(log.DebugLevel, "Can't migrate %v: %v", s, err)
+				continue
+			}
+		}
+		if err := m.migrateSession(s, underlay); err != nil {
+			m.logf(log.DebugLevel, "Can't migrate %v: %v", s, err)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/testtool"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestMigrateSession(t *testing.T) {
+	log.SetOutputToTest(t)
+	_, endpoint := startTestServer(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+
+	used, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer used.Close()
+	rot13RoundTrip(t, used, 1024)
+	fresh, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer fresh.Close()
+
+	if err := clientMux.Warmup(context.Background(), 2); err != nil {
+		t.Fatalf("Warmup() failed: %v", err)
+	}
+	var target Underlay
+	for _, underlay := range clientMux.Underlays() {
+		if underlay != fresh.(*Session).underlay() {
+			target = underlay
+		}
+	}
+	if target == nil {
+		t.Fatalf("Underlays() doesn't return the warmed underlay")
+	}
+
+	if err := clientMux.MigrateSession(used.(*Session), target); err == nil {
+		t.Errorf("MigrateSession() succeeded for a session that has sent data")
+	}
+	if err := clientMux.MigrateSession(fresh.(*Session), target); err != nil {
+		t.Fatalf("MigrateSession() failed: %v", err)
+	}
+	if fresh.(*Session).underlay() != target {
+		t.Errorf("session is not attached to the new underlay")
+	}
+	rot13RoundTrip(t, fresh, 1024)
+	rot13RoundTrip(t, used, 1024)
+}
+
+func TestMigrateSessionOnUnderlayFailure(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestServer(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	session := conn.(*Session)
+	clientMux.mu.Lock()
+	broken := session.underlay()
+	clientMux.mu.Unlock()
+
+	// Break the underlay from the server side.
+	var stats []UnderlayStats
+	for i := 0; i < 50; i++ {
+		if stats = serverMux.Stats(); len(stats) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got %d server underlays, want 1", len(stats))
+	}
+	if err := serverMux.CloseUnderlay(stats[0].RemoteAddr.String()); err != nil {
+		t.Fatalf("CloseUnderlay() failed: %v", err)
+	}
+	select {
+	case <-broken.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client underlay is not closed")
+	}
+
+	clientMux.mu.Lock()
+	migrated := session.underlay() != broken
+	clientMux.mu.Unlock()
+	if !migrated {
+		t.Fatalf("session is not migrated from the broken underlay")
+	}
+	rot13RoundTrip(t, conn, 1024)
+}
+
+func TestMigrateSessionDialDoesNotBlockMux(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+	var dials atomic.Int32
+	blocked := make(chan struct{})
+	canceled := make(chan struct{})
+	clientMux := newTestClient(endpoint).SetDialer(func(ctx context.Context, network, laddr, raddr string) (net.Conn, error) {
+		if dials.Add(1) == 1 {
+			return defaultDial(ctx, network, laddr, raddr)
+		}
+		// The dial of the migration hangs until the mux is closed.
+		close(blocked)
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	var stats []UnderlayStats
+	for i := 0; i < 50; i++ {
+		if stats = serverMux.Stats(); len(stats) == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got %d server underlays, want 1", len(stats))
+	}
+	if err := serverMux.CloseUnderlay(stats[0].RemoteAddr.String()); err != nil {
+		t.Fatalf("CloseUnderlay() failed: %v", err)
+	}
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("session is not migrated to a new underlay")
+	}
+
+	statsDone := make(chan struct{})
+	go func() {
+		clientMux.Stats()
+		close(statsDone)
+	}()
+	select {
+	case <-statsDone:
+	case <-time.After(time.Second):
+		t.Fatalf("mux is locked while the migration is dialing")
+	}
+	clientMux.Close()
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Fatalf("migration dial is not canceled after the mux is closed")
+	}
+}
+
+func TestMigrateSessionWithData(t *testing.T) {
+	log.SetOutputToTest(t)
+	_, serverEndpoint := startTestServer(t, util.TCPTransport, func(m *Mux) {
+		m.SetMigrationBuffer(1 << 20)
+	})
+	proxy := newCutProxy(t, serverEndpoint.RemoteAddr().String())
+	defer proxy.Close()
+	endpoint := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, proxy.Addr())
+	clientMux := newTestClient(endpoint).SetMigrationBuffer(1 << 20)
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	rot13RoundTrip(t, conn, 1024)
+	// Wait for the peers to acknowledge the data.
+	time.Sleep(200 * time.Millisecond)
+	session := conn.(*Session)
+	broken := session.underlay()
+
+	// Break the connection while the data is in flight.
+	payload := testtool.TestHelperGenRot13Input(64 * 1024)
+	if _, err := conn.Write(payload[:32*1024]); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	proxy.cut()
+	if _, err := conn.Write(payload[32*1024:]); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	resp := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v", err)
+	}
+	rot13, err := testtool.TestHelperRot13(resp)
+	if err != nil {
+		t.Fatalf("TestHelperRot13() failed: %v", err)
+	}
+	if !bytes.Equal(payload, rot13) {
+		t.Fatalf("Received unexpected response")
+	}
+	if session.underlay() == broken {
+		t.Errorf("session is not migrated from the broken underlay")
+	}
+	rot13RoundTrip(t, conn, 1024)
+}
+
+// cutProxy forwards TCP connections to a target address. The connections
+// can be reset like a network failure, and new connections are accepted.
+type cutProxy struct {
+	net.Listener
+	target string
+	mu     sync.Mutex
+	conns  []*net.TCPConn
+}
+
+func newCutProxy(t *testing.T, target string) *cutProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	p := &cutProxy{Listener: l, target: target}
+	go func() {
+		for {
+			down, err := l.Accept()
+			if err != nil {
+				return
+			}
+			up, err := net.Dial("tcp", target)
+			if err != nil {
+				down.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, down.(*net.TCPConn), up.(*net.TCPConn))
+			p.mu.Unlock()
+			go io.Copy(up, down)
+			go io.Copy(down, up)
+		}
+	}()
+	return p
+}
+
+// cut resets the forwarded connections on both sides.
+func (p *cutProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.SetLinger(0)
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func TestConnectionMigration(t *testing.T) {
+	serverMux, endpoint := startTestServer(t, util.UDPTransport, func(m *Mux) {
+		m.SetConnectionMigration(true)
+	})
+	clientMux := newTestClient(endpoint).SetConnectionMigration(true)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	rot13RoundTrip(t, conn, 4096)
+
+	var serverSession *Session
+	serverMux.mu.Lock()
+	for _, underlay := range serverMux.underlays {
+		if s, ok := underlay.(*UDPUnderlay).sessionMap.Load(conn.(*Session).id); ok {
+			serverSession = s.(*Session)
+		}
+	}
+	serverMux.mu.Unlock()
+	if serverSession == nil {
+		t.Fatalf("session is not found in server")
+	}
+
+	// Simulate a change of the client address. The socket can't send any
+	// more, so the next write moves the underlay to a new socket.
+	underlay := conn.(*Session).underlay().(*UDPUnderlay)
+	oldConn := underlay.udpConn()
+	oldPort := underlay.LocalAddr().(*net.UDPAddr).Port
+	before := UDPUnderlayMigrations.Load()
+	if err := oldConn.SetWriteDeadline(time.Unix(1, 0)); err != nil {
+		t.Fatalf("SetWriteDeadline() failed: %v", err)
+	}
+
+	// The session survives and the server replies to the new address.
+	rot13RoundTrip(t, conn, 4096)
+	if underlay.udpConn() == oldConn {
+		t.Fatalf("UDP socket is not replaced after write failure")
+	}
+	newPort := underlay.LocalAddr().(*net.UDPAddr).Port
+	if newPort == oldPort {
+		t.Fatalf("local port %d is not changed", oldPort)
+	}
+	if got := serverSession.RemoteAddr().(*net.UDPAddr).Port; got != newPort {
+		t.Errorf("server session remote port is %d, want %d", got, newPort)
+	}
+	if got := UDPUnderlayMigrations.Load() - before; got != 2 {
+		t.Errorf("got %d migrations, want 2", got)
+	}
+}
+
+func TestConnectionMigrationNeedsPathValidation(t *testing.T) {
+	serverMux, endpoint := startTestServer(t, util.UDPTransport, func(m *Mux) {
+		m.SetConnectionMigration(true)
+	})
+	clientMux := newTestClient(endpoint).SetConnectionMigration(true)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	rot13RoundTrip(t, conn, 4096)
+
+	var serverUnderlay *UDPUnderlay
+	var serverSession *Session
+	serverMux.mu.Lock()
+	for _, underlay := range serverMux.underlays {
+		if s, ok := underlay.(*UDPUnderlay).sessionMap.Load(conn.(*Session).id); ok {
+			serverUnderlay = underlay.(*UDPUnderlay)
+			serverSession = s.(*Session)
+		}
+	}
+	serverMux.mu.Unlock()
+	if serverSession == nil {
+		t.Fatalf("session is not found in server")
+	}
+	remoteAddr := serverSession.RemoteAddr().String()
+	newAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}
+	dataSegment := func(seq uint32, flags uint8, payload []byte) *segment {
+		return &segment{
+			metadata: &dataAckStruct{
+				baseStruct: baseStruct{
+					protocol: uint8(dataClientToServer),
+				},
+				sessionID:  serverSession.id,
+				seq:        seq,
+				flags:      flags,
+				payloadLen: uint16(len(payload)),
+			},
+			payload:   payload,
+			transport: util.UDPTransport,
+			block:     serverSession.getBlock(),
+		}
+	}
+
+	// A delayed segment from another address is not a candidate.
+	if serverUnderlay.maybeMigrate(serverSession, dataSegment(0, 0, nil), newAddr) {
+		t.Errorf("delayed data segment is consumed")
+	}
+	serverSession.path.mu.Lock()
+	candidate := serverSession.path.candidate
+	serverSession.path.mu.Unlock()
+	if candidate != nil {
+		t.Errorf("delayed data segment makes %v a candidate", candidate)
+	}
+
+	// A newer segment makes the address a candidate, but the session
+	// doesn't move before the client answers the path challenge.
+	if serverUnderlay.maybeMigrate(serverSession, dataSegment(1<<30, 0, nil), newAddr) {
+		t.Errorf("new data segment is consumed")
+	}
+	serverSession.path.mu.Lock()
+	candidate = serverSession.path.candidate
+	serverSession.path.mu.Unlock()
+	if candidate == nil || candidate.String() != newAddr.String() {
+		t.Errorf("candidate address is %v, want %v", candidate, newAddr)
+	}
+	if !serverUnderlay.maybeMigrate(serverSession, dataSegment(1<<30+1, dataFlagPathResponse, make([]byte, 8)), newAddr) {
+		t.Errorf("path response is not consumed")
+	}
+	if got := serverSession.RemoteAddr().String(); got != remoteAddr {
+		t.Errorf("session is moved to %v without path validation", got)
+	}
+}
+
+func TestConnectionMigrationNeedsCapability(t *testing.T) {
+	serverMux, endpoint := startTestMux(t, util.UDPTransport, func(m *Mux) {
+		m.SetConnectionMigration(true)
+	})
+	// The client doesn't offer path validation, like an old client.
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	accepted, err := serverMux.Accept()
+	if err != nil {
+		t.Fatalf("Accept() failed: %v", err)
+	}
+	defer accepted.Close()
+	serverSession := accepted.(*Session)
+	if _, err := io.ReadFull(serverSession, make([]byte, 5)); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v", err)
+	}
+	if serverSession.hasCapability(capPathValidation) {
+		t.Fatalf("path validation is negotiated with a client that doesn't offer it")
+	}
+
+	seg := &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{
+				protocol: uint8(dataClientToServer),
+			},
+			sessionID: serverSession.id,
+			seq:       1 << 30,
+		},
+		transport: util.UDPTransport,
+		block:     serverSession.getBlock(),
+	}
+	underlay := serverSession.underlay().(*UDPUnderlay)
+	if underlay.maybeMigrate(serverSession, seg, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9}) {
+		t.Errorf("data segment is consumed")
+	}
+	serverSession.path.mu.Lock()
+	candidate := serverSession.path.candidate
+	serverSession.path.mu.Unlock()
+	if candidate != nil {
+		t.Errorf("%v is a candidate address without path validation", candidate)
+	}
+}
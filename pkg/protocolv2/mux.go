@@ -17,44 +17,152 @@ package protocolv2
 
 import (
 	"context"
-	"encoding/hex"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	mrand "math/rand"
+	"math"
 	"net"
+	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/enfein/mieru/pkg/appctl/appctlpb"
 	"github.com/enfein/mieru/pkg/cipher"
 	"github.com/enfein/mieru/pkg/log"
 	"github.com/enfein/mieru/pkg/mathext"
+	"github.com/enfein/mieru/pkg/replay"
 	"github.com/enfein/mieru/pkg/stderror"
 	"github.com/enfein/mieru/pkg/util"
-	"github.com/enfein/mieru/pkg/util/sockopts"
 )
 
 const idleUnderlayTickerInterval = 5 * time.Second
 
+const (
+	// minAcceptBackoff is the initial time to wait before accepting again
+	// after a temporary error.
+	minAcceptBackoff = 5 * time.Millisecond
+
+	// maxAcceptBackoff is the maximum time to wait before accepting again
+	// after a temporary error.
+	maxAcceptBackoff = time.Second
+)
+
+// maxSessionIDAttempts is the number of random session IDs to try
+// before giving up, if the IDs are already used in the underlay.
+const maxSessionIDAttempts = 8
+
+// maxNewUnderlayAttempts is the number of new underlays to create for
+// a session before giving up, if the new underlays can't accept it.
+const maxNewUnderlayAttempts = 3
+
+// ErrNoAvailableUnderlay is returned by the client when none of the
+// existing or new underlays can accept a new session.
+var ErrNoAvailableUnderlay = errors.New("no underlay can accept a new session")
+
 // Mux manages the sessions and underlays.
 type Mux struct {
 	// ---- common fields ----
-	isClient    bool
-	endpoints   []UnderlayProperties
-	underlays   []Underlay
-	chAccept    chan net.Conn
-	chAcceptErr chan error
-	used        bool
-	done        chan struct{}
-	mu          sync.Mutex
-	cleaner     *time.Ticker
+	isClient         bool
+	endpoints        []UnderlayProperties
+	underlays        []Underlay
+	chAccept         chan net.Conn
+	chAcceptErr      chan error
+	overflow         OverflowPolicy
+	used             bool
+	done             chan struct{}
+	draining         chan struct{}
+	listeners        []net.Listener
+	observer         SessionObserver
+	uObserver        UnderlayObserver
+	logger           Logger                    // nil if structured logging is not used
+	logLevel         atomic.Pointer[log.Level] // nil if only the global log level is used
+	ciphers          CipherFactory
+	tlsConfig        *tls.Config // used by TLS underlays
+	handshakes       durationHistogram
+	mu               sync.Mutex
+	cleaner          *time.Timer   // nil before the mux is used, or if the cleaner is disabled
+	noCleaner        bool          // if the idle underlay cleaner is disabled
+	jitter           time.Duration // random variation of the cleaner interval
+	rand             randSource
+	udpSessionBuffer int // zero if the default capacity is used
+	udpBufferPolicy  UDPBufferPolicy
+	migration        bool // if UDP sessions can move to a new client address
+	sessionRate      int  // bytes per second of each session direction, zero if unlimited
+	migrationBuffer  int  // bytes each TCP session keeps to be migrated, zero if disabled
 
 	// ---- client fields ----
-	password        []byte
-	multiplexFactor int
+	underlayEndpoints map[Underlay]string // endpoint key of each underlay
+	affinity          map[string]Underlay // last underlay of each routing key
+	endpointHealth    []*endpointHealth
+	endpointWeights   []int
+	endpointSelection EndpointSelection
+	nextEndpoint      atomic.Uint64 // round robin counter
+	transportFallback bool          // if TCP is tried after UDP failed
+	password          []byte
+	passwords         [][]byte // nil if there is only one password
+	passwordIndex     int      // index of the last password accepted by the server
+	multiplexFactor   int
+	maxUnderlays      int
+	maxSessions       int // maximum number of sessions per underlay
+	selector          UnderlaySelector
+	dialAttempts      int
+	dialBackoff       time.Duration
+	dialTimeout       time.Duration    // zero if only the caller's context is used
+	mtuWarned         bool             // if the MTU mismatch warning is printed
+	dialer            DialFunc         // nil if the default network stack is used
+	localAddr         string           // empty if an automatic address is used
+	dialing           atomic.Int32     // number of DialContext calls in flight
+	dnsCache          *dnsCache        // nil if endpoint host names are resolved by every dial
+	lookupIPAddr      lookupIPAddrFunc // resolves endpoint host names
+	minWarm           int              // minimum number of warm underlays
+	warmWake          chan struct{}    // nil if warm underlays are not kept
+
+	// warmUnderlays are the underlays created by Warmup that no session
+	// has been scheduled to. The idle cleaner disables them if they stay
+	// unused. Other underlays are disabled when their last session closes.
+	warmUnderlays map[Underlay]bool
+
+	// newSessionID returns the ID of a new client session. If it is nil,
+	// the ID is a random number from rand.
+	newSessionID func() uint32
 
 	// ---- server fields ----
-	users map[string]*appctlpb.User
+	users         map[string]*appctlpb.User
+	fallbackUser  *appctlpb.User // nil if there is no fallback user
+	limiter       *userConnLimiter
+	accepts       *acceptRateLimiter // nil if the accept rate is unlimited
+	acl           *addressACL        // nil if all source addresses are allowed
+	proxyProtocol bool
+	shards        int                     // number of listeners per stream endpoint, zero means one
+	acceptWorkers int                     // zero if each underlay has its own accept goroutine
+	preBound      map[string]net.Listener // listeners of endpoints by local address
+	readySessions chan *Session           // shared by the underlays if acceptWorkers is set
+	ready         bool                    // if all the endpoints are bound by Start
+	listenAddrs   []net.Addr              // nil before the endpoints are bound
+	traffic       *userTrafficTable
+	replays       replayCaches
+	onAuth        func(userName string, remoteAddr net.Addr) // nil if not set
+	blockContext  BlockContextFunc                           // nil if the block context only has the user name
+
+	// inputWorkers is the size of inputPool, which processes the
+	// segments of the sessions of all the server underlays. It is zero
+	// if each session has its own input goroutine.
+	inputWorkers int
+	inputPool    *inputPool
+
+	// parked are the sessions of broken underlays waiting to be migrated.
+	parked map[parkedSession]*Session
+
+	memoryPressure  func() bool   // nil if memory pressure is not checked
+	writeBuffer     int           // zero if DefaultSessionWriteBuffer is used
+	compression     Compression   // CompressionNone if compression is disabled
+	dscp            int           // zero if packets are not marked
+	idleTimeout     time.Duration // zero if idle sessions are not closed
+	sockReadBuffer  int           // zero if the OS default is used
+	sockWriteBuffer int           // zero if the OS default is used
 }
 
 var _ net.Listener = &Mux{}
@@ -67,29 +175,71 @@ func NewMux(isClinet bool) *Mux {
 		log.Infof("Initializing server multiplexer")
 	}
 	mux := &Mux{
-		isClient:    isClinet,
-		underlays:   make([]Underlay, 0),
-		chAccept:    make(chan net.Conn, sessionChanCapacity),
-		chAcceptErr: make(chan error, 1), // non-blocking
-		done:        make(chan struct{}),
-		cleaner:     time.NewTicker(idleUnderlayTickerInterval),
+		isClient:     isClinet,
+		underlays:    make([]Underlay, 0),
+		chAccept:     make(chan net.Conn, sessionChanCapacity),
+		chAcceptErr:  make(chan error, 1), // non-blocking
+		done:         make(chan struct{}),
+		draining:     make(chan struct{}),
+		ciphers:      DefaultCipherFactory{},
+		lookupIPAddr: net.DefaultResolver.LookupIPAddr,
+		traffic:      &userTrafficTable{},
 	}
+	return mux
+}
 
-	// Run idle underlay cleaner in the background.
+// markUsed marks the mux as used. The first time, it starts the idle
+// underlay cleaner in the background, unless the cleaner is disabled.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) markUsed() {
+	if m.used {
+		return
+	}
+	m.used = true
+	m.startWarmKeeper()
+	if m.noCleaner {
+		return
+	}
+	m.cleaner = time.NewTimer(cleanerInterval(m.jitter))
 	go func() {
 		for {
 			select {
-			case <-mux.cleaner.C:
-				mux.mu.Lock()
-				mux.cleanUnderlay()
-				mux.mu.Unlock()
-			case <-mux.done:
-				mux.cleaner.Stop()
+			case <-m.cleaner.C:
+				m.mu.Lock()
+				m.cleanUnderlay()
+				m.cleaner.Reset(cleanerInterval(m.jitter))
+				m.mu.Unlock()
+			case <-m.done:
+				m.cleaner.Stop()
 				return
 			}
 		}
 	}()
-	return mux
+}
+
+func (m *Mux) SetSessionIdleTimeout(d time.Duration) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set session idle timeout after mux is used")
+	}
+	m.idleTimeout = mathext.Max(d, 0)
+	m.logf(log.InfoLevel, "Mux session idle timeout is set to %v", m.idleTimeout)
+	return m
+}
+
+func (m *Mux) SetSessionWriteBuffer(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n <= 0 {
+		panic(fmt.Sprintf("Session write buffer %d is not positive", n))
+	}
+	if m.used {
+		panic("Can't set session write buffer after mux is used")
+	}
+	m.writeBuffer = n
+	m.logf(log.InfoLevel, "Mux session write buffer is set to %d bytes", n)
+	return m
 }
 
 func (m *Mux) SetClientPassword(password []byte) *Mux {
@@ -102,6 +252,7 @@ func (m *Mux) SetClientPassword(password []byte) *Mux {
 		panic("Can't set client password after mux is used")
 	}
 	m.password = password
+	m.passwords = nil
 	return m
 }
 
@@ -115,7 +266,68 @@ func (m *Mux) SetClientMultiplexFactor(n int) *Mux {
 		panic("Can't set multiplex factor after mux is used")
 	}
 	m.multiplexFactor = mathext.Max(n, 0)
-	log.Infof("Mux multiplexing factor is set to %d", m.multiplexFactor)
+	m.logf(log.InfoLevel, "Mux multiplexing factor is set to %d", m.multiplexFactor)
+	return m
+}
+
+func (m *Mux) SetMaxSessionsPerUnderlay(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set max sessions per underlay in server mux")
+	}
+	if m.used {
+		panic("Can't set max sessions per underlay after mux is used")
+	}
+	m.maxSessions = mathext.Max(n, 0)
+	m.logf(log.InfoLevel, "Mux max sessions per underlay is set to %d", m.maxSessions)
+	return m
+}
+
+func (m *Mux) SetMaxUnderlays(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set max underlays in server mux")
+	}
+	if m.used {
+		panic("Can't set max underlays after mux is used")
+	}
+	m.maxUnderlays = mathext.Max(n, 0)
+	m.logf(log.InfoLevel, "Mux max underlays is set to %d", m.maxUnderlays)
+	return m
+}
+
+func (m *Mux) SetReplayWindow(window time.Duration) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set replay window in client mux")
+	}
+	if m.used {
+		panic("Can't set replay window after mux is used")
+	}
+	if window <= 0 {
+		panic(fmt.Sprintf("Replay window %v is not positive", window))
+	}
+	m.replays = replayCaches{
+		tcp: replay.NewCache(replayCacheCapacity, window),
+		udp: replay.NewCache(replayCacheCapacity, window),
+	}
+	m.logf(log.InfoLevel, "Mux replay window is set to %v", window)
+	return m
+}
+
+func (m *Mux) SetOnUserAuthenticated(f func(userName string, remoteAddr net.Addr)) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set user authenticated callback in client mux")
+	}
+	if m.used {
+		panic("Can't set user authenticated callback after mux is used")
+	}
+	m.onAuth = f
 	return m
 }
 
@@ -132,6 +344,45 @@ func (m *Mux) SetServerUsers(users map[string]*appctlpb.User) *Mux {
 	return m
 }
 
+func (m *Mux) SetFallbackUser(user *appctlpb.User) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set fallback user in client mux")
+	}
+	if user == nil {
+		panic("Fallback user is nil")
+	}
+	if m.used {
+		panic("Can't set fallback user after mux is used")
+	}
+	m.fallbackUser = user
+	m.logf(log.InfoLevel, "Mux fallback user is set to %q", user.GetName())
+	return m
+}
+
+// UpdateServerUsers replaces the registered users at runtime.
+// Existing sessions keep using their current credentials;
+// only new handshakes use the updated users.
+func (m *Mux) UpdateServerUsers(users map[string]*appctlpb.User) error {
+	if m.isClient {
+		return stderror.ErrInvalidOperation
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("no user found")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users = users
+	for _, underlay := range m.underlays {
+		if udpUnderlay, ok := underlay.(*UDPUnderlay); ok {
+			udpUnderlay.setUsers(users)
+		}
+	}
+	m.logf(log.InfoLevel, "Mux updated %d server users", len(users))
+	return nil
+}
+
 func (m *Mux) SetEndpoints(endpoints []UnderlayProperties) *Mux {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -139,10 +390,20 @@ func (m *Mux) SetEndpoints(endpoints []UnderlayProperties) *Mux {
 		panic("Can't set endpoints after mux is used")
 	}
 	m.endpoints = endpoints
+	m.endpointHealth = newEndpointHealthList(len(endpoints))
+	m.endpointWeights = nil
 	return m
 }
 
+// Accept implements net.Listener interface.
+// It blocks until a new connection is available or the mux is closed.
 func (m *Mux) Accept() (net.Conn, error) {
+	return m.AcceptContext(context.Background())
+}
+
+// AcceptContext is similar to Accept, but it also returns
+// when the context is cancelled or reaches the deadline.
+func (m *Mux) AcceptContext(ctx context.Context) (net.Conn, error) {
 	select {
 	case err := <-m.chAcceptErr:
 		return nil, err
@@ -150,9 +411,14 @@ func (m *Mux) Accept() (net.Conn, error) {
 		return conn, nil
 	case <-m.done:
 		return nil, io.EOF
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 }
 
+// Close closes all the underlays and the mux.
+// All the errors returned from closing underlays are joined together.
+// Calling Close on a closed mux returns nil.
 func (m *Mux) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -163,16 +429,35 @@ func (m *Mux) Close() error {
 	}
 
 	if m.isClient {
-		log.Infof("Closing client multiplexer")
+		m.logf(log.InfoLevel, "Closing client multiplexer")
 	} else {
-		log.Infof("Closing server multiplexer")
+		m.logf(log.InfoLevel, "Closing server multiplexer")
 	}
+	m.closeListeners()
+	var errs []error
 	for _, underlay := range m.underlays {
-		underlay.Close()
+		if err := underlay.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close %v failed: %w", underlay, err))
+		}
 	}
 	m.underlays = make([]Underlay, 0)
+	m.closeParkedSessions()
 	close(m.done)
-	return nil
+	return errors.Join(errs...)
+}
+
+// Done returns a channel that is closed when the mux is closed, either by
+// Close or after Drain. The channel is closed exactly once, and it is never
+// closed if the mux is not closed.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// IsClient returns true if the mux is a client, which creates sessions with
+// DialContext, or false if it is a server, which is started by Start.
+// The role is fixed by NewMux, so no lock is needed.
+func (m *Mux) IsClient() bool {
+	return m.isClient
 }
 
 // Addr is not supported by Mux.
@@ -180,296 +465,735 @@ func (m *Mux) Addr() net.Addr {
 	return util.NilNetAddr()
 }
 
+// MultiplexFactor returns the configured multiplexing factor of the client.
+func (m *Mux) MultiplexFactor() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.multiplexFactor
+}
+
+// UnderlayCount returns the number of underlays that can accept new sessions,
+// and the number of all underlays tracked by the mux, including the ones
+// that are closed but not cleaned yet.
+func (m *Mux) UnderlayCount() (active, total int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.activeUnderlays(nil)), len(m.underlays)
+}
+
+// Underlays returns the underlays that can accept new sessions, e.g. to
+// choose the destination of MigrateSession.
+func (m *Mux) Underlays() []Underlay {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activeUnderlays(nil)
+}
+
+// PendingDials returns the number of DialContext calls that haven't
+// returned, including the ones waiting for another dial to create a
+// underlay, and the ones waiting to retry. A large number indicates a
+// dial storm. The pending counters of the underlay schedulers are not
+// used, because they are only held while the mux is locked.
+func (m *Mux) PendingDials() int {
+	return int(m.dialing.Load())
+}
+
 // Start listens on all the server addresses for incoming connections.
 // Call this method in client results in an error.
-// This method doesn't block.
+// All the endpoints are bound before Start returns, and an error is
+// returned if any of them can't be bound. The underlays are accepted
+// in the background, so this method doesn't block.
 func (m *Mux) Start() error {
 	if m.isClient {
 		return stderror.ErrInvalidOperation
 	}
-	if len(m.users) == 0 {
-		return fmt.Errorf("no user found")
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.checkConfig(); err != nil {
+		return err
 	}
-	if len(m.endpoints) == 0 {
-		return fmt.Errorf("no server listening endpoint found")
+	if m.isStopped() {
+		return fmt.Errorf("mux is closed: %w", io.ErrClosedPipe)
 	}
+	bound := make([]boundEndpoint, 0, len(m.endpoints))
+	listenAddrs := make([]net.Addr, 0, len(m.endpoints))
 	for _, p := range m.endpoints {
-		if util.IsNilNetAddr(p.LocalAddr()) {
-			return fmt.Errorf("endpoint local address is not set")
+		var shards []boundEndpoint
+		var err error
+		if l, ok := m.preBound[p.LocalAddr().String()]; ok {
+			shards = []boundEndpoint{{properties: p, listener: l}}
+		} else {
+			shards, err = bindEndpointShards(p, m.shards)
 		}
+		if err != nil {
+			for _, b := range bound {
+				b.close()
+			}
+			return fmt.Errorf("bind endpoint %v failed: %w", p.LocalAddr(), err)
+		}
+		bound = append(bound, shards...)
+		listenAddrs = append(listenAddrs, shards[0].addr())
 	}
-
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.used = true
-	for _, p := range m.endpoints {
-		go m.acceptUnderlayLoop(p)
+	m.markUsed()
+	m.listenAddrs = listenAddrs
+	m.startAcceptWorkers()
+	m.startSessionInputWorkers()
+	for _, b := range bound {
+		if b.listener != nil {
+			m.listeners = append(m.listeners, b.listener)
+		}
+		go m.acceptUnderlayLoop(b)
 	}
+	m.ready = true
 	return nil
 }
 
 // DialContext returns a network connection for the client to consume.
 // The connection may be a session established from an existing underlay.
 func (m *Mux) DialContext(ctx context.Context) (net.Conn, error) {
-	if !m.isClient {
-		return nil, stderror.ErrInvalidOperation
+	return m.dial(ctx, &dialOptions{endpoint: -1})
+}
+
+// DialContextWithLabel is like DialContext, but the session carries a
+// label that the server reads from Session.Label of the accepted
+// connection, e.g. to route the session by an application tenant ID.
+// The label is sent with the open session request, so it is at most
+// MaxSessionLabelLength bytes.
+func (m *Mux) DialContextWithLabel(ctx context.Context, label string) (net.Conn, error) {
+	if len(label) > MaxSessionLabelLength {
+		return nil, fmt.Errorf("session label of %d bytes exceeds the maximum of %d bytes: %w", len(label), MaxSessionLabelLength, stderror.ErrOutOfRange)
 	}
-	if len(m.password) == 0 {
-		return nil, fmt.Errorf("client password is not set")
+	return m.dial(ctx, &dialOptions{endpoint: -1, label: label})
+}
+
+// DialContextWithEndpoint is like DialContext, but the connection is
+// established only with the server endpoint at endpointIndex, as set by
+// SetEndpoints. Existing underlays of other endpoints are not reused.
+func (m *Mux) DialContextWithEndpoint(ctx context.Context, endpointIndex int) (net.Conn, error) {
+	m.mu.Lock()
+	n := len(m.endpoints)
+	m.mu.Unlock()
+	if endpointIndex < 0 || endpointIndex >= n {
+		return nil, fmt.Errorf("endpoint index %d is out of range [0, %d)", endpointIndex, n)
 	}
-	if len(m.endpoints) == 0 {
-		return nil, fmt.Errorf("no server listening endpoint found")
+	conn, err := m.dial(ctx, &dialOptions{endpoint: endpointIndex})
+	if err != nil {
+		return nil, fmt.Errorf("endpoint %d is unavailable: %w", endpointIndex, err)
 	}
-	for _, p := range m.endpoints {
-		if util.IsNilNetAddr(p.RemoteAddr()) {
-			return nil, fmt.Errorf("endpoint remote address is not set")
+	return conn, nil
+}
+
+// DialContextWithPriority is like DialContext, but the session is created
+// with the priority. See Session.SetPriority.
+func (m *Mux) DialContextWithPriority(ctx context.Context, priority SessionPriority) (net.Conn, error) {
+	if !priority.isValid() {
+		return nil, fmt.Errorf("invalid session priority %d: %w", priority, stderror.ErrInvalidArgument)
+	}
+	conn, err := m.dial(ctx, &dialOptions{endpoint: -1})
+	if err != nil {
+		return nil, err
+	}
+	conn.(*Session).SetPriority(priority)
+	return conn, nil
+}
+
+// DialContextWithRoutingKey is like DialContext, but sessions with the
+// same routing key prefer the underlay used by the last of them, if it can
+// still accept new sessions. For example, a HTTP proxy can use a hash of
+// the destination as the key, so the connections to the same upstream host
+// share a underlay. An empty key has no affinity.
+func (m *Mux) DialContextWithRoutingKey(ctx context.Context, key string) (net.Conn, error) {
+	return m.dial(ctx, &dialOptions{endpoint: -1, routingKey: key})
+}
+
+// dial creates a client session with retry, using the endpoint, label
+// and routing key of opts.
+func (m *Mux) dial(ctx context.Context, opts *dialOptions) (net.Conn, error) {
+	m.dialing.Add(1)
+	defer m.dialing.Add(-1)
+	if err := m.checkClientConfig(); err != nil {
+		return nil, err
+	}
+	if m.isStopped() {
+		return nil, fmt.Errorf("mux is closed: %w", io.ErrClosedPipe)
+	}
+
+	m.mu.Lock()
+	attempts := m.dialAttempts
+	backoff := m.dialBackoff
+	m.mu.Unlock()
+
+	for attempt := 1; ; attempt++ {
+		session, err := m.dialAllEndpoints(ctx, opts)
+		if err == nil {
+			m.onSessionOpen(session)
+			return session, nil
+		}
+		if attempt >= attempts || ctx.Err() != nil {
+			return nil, err
 		}
+		m.logf(log.DebugLevel, "DialContext() attempt %d failed: %v. Retry in %v", attempt, err, backoff)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
 	}
+}
 
+// dialAllEndpoints creates a client session. If the endpoint is not fixed
+// by opts and a underlay can't be created, the other endpoints are tried
+// before giving up, and the errors of all the tried endpoints are returned.
+func (m *Mux) dialAllEndpoints(ctx context.Context, opts *dialOptions) (*Session, error) {
+	m.mu.Lock()
+	n := len(m.endpoints)
+	opts.failedEndpoints = make(map[int]bool)
+	opts.fallbackEndpoints = nil
+	m.mu.Unlock()
+	failedCount := func() int {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return len(opts.failedEndpoints)
+	}
+
+	var errs []error
+	for i := 0; i < n; i++ {
+		session, err := m.dialSession(ctx, opts)
+		if err == nil {
+			return session, nil
+		}
+		errs = append(errs, err)
+		var dialErr *UnderlayDialError
+		if opts.endpoint >= 0 || !errors.As(err, &dialErr) || failedCount() >= n {
+			break
+		}
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+	}
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+	if failed := failedCount(); failed < n {
+		return nil, fmt.Errorf("%d of %d endpoints are unreachable: %w", failed, n, errors.Join(errs...))
+	}
+	return nil, fmt.Errorf("all %d endpoints are unreachable: %w", n, errors.Join(errs...))
+}
+
+// dialOptions controls how a client session is created.
+type dialOptions struct {
+	// endpoint is the index of the only endpoint that can be used.
+	// If it is negative, any endpoint can be used.
+	endpoint int
+
+	// failedEndpoints collects the endpoints that can't be connected.
+	failedEndpoints map[int]bool
+
+	// fallbackEndpoints are tried before the endpoint selection, after
+	// a UDP endpoint failed and transport fallback is enabled.
+	fallbackEndpoints []int
+
+	// loopCtx is the context to run the event loop of new underlays.
+	// If it is nil, the dial context is used.
+	loopCtx context.Context
+
+	// unlocked releases the mu lock while connecting to the server.
+	unlocked bool
+
+	// label is the label of the new session.
+	label string
+
+	// routingKey selects the underlay of the last session with the same key.
+	// If it is empty, there is no affinity.
+	routingKey string
+}
+
+// sessionID returns the ID of a new client session.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) sessionID() uint32 {
+	if m.newSessionID != nil {
+		return m.newSessionID()
+	}
+	return m.rand.Uint32()
+}
+
+// dialSession creates a new client session and attaches it to a underlay.
+func (m *Mux) dialSession(ctx context.Context, opts *dialOptions) (*Session, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	m.used = true
+	m.markUsed()
 	var err error
 
 	// Try to find a underlay for the session.
 	m.cleanUnderlay()
-	underlay := m.maybePickExistingUnderlay()
+	underlay := m.maybePickExistingUnderlay(opts)
 	if underlay == nil {
-		underlay, err = m.newUnderlay(ctx)
+		if m.isMaxUnderlaysReached() {
+			return nil, fmt.Errorf("reached the maximum number of %d underlays: %w", m.maxUnderlays, ErrNoAvailableUnderlay)
+		}
+		underlay, err = m.newUnderlay(ctx, opts)
 		if err != nil {
 			return nil, err
 		}
-		log.Debugf("Created new underlay %v", underlay)
+		m.logEvent(log.DebugLevel, EventUnderlayOpen, underlayFields(underlay), "Created new underlay %v", underlay)
 	} else {
-		log.Debugf("Reusing existing underlay %v", underlay)
+		m.logf(log.DebugLevel, "Reusing existing underlay %v", underlay)
 	}
 
 	if ok := underlay.Scheduler().IncPending(); !ok {
-		// This underlay can't be used. Create a new one.
-		underlay, err = m.newUnderlay(ctx)
-		if err != nil {
-			return nil, err
+		if m.isMaxUnderlaysReached() {
+			// Can't create more underlays. Try all the existing ones.
+			underlay = nil
+			for _, candidate := range m.schedulableUnderlays(opts) {
+				if candidate.Scheduler().IncPending() {
+					underlay = candidate
+					break
+				}
+			}
+			if underlay == nil {
+				return nil, fmt.Errorf("reached the maximum number of %d underlays: %w", m.maxUnderlays, ErrNoAvailableUnderlay)
+			}
+			m.logf(log.DebugLevel, "Reusing another existing underlay %v", underlay)
+		} else {
+			// This underlay can't be used. Create a new one.
+			underlay, err = m.newAcceptingUnderlay(func() (Underlay, error) {
+				u, err := m.newUnderlay(ctx, opts)
+				if err != nil {
+					return nil, err
+				}
+				m.logEvent(log.DebugLevel, EventUnderlayOpen, underlayFields(u), "Created yet another new underlay %v", u)
+				return u, nil
+			})
+			if err != nil {
+				return nil, err
+			}
 		}
-		log.Debugf("Created yet another new underlay %v", underlay)
-		underlay.Scheduler().IncPending()
 	}
 	defer func() {
 		underlay.Scheduler().DecPending()
 	}()
-	session := NewSession(mrand.Uint32(), true, underlay.MTU())
-	if err := underlay.AddSession(session, nil); err != nil {
-		return nil, fmt.Errorf("AddSession() failed: %v", err)
+	var session *Session
+	for attempt := 0; attempt < maxSessionIDAttempts; attempt++ {
+		session = NewSession(m.sessionID(), true, underlay.MTU())
+		session.label = opts.label
+		session.capabilities = m.capabilities()
+		if m.writeBuffer > 0 {
+			session.writeBuffer = m.writeBuffer
+		}
+		if m.migrationBuffer > 0 && sessionUnderlay(underlay).TransportProtocol() == util.TCPTransport {
+			session.resend = newResendBuffer(m.migrationBuffer)
+		}
+		if err = underlay.AddSession(session, nil); !errors.Is(err, stderror.ErrAlreadyExist) {
+			break
+		}
+		m.logf(log.DebugLevel, "Session ID %d is already used in %v, generating a new one", session.id, underlay)
 	}
-	return session, nil
-}
-
-func (m *Mux) acceptUnderlayLoop(properties UnderlayProperties) {
-	laddr := properties.LocalAddr().String()
-	if laddr == "" {
-		m.chAcceptErr <- fmt.Errorf("underlay local address is empty")
-		return
+	if err != nil {
+		UnderlayAddSessionError.Add(1)
 	}
-
-	network := properties.LocalAddr().Network()
-	switch network {
-	case "tcp", "tcp4", "tcp6":
-		listenConfig := net.ListenConfig{
-			Control: sockopts.ReuseAddrPort(),
-		}
-		rawListener, err := listenConfig.Listen(context.Background(), network, laddr)
+	if errors.Is(err, stderror.ErrAlreadyExist) {
+		return nil, fmt.Errorf("no unused session ID found in %v after %d attempts: %w", underlay, maxSessionIDAttempts, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("AddSession() failed: %v", err)
+	}
+	select {
+	case <-underlay.Done():
+		// The underlay was closed before the session is attached.
+		// Move the session to a new underlay instead of failing it.
+		replacement, err := m.newUnderlay(ctx, opts)
 		if err != nil {
-			m.chAcceptErr <- fmt.Errorf("Listen() failed: %w", err)
-			return
+			session.Close()
+			return nil, err
 		}
-		log.Infof("Mux is listening to endpoint %s %s", network, laddr)
-		for {
-			underlay, err := m.acceptTCPUnderlay(rawListener, properties)
-			if err != nil {
-				m.chAcceptErr <- err
-				return
-			}
-			log.Debugf("Created new server underlay %v", underlay)
-			m.mu.Lock()
-			m.underlays = append(m.underlays, underlay)
-			m.cleanUnderlay()
-			m.mu.Unlock()
-			UnderlayPassiveOpens.Add(1)
-			currEst := UnderlayCurrEstablished.Add(1)
-			maxConn := UnderlayMaxConn.Load()
-			if currEst > maxConn {
-				UnderlayMaxConn.Store(currEst)
-			}
+		if err := m.migrateSession(session, replacement); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("migrateSession() failed: %w", err)
+		}
+	default:
+	}
+	m.recordAffinity(opts.routingKey, session.underlay())
+	return session, nil
+}
 
-			go func() {
-				err := underlay.RunEventLoop(context.Background())
-				if err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
-					log.Debugf("%v RunEventLoop(): %v", underlay, err)
-				}
-				underlay.Close()
-			}()
-
-			go func() {
-				for {
-					conn, err := underlay.Accept()
-					if err != nil {
-						if !stderror.IsEOF(err) && !stderror.IsClosed(err) {
-							log.Debugf("%v Accept(): %v", underlay, err)
-						}
-						break
-					}
-					m.chAccept <- conn
-				}
-			}()
+// newAcceptingUnderlay creates underlays with the create function until one
+// of them accepts a new session, up to maxNewUnderlayAttempts times. The
+// pending session count of the returned underlay is increased.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) newAcceptingUnderlay(create func() (Underlay, error)) (Underlay, error) {
+	for attempt := 0; attempt < maxNewUnderlayAttempts; attempt++ {
+		if m.isMaxUnderlaysReached() {
+			return nil, fmt.Errorf("reached the maximum number of %d underlays: %w", m.maxUnderlays, ErrNoAvailableUnderlay)
 		}
-	case "udp", "udp4", "udp6":
-		conn, err := net.ListenUDP(network, properties.LocalAddr().(*net.UDPAddr))
+		underlay, err := create()
 		if err != nil {
-			m.chAcceptErr <- fmt.Errorf("ListenUDP() failed: %w", err)
-			return
+			return nil, err
 		}
-		rawConn, err := conn.SyscallConn()
-		if err != nil {
-			m.chAcceptErr <- fmt.Errorf("SyscallConn() failed: %w", err)
-			return
+		if underlay.Scheduler().IncPending() {
+			return underlay, nil
 		}
-		rawConn.Control(sockopts.ReuseAddrPortRaw())
-		log.Infof("Mux is listening to endpoint %s %s", network, laddr)
+		m.logf(log.DebugLevel, "New underlay %v can't accept a new session", underlay)
+	}
+	return nil, fmt.Errorf("%d new underlays can't accept a new session: %w", maxNewUnderlayAttempts, ErrNoAvailableUnderlay)
+}
+
+// acceptUnderlayLoop accepts underlays from a bound endpoint until the
+// listening socket is closed.
+func (m *Mux) acceptUnderlayLoop(b boundEndpoint) {
+	properties := b.properties
+	if b.udpConn != nil && properties.TransportProtocol() == util.QUICTransport {
+		m.acceptQUICUnderlays(b)
+		return
+	}
+	if b.udpConn != nil {
+		m.markDSCP(b.udpConn)
+		m.applySocketBuffers(b.udpConn)
 		underlay := &UDPUnderlay{
 			baseUnderlay:      *newBaseUnderlay(false, properties.MTU()),
-			conn:              conn,
+			conn:              b.udpConn,
 			idleSessionTicker: time.NewTicker(idleSessionTickerInterval),
-			users:             m.users,
+			ciphers:           m.ciphers,
+			limiter:           m.limiter,
+			traffic:           m.traffic,
+			replays:           m.replays.udp,
+			onAuth:            m.onAuth,
+			capabilities:      m.capabilities(),
+			acl:               m.acl,
+			fallbackUser:      m.fallbackUser,
+			sessionBuffer:     m.udpSessionBuffer,
+			bufferPolicy:      m.udpBufferPolicy,
+			migration:         m.migration,
+			blockContext:      m.blockContext,
 		}
-		log.Infof("Created new server underlay %v", underlay)
+		m.logEvent(log.InfoLevel, EventUnderlayOpen, underlayFields(underlay), "Created new server underlay %v", underlay)
 		m.mu.Lock()
+		underlay.setUsers(m.users)
 		m.underlays = append(m.underlays, underlay)
 		m.cleanUnderlay()
 		m.mu.Unlock()
-		UnderlayPassiveOpens.Add(1)
-		currEst := UnderlayCurrEstablished.Add(1)
-		maxConn := UnderlayMaxConn.Load()
-		if currEst > maxConn {
-			UnderlayMaxConn.Store(currEst)
+		m.serveUnderlay(underlay)
+		return
+	}
+
+	switch properties.TransportProtocol() {
+	case util.WebSocketTransport:
+		m.acceptHandshakeUnderlays(b.listener, properties, m.serverWrapWebSocketConn)
+		return
+	case util.TLSTransport:
+		m.acceptHandshakeUnderlays(b.listener, properties, m.serverWrapTLSConn)
+		return
+	}
+	m.mu.Lock()
+	proxyProtocol := m.proxyProtocol
+	m.mu.Unlock()
+	if proxyProtocol {
+		m.acceptHandshakeUnderlays(b.listener, properties, m.serverWrapProxyProtocolConn)
+		return
+	}
+	for {
+		underlay, err := m.acceptTCPUnderlay(b.listener, properties)
+		if err != nil {
+			if m.isStopped() {
+				return
+			}
+			m.onAcceptLoopError(err)
+			return
 		}
+		m.logEvent(log.DebugLevel, EventUnderlayOpen, underlayFields(underlay), "Created new server underlay %v", underlay)
+		m.mu.Lock()
+		m.underlays = append(m.underlays, underlay)
+		m.cleanUnderlay()
+		m.mu.Unlock()
+		m.serveUnderlay(underlay)
+	}
+}
 
-		go func() {
-			err := underlay.RunEventLoop(context.Background())
-			if err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
-				log.Debugf("%v RunEventLoop(): %v", underlay, err)
+// onAcceptLoopError marks the server not ready, and returns the error
+// of an accept loop from Accept.
+func (m *Mux) onAcceptLoopError(err error) {
+	m.mu.Lock()
+	m.ready = false
+	m.mu.Unlock()
+	m.chAcceptErr <- err
+}
+
+// serveUnderlay runs the event loop of a server underlay, and forwards
+// the sessions accepted by the underlay to the mux. If the accept worker
+// pool is enabled, the sessions are forwarded by the pool instead of
+// a goroutine of the underlay.
+func (m *Mux) serveUnderlay(underlay Underlay) {
+	onUnderlayOpen(underlay.TransportProtocol(), false)
+	m.mu.Lock()
+	pool, inputs := m.readySessions, m.inputPool
+	m.mu.Unlock()
+	sharer, pooled := underlay.(readySessionSharer)
+	pooled = pooled && pool != nil
+	if pooled {
+		sharer.shareReadySessions(pool)
+	}
+	if inputSharer, ok := underlay.(inputPoolSharer); ok && inputs != nil {
+		inputSharer.shareInputPool(inputs)
+	}
+
+	go func() {
+		if m.uObserver != nil {
+			m.uObserver.OnUnderlayOpen(underlay)
+		}
+		err := m.runEventLoop(context.Background(), underlay)
+		if err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
+			m.logf(log.DebugLevel, "%v RunEventLoop(): %v", underlay, err)
+		}
+		if err != nil && !stderror.IsClosed(err) {
+			// The underlay is broken. The clients may migrate the sessions.
+			m.parkSessions(underlay)
+		}
+		m.onUnderlayExit(underlay, err)
+		underlay.Close()
+		if m.uObserver != nil {
+			m.uObserver.OnUnderlayClose(underlay)
+		}
+	}()
+
+	if pooled {
+		return
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				m.onUnderlayPanic(underlay, "Accept", r)
+				underlay.Close()
 			}
-			underlay.Close()
 		}()
+		for {
+			conn, err := underlay.Accept()
+			if err != nil {
+				if !stderror.IsEOF(err) && !stderror.IsClosed(err) {
+					m.logf(log.DebugLevel, "%v Accept(): %v", underlay, err)
+				}
+				break
+			}
+			m.forwardAccepted(conn)
+		}
+	}()
+}
 
+// runEventLoop runs the event loop of the underlay. A panic in the event
+// loop is returned as an error, so only this underlay is closed and the
+// process keeps running.
+func (m *Mux) runEventLoop(ctx context.Context, underlay Underlay) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = m.onUnderlayPanic(underlay, "RunEventLoop", r)
+		}
+	}()
+	return underlay.RunEventLoop(ctx)
+}
+
+// onUnderlayPanic reports a panic recovered from the goroutine of a
+// underlay, and returns it as an error.
+func (m *Mux) onUnderlayPanic(underlay Underlay, where string, r any) error {
+	stack := debug.Stack()
+	fields := withFields(underlayFields(underlay), log.Fields{"where": where, "panic": fmt.Sprint(r), "stack": string(stack)})
+	m.logEvent(log.ErrorLevel, EventUnderlayPanic, fields, "%v %s() panic: %v\n%s", underlay, where, r, stack)
+	return fmt.Errorf("%s() panic: %v: %w", where, r, stderror.ErrInternal)
+}
+
+// acceptHandshakeUnderlays accepts underlays from the listener that need
+// a handshake before the underlay protocol starts, e.g. TLS and WebSocket.
+// The handshakes run in parallel, so a slow client doesn't block others.
+// A TCP endpoint only has a handshake if the PROXY protocol is enabled,
+// so its source address is checked by the ACL after the header is parsed.
+func (m *Mux) acceptHandshakeUnderlays(rawListener net.Listener, properties UnderlayProperties, wrap func(net.Conn, UnderlayProperties) (Underlay, error)) {
+	checkACL := properties.TransportProtocol() != util.TCPTransport
+	for {
+		rawConn, err := m.acceptRawConn(rawListener, checkACL)
+		if err != nil {
+			if m.isStopped() {
+				return
+			}
+			m.onAcceptLoopError(err)
+			return
+		}
 		go func() {
-			for {
-				conn, err := underlay.Accept()
-				if err != nil {
-					if !stderror.IsEOF(err) && !stderror.IsClosed(err) {
-						log.Debugf("%v Accept(): %v", underlay, err)
-					}
-					break
-				}
-				m.chAccept <- conn
+			start := time.Now()
+			underlay, err := wrap(rawConn, properties)
+			if err != nil {
+				m.logf(log.DebugLevel, "Failed to accept %s underlay from %v: %v", transportName(properties.TransportProtocol()), rawConn.RemoteAddr(), err)
+				rawConn.Close()
+				return
 			}
+			m.handshakes.record(time.Since(start))
+			m.logEvent(log.DebugLevel, EventUnderlayOpen, underlayFields(underlay), "Created new server underlay %v", underlay)
+			m.mu.Lock()
+			if m.isStopped() {
+				m.mu.Unlock()
+				rawConn.Close()
+				return
+			}
+			m.underlays = append(m.underlays, underlay)
+			m.cleanUnderlay()
+			m.mu.Unlock()
+			m.serveUnderlay(underlay)
 		}()
-	default:
-		m.chAcceptErr <- fmt.Errorf("unsupported underlay network type %q", network)
+	}
+}
+
+// acceptRawConn accepts the next connection from the listener that is not
+// rate limited. Temporary errors, e.g. running out of file descriptors,
+// are retried with exponential backoff. Other errors are returned.
+// If checkACL is false, the caller checks the source address instead.
+func (m *Mux) acceptRawConn(rawListener net.Listener, checkACL bool) (net.Conn, error) {
+	var backoff time.Duration
+	for {
+		rawConn, err := rawListener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !(netErr.Temporary() || netErr.Timeout()) || m.isStopped() {
+				return nil, fmt.Errorf("Accept() underlay failed: %w", err)
+			}
+			if backoff == 0 {
+				backoff = minAcceptBackoff
+			} else {
+				backoff = mathext.Min(2*backoff, maxAcceptBackoff)
+			}
+			m.logf(log.WarnLevel, "Accept() underlay failed: %v. Retry in %v", err, backoff)
+			timer := time.NewTimer(backoff)
+			select {
+			case <-timer.C:
+			case <-m.draining:
+				timer.Stop()
+			case <-m.done:
+				timer.Stop()
+			}
+			continue
+		}
+		backoff = 0
+		if checkACL && m.dropBlockedByACL(rawConn) {
+			continue
+		}
+		if m.dropRateLimited(rawConn) || m.dropUnderMemoryPressure(rawConn) {
+			continue
+		}
+		m.markDSCP(rawConn)
+		m.applySocketBuffers(rawConn)
+		return rawConn, nil
 	}
 }
 
 func (m *Mux) acceptTCPUnderlay(rawListener net.Listener, properties UnderlayProperties) (Underlay, error) {
-	rawConn, err := rawListener.Accept()
+	rawConn, err := m.acceptRawConn(rawListener, true)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	underlay, err := m.newServerTCPUnderlay(rawConn, properties)
 	if err != nil {
-		return nil, fmt.Errorf("Accept() underlay failed: %w", err)
+		rawConn.Close()
+		return nil, err
 	}
-	return m.serverWrapTCPConn(rawConn, properties.MTU(), m.users), nil
+	m.handshakes.record(time.Since(start))
+	return underlay, nil
+}
+
+// newServerTCPUnderlay returns the server TCP underlay of an accepted
+// connection.
+func (m *Mux) newServerTCPUnderlay(conn net.Conn, properties UnderlayProperties) (Underlay, error) {
+	m.mu.Lock()
+	users := m.users
+	m.mu.Unlock()
+	underlay := m.serverWrapTCPConn(conn, properties.MTU(), users)
+	if err := underlay.(*TCPUnderlay).applyOptions(underlayOptions(properties)); err != nil {
+		return nil, fmt.Errorf("applyOptions() failed: %w", err)
+	}
+	return underlay, nil
 }
 
 func (m *Mux) serverWrapTCPConn(rawConn net.Conn, mtu int, users map[string]*appctlpb.User) Underlay {
-	var err error
 	var blocks []cipher.BlockCipher
 	for _, user := range users {
-		var password []byte
-		password, err = hex.DecodeString(user.GetHashedPassword())
+		blocksFromUser, err := userBlockCiphers(m.ciphers, user, false)
 		if err != nil {
-			log.Debugf("Unable to decode hashed password %q from user %q", user.GetHashedPassword(), user.GetName())
-			continue
-		}
-		if len(password) == 0 {
-			password = cipher.HashPassword([]byte(user.GetPassword()), []byte(user.GetName()))
-		}
-		blocksFromUser, err := cipher.BlockCipherListFromPassword(password, false)
-		if err != nil {
-			log.Debugf("Unable to create block cipher of user %q", user.GetName())
+			m.logf(log.DebugLevel, "%v", err)
 			continue
 		}
+		bc := userBlockContext(user, m.blockContext)
 		for _, block := range blocksFromUser {
-			block.SetBlockContext(cipher.BlockContext{
-				UserName: user.GetName(),
-			})
+			block.SetBlockContext(bc)
 		}
 		blocks = append(blocks, blocksFromUser...)
 	}
+	var fallback []cipher.BlockCipher
+	if m.fallbackUser != nil {
+		var err error
+		if fallback, err = userBlockCiphers(m.ciphers, m.fallbackUser, false); err != nil {
+			m.logf(log.DebugLevel, "%v", err)
+		}
+		bc := userBlockContext(m.fallbackUser, m.blockContext)
+		for _, block := range fallback {
+			block.SetBlockContext(bc)
+		}
+	}
 	return &TCPUnderlay{
 		baseUnderlay: *newBaseUnderlay(false, mtu),
-		conn:         rawConn.(*net.TCPConn),
+		conn:         rawConn,
 		candidates:   blocks,
+		fallback:     fallback,
 		users:        users,
+		limiter:      m.limiter,
+		traffic:      m.traffic,
+		replays:      m.replays.tcp,
+		onAuth:       m.onAuth,
+		capabilities: m.capabilities(),
+		resendLimit:  m.migrationBuffer,
+		rehome:       m.rehomeSession,
 	}
 }
 
-// newUnderlay returns a new underlay.
+// maybePickExistingUnderlay returns either an existing underlay that
+// can be used by a session, or nil. In the later case a new underlay
+// should be created.
 // This method MUST be called only when holding the mu lock.
-func (m *Mux) newUnderlay(ctx context.Context) (Underlay, error) {
-	var underlay Underlay
-	i := mrand.Intn(len(m.endpoints))
-	p := m.endpoints[i]
-	switch p.TransportProtocol() {
-	case util.TCPTransport:
-		block, err := cipher.BlockCipherFromPassword(m.password, false)
-		if err != nil {
-			return nil, fmt.Errorf("cipher.BlockCipherFromPassword() failed: %v", err)
-		}
-		underlay, err = NewTCPUnderlay(ctx, p.RemoteAddr().Network(), "", p.RemoteAddr().String(), p.MTU(), block)
-		if err != nil {
-			return nil, fmt.Errorf("NewTCPUnderlay() failed: %v", err)
-		}
-	case util.UDPTransport:
-		block, err := cipher.BlockCipherFromPassword(m.password, true)
-		if err != nil {
-			return nil, fmt.Errorf("cipher.BlockCipherFromPassword() failed: %v", err)
-		}
-		underlay, err = NewUDPUnderlay(ctx, p.RemoteAddr().Network(), "", p.RemoteAddr().String(), p.MTU(), block)
-		if err != nil {
-			return nil, fmt.Errorf("NewUDPUnderlay() failed: %v", err)
+func (m *Mux) maybePickExistingUnderlay(opts *dialOptions) Underlay {
+	active := m.schedulableUnderlays(opts)
+	if len(active) == 0 {
+		return nil
+	}
+	if opts != nil {
+		if underlay := m.affinityUnderlay(opts.routingKey, active); underlay != nil {
+			return underlay
 		}
-	default:
-		return nil, fmt.Errorf("unsupport transport protocol %v", p.TransportProtocol())
 	}
-	m.underlays = append(m.underlays, underlay)
-	UnderlayActiveOpens.Add(1)
-	currEst := UnderlayCurrEstablished.Add(1)
-	maxConn := UnderlayMaxConn.Load()
-	if currEst > maxConn {
-		UnderlayMaxConn.Store(currEst)
+	if m.isMaxUnderlaysReached() {
+		return active[m.rand.Intn(len(active))]
 	}
-	go func() {
-		err := underlay.RunEventLoop(ctx)
-		if err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
-			log.Debugf("%v RunEventLoop(): %v", underlay, err)
-		}
-		underlay.Close()
-	}()
-	return underlay, nil
+	if m.underMemoryPressure() {
+		// Avoid the memory of a new underlay.
+		return LeastPendingSelector{}.Select(active)
+	}
+
+	selector := m.selector
+	if selector == nil {
+		selector = MultiplexFactorSelector{Factor: m.multiplexFactor, rand: &m.rand}
+	}
+	return selector.Select(active)
 }
 
-// maybePickExistingUnderlay returns either an existing underlay that
-// can be used by a session, or nil. In the later case a new underlay
-// should be created.
+// activeUnderlays returns the underlays that are not closed
+// and can accept new sessions. If opts restricts the endpoint,
+// only underlays connected to that endpoint are returned.
+// The underlays are sorted by their creation order, so the selection
+// is reproducible with a seeded random source.
 // This method MUST be called only when holding the mu lock.
-func (m *Mux) maybePickExistingUnderlay() Underlay {
+func (m *Mux) activeUnderlays(opts *dialOptions) []Underlay {
 	active := make([]Underlay, 0)
 	for _, underlay := range m.underlays {
+		if opts != nil && opts.endpoint >= 0 && !m.isUnderlayOfEndpoint(underlay, m.endpoints[opts.endpoint]) {
+			continue
+		}
 		select {
 		case <-underlay.Done():
 		default:
@@ -478,15 +1202,66 @@ func (m *Mux) maybePickExistingUnderlay() Underlay {
 			}
 		}
 	}
+	sortUnderlays(active)
+	return active
+}
 
-	if m.multiplexFactor > 0 {
-		reuseUnderlayFactor := len(active) * m.multiplexFactor
-		n := mrand.Intn(reuseUnderlayFactor + 1)
-		if n < reuseUnderlayFactor {
-			return active[n/m.multiplexFactor]
+// idleTracker is a underlay that knows how long it has had no session.
+type idleTracker interface {
+	idleTime() time.Duration
+}
+
+// identifiedUnderlay is a underlay with an ID of the creation order.
+type identifiedUnderlay interface {
+	underlayID() uint64
+}
+
+// sortUnderlays sorts the underlays by their IDs. Underlays without
+// an ID are put after the others, in the original order.
+func sortUnderlays(underlays []Underlay) {
+	id := func(u Underlay) uint64 {
+		if i, ok := u.(identifiedUnderlay); ok {
+			return i.underlayID()
 		}
+		return math.MaxUint64
 	}
-	return nil
+	sort.SliceStable(underlays, func(i, j int) bool {
+		return id(underlays[i]) < id(underlays[j])
+	})
+}
+
+// schedulableUnderlays returns the active underlays that have not
+// reached the maximum number of sessions.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) schedulableUnderlays(opts *dialOptions) []Underlay {
+	active := m.activeUnderlays(opts)
+	if m.maxSessions <= 0 {
+		return active
+	}
+	res := make([]Underlay, 0, len(active))
+	for _, underlay := range active {
+		if sessionCount(underlay) < m.maxSessions {
+			res = append(res, underlay)
+		}
+	}
+	return res
+}
+
+// isMaxUnderlaysReached returns true if no more underlay can be created.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) isMaxUnderlaysReached() bool {
+	if m.maxUnderlays <= 0 {
+		return false
+	}
+	live := 0
+	for _, underlay := range m.underlays {
+		select {
+		case <-underlay.Done():
+		default:
+			live++
+		}
+	}
+	return live >= m.maxUnderlays
 }
 
 // cleanUnderlay removes closed underlays.
@@ -494,11 +1269,24 @@ func (m *Mux) maybePickExistingUnderlay() Underlay {
 func (m *Mux) cleanUnderlay() {
 	remaining := make([]Underlay, 0)
 	cnt := 0
+	warm := len(m.activeUnderlays(nil))
 	for _, underlay := range m.underlays {
 		select {
 		case <-underlay.Done():
 		default:
+			if m.warmUnderlays[underlay] {
+				if sessionCount(underlay) > 0 {
+					delete(m.warmUnderlays, underlay)
+				} else if warm > m.minWarm {
+					// Warm underlays that are never used also become
+					// idle, unless they are kept warm.
+					if !underlay.Scheduler().IsDisabled() && underlay.Scheduler().TryDisable() {
+						warm--
+					}
+				}
+			}
 			if underlay.Scheduler().Idle() {
+				m.logEvent(log.DebugLevel, EventUnderlayClose, withFields(underlayFields(underlay), log.Fields{"reason": "idle"}), "")
 				underlay.Close()
 				cnt++
 			} else {
@@ -507,7 +1295,22 @@ func (m *Mux) cleanUnderlay() {
 		}
 	}
 	m.underlays = remaining
+	for underlay := range m.underlayEndpoints {
+		select {
+		case <-underlay.Done():
+			delete(m.underlayEndpoints, underlay)
+		default:
+		}
+	}
+	for underlay := range m.warmUnderlays {
+		select {
+		case <-underlay.Done():
+			delete(m.warmUnderlays, underlay)
+		default:
+		}
+	}
+	m.cleanAffinity()
 	if cnt > 0 {
-		log.Debugf("Mux cleaned %d underlays", cnt)
+		m.logf(log.DebugLevel, "Mux cleaned %d underlays", cnt)
 	}
 }
@@ -18,16 +18,22 @@ package protocolv2
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	mrand "math/rand"
 	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/enfein/mieru/pkg/appctl/appctlpb"
 	"github.com/enfein/mieru/pkg/cipher"
 	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
 	"github.com/enfein/mieru/pkg/testtool"
 	"github.com/enfein/mieru/pkg/util"
 	"google.golang.org/protobuf/proto"
@@ -151,6 +157,35 @@ func TestIPv6TCPUnderlay(t *testing.T) {
 	}
 }
 
+func TestUnixSocketUnderlay(t *testing.T) {
+	log.SetOutputToTest(t)
+	log.SetLevel("DEBUG")
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "mieru.sock"), Net: "unix"}
+	serverProperties := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, addr, nil)
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{serverProperties})
+	testServer := testtool.NewTestHelperServer()
+
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("[%s] Start() failed: %v", time.Now().Format(testtool.TimeLayout), err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	go func() {
+		if err := testServer.Serve(serverMux); err != nil {
+			t.Errorf("[%s] Serve() failed: %v", time.Now().Format(testtool.TimeLayout), err)
+		}
+	}()
+	defer testServer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	clientProperties := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, addr)
+	runClient(t, clientProperties, []byte("xiaochitang"), []byte("kuiranbudong"), 4)
+	if err := serverMux.Close(); err != nil {
+		t.Errorf("Server mux close failed: %v", err)
+	}
+}
+
 func TestIPv4UDPUnderlay(t *testing.T) {
 	log.SetOutputToTest(t)
 	log.SetLevel("DEBUG")
@@ -214,3 +249,835 @@ func TestIPv6UDPUnderlay(t *testing.T) {
 		t.Errorf("Server mux close failed: %v", err)
 	}
 }
+
+func TestAcceptContext(t *testing.T) {
+	mux := NewMux(false)
+	defer mux.Close()
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelFunc()
+	if _, err := mux.AcceptContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AcceptContext() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	mux.Close()
+	if _, err := mux.AcceptContext(context.Background()); err != io.EOF {
+		t.Errorf("AcceptContext() after Close() returned %v, want %v", err, io.EOF)
+	}
+}
+
+// startTestServer starts a server mux which runs a ROT13 service.
+// The options are applied to the server mux before it starts.
+// It returns the server mux and the client endpoint to connect to it.
+func startTestServer(t testing.TB, transport util.TransportProtocol, opts ...func(*Mux)) (*Mux, UnderlayProperties) {
+	t.Helper()
+	serverMux, clientProperties := startTestMux(t, transport, opts...)
+	testServer := testtool.NewTestHelperServer()
+	go testServer.Serve(serverMux)
+	t.Cleanup(func() {
+		testServer.Close()
+	})
+	time.Sleep(100 * time.Millisecond)
+	return serverMux, clientProperties
+}
+
+// startTestMux starts a server mux without serving the accepted sessions.
+// It returns the mux and the endpoint that a client can connect to.
+func startTestMux(t testing.TB, transport util.TransportProtocol, opts ...func(*Mux)) (*Mux, UnderlayProperties) {
+	t.Helper()
+	var serverProperties, clientProperties UnderlayProperties
+	switch transport {
+	case util.TCPTransport:
+		port, err := util.UnusedTCPPort()
+		if err != nil {
+			t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+		}
+		addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+		serverProperties = NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, addr, nil)
+		clientProperties = NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, addr)
+	case util.UDPTransport:
+		port, err := util.UnusedUDPPort()
+		if err != nil {
+			t.Fatalf("util.UnusedUDPPort() failed: %v", err)
+		}
+		addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+		serverProperties = NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, addr, nil)
+		clientProperties = NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, nil, addr)
+	default:
+		t.Fatalf("unsupported transport protocol %v", transport)
+	}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{serverProperties})
+	for _, opt := range opts {
+		opt(serverMux)
+	}
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		serverMux.Close()
+	})
+	return serverMux, clientProperties
+}
+
+// newTestClient returns a client mux that connects to the endpoint.
+func newTestClient(endpoint UnderlayProperties) *Mux {
+	return NewMux(true).
+		SetClientPassword(cipher.HashPassword([]byte("kuiranbudong"), []byte("xiaochitang"))).
+		SetEndpoints([]UnderlayProperties{endpoint})
+}
+
+// acceptTestSession writes to the client session, so the server opens
+// its end, and returns the session accepted by the server mux.
+func acceptTestSession(t testing.TB, serverMux *Mux, conn net.Conn) *Session {
+	t.Helper()
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := serverMux.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		t.Cleanup(func() { c.Close() })
+		return c.(*Session)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("server mux doesn't accept the session")
+		return nil
+	}
+}
+
+// rot13RoundTrip writes a payload to the connection and verifies the ROT13 response.
+func rot13RoundTrip(t testing.TB, conn net.Conn, size int) {
+	t.Helper()
+	payload := testtool.TestHelperGenRot13Input(size)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v", err)
+	}
+	rot13, err := testtool.TestHelperRot13(resp)
+	if err != nil {
+		t.Fatalf("TestHelperRot13() failed: %v", err)
+	}
+	if !bytes.Equal(payload, rot13) {
+		t.Fatalf("Received unexpected response")
+	}
+}
+
+func TestMuxDone(t *testing.T) {
+	mux := NewMux(true)
+	select {
+	case <-mux.Done():
+		t.Fatalf("Done() is closed before Close()")
+	default:
+	}
+	if err := mux.Close(); err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+	select {
+	case <-mux.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Done() is not closed after Close()")
+	}
+	// Close again doesn't close the channel twice.
+	if err := mux.Close(); err != nil {
+		t.Errorf("second Close() failed: %v", err)
+	}
+}
+
+func TestMuxIsClient(t *testing.T) {
+	if !NewMux(true).IsClient() {
+		t.Errorf("IsClient() = false for client mux")
+	}
+	if NewMux(false).IsClient() {
+		t.Errorf("IsClient() = true for server mux")
+	}
+}
+
+func TestUnderlayCount(t *testing.T) {
+	mux := NewMux(true).SetClientMultiplexFactor(2)
+	defer mux.Close()
+	if got := mux.MultiplexFactor(); got != 2 {
+		t.Errorf("MultiplexFactor() = %d, want 2", got)
+	}
+
+	active := newFakeUnderlay(true)
+	disabled := newFakeUnderlay(true)
+	disabled.Scheduler().lastScheduleTime = time.Now().Add(-scheduleIdleTime - time.Second)
+	if !disabled.Scheduler().TryDisable() {
+		t.Fatalf("TryDisable() failed")
+	}
+	closed := newFakeUnderlay(true)
+	closed.Close()
+	mux.mu.Lock()
+	mux.underlays = []Underlay{active, disabled, closed}
+	mux.mu.Unlock()
+	UnderlayCurrEstablished.Add(3)
+	if a, total := mux.UnderlayCount(); a != 1 || total != 3 {
+		t.Errorf("UnderlayCount() = (%d, %d), want (1, 3)", a, total)
+	}
+}
+
+// newDisabledFakeUnderlay returns a fake client underlay that can't accept
+// new sessions.
+func newDisabledFakeUnderlay(t *testing.T) *fakeUnderlay {
+	t.Helper()
+	u := newFakeUnderlay(true)
+	u.Scheduler().lastScheduleTime = time.Now().Add(-scheduleIdleTime - time.Second)
+	if !u.Scheduler().TryDisable() {
+		t.Fatalf("TryDisable() failed")
+	}
+	return u
+}
+
+func TestNewAcceptingUnderlay(t *testing.T) {
+	mux := NewMux(true)
+	defer mux.Close()
+
+	created := 0
+	mux.mu.Lock()
+	_, err := mux.newAcceptingUnderlay(func() (Underlay, error) {
+		created++
+		return newDisabledFakeUnderlay(t), nil
+	})
+	mux.mu.Unlock()
+	if !errors.Is(err, ErrNoAvailableUnderlay) {
+		t.Errorf("newAcceptingUnderlay() error = %v, want %v", err, ErrNoAvailableUnderlay)
+	}
+	if created != maxNewUnderlayAttempts {
+		t.Errorf("created %d underlays, want %d", created, maxNewUnderlayAttempts)
+	}
+
+	created = 0
+	mux.mu.Lock()
+	u, err := mux.newAcceptingUnderlay(func() (Underlay, error) {
+		created++
+		if created == 1 {
+			return newDisabledFakeUnderlay(t), nil
+		}
+		return newFakeUnderlay(true), nil
+	})
+	mux.mu.Unlock()
+	if err != nil {
+		t.Fatalf("newAcceptingUnderlay() failed: %v", err)
+	}
+	if created != 2 || u.Scheduler().Pending() != 1 {
+		t.Errorf("got %d created underlays and %d pending sessions, want 2 and 1", created, u.Scheduler().Pending())
+	}
+}
+
+func TestDialNoAvailableUnderlay(t *testing.T) {
+	mux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})).
+		SetMaxUnderlays(1)
+	defer mux.Close()
+	mux.underlays = append(mux.underlays, newDisabledFakeUnderlay(t))
+	UnderlayCurrEstablished.Add(1)
+	if _, err := mux.DialContext(context.Background()); !errors.Is(err, ErrNoAvailableUnderlay) {
+		t.Errorf("DialContext() error = %v, want %v", err, ErrNoAvailableUnderlay)
+	}
+}
+
+// firstWriteConn records the data of the first Write call.
+type firstWriteConn struct {
+	net.Conn
+	mu    sync.Mutex
+	first []byte
+}
+
+func (c *firstWriteConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.first == nil {
+		c.first = append([]byte{}, b...)
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestReplayDropped(t *testing.T) {
+	serverMux, endpoint := startTestMux(t, util.TCPTransport, func(m *Mux) {
+		m.SetReplayWindow(time.Minute)
+	})
+	var recorder *firstWriteConn
+	clientMux := newTestClient(endpoint).SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+		conn, err := defaultDial(ctx, network, localAddr, remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		recorder = &firstWriteConn{Conn: conn}
+		return recorder, nil
+	})
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	// The original handshake is accepted.
+	acceptTestSession(t, serverMux, conn)
+	conn.Close()
+	recorder.mu.Lock()
+	handshake := recorder.first
+	recorder.mu.Unlock()
+
+	before := UnderlayReplayDropped.Load()
+	attacker, err := net.Dial("tcp", endpoint.RemoteAddr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer attacker.Close()
+	if _, err := attacker.Write(handshake); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	// The server reads some data before it closes the connection.
+	go attacker.Write(make([]byte, 64*1024))
+	attacker.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadAll(attacker); err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("connection with replayed handshake is not dropped")
+		}
+	}
+	if got := UnderlayReplayDropped.Load(); got != before+1 {
+		t.Errorf("UnderlayReplayDropped = %d, want %d", got, before+1)
+	}
+}
+
+func TestSessionIDCollision(t *testing.T) {
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+
+	// The second dial gets the session ID of the first dial once, and then
+	// a new one.
+	clientMux := newTestClient(endpoint).SetUnderlaySelector(LeastPendingSelector{})
+	defer clientMux.Close()
+	ids := []uint32{12345, 12345, 67890}
+	clientMux.newSessionID = func() uint32 {
+		id := ids[0]
+		ids = ids[1:]
+		return id
+	}
+	first, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer first.Close()
+	second, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer second.Close()
+	if first.(*Session).ID() != 12345 || second.(*Session).ID() != 67890 {
+		t.Errorf("session IDs are %d and %d, want 12345 and 67890", first.(*Session).ID(), second.(*Session).ID())
+	}
+	// The server opens both sessions with the IDs.
+	for _, conn := range []net.Conn{first, second} {
+		want := conn.(*Session).ID()
+		if got := acceptTestSession(t, serverMux, conn).ID(); got != want {
+			t.Errorf("server session ID is %d, want %d", got, want)
+		}
+	}
+
+	// The session ID is always the same.
+	stuck := newTestClient(endpoint).SetUnderlaySelector(LeastPendingSelector{})
+	defer stuck.Close()
+	stuck.newSessionID = func() uint32 { return 12345 }
+	conn, err := stuck.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := stuck.DialContext(context.Background()); !errors.Is(err, stderror.ErrAlreadyExist) {
+		t.Errorf("DialContext() returned %v, want %v", err, stderror.ErrAlreadyExist)
+	}
+}
+
+func TestMaxSessionsPerUnderlay(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint).
+		SetUnderlaySelector(LeastPendingSelector{}).
+		SetMaxSessionsPerUnderlay(2)
+	defer clientMux.Close()
+
+	sessions := make([]*Session, 0)
+	for i := 0; i < 3; i++ {
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		defer conn.Close()
+		sessions = append(sessions, conn.(*Session))
+	}
+	if sessions[0].underlay() != sessions[1].underlay() {
+		t.Errorf("the first 2 sessions are scheduled to different underlays")
+	}
+	if sessions[2].underlay() == sessions[0].underlay() {
+		t.Errorf("session 3 is scheduled to a full underlay")
+	}
+	if _, total := clientMux.UnderlayCount(); total != 2 {
+		t.Errorf("got %d underlays, want 2", total)
+	}
+}
+
+func TestFallbackUser(t *testing.T) {
+	fallbackUser := &appctlpb.User{
+		Name:     proto.String("jiuming"),
+		Password: proto.String("pojingerchu"),
+	}
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport, func(m *Mux) { m.SetFallbackUser(fallbackUser) })
+
+			// A server user is authenticated by the primary ciphers.
+			before := UnderlayFallbackAuth.Load()
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			if got := acceptTestSession(t, serverMux, conn).User(); got != "xiaochitang" {
+				t.Errorf("User() = %q, want %q", got, "xiaochitang")
+			}
+			if got := UnderlayFallbackAuth.Load() - before; got != 0 {
+				t.Errorf("server user is authenticated as fallback user %d times", got)
+			}
+
+			// The fallback user is authenticated only after the primary ciphers fail.
+			fallbackMux := NewMux(true).
+				SetClientPassword(cipher.HashPassword([]byte(fallbackUser.GetPassword()), []byte(fallbackUser.GetName()))).
+				SetEndpoints([]UnderlayProperties{endpoint})
+			defer fallbackMux.Close()
+			fallbackConn, err := fallbackMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer fallbackConn.Close()
+			if got := acceptTestSession(t, serverMux, fallbackConn).User(); got != fallbackUser.GetName() {
+				t.Errorf("User() = %q, want %q", got, fallbackUser.GetName())
+			}
+			if got := UnderlayFallbackAuth.Load() - before; got != 1 {
+				t.Errorf("fallback user is authenticated %d times, want 1", got)
+			}
+		})
+	}
+}
+
+func TestMaxUnderlays(t *testing.T) {
+	log.SetOutputToTest(t)
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint).SetMaxUnderlays(2)
+	defer clientMux.Close()
+
+	var wg sync.WaitGroup
+	conns := make(chan net.Conn, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Errorf("DialContext() failed: %v", err)
+				return
+			}
+			conns <- conn
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	defer func() {
+		for conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	// All the sessions share the underlays.
+	if n := len(clientMux.Stats()); n > 2 {
+		t.Errorf("got %d underlays, want at most 2", n)
+	}
+	if n := len(clientMux.Sessions()); n != 8 {
+		t.Errorf("got %d sessions, want 8", n)
+	}
+}
+
+func TestUpdateServerUsers(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestServer(t, util.TCPTransport)
+	inflightMux := newTestClient(endpoint)
+	defer inflightMux.Close()
+	inflight, err := inflightMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer inflight.Close()
+	rot13RoundTrip(t, inflight, 64)
+
+	// Revoke the existing user and add a new user.
+	if err := serverMux.UpdateServerUsers(map[string]*appctlpb.User{
+		"dahuangya": {
+			Name:     proto.String("dahuangya"),
+			Password: proto.String("yanjingbufang"),
+		},
+	}); err != nil {
+		t.Fatalf("UpdateServerUsers() failed: %v", err)
+	}
+
+	// The in-flight session survives.
+	rot13RoundTrip(t, inflight, 64)
+
+	// New connection from the revoked user fails.
+	revokedMux := newTestClient(endpoint)
+	defer revokedMux.Close()
+	revoked, err := revokedMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer revoked.Close()
+	if _, err := revoked.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	revoked.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if _, err := revoked.Read(make([]byte, 5)); err == nil {
+		t.Errorf("Read() from revoked user succeeded, want error")
+	}
+
+	// New connection from the new user succeeds.
+	newMux := NewMux(true).
+		SetClientPassword(cipher.HashPassword([]byte("yanjingbufang"), []byte("dahuangya"))).
+		SetEndpoints([]UnderlayProperties{endpoint})
+	defer newMux.Close()
+	conn, err := newMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	rot13RoundTrip(t, conn, 64)
+}
+
+// fakeUnderlay is a underlay without network connection.
+type fakeUnderlay struct {
+	baseUnderlay
+	closeErr error
+}
+
+func newFakeUnderlay(isClient bool) *fakeUnderlay {
+	return &fakeUnderlay{baseUnderlay: *newBaseUnderlay(isClient, 1500)}
+}
+
+func (f *fakeUnderlay) Close() error {
+	f.closeMutex.Lock()
+	defer f.closeMutex.Unlock()
+	f.baseUnderlay.Close()
+	return f.closeErr
+}
+
+// panicUnderlay is a underlay that panics in the event loop or in Accept.
+type panicUnderlay struct {
+	fakeUnderlay
+	panicInAccept bool
+}
+
+func (p *panicUnderlay) RunEventLoop(ctx context.Context) error {
+	if !p.panicInAccept {
+		panic("bad segment")
+	}
+	<-p.done
+	return nil
+}
+
+func (p *panicUnderlay) Accept() (net.Conn, error) {
+	if p.panicInAccept {
+		panic("bad session")
+	}
+	return p.fakeUnderlay.Accept()
+}
+
+func TestUnderlayPanicRecovery(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+	for _, panicInAccept := range []bool{false, true} {
+		underlay := &panicUnderlay{fakeUnderlay: *newFakeUnderlay(false), panicInAccept: panicInAccept}
+		UnderlayCurrEstablished.Add(1)
+		serverMux.serveUnderlay(underlay)
+		select {
+		case <-underlay.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("underlay is not closed after panic in Accept = %v", panicInAccept)
+		}
+	}
+
+	// The mux still accepts sessions from other underlays.
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	acceptTestSession(t, serverMux, conn)
+	if isDone(serverMux.Done()) {
+		t.Errorf("server mux is closed after underlay panic")
+	}
+}
+
+func TestMuxCloseJoinErrors(t *testing.T) {
+	errA := errors.New("error A")
+	errB := errors.New("error B")
+	underlays := []*fakeUnderlay{newFakeUnderlay(true), newFakeUnderlay(true), newFakeUnderlay(true)}
+	underlays[0].closeErr = errA
+	underlays[2].closeErr = errB
+
+	mux := NewMux(true)
+	for _, underlay := range underlays {
+		UnderlayCurrEstablished.Add(1)
+		mux.underlays = append(mux.underlays, underlay)
+	}
+	err := mux.Close()
+	if !errors.Is(err, errA) || !errors.Is(err, errB) {
+		t.Errorf("Close() returned %v, want both %v and %v", err, errA, errB)
+	}
+	for i, underlay := range underlays {
+		select {
+		case <-underlay.Done():
+		default:
+			t.Errorf("underlay %d is not closed", i)
+		}
+	}
+	if err := mux.Close(); err != nil {
+		t.Errorf("second Close() returned %v, want nil", err)
+	}
+}
+
+// temporaryError is a net.Error that is temporary.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails Accept with temporary errors before accepting a
+// connection from the wrapped listener.
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, temporaryError{}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptTemporaryError(t *testing.T) {
+	rawListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() failed: %v", err)
+	}
+	listener := &flakyListener{Listener: rawListener}
+	listener.failures.Store(3)
+	serverMux := NewMux(false).SetServerUsers(users)
+	defer serverMux.Close()
+	if !serverMux.addListener(listener) {
+		t.Fatalf("addListener() failed")
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", rawListener.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	properties := NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, rawListener.Addr(), nil)
+	underlay, err := serverMux.acceptTCPUnderlay(listener, properties)
+	if err != nil {
+		t.Fatalf("acceptTCPUnderlay() failed after temporary errors: %v", err)
+	}
+	underlay.Close()
+
+	// A permanent error is returned.
+	rawListener.Close()
+	if _, err := serverMux.acceptTCPUnderlay(listener, properties); err == nil {
+		t.Errorf("acceptTCPUnderlay() succeeded with a closed listener")
+	}
+}
+
+func TestDialContextWithLabel(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			var serverProperties UnderlayProperties
+			if transport == util.TCPTransport {
+				addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}
+				serverProperties = NewUnderlayProperties(1500, util.IPVersion4, transport, addr, nil)
+			} else {
+				addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1")}
+				serverProperties = NewUnderlayProperties(1500, util.IPVersion4, transport, addr, nil)
+			}
+			serverMux := NewMux(false).
+				SetServerUsers(users).
+				SetEndpoints([]UnderlayProperties{serverProperties})
+			if err := serverMux.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer serverMux.Close()
+			clientProperties := NewUnderlayProperties(1500, util.IPVersion4, transport, nil, serverMux.ListeningAddrs()[0])
+			clientMux := newTestClient(clientProperties)
+			defer clientMux.Close()
+
+			if _, err := clientMux.DialContextWithLabel(context.Background(), strings.Repeat("x", MaxSessionLabelLength+1)); !errors.Is(err, stderror.ErrOutOfRange) {
+				t.Errorf("DialContextWithLabel() with a long label returned %v, want %v", err, stderror.ErrOutOfRange)
+			}
+			conn, err := clientMux.DialContextWithLabel(context.Background(), "tenant-42")
+			if err != nil {
+				t.Fatalf("DialContextWithLabel() failed: %v", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			serverConn, err := serverMux.Accept()
+			if err != nil {
+				t.Fatalf("Accept() failed: %v", err)
+			}
+			defer serverConn.Close()
+			if got := serverConn.(*Session).Label(); got != "tenant-42" {
+				t.Errorf("server Label() = %q, want %q", got, "tenant-42")
+			}
+		})
+	}
+}
+
+func TestPendingDials(t *testing.T) {
+	log.SetOutputToTest(t)
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	release := make(chan struct{})
+	clientMux := newTestClient(endpoint).
+		SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+			<-release
+			var d net.Dialer
+			return d.DialContext(ctx, network, remoteAddr)
+		})
+	defer clientMux.Close()
+	if n := clientMux.PendingDials(); n != 0 {
+		t.Errorf("PendingDials() = %d before dial, want 0", n)
+	}
+
+	const dials = 3
+	var wg sync.WaitGroup
+	for i := 0; i < dials; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Errorf("DialContext() failed: %v", err)
+				return
+			}
+			conn.Close()
+		}()
+	}
+	deadline := time.Now().Add(time.Second)
+	for clientMux.PendingDials() != dials && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := clientMux.PendingDials(); n != dials {
+		t.Errorf("PendingDials() = %d while the dialer is blocked, want %d", n, dials)
+	}
+	close(release)
+	wg.Wait()
+	if n := clientMux.PendingDials(); n != 0 {
+		t.Errorf("PendingDials() = %d after dials return, want 0", n)
+	}
+}
+
+func TestDeterministicUnderlayOrder(t *testing.T) {
+	underlays := []Underlay{newFakeUnderlay(true), newFakeUnderlay(true), newFakeUnderlay(true)}
+	orders := [][]int{{0, 1, 2}, {2, 0, 1}, {1, 2, 0}}
+	var want []Underlay
+	for _, order := range orders {
+		clientMux := NewMux(true).SetMaxUnderlays(len(underlays)).SetRandSource(mrand.NewSource(7))
+		for _, i := range order {
+			clientMux.underlays = append(clientMux.underlays, underlays[i])
+		}
+		clientMux.mu.Lock()
+		active := clientMux.activeUnderlays(nil)
+		for i := range active {
+			if active[i] != underlays[i] {
+				t.Errorf("order %v: active underlay %d is not sorted by creation", order, i)
+			}
+		}
+		var picks []Underlay
+		for i := 0; i < 10; i++ {
+			picks = append(picks, clientMux.maybePickExistingUnderlay(&dialOptions{endpoint: -1}))
+		}
+		clientMux.mu.Unlock()
+		if want == nil {
+			want = picks
+		} else if !reflect.DeepEqual(picks, want) {
+			t.Errorf("order %v: picked underlays are different with the same random source", order)
+		}
+	}
+}
+
+// dialTestClients connects n clients to the endpoint, each with its own
+// underlay. The clients are closed when the test finishes.
+func dialTestClients(t testing.TB, endpoint UnderlayProperties, n int) []net.Conn {
+	t.Helper()
+	conns := make([]net.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		clientMux := newTestClient(endpoint)
+		t.Cleanup(func() { clientMux.Close() })
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+func TestOnUserAuthenticated(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			var mu sync.Mutex
+			var names []string
+			var addrs []net.Addr
+			serverMux, endpoint := startTestMux(t, transport, func(m *Mux) {
+				m.SetOnUserAuthenticated(func(userName string, remoteAddr net.Addr) {
+					mu.Lock()
+					defer mu.Unlock()
+					names = append(names, userName)
+					addrs = append(addrs, remoteAddr)
+				})
+			})
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			acceptTestSession(t, serverMux, conn)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(names) != 1 || names[0] != "xiaochitang" {
+				t.Fatalf("authenticated users are %v, want [xiaochitang]", names)
+			}
+			// The client may listen to a wildcard address.
+			_, gotPort, _ := net.SplitHostPort(addrs[0].String())
+			_, wantPort, _ := net.SplitHostPort(conn.LocalAddr().String())
+			if gotPort != wantPort {
+				t.Errorf("authenticated remote address is %v, want port of %v", addrs[0], conn.LocalAddr())
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package muxsignal runs a server mux until the process receives a
+// termination signal. It is kept out of package protocolv2, so the core
+// doesn't depend on os/signal.
+package muxsignal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/protocolv2"
+)
+
+// RunWithSignalHandling starts the server mux and blocks until it is shut
+// down. On the first SIGINT or SIGTERM, the mux stops accepting new
+// underlays and sessions, and drains the existing sessions. A second
+// signal or the end of ctx closes the mux without waiting for the sessions,
+// and the returned error wraps context.Canceled or the context error. If
+// ctx is done before any signal, the mux is closed immediately. The caller
+// still needs to call Accept of the mux to serve the sessions.
+func RunWithSignalHandling(ctx context.Context, m *protocolv2.Mux) error {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	return run(ctx, m, signals)
+}
+
+// run implements RunWithSignalHandling with the signals from the channel.
+func run(ctx context.Context, m *protocolv2.Mux, signals <-chan os.Signal) error {
+	if err := m.Start(); err != nil {
+		return fmt.Errorf("Start() failed: %w", err)
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Infof("Context is done, closing server multiplexer")
+		return m.Close()
+	case <-m.Done():
+		return nil
+	case sig := <-signals:
+		log.Infof("Received signal %v, draining server multiplexer", sig)
+	}
+
+	drainCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Infof("Received signal %v, closing server multiplexer", sig)
+			cancel()
+		case <-drainCtx.Done():
+		}
+	}()
+	return m.Drain(drainCtx)
+}
@@ -0,0 +1,187 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package muxsignal
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/appctl/appctlpb"
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/protocolv2"
+	"github.com/enfein/mieru/pkg/util"
+	"google.golang.org/protobuf/proto"
+)
+
+var users = map[string]*appctlpb.User{
+	"xiaochitang": {
+		Name:     proto.String("xiaochitang"),
+		Password: proto.String("kuiranbudong"),
+	},
+}
+
+// newTestMuxPair returns a server mux that is not started, and a client
+// mux connecting to it.
+func newTestMuxPair(t *testing.T) (*protocolv2.Mux, *protocolv2.Mux) {
+	t.Helper()
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	serverMux := protocolv2.NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]protocolv2.UnderlayProperties{protocolv2.NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, addr, nil)})
+	clientMux := protocolv2.NewMux(true).
+		SetClientPassword(cipher.HashPassword([]byte("kuiranbudong"), []byte("xiaochitang"))).
+		SetEndpoints([]protocolv2.UnderlayProperties{protocolv2.NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, addr)})
+	t.Cleanup(func() {
+		clientMux.Close()
+		serverMux.Close()
+	})
+	return serverMux, clientMux
+}
+
+func TestRunDrainOnSignal(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, clientMux := newTestMuxPair(t)
+	signals := make(chan os.Signal, 2)
+	result := make(chan error, 1)
+	go func() {
+		result <- run(context.Background(), serverMux, signals)
+	}()
+
+	// Open a session, so the drain waits for it.
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = clientMux.DialContext(context.Background()); err == nil {
+			if _, err = conn.Write([]byte("hello")); err == nil {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	accepted, err := serverMux.Accept()
+	if err != nil {
+		t.Fatalf("Accept() failed: %v", err)
+	}
+
+	signals <- syscall.SIGTERM
+	select {
+	case err := <-result:
+		t.Fatalf("run() returned %v before the session is finished", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	if serverMux.Ready() {
+		t.Errorf("server is ready while draining")
+	}
+
+	// The drain completes after the session is closed.
+	accepted.Close()
+	conn.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("run() returned %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run() is not returned after the session is closed")
+	}
+	select {
+	case <-serverMux.Done():
+	default:
+		t.Errorf("server mux is not closed")
+	}
+}
+
+func TestRunForceCloseOnSecondSignal(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, clientMux := newTestMuxPair(t)
+	signals := make(chan os.Signal, 2)
+	result := make(chan error, 1)
+	go func() {
+		result <- run(context.Background(), serverMux, signals)
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = clientMux.DialContext(context.Background()); err == nil {
+			if _, err = conn.Write([]byte("hello")); err == nil {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if _, err := serverMux.Accept(); err != nil {
+		t.Fatalf("Accept() failed: %v", err)
+	}
+
+	signals <- syscall.SIGINT
+	signals <- syscall.SIGINT
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("run() returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run() is not returned after the second signal")
+	}
+	select {
+	case <-serverMux.Done():
+	default:
+		t.Errorf("server mux is not closed")
+	}
+}
+
+func TestRunContextDone(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, _ := newTestMuxPair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- run(ctx, serverMux, make(chan os.Signal))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("run() returned %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("run() is not returned after the context is done")
+	}
+
+	// Start fails on a closed mux.
+	if err := run(context.Background(), serverMux, make(chan os.Signal)); err == nil {
+		t.Errorf("run() succeeded with a closed mux")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// SessionObserver receives notifications of session lifecycle events.
+// The callbacks are not called while holding the mux lock, so it is safe
+// to call mux methods from the callbacks.
+type SessionObserver interface {
+	// OnSessionOpen is called when a session is created by DialContext,
+	// or when a session is accepted by the server.
+	OnSessionOpen(s *Session)
+
+	// OnSessionClose is called when the session is terminated.
+	// err is nil if the session is closed normally.
+	OnSessionClose(s *Session, err error)
+}
+
+// UnderlayObserver receives notifications when underlays are opened
+// and closed, e.g. to account for the file descriptors used by the mux.
+// The callbacks are not called while holding the mux lock.
+type UnderlayObserver interface {
+	// OnUnderlayOpen is called when a underlay is created by the client,
+	// or accepted by the server.
+	OnUnderlayOpen(u Underlay)
+
+	// OnUnderlayClose is called after the underlay is closed.
+	OnUnderlayClose(u Underlay)
+}
+
+func (m *Mux) SetSessionObserver(observer SessionObserver) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set session observer after mux is used")
+	}
+	m.observer = observer
+	return m
+}
+
+func (m *Mux) SetUnderlayObserver(observer UnderlayObserver) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set underlay observer after mux is used")
+	}
+	m.uObserver = observer
+	return m
+}
+
+// onSessionOpen notifies the session observer that a new session is opened,
+// and notifies it again when the session is closed.
+// This method MUST NOT be called when holding the mu lock.
+func (m *Mux) onSessionOpen(session *Session) {
+	if m.logger != nil {
+		fields := log.Fields{
+			"session_id": session.id,
+			"client":     session.isClient,
+		}
+		if conn := session.underlay(); conn != nil {
+			fields = withFields(fields, underlayFields(conn))
+		}
+		m.logger.LogEvent(log.DebugLevel, EventSessionOpen, fields)
+	}
+	if m.idleTimeout > 0 {
+		session.closeWhenIdle(m.idleTimeout, m.logf)
+	}
+	if m.sessionRate > 0 {
+		session.setRateLimit(m.sessionRate)
+	}
+	if m.observer == nil {
+		return
+	}
+	m.observer.OnSessionOpen(session)
+	go func() {
+		<-session.done
+		m.observer.OnSessionClose(session, session.closeError())
+	}()
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// recordingObserver records session lifecycle events.
+type recordingObserver struct {
+	mux    *Mux
+	mu     sync.Mutex
+	opened map[uint32]bool
+	closed map[uint32]bool
+}
+
+func newRecordingObserver() *recordingObserver {
+	return &recordingObserver{
+		opened: make(map[uint32]bool),
+		closed: make(map[uint32]bool),
+	}
+}
+
+func (o *recordingObserver) OnSessionOpen(s *Session) {
+	if o.mux != nil {
+		o.mux.Stats() // must not deadlock
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.opened[s.ID()] = true
+}
+
+func (o *recordingObserver) OnSessionClose(s *Session, err error) {
+	if o.mux != nil {
+		o.mux.Stats() // must not deadlock
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed[s.ID()] = true
+}
+
+func (o *recordingObserver) counts() (opened, closed int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.opened), len(o.closed)
+}
+
+func (o *recordingObserver) state(id uint32) (opened, closed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.opened[id], o.closed[id]
+}
+
+func TestSessionObserver(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverObserver := newRecordingObserver()
+	serverMux, endpoint := startTestMux(t, util.TCPTransport, func(m *Mux) {
+		serverObserver.mux = m
+		m.SetSessionObserver(serverObserver)
+	})
+	clientObserver := newRecordingObserver()
+	clientMux := newTestClient(endpoint)
+	clientObserver.mux = clientMux
+	clientMux.SetSessionObserver(clientObserver)
+	defer clientMux.Close()
+
+	var clientIDs, serverIDs []uint32
+	for i := 0; i < 2; i++ {
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		serverSession := acceptTestSession(t, serverMux, conn)
+		clientID := conn.(*Session).ID()
+		if opened, closed := clientObserver.state(clientID); !opened || closed {
+			t.Errorf("client session %d: opened = %v, closed = %v, want opened only", clientID, opened, closed)
+		}
+		if opened, closed := serverObserver.state(serverSession.ID()); !opened || closed {
+			t.Errorf("server session %d: opened = %v, closed = %v, want opened only", serverSession.ID(), opened, closed)
+		}
+		clientIDs = append(clientIDs, clientID)
+		serverIDs = append(serverIDs, serverSession.ID())
+		conn.Close()
+	}
+
+	allClosed := func(o *recordingObserver, ids []uint32) bool {
+		for _, id := range ids {
+			if _, closed := o.state(id); !closed {
+				return false
+			}
+		}
+		return true
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if allClosed(clientObserver, clientIDs) && allClosed(serverObserver, serverIDs) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !allClosed(clientObserver, clientIDs) || !allClosed(serverObserver, serverIDs) {
+		t.Errorf("close of client sessions %v or server sessions %v is not observed", clientIDs, serverIDs)
+	}
+	clientOpened, _ := clientObserver.counts()
+	serverOpened, _ := serverObserver.counts()
+	if clientOpened != 2 || serverOpened != 2 {
+		t.Errorf("client opened %d, server opened %d, want 2", clientOpened, serverOpened)
+	}
+}
+
+type recordingUnderlayObserver struct {
+	mux    *Mux
+	mu     sync.Mutex
+	opened map[Underlay]bool
+	closed map[Underlay]bool
+}
+
+func newRecordingUnderlayObserver() *recordingUnderlayObserver {
+	return &recordingUnderlayObserver{
+		opened: make(map[Underlay]bool),
+		closed: make(map[Underlay]bool),
+	}
+}
+
+func (o *recordingUnderlayObserver) OnUnderlayOpen(u Underlay) {
+	if o.mux != nil {
+		o.mux.UnderlayCount() // must not deadlock
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.opened[u] = true
+}
+
+func (o *recordingUnderlayObserver) OnUnderlayClose(u Underlay) {
+	if o.mux != nil {
+		o.mux.UnderlayCount() // must not deadlock
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.opened[u] {
+		panic("underlay is closed before it is opened")
+	}
+	o.closed[u] = true
+}
+
+func (o *recordingUnderlayObserver) counts() (opened, closed int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.opened), len(o.closed)
+}
+
+func TestUnderlayObserver(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		serverObserver := newRecordingUnderlayObserver()
+		serverMux, endpoint := startTestMux(t, transport, func(m *Mux) {
+			serverObserver.mux = m
+			m.SetUnderlayObserver(serverObserver)
+		})
+		clientObserver := newRecordingUnderlayObserver()
+		clientMux := newTestClient(endpoint)
+		clientObserver.mux = clientMux
+		clientMux.SetUnderlayObserver(clientObserver)
+
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		acceptTestSession(t, serverMux, conn)
+		for _, u := range clientMux.Underlays() {
+			clientObserver.mu.Lock()
+			opened := clientObserver.opened[u]
+			clientObserver.mu.Unlock()
+			if !opened {
+				t.Errorf("%v: open of client underlay %v is not observed", transport, u)
+			}
+		}
+		conn.Close()
+		clientMux.Close()
+		serverMux.Close()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			clientOpened, clientClosed := clientObserver.counts()
+			serverOpened, serverClosed := serverObserver.counts()
+			if clientOpened == 1 && clientClosed == 1 && serverOpened == 1 && serverClosed == 1 {
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		clientOpened, clientClosed := clientObserver.counts()
+		serverOpened, serverClosed := serverObserver.counts()
+		if clientOpened != 1 || clientClosed != 1 || serverOpened != 1 || serverClosed != 1 {
+			t.Errorf("%v: client opened %d closed %d, server opened %d closed %d, want all 1", transport, clientOpened, clientClosed, serverOpened, serverClosed)
+		}
+	}
+}
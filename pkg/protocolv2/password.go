@@ -0,0 +1,190 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+const (
+	// passwordProbeTimeout is the maximum time to wait for the server to
+	// answer the probe of a client password.
+	passwordProbeTimeout = 3 * time.Second
+
+	// passwordProbeInterval is the time between two probes of a client
+	// password, in case a UDP probe is lost.
+	passwordProbeInterval = 500 * time.Millisecond
+)
+
+// passwordProber is a client underlay that can check if the server
+// accepts its password.
+type passwordProber interface {
+	Underlay
+
+	// probe sends a segment that the server answers if it can decrypt it.
+	probe() error
+
+	// receivedSegment returns a channel that is closed after a segment
+	// is decrypted from the server.
+	receivedSegment() <-chan struct{}
+}
+
+var (
+	_ passwordProber = &TCPUnderlay{}
+	_ passwordProber = &UDPUnderlay{}
+)
+
+// newProbeSegment returns an ack of the reserved session ID 0.
+// No session uses this ID, so a server that can decrypt the segment
+// requests the client to close the session, and nothing else changes.
+func newProbeSegment(u Underlay) *segment {
+	return &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{
+				protocol: uint8(ackClientToServer),
+			},
+		},
+		transport: u.TransportProtocol(),
+	}
+}
+
+func (t *TCPUnderlay) probe() error {
+	return t.writeOneSegment(newProbeSegment(t))
+}
+
+func (u *UDPUnderlay) probe() error {
+	return u.writeOneSegment(newProbeSegment(u), u.serverAddr)
+}
+
+// newUnderlay creates a client underlay. If there are multiple client
+// passwords, they are tried in order, starting from the last password
+// accepted by the server, until the server answers a probe. The mu lock
+// is released while the underlay is probed. Only the accepted underlay is
+// added to the mux and recorded to the handshake and endpoint statistics.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) newUnderlay(ctx context.Context, opts *dialOptions) (Underlay, error) {
+	if len(m.passwords) <= 1 {
+		d, err := m.dialUnderlay(ctx, opts, m.password)
+		if err != nil {
+			return nil, err
+		}
+		if !m.needsFallbackProbe(d, opts) {
+			return m.openUnderlay(d, nil), nil
+		}
+		loopErr, err := m.probeUnderlay(ctx, d)
+		if err != nil {
+			return nil, m.onProbeFailure(d, opts, err)
+		}
+		return m.openUnderlay(d, loopErr), nil
+	}
+	var errs []error
+	var last *dialedUnderlay
+	for k := 0; k < len(m.passwords); k++ {
+		i := (m.passwordIndex + k) % len(m.passwords)
+		d, err := m.dialUnderlay(ctx, opts, m.passwords[i])
+		if err != nil {
+			// The server is not reachable. Another password doesn't help.
+			return nil, err
+		}
+		loopErr, err := m.probeUnderlay(ctx, d)
+		if err != nil {
+			m.logf(log.DebugLevel, "Client password %d is not accepted by %v: %v", i, d.underlay, err)
+			errs = append(errs, fmt.Errorf("password %d: %w", i, err))
+			last = d
+			continue
+		}
+		if i != m.passwordIndex {
+			m.logf(log.InfoLevel, "Mux switched to client password %d", i)
+			m.passwordIndex = i
+		}
+		return m.openUnderlay(d, loopErr), nil
+	}
+	err := fmt.Errorf("none of the %d client passwords is accepted by the server: %w", len(m.passwords), errors.Join(errs...))
+	if last != nil && m.needsFallbackProbe(last, opts) {
+		// A wrong password and a blocked UDP port look the same.
+		return nil, m.onProbeFailure(last, opts, err)
+	}
+	return nil, err
+}
+
+// probeUnderlay starts the event loop of a dialed underlay, and probes
+// the server without holding the mu lock. The underlay is closed if the
+// probe fails. Otherwise the returned channel is passed to openUnderlay.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) probeUnderlay(ctx context.Context, d *dialedUnderlay) (<-chan error, error) {
+	loopErr := m.goEventLoop(d)
+	m.mu.Unlock()
+	err := probePassword(ctx, d.underlay)
+	m.mu.Lock()
+	if err != nil {
+		d.underlay.Close()
+		return nil, err
+	}
+	return loopErr, nil
+}
+
+// probePassword returns nil if the server can decrypt the data
+// from the underlay.
+func probePassword(ctx context.Context, underlay Underlay) error {
+	prober, ok := underlay.(passwordProber)
+	if !ok {
+		return nil
+	}
+	timeout := time.NewTimer(passwordProbeTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(passwordProbeInterval)
+	defer ticker.Stop()
+	for {
+		if err := prober.probe(); err != nil {
+			return fmt.Errorf("probe() failed: %w", err)
+		}
+		select {
+		case <-prober.receivedSegment():
+			return nil
+		case <-underlay.Done():
+			return fmt.Errorf("underlay is closed")
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("no response from the server after %v", passwordProbeTimeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Mux) SetClientPasswords(passwords [][]byte) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set client passwords in server mux")
+	}
+	if m.used {
+		panic("Can't set client passwords after mux is used")
+	}
+	if len(passwords) == 0 {
+		panic("Client passwords are empty")
+	}
+	m.password = passwords[0]
+	m.passwords = append([][]byte(nil), passwords...)
+	m.passwordIndex = 0
+	m.logf(log.InfoLevel, "Mux client passwords are set to %d passwords", len(passwords))
+	return m
+}
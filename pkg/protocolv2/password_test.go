@@ -0,0 +1,80 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestClientPasswordRotation(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport)
+			clientMux := newTestClient(endpoint).SetClientPasswords([][]byte{
+				cipher.HashPassword([]byte("wrong"), []byte("xiaochitang")),
+				cipher.HashPassword([]byte("kuiranbudong"), []byte("xiaochitang")),
+			})
+			defer clientMux.Close()
+			type dialResult struct {
+				conn net.Conn
+				err  error
+			}
+			dialed := make(chan dialResult, 1)
+			go func() {
+				conn, err := clientMux.DialContext(context.Background())
+				dialed <- dialResult{conn, err}
+			}()
+
+			// The mux is not locked while the wrong password is probed.
+			time.Sleep(100 * time.Millisecond)
+			start := time.Now()
+			clientMux.UnderlayCount()
+			if d := time.Since(start); d > passwordProbeTimeout/2 {
+				t.Errorf("UnderlayCount() is blocked for %v by the password probe", d)
+			}
+
+			r := <-dialed
+			if r.err != nil {
+				t.Fatalf("DialContext() failed: %v", r.err)
+			}
+			conn := r.conn
+			defer conn.Close()
+			acceptTestSession(t, serverMux, conn)
+			clientMux.mu.Lock()
+			index := clientMux.passwordIndex
+			clientMux.mu.Unlock()
+			if index != 1 {
+				t.Errorf("accepted password index is %d, want 1", index)
+			}
+
+			// Only the underlay of the accepted password is recorded.
+			if _, total := clientMux.UnderlayCount(); total != 1 {
+				t.Errorf("got %d underlays, want 1", total)
+			}
+			if n := clientMux.HandshakeDuration().Count; n != 1 {
+				t.Errorf("got %d handshakes, want 1", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/mathext"
+)
+
+const (
+	// minUDPPathMTU is the conservative MTU used before any probe succeeds.
+	minUDPPathMTU = 1280
+
+	// maxUDPPathMTU is the largest MTU that can be probed.
+	// It must not exceed the read buffer size of UDP underlay.
+	maxUDPPathMTU = 1500
+
+	// pathMTUProbeGranularity stops the search when the distance between
+	// the confirmed MTU and the failed MTU is not larger than this value.
+	pathMTUProbeGranularity = 8
+
+	// maxPathMTUProbeAttempts is the number of probes sent with the same size
+	// before that size is considered not working.
+	maxPathMTUProbeAttempts = 3
+)
+
+var (
+	// pathMTUProbeInterval is the time to wait for a probe response.
+	pathMTUProbeInterval = 2 * time.Second
+
+	// pathMTURaiseInterval is the time to wait before probing a larger MTU
+	// after the search is completed.
+	pathMTURaiseInterval = 10 * time.Minute
+)
+
+// pathMTUDiscovery finds the largest MTU working between the client and
+// the server. It does a binary search between a conservative MTU and the
+// configured MTU.
+//
+// A probe is a data segment with a random unused session ID, sent with the
+// don't fragment bit. The server doesn't know the session and replies with a
+// close session request, which confirms the probe is delivered. If probes are
+// dropped by the network, the conservative MTU is used.
+type pathMTUDiscovery struct {
+	mu sync.Mutex
+
+	start   int // conservative MTU
+	max     int // configured MTU
+	current int // largest MTU known working
+	ceiling int // smallest MTU known not working
+
+	probeID       uint32 // session ID of the probe in flight
+	probeMTU      int    // MTU of the probe in flight, 0 if no probe
+	probeAttempts int
+	nextRaise     time.Time
+}
+
+func newPathMTUDiscovery(mtu int) *pathMTUDiscovery {
+	max := mathext.Min(mtu, maxUDPPathMTU)
+	start := mathext.Min(minUDPPathMTU, max)
+	return &pathMTUDiscovery{
+		start:   start,
+		max:     max,
+		current: start,
+		ceiling: max + 1,
+	}
+}
+
+// mtu returns the largest MTU known working.
+func (p *pathMTUDiscovery) mtu() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current
+}
+
+// nextProbe returns the session ID and MTU of the next probe.
+// It returns 0 MTU if there is nothing to probe.
+// isUsed reports whether a session ID is already used by the underlay.
+func (p *pathMTUDiscovery) nextProbe(now time.Time, isUsed func(uint32) bool) (uint32, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.probeMTU != 0 {
+		// The previous probe is not confirmed.
+		if p.probeAttempts < maxPathMTUProbeAttempts {
+			p.probeAttempts++
+			return p.probeID, p.probeMTU
+		}
+		p.ceiling = p.probeMTU
+		p.probeMTU = 0
+	}
+	if p.ceiling-p.current <= pathMTUProbeGranularity {
+		if p.nextRaise.IsZero() {
+			p.nextRaise = now.Add(pathMTURaiseInterval)
+		}
+		if now.Before(p.nextRaise) {
+			return 0, 0
+		}
+		// The path may have changed. Search again.
+		p.ceiling = p.max + 1
+		p.nextRaise = time.Time{}
+		if p.ceiling-p.current <= pathMTUProbeGranularity {
+			return 0, 0
+		}
+	}
+
+	p.probeID = 0
+	for p.probeID == 0 || isUsed(p.probeID) {
+		p.probeID = mrand.Uint32()
+	}
+	p.probeMTU = (p.current + p.ceiling) / 2
+	p.probeAttempts = 1
+	return p.probeID, p.probeMTU
+}
+
+// onProbeResponse returns true if the session ID belongs to the probe in
+// flight. The MTU of the probe is confirmed.
+func (p *pathMTUDiscovery) onProbeResponse(sessionID uint32) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.probeMTU == 0 || sessionID != p.probeID {
+		return false
+	}
+	if p.probeMTU > p.current {
+		p.current = p.probeMTU
+	}
+	p.probeMTU = 0
+	return true
+}
+
+// onMessageTooLong is called when a packet with the given MTU can't be sent
+// because it is larger than the path MTU known by the operating system.
+func (p *pathMTUDiscovery) onMessageTooLong(mtu int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if mtu < p.ceiling {
+		p.ceiling = mtu
+	}
+	if p.current >= p.ceiling {
+		p.current = mathext.Min(p.start, p.ceiling-1)
+	}
+	if p.probeMTU >= p.ceiling {
+		p.probeMTU = 0
+	}
+	p.nextRaise = time.Time{}
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/testtool"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func neverUsed(uint32) bool { return false }
+
+func TestPathMTUDiscoverySearch(t *testing.T) {
+	p := newPathMTUDiscovery(1400)
+	if p.mtu() != minUDPPathMTU {
+		t.Fatalf("initial mtu() = %d, want %d", p.mtu(), minUDPPathMTU)
+	}
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		id, mtu := p.nextProbe(now, neverUsed)
+		if mtu == 0 {
+			break
+		}
+		if mtu > 1400 {
+			t.Fatalf("probe MTU %d is larger than configured MTU", mtu)
+		}
+		if !p.onProbeResponse(id) {
+			t.Fatalf("onProbeResponse() = false, want true")
+		}
+	}
+	if got := p.mtu(); got < 1400-pathMTUProbeGranularity || got > 1400 {
+		t.Errorf("mtu() = %d, want close to 1400", got)
+	}
+	if _, mtu := p.nextProbe(now, neverUsed); mtu != 0 {
+		t.Errorf("nextProbe() returned MTU %d after search is completed", mtu)
+	}
+	if _, mtu := p.nextProbe(now.Add(pathMTURaiseInterval+time.Second), neverUsed); mtu != 0 {
+		t.Errorf("nextProbe() returned MTU %d when current MTU is already the maximum", mtu)
+	}
+}
+
+func TestPathMTUDiscoveryBlocked(t *testing.T) {
+	p := newPathMTUDiscovery(1500)
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if _, mtu := p.nextProbe(now, neverUsed); mtu == 0 {
+			break
+		}
+	}
+	if p.mtu() != minUDPPathMTU {
+		t.Errorf("mtu() = %d, want %d when all probes are dropped", p.mtu(), minUDPPathMTU)
+	}
+	if p.onProbeResponse(12345) {
+		t.Errorf("onProbeResponse() = true with unknown session ID")
+	}
+}
+
+func TestPathMTUDiscoveryMessageTooLong(t *testing.T) {
+	p := newPathMTUDiscovery(1500)
+	now := time.Now()
+	id, mtu := p.nextProbe(now, neverUsed)
+	p.onProbeResponse(id)
+	if p.mtu() != mtu {
+		t.Fatalf("mtu() = %d, want %d", p.mtu(), mtu)
+	}
+	p.onMessageTooLong(mtu - 10)
+	if p.mtu() != minUDPPathMTU {
+		t.Errorf("mtu() = %d, want %d after message too long", p.mtu(), minUDPPathMTU)
+	}
+	if _, next := p.nextProbe(now, neverUsed); next >= mtu-10 {
+		t.Errorf("nextProbe() = %d, want less than %d", next, mtu-10)
+	}
+}
+
+func TestPathMTUDiscoveryProbeID(t *testing.T) {
+	p := newPathMTUDiscovery(1500)
+	calls := 0
+	isUsed := func(id uint32) bool {
+		calls++
+		return calls < 3
+	}
+	id, _ := p.nextProbe(time.Now(), isUsed)
+	if id == 0 {
+		t.Errorf("probe session ID must not be 0")
+	}
+	if calls != 3 {
+		t.Errorf("isUsed() is called %d times, want 3", calls)
+	}
+}
+
+func TestUDPUnderlayPathMTUDiscovery(t *testing.T) {
+	savedInterval := pathMTUProbeInterval
+	pathMTUProbeInterval = 20 * time.Millisecond
+	defer func() { pathMTUProbeInterval = savedInterval }()
+
+	serverMux, endpoint := startTestMux(t, util.UDPTransport)
+	endpoint = NewUnderlayPropertiesWithOptions(1400, endpoint.IPVersion(), endpoint.TransportProtocol(), nil, endpoint.RemoteAddr(), UnderlayOptions{
+		UDPPathMTUDiscovery: true,
+	})
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	serverSession := acceptTestSession(t, serverMux, conn)
+	if _, err := io.ReadFull(serverSession, make([]byte, 5)); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v", err)
+	}
+
+	clientMux.mu.Lock()
+	underlay := clientMux.underlays[0].(*UDPUnderlay)
+	clientMux.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for underlay.PathMTU() < 1400-pathMTUProbeGranularity && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := underlay.PathMTU(); got < 1400-pathMTUProbeGranularity || got > 1400 {
+		t.Errorf("PathMTU() = %d, want close to 1400", got)
+	}
+
+	// Segments of the discovered size are delivered.
+	payload := testtool.TestHelperGenRot13Input(4096)
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(serverSession, got); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("server received unexpected data")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"sync"
+)
+
+// SessionPriority is a hint of how urgent the data of a session is.
+// When sessions share an underlay, the segments of a session with a
+// higher priority are written to the underlay before the segments of
+// sessions with a lower priority that are waiting at the same time.
+// The priority is local to one side of the session, and it isn't sent
+// to the peer.
+//
+// The priority is strict. All the segments of a session use its priority,
+// including the ACKs, so a high priority session that saturates the
+// underlay also delays the ACKs of the lower priority sessions. The peer
+// of such a session stops sending when its window is full, and over UDP
+// it resends the data that is not acknowledged in time.
+type SessionPriority int8
+
+const (
+	// PriorityLow is for bulk transfers that can yield to other sessions.
+	PriorityLow SessionPriority = -1
+
+	// PriorityNormal is the default priority.
+	PriorityNormal SessionPriority = 0
+
+	// PriorityHigh is for interactive sessions that are sensitive to
+	// latency.
+	PriorityHigh SessionPriority = 1
+)
+
+func (p SessionPriority) String() string {
+	switch p {
+	case PriorityLow:
+		return "LOW"
+	case PriorityNormal:
+		return "NORMAL"
+	case PriorityHigh:
+		return "HIGH"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// isValid returns true if p is one of the defined priorities.
+func (p SessionPriority) isValid() bool {
+	return p >= PriorityLow && p <= PriorityHigh
+}
+
+// prioritySendLock is a mutex that is granted to the waiter with the
+// highest priority. Waiters with the same priority are not ordered.
+// A steady stream of high priority writes can starve lower priority
+// writes, including their ACKs. See SessionPriority.
+// The zero value is an unlocked lock.
+type prioritySendLock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	busy    bool
+	waiting [PriorityHigh - PriorityLow + 1]int
+}
+
+// Lock acquires the lock with the normal priority.
+func (l *prioritySendLock) Lock() {
+	l.lockWithPriority(PriorityNormal)
+}
+
+// lockWithPriority acquires the lock with the priority.
+func (l *prioritySendLock) lockWithPriority(p SessionPriority) {
+	if !p.isValid() {
+		p = PriorityNormal
+	}
+	i := int(p - PriorityLow)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mu)
+	}
+	l.waiting[i]++
+	for l.busy || l.higherWaiting(i) {
+		l.cond.Wait()
+	}
+	l.waiting[i]--
+	l.busy = true
+}
+
+// Unlock releases the lock.
+func (l *prioritySendLock) Unlock() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.busy {
+		panic("prioritySendLock is not locked")
+	}
+	l.busy = false
+	if l.cond != nil {
+		l.cond.Broadcast()
+	}
+}
+
+// higherWaiting returns true if a waiter has a higher priority than the
+// priority at index i. The caller must hold mu.
+func (l *prioritySendLock) higherWaiting(i int) bool {
+	for j := i + 1; j < len(l.waiting); j++ {
+		if l.waiting[j] > 0 {
+			return true
+		}
+	}
+	return false
+}
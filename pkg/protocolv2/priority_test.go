@@ -0,0 +1,228 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestPrioritySendLock(t *testing.T) {
+	var l prioritySendLock
+	l.Lock()
+
+	// Low priority waiters queue up before a high priority waiter.
+	var mu sync.Mutex
+	var order []SessionPriority
+	var wg sync.WaitGroup
+	acquire := func(p SessionPriority) {
+		defer wg.Done()
+		l.lockWithPriority(p)
+		mu.Lock()
+		order = append(order, p)
+		mu.Unlock()
+		l.Unlock()
+	}
+	waiting := func(p SessionPriority, n int) {
+		for i := 0; i < 100; i++ {
+			l.mu.Lock()
+			got := l.waiting[p-PriorityLow]
+			l.mu.Unlock()
+			if got == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		t.Fatalf("waiters of priority %v are not blocked", p)
+	}
+	wg.Add(4)
+	for i := 0; i < 3; i++ {
+		go acquire(PriorityLow)
+	}
+	waiting(PriorityLow, 3)
+	go acquire(PriorityHigh)
+	waiting(PriorityHigh, 1)
+
+	l.Unlock()
+	wg.Wait()
+	if len(order) != 4 || order[0] != PriorityHigh {
+		t.Errorf("lock is acquired in order %v, want %v first", order, PriorityHigh)
+	}
+}
+
+// sizeRecorderConn records the size of each write to the connection
+// while recording is enabled.
+type sizeRecorderConn struct {
+	net.Conn
+	mu        sync.Mutex
+	recording bool
+	sizes     []int
+}
+
+func (c *sizeRecorderConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if c.recording {
+		c.sizes = append(c.sizes, len(b))
+	}
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *sizeRecorderConn) record() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recording = true
+	c.sizes = nil
+}
+
+// firstSize returns the size of the first write since record is called.
+func (c *sizeRecorderConn) firstSize() (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sizes) == 0 {
+		return 0, false
+	}
+	c.recording = false
+	return c.sizes[0], true
+}
+
+func TestDialContextWithPriority(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+	go func() {
+		for {
+			conn, err := serverMux.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	var recorder *sizeRecorderConn
+	clientMux := newTestClient(endpoint).
+		SetMaxUnderlays(1).
+		SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+			conn, err := defaultDial(ctx, network, localAddr, remoteAddr)
+			if err != nil {
+				return nil, err
+			}
+			recorder = &sizeRecorderConn{Conn: conn}
+			return recorder, nil
+		})
+	defer clientMux.Close()
+
+	if _, err := clientMux.DialContextWithPriority(context.Background(), SessionPriority(5)); !errors.Is(err, stderror.ErrInvalidArgument) {
+		t.Errorf("DialContextWithPriority() returned %v, want %v", err, stderror.ErrInvalidArgument)
+	}
+	bulk, err := clientMux.DialContextWithPriority(context.Background(), PriorityLow)
+	if err != nil {
+		t.Fatalf("DialContextWithPriority() failed: %v", err)
+	}
+	defer bulk.Close()
+	if got := bulk.(*Session).Priority(); got != PriorityLow {
+		t.Errorf("Priority() = %v, want %v", got, PriorityLow)
+	}
+	interactive, err := clientMux.DialContextWithPriority(context.Background(), PriorityHigh)
+	if err != nil {
+		t.Fatalf("DialContextWithPriority() failed: %v", err)
+	}
+	defer interactive.Close()
+	if _, err := interactive.Write([]byte("ping")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if _, total := clientMux.UnderlayCount(); total != 1 {
+		t.Fatalf("sessions use %d underlays, want 1", total)
+	}
+
+	// Block the underlay until the interactive session and then the bulk
+	// session wait to send, and check the segment of the interactive
+	// session is sent first. Without priorities, the last waiter usually
+	// gets the lock.
+	lock := &bulk.(*Session).underlay().(*TCPUnderlay).sendMutex
+	waiting := func() int {
+		lock.mu.Lock()
+		defer lock.mu.Unlock()
+		n := 0
+		for _, w := range lock.waiting {
+			n += w
+		}
+		return n
+	}
+	waitFor := func(want int) {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			if waiting() >= want {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+		lock.Unlock()
+		t.Fatalf("%d sessions are not waiting to send", want)
+	}
+	sendQueue := bulk.(*Session).sendQueue
+	bulkPayload := make([]byte, 4*maxPDU)
+	for i := 0; i < 10; i++ {
+		lock.Lock()
+		if _, err := interactive.Write([]byte("ping")); err != nil {
+			lock.Unlock()
+			t.Fatalf("Write() failed: %v", err)
+		}
+		waitFor(1)
+		bulkDone := make(chan error, 1)
+		go func() {
+			_, err := bulk.Write(bulkPayload)
+			bulkDone <- err
+		}()
+		waitFor(2)
+		recorder.record()
+		lock.Unlock()
+
+		var size int
+		var ok bool
+		for j := 0; j < 1000 && !ok; j++ {
+			if size, ok = recorder.firstSize(); !ok {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		if !ok {
+			t.Fatalf("nothing is written to the underlay")
+		}
+		// The bulk segments are much larger than the interactive one.
+		if size >= 1024 {
+			t.Fatalf("round %d: first write after unlock has %d bytes, want the interactive segment", i, size)
+		}
+
+		// Wait until the bulk data is sent.
+		if err := <-bulkDone; err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		for j := 0; j < 1000 && (sendQueue.Len() > 0 || waiting() > 0); j++ {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
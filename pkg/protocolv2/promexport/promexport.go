@@ -0,0 +1,100 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package promexport exports the underlay metrics of mieru protocol to
+// a Prometheus registry. It is a separate package so the core protocol
+// doesn't depend on the Prometheus client library.
+package promexport
+
+import (
+	"github.com/enfein/mieru/pkg/metrics"
+	"github.com/enfein/mieru/pkg/protocolv2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace      = "mieru"
+	subsystem      = "underlay"
+	transportLabel = "transport"
+)
+
+var (
+	activeOpensDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "active_opens_total"),
+		"Number of underlays created by the client.",
+		[]string{transportLabel}, nil,
+	)
+	passiveOpensDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "passive_opens_total"),
+		"Number of underlays accepted by the server.",
+		[]string{transportLabel}, nil,
+	)
+	currEstablishedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "current_established"),
+		"Number of underlays currently established.",
+		[]string{transportLabel}, nil,
+	)
+	maxConnDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "max_established"),
+		"Maximum number of underlays established at the same time.",
+		nil, nil,
+	)
+	malformedUDPDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "malformed_udp_packets_total"),
+		"Number of malformed UDP packets received by underlays.",
+		nil, nil,
+	)
+	unsolicitedUDPDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "unsolicited_udp_packets_total"),
+		"Number of UDP packets received from unknown peers by client underlays.",
+		nil, nil,
+	)
+)
+
+// underlayCollector implements prometheus.Collector.
+// The values are loaded from mieru metrics when they are collected.
+type underlayCollector struct{}
+
+var _ prometheus.Collector = underlayCollector{}
+
+func (underlayCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeOpensDesc
+	ch <- passiveOpensDesc
+	ch <- currEstablishedDesc
+	ch <- maxConnDesc
+	ch <- malformedUDPDesc
+	ch <- unsolicitedUDPDesc
+}
+
+func (underlayCollector) Collect(ch chan<- prometheus.Metric) {
+	collect(ch, activeOpensDesc, prometheus.CounterValue, protocolv2.TCPUnderlayActiveOpens, "tcp")
+	collect(ch, activeOpensDesc, prometheus.CounterValue, protocolv2.UDPUnderlayActiveOpens, "udp")
+	collect(ch, passiveOpensDesc, prometheus.CounterValue, protocolv2.TCPUnderlayPassiveOpens, "tcp")
+	collect(ch, passiveOpensDesc, prometheus.CounterValue, protocolv2.UDPUnderlayPassiveOpens, "udp")
+	collect(ch, currEstablishedDesc, prometheus.GaugeValue, protocolv2.TCPUnderlayCurrEstablished, "tcp")
+	collect(ch, currEstablishedDesc, prometheus.GaugeValue, protocolv2.UDPUnderlayCurrEstablished, "udp")
+	collect(ch, maxConnDesc, prometheus.GaugeValue, protocolv2.UnderlayMaxConn)
+	collect(ch, malformedUDPDesc, prometheus.CounterValue, protocolv2.UnderlayMalformedUDP)
+	collect(ch, unsolicitedUDPDesc, prometheus.CounterValue, protocolv2.UnderlayUnsolicitedUDP)
+}
+
+func collect(ch chan<- prometheus.Metric, desc *prometheus.Desc, valueType prometheus.ValueType, m metrics.Metric, labelValues ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, valueType, float64(m.Load()), labelValues...)
+}
+
+// RegisterMetrics registers the underlay metrics to the Prometheus registry.
+func RegisterMetrics(registry *prometheus.Registry) error {
+	return registry.Register(underlayCollector{})
+}
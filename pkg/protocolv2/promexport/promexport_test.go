@@ -0,0 +1,98 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package promexport
+
+import (
+	"testing"
+
+	"github.com/enfein/mieru/pkg/protocolv2"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gather returns the metric value with the given name and transport label.
+func gather(t *testing.T, registry *prometheus.Registry, name, transport string) float64 {
+	t.Helper()
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather() failed: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if transport != "" && !hasLabel(m, transportLabel, transport) {
+				continue
+			}
+			if m.GetCounter() != nil {
+				return m.GetCounter().GetValue()
+			}
+			return m.GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s with transport %q is not found", name, transport)
+	return 0
+}
+
+func hasLabel(m *dto.Metric, name, value string) bool {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name && l.GetValue() == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRegisterMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := RegisterMetrics(registry); err != nil {
+		t.Fatalf("RegisterMetrics() failed: %v", err)
+	}
+
+	protocolv2.TCPUnderlayActiveOpens.Add(3)
+	protocolv2.UDPUnderlayPassiveOpens.Add(2)
+	protocolv2.UDPUnderlayCurrEstablished.Add(1)
+	protocolv2.UnderlayMaxConn.Store(7)
+
+	testCases := []struct {
+		name      string
+		transport string
+		want      int64
+	}{
+		{"mieru_underlay_active_opens_total", "tcp", protocolv2.TCPUnderlayActiveOpens.Load()},
+		{"mieru_underlay_active_opens_total", "udp", protocolv2.UDPUnderlayActiveOpens.Load()},
+		{"mieru_underlay_passive_opens_total", "udp", protocolv2.UDPUnderlayPassiveOpens.Load()},
+		{"mieru_underlay_current_established", "udp", protocolv2.UDPUnderlayCurrEstablished.Load()},
+		{"mieru_underlay_max_established", "", 7},
+	}
+	for _, tc := range testCases {
+		if got := gather(t, registry, tc.name, tc.transport); got != float64(tc.want) {
+			t.Errorf("%s{transport=%q} = %v, want %v", tc.name, tc.transport, got, tc.want)
+		}
+	}
+
+	// Values track later updates.
+	protocolv2.TCPUnderlayActiveOpens.Add(1)
+	want := protocolv2.TCPUnderlayActiveOpens.Load()
+	if got := gather(t, registry, "mieru_underlay_active_opens_total", "tcp"); got != float64(want) {
+		t.Errorf("mieru_underlay_active_opens_total{transport=\"tcp\"} = %v, want %v", got, want)
+	}
+
+	if err := RegisterMetrics(registry); err == nil {
+		t.Errorf("RegisterMetrics() twice succeeded, want error")
+	}
+}
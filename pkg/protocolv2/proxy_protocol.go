@@ -0,0 +1,242 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+)
+
+const (
+	// proxyV1MaxHeaderLen is the maximum length of a PROXY protocol v1
+	// header, including the trailing CRLF.
+	proxyV1MaxHeaderLen = 107
+
+	// proxyV2FixedHeaderLen is the length of a PROXY protocol v2 header
+	// before the address block.
+	proxyV2FixedHeaderLen = 16
+
+	// proxyHeaderTimeout is the maximum time to receive the PROXY protocol
+	// header after a connection is accepted.
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+// proxyV2Signature is the first 12 bytes of a PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolConn is a server connection that starts with a PROXY
+// protocol v1 or v2 header. The header is parsed by parseHeader or on
+// the first Read. After that, RemoteAddr returns the original client
+// address from the header.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	mu         sync.Mutex
+	remoteAddr net.Addr // nil if the header doesn't carry an address
+	err        error
+}
+
+var _ net.Conn = &proxyProtocolConn{}
+
+func newProxyProtocolConn(conn net.Conn) *proxyProtocolConn {
+	return &proxyProtocolConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// Read implements net.Conn.
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr implements net.Conn. It returns the address of the
+// upstream until the header is parsed.
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// parseHeader parses the header if it is not parsed yet. It fails if
+// the header is not received within timeout.
+func (c *proxyProtocolConn) parseHeader(timeout time.Duration) error {
+	c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	c.once.Do(c.readHeader)
+	c.Conn.SetReadDeadline(time.Time{})
+	return c.err
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	addr, err := readProxyHeader(c.reader)
+	if err != nil {
+		UnderlayBadProxyHeader.Add(1)
+		c.err = fmt.Errorf("read PROXY protocol header from %v failed: %w", c.Conn.RemoteAddr(), err)
+		return
+	}
+	c.mu.Lock()
+	c.remoteAddr = addr
+	c.mu.Unlock()
+}
+
+// readProxyHeader consumes a PROXY protocol v1 or v2 header from r and
+// returns the source address in it. The returned address is nil if the
+// header is from a health check of the upstream, or the upstream doesn't
+// know the source address.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	prefix, err := r.Peek(len(proxyV2Signature))
+	if err == nil && bytes.Equal(prefix, proxyV2Signature) {
+		return readProxyV2Header(r)
+	}
+	if len(prefix) >= 6 && string(prefix[:6]) == "PROXY " {
+		return readProxyV1Header(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("PROXY protocol signature not found: %w", stderror.ErrInvalidArgument)
+}
+
+func readProxyV1Header(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxHeaderLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY protocol v1 header is not terminated by CRLF: %w", stderror.ErrInvalidArgument)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("PROXY protocol v1 header %q is malformed: %w", line, stderror.ErrInvalidArgument)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("PROXY protocol v1 source IP %q is invalid: %w", fields[2], stderror.ErrInvalidArgument)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("PROXY protocol v1 source port %q is invalid: %w", fields[4], stderror.ErrInvalidArgument)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyV2Header(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, proxyV2FixedHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	version, command := header[12]>>4, header[12]&0x0f
+	if version != 2 {
+		return nil, fmt.Errorf("PROXY protocol version %d is not supported: %w", version, stderror.ErrUnsupported)
+	}
+	if command > 1 {
+		return nil, fmt.Errorf("PROXY protocol v2 command %d is invalid: %w", command, stderror.ErrInvalidArgument)
+	}
+	family, protocol := header[13]>>4, header[13]&0x0f
+	addrBlock := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, addrBlock); err != nil {
+		return nil, err
+	}
+
+	// The LOCAL command is sent by the upstream itself, e.g. a health check.
+	if command == 0 {
+		return nil, nil
+	}
+	var ipLen int
+	switch family {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// The source address is unspecified or a unix socket.
+		return nil, nil
+	}
+	if protocol != 1 && protocol != 2 {
+		return nil, fmt.Errorf("PROXY protocol v2 transport protocol %d is invalid: %w", protocol, stderror.ErrInvalidArgument)
+	}
+	if len(addrBlock) < 2*ipLen+4 {
+		return nil, fmt.Errorf("PROXY protocol v2 address block of %d bytes is too short: %w", len(addrBlock), stderror.ErrInvalidArgument)
+	}
+	ip := net.IP(addrBlock[:ipLen])
+	port := int(binary.BigEndian.Uint16(addrBlock[2*ipLen:]))
+	if protocol == 2 {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// SetProxyProtocol should only be used behind a trusted upstream that sends
+// the header, otherwise a client can spoof its address.
+func (m *Mux) SetProxyProtocol(enable bool) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set PROXY protocol in client mux")
+	}
+	if m.used {
+		panic("Can't set PROXY protocol after mux is used")
+	}
+	m.proxyProtocol = enable
+	m.logf(log.InfoLevel, "Mux PROXY protocol is set to %v", enable)
+	return m
+}
+
+// serverWrapProxyProtocolConn parses the PROXY protocol header of an
+// accepted TCP connection, and checks the source address in the header
+// with the ACL before it returns the server TCP underlay. The header is
+// parsed in the handshake goroutine, so a slow upstream doesn't block
+// the accept loop.
+func (m *Mux) serverWrapProxyProtocolConn(rawConn net.Conn, properties UnderlayProperties) (Underlay, error) {
+	conn := newProxyProtocolConn(rawConn)
+	if err := conn.parseHeader(proxyHeaderTimeout); err != nil {
+		return nil, err
+	}
+	if m.dropBlockedByACL(conn) {
+		return nil, fmt.Errorf("source address %v is blocked by ACL", conn.RemoteAddr())
+	}
+	return m.newServerTCPUnderlay(conn, properties)
+}
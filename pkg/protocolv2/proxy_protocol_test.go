@@ -0,0 +1,225 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// proxyV2Header returns a PROXY protocol v2 header of a TCP connection
+// from src to dst.
+func proxyV2Header(src, dst *net.TCPAddr) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x21) // version 2, PROXY command
+	var addrs []byte
+	if src.IP.To4() != nil {
+		b.WriteByte(0x11) // IPv4, TCP
+		addrs = append(append(addrs, src.IP.To4()...), dst.IP.To4()...)
+	} else {
+		b.WriteByte(0x21) // IPv6, TCP
+		addrs = append(append(addrs, src.IP.To16()...), dst.IP.To16()...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(src.Port))
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(dst.Port))
+	b.Write(binary.BigEndian.AppendUint16(nil, uint16(len(addrs))))
+	b.Write(addrs)
+	return b.Bytes()
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	srcV4 := &net.TCPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 4242}
+	dstV4 := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}
+	srcV6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 4242}
+	dstV6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+	testCases := []struct {
+		name   string
+		header []byte
+		want   string // empty if the header carries no address
+	}{
+		{"v2 IPv4", proxyV2Header(srcV4, dstV4), "203.0.113.7:4242"},
+		{"v2 IPv6", proxyV2Header(srcV6, dstV6), "[2001:db8::7]:4242"},
+		{"v2 LOCAL", append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0x00, 0x00), ""},
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 198.51.100.1 4242 443\r\n"), "203.0.113.7:4242"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(tc.header, "payload"...)))
+			addr, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatalf("readProxyHeader() failed: %v", err)
+			}
+			if tc.want == "" {
+				if addr != nil {
+					t.Errorf("readProxyHeader() = %v, want nil", addr)
+				}
+			} else if addr == nil || addr.String() != tc.want {
+				t.Errorf("readProxyHeader() = %v, want %s", addr, tc.want)
+			}
+			rest := make([]byte, 16)
+			n, _ := r.Read(rest)
+			if string(rest[:n]) != "payload" {
+				t.Errorf("payload after header = %q, want %q", rest[:n], "payload")
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderMalformed(t *testing.T) {
+	valid := proxyV2Header(&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443})
+	badVersion := append([]byte{}, valid...)
+	badVersion[12] = 0x11
+	shortAddrs := append([]byte{}, valid[:proxyV2FixedHeaderLen]...)
+	shortAddrs[15] = 4
+	shortAddrs = append(shortAddrs, 1, 2, 3, 4)
+	testCases := []struct {
+		name   string
+		header []byte
+	}{
+		{"no header", []byte("GET / HTTP/1.1\r\n\r\n")},
+		{"v2 bad version", badVersion},
+		{"v2 short address block", shortAddrs},
+		{"v2 truncated", valid[:len(valid)-3]},
+		{"v1 bad IP", []byte("PROXY TCP4 203.0.113 198.51.100.1 4242 443\r\n")},
+		{"v1 no CRLF", []byte("PROXY TCP4 203.0.113.7 198.51.100.1 4242 443\n")},
+		{"v1 too long", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte{'1'}, proxyV1MaxHeaderLen)...)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if addr, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tc.header))); err == nil {
+				t.Errorf("readProxyHeader() = %v, want error", addr)
+			}
+		})
+	}
+}
+
+// startProxyProtocolServer starts a server mux that parses the PROXY
+// protocol header, and returns its address.
+func startProxyProtocolServer(t *testing.T, opts ...func(*Mux)) (*Mux, *net.TCPAddr) {
+	t.Helper()
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetProxyProtocol(true).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, addr, nil)})
+	for _, opt := range opts {
+		opt(serverMux)
+	}
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		serverMux.Close()
+	})
+	time.Sleep(100 * time.Millisecond)
+	return serverMux, addr
+}
+
+// newProxyProtocolClient returns a client mux that sends a PROXY protocol
+// header with the source address src, like a load balancer.
+func newProxyProtocolClient(addr, src *net.TCPAddr) *Mux {
+	return newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, addr)).
+		SetDialer(func(ctx context.Context, network, localAddr, remoteAddr string) (net.Conn, error) {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, network, remoteAddr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := conn.Write(proxyV2Header(src, addr)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		})
+}
+
+func TestProxyProtocol(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, addr := startProxyProtocolServer(t)
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}
+	clientMux := newProxyProtocolClient(addr, src)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if got := acceptTestSession(t, serverMux, conn).RemoteAddr().String(); got != src.String() {
+		t.Errorf("RemoteAddr() = %s, want %s", got, src)
+	}
+}
+
+func TestProxyProtocolACL(t *testing.T) {
+	log.SetOutputToTest(t)
+	// The ACL checks the source address in the header, not the address
+	// of the load balancer, which is 127.0.0.1.
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4242}
+	for _, tc := range []struct {
+		name    string
+		opt     func(*Mux)
+		blocked bool
+	}{
+		{"blocked", func(m *Mux) { m.SetBlockedCIDRs([]string{"203.0.113.0/24"}) }, true},
+		{"allowed", func(m *Mux) { m.SetAllowedCIDRs([]string{"203.0.113.0/24"}) }, false},
+		{"load balancer blocked", func(m *Mux) { m.SetBlockedCIDRs([]string{"127.0.0.1"}) }, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverMux, addr := startProxyProtocolServer(t, tc.opt)
+			before := UnderlayBlockedByACL.Load()
+			clientMux := newProxyProtocolClient(addr, src)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			if !tc.blocked {
+				acceptTestSession(t, serverMux, conn)
+				if UnderlayBlockedByACL.Load() != before {
+					t.Errorf("UnderlayBlockedByACL is increased")
+				}
+				return
+			}
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Errorf("Read() succeeded from a blocked source address")
+			}
+			if UnderlayBlockedByACL.Load() == before {
+				t.Errorf("UnderlayBlockedByACL is not increased")
+			}
+			if stats := serverMux.Stats(); len(stats) != 0 {
+				t.Errorf("server has %d underlays, want 0", len(stats))
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	mrand "math/rand"
+	"sync"
+)
+
+// randSource generates the random numbers used by a mux to select
+// endpoints and underlays and to create session IDs. It is safe for
+// concurrent use. The zero value uses the global source of math/rand.
+type randSource struct {
+	mu sync.Mutex
+	r  *mrand.Rand // nil if the global source is used
+}
+
+// set replaces the source. If src is nil, the global source is used.
+func (s *randSource) set(src mrand.Source) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if src == nil {
+		s.r = nil
+		return
+	}
+	s.r = mrand.New(src)
+}
+
+// Intn returns a random number in [0, n).
+func (s *randSource) Intn(n int) int {
+	if s == nil {
+		return mrand.Intn(n)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.r == nil {
+		return mrand.Intn(n)
+	}
+	return s.r.Intn(n)
+}
+
+// Float64 returns a random number in [0.0, 1.0).
+func (s *randSource) Float64() float64 {
+	if s == nil {
+		return mrand.Float64()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.r == nil {
+		return mrand.Float64()
+	}
+	return s.r.Float64()
+}
+
+// Uint32 returns a random 32-bit number.
+func (s *randSource) Uint32() uint32 {
+	if s == nil {
+		return mrand.Uint32()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.r == nil {
+		return mrand.Uint32()
+	}
+	return s.r.Uint32()
+}
+
+func (m *Mux) SetRandSource(src mrand.Source) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set random source in server mux")
+	}
+	if m.used {
+		panic("Can't set random source after mux is used")
+	}
+	m.rand.set(src)
+	return m
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	mrand "math/rand"
+	"testing"
+
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestSetRandSource(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	sessionIDs := func(seed int64) []uint32 {
+		clientMux := newTestClient(endpoint).SetRandSource(mrand.NewSource(seed))
+		defer clientMux.Close()
+		ids := make([]uint32, 0)
+		for i := 0; i < 3; i++ {
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			ids = append(ids, conn.(*Session).ID())
+			conn.Close()
+		}
+		return ids
+	}
+	first := sessionIDs(42)
+	second := sessionIDs(42)
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("session IDs with the same seed = %v and %v, want equal", first, second)
+			break
+		}
+	}
+	other := sessionIDs(43)
+	if first[0] == other[0] && first[1] == other[1] && first[2] == other[2] {
+		t.Errorf("session IDs with different seeds are the same: %v", first)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"net"
+)
+
+// RejectReason is the reason given by the server to reject a session.
+// It is carried by the status code of the close session request.
+type RejectReason uint8
+
+const (
+	// RejectQuotaExhausted means the user has used all the traffic quota.
+	RejectQuotaExhausted RejectReason = RejectReason(statusQuotaExhausted)
+
+	// RejectConnLimitReached means the user has too many sessions.
+	RejectConnLimitReached RejectReason = RejectReason(statusConnLimitReached)
+
+	// RejectOverloaded means the server can't take more sessions now,
+	// e.g. the accept queue is full. The client should back off before
+	// it tries again.
+	RejectOverloaded RejectReason = RejectReason(statusOverloaded)
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectQuotaExhausted:
+		return "user has exhausted quota"
+	case RejectConnLimitReached:
+		return "user has reached the connection limit"
+	case RejectOverloaded:
+		return "server is overloaded"
+	default:
+		return fmt.Sprintf("unknown reason %d", uint8(r))
+	}
+}
+
+// Retryable returns true if the client may succeed by trying again later.
+func (r RejectReason) Retryable() bool {
+	return r == RejectConnLimitReached || r == RejectOverloaded
+}
+
+// RejectError is returned by the Read and Write of a client session that
+// is rejected by the server. Use errors.As to get the reason. Other
+// sessions are not affected. The server can only reject a session after
+// the handshake. A connection that is closed before the handshake, e.g.
+// a connection over the accept rate limit, doesn't carry a reason.
+type RejectError struct {
+	Reason RejectReason
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("session is rejected by the server: %v", e.Reason)
+}
+
+// rejectErrorOf returns the RejectError of a close session status code,
+// or nil if the code is not a reject reason.
+func rejectErrorOf(code statusCode) *RejectError {
+	switch code {
+	case statusQuotaExhausted, statusConnLimitReached, statusOverloaded:
+		return &RejectError{Reason: RejectReason(code)}
+	default:
+		return nil
+	}
+}
+
+// rejectOverloaded closes a connection that the server can't take.
+// The client of a session is told that the server is overloaded.
+func rejectOverloaded(conn net.Conn) {
+	if session, ok := conn.(*Session); ok {
+		session.reject(statusOverloaded)
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,126 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestRejectReason(t *testing.T) {
+	log.SetOutputToTest(t)
+	testCases := []struct {
+		name string
+		opt  func(*Mux)
+		want RejectReason
+	}{
+		{"overloaded", func(m *Mux) { m.SetAcceptQueueSize(1).SetAcceptOverflowPolicy(OverflowDropNewest) }, RejectOverloaded},
+		{"conn limit", func(m *Mux) { m.SetUserConnLimit(map[string]int{"xiaochitang": 1}) }, RejectConnLimitReached},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			serverMux := NewMux(false).
+				SetServerUsers(users).
+				SetEndpoints([]UnderlayProperties{
+					NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil),
+				})
+			tc.opt(serverMux)
+			if err := serverMux.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer serverMux.Close()
+			clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, serverMux.ListeningAddrs()[0]))
+			defer clientMux.Close()
+
+			// The first session is queued but never accepted,
+			// so the second one exceeds the capacity.
+			first, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer first.Close()
+			if _, err := first.Write([]byte("first")); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			time.Sleep(100 * time.Millisecond)
+			second, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer second.Close()
+			if _, err := second.Write([]byte("second")); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			second.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = second.Read(make([]byte, 16))
+			var rejectErr *RejectError
+			if !errors.As(err, &rejectErr) {
+				t.Fatalf("Read() error = %v, want a RejectError", err)
+			}
+			if rejectErr.Reason != tc.want {
+				t.Errorf("reject reason = %v, want %v", rejectErr.Reason, tc.want)
+			}
+			if !rejectErr.Reason.Retryable() {
+				t.Errorf("reject reason %v is not retryable", rejectErr.Reason)
+			}
+
+			// Other sessions are not affected by the reject.
+			if _, err := first.Write([]byte("first")); err != nil {
+				t.Errorf("Write() of the first session failed: %v", err)
+			}
+			third, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed after a reject: %v", err)
+			}
+			third.Close()
+		})
+	}
+}
+
+func TestRejectRateLimited(t *testing.T) {
+	log.SetOutputToTest(t)
+	factory := &countingCipherFactory{}
+	_, endpoint := startTestMux(t, util.TCPTransport, func(m *Mux) {
+		m.SetAcceptRateLimit(1, 1).SetCipherFactory(factory)
+	})
+	first, err := net.Dial("tcp", endpoint.RemoteAddr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer first.Close()
+	second, err := net.Dial("tcp", endpoint.RemoteAddr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer second.Close()
+
+	// The connection over the limit is closed before any cipher is created
+	// for it. The first connection is wrapped before the second is accepted.
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() error = %v, want %v", err, io.EOF)
+	}
+	if got := factory.list.Load(); got != int32(len(users)) {
+		t.Errorf("created the block ciphers of %d users, want %d", got, len(users))
+	}
+}
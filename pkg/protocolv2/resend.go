@@ -0,0 +1,318 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/mathext"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+const (
+	// migrationAckInterval is the minimum interval between two ACKs that a
+	// TCP session sends to let the peer release the kept segments.
+	migrationAckInterval = 50 * time.Millisecond
+
+	// migrationTimeout is how long a TCP session waits to be migrated after
+	// its underlay is broken, before it is closed.
+	migrationTimeout = 10 * time.Second
+)
+
+// resendBuffer keeps the segments that a TCP session has sent, until the
+// peer acknowledges them. After the session is migrated to another
+// underlay, the segments are sent again, because the peer may not have
+// received them from the broken underlay.
+type resendBuffer struct {
+	mu    sync.Mutex
+	segs  []*segment // ordered by the sequence number
+	bytes int        // total payload size of segs
+	limit int        // maximum value of bytes
+	acked uint32     // the peer has received the segments before acked
+	lost  uint32     // the segments before lost may have been dropped
+}
+
+func newResendBuffer(limit int) *resendBuffer {
+	return &resendBuffer{limit: limit}
+}
+
+// add keeps a segment after it is sent. The oldest segments are dropped
+// if the buffer is full. Segments that are never sent again, like the
+// close session request, are not kept.
+func (r *resendBuffer) add(seg *segment) {
+	switch seg.metadata.Protocol() {
+	case openSessionRequest, openSessionResponse, dataClientToServer, dataServerToClient:
+	default:
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.segs = append(r.segs, seg)
+	r.bytes += len(seg.payload)
+	for r.bytes > r.limit && len(r.segs) > 0 {
+		oldest := r.segs[0]
+		r.segs[0] = nil
+		r.segs = r.segs[1:]
+		r.bytes -= len(oldest.payload)
+		seq, _ := oldest.Seq()
+		r.lost = seq + 1
+	}
+}
+
+// ack releases the segments before unAckSeq.
+func (r *resendBuffer) ack(unAckSeq uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !seqBefore(r.acked, unAckSeq) {
+		return
+	}
+	r.acked = unAckSeq
+	n := 0
+	for n < len(r.segs) {
+		if seq, _ := r.segs[n].Seq(); !seqBefore(seq, unAckSeq) {
+			break
+		}
+		r.bytes -= len(r.segs[n].payload)
+		r.segs[n] = nil
+		n++
+	}
+	r.segs = r.segs[n:]
+}
+
+// isAcked returns true if the peer has received the segment with seq.
+func (r *resendBuffer) isAcked(seq uint32) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return seqBefore(seq, r.acked)
+}
+
+// complete returns true if the buffer has all the segments that the peer
+// may not have received.
+func (r *resendBuffer) complete() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !seqBefore(r.acked, r.lost)
+}
+
+// pending returns the segments that are not acknowledged, in order.
+func (r *resendBuffer) pending() []*segment {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*segment(nil), r.segs...)
+}
+
+// seqBefore returns true if sequence number a is before b.
+// It works across the wrap around of sequence numbers.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (m *Mux) SetMigrationBuffer(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set migration buffer after mux is used")
+	}
+	m.migrationBuffer = mathext.Max(n, 0)
+	m.logf(log.InfoLevel, "Mux migration buffer is set to %d bytes", m.migrationBuffer)
+	return m
+}
+
+// canResume returns true if the session can continue on another underlay
+// without losing data.
+func (s *Session) canResume() bool {
+	if s.resend == nil || s.resumeToken.Load() == 0 || s.isStateAfter(sessionClosed, true) {
+		return false
+	}
+	// The client can't tell if the server has received an open session
+	// request that is not acknowledged. It would be opened twice if it is
+	// sent again.
+	if s.isClient && !s.resend.isAcked(0) {
+		return false
+	}
+	return s.resend.complete()
+}
+
+// ackSegment creates a TCP ACK segment that tells the peer all the
+// segments before unAckSeq are received.
+func (s *Session) ackSegment(unAckSeq uint32) *segment {
+	baseStruct := baseStruct{}
+	if s.isClient {
+		baseStruct.protocol = uint8(ackClientToServer)
+	} else {
+		baseStruct.protocol = uint8(ackServerToClient)
+	}
+	return &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct,
+			sessionID:  s.id,
+			unAckSeq:   unAckSeq,
+		},
+		transport: util.TCPTransport,
+	}
+}
+
+// resumeSegment creates a TCP ACK segment that carries the resume token,
+// so the server moves the session to the underlay that receives it.
+func (s *Session) resumeSegment() *segment {
+	seg := s.ackSegment(s.recvSeq.Load())
+	das := seg.metadata.(*dataAckStruct)
+	das.flags = dataFlagResume
+	das.payloadLen = 8
+	seg.payload = binary.BigEndian.AppendUint64(nil, s.resumeToken.Load())
+	return seg
+}
+
+// newResumeToken returns a random resume token. It is never 0.
+func newResumeToken() (uint64, error) {
+	b := make([]byte, 8)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		if token := binary.BigEndian.Uint64(b); token != 0 {
+			return token, nil
+		}
+	}
+}
+
+// resendTo sends the kept segments again to the new underlay of a migrated
+// session, followed by an ACK, so the peer knows what is received. The
+// client sends the resume token first, so the server finds the session.
+// An idle client session has nothing to send.
+func (s *Session) resendTo(conn Underlay) error {
+	if s.isClient && !s.resend.isAcked(0) {
+		return nil
+	}
+	if s.isClient {
+		if err := s.outputTo(conn, s.resumeSegment(), nil); err != nil {
+			return err
+		}
+	}
+	for _, seg := range s.resend.pending() {
+		if err := s.outputTo(conn, seg, nil); err != nil {
+			return err
+		}
+	}
+	return s.outputTo(conn, s.ackSegment(s.recvSeq.Load()), nil)
+}
+
+// parkedSession identifies a server session waiting to be migrated.
+type parkedSession struct {
+	id   uint32
+	user string
+}
+
+// parkSessions keeps the sessions of a broken server underlay that can be
+// migrated, so the client can move them to another underlay.
+func (m *Mux) parkSessions(broken Underlay) {
+	src, ok := broken.(migratableUnderlay)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isStopped() {
+		return
+	}
+	for _, s := range src.sessions() {
+		if !s.canResume() {
+			continue
+		}
+		src.detachSession(s)
+		key := parkedSession{id: s.id, user: s.User()}
+		if m.parked == nil {
+			m.parked = make(map[parkedSession]*Session)
+		}
+		m.parked[key] = s
+		m.logf(log.DebugLevel, "Waiting %v for %v to migrate from %v", migrationTimeout, s, broken)
+		time.AfterFunc(migrationTimeout, func() {
+			m.mu.Lock()
+			parked := m.parked[key] == s
+			if parked {
+				delete(m.parked, key)
+			}
+			m.mu.Unlock()
+			if parked {
+				s.closeWithError(fmt.Errorf("session is not migrated in %v: %w", migrationTimeout, stderror.ErrTimeout))
+			}
+		})
+	}
+}
+
+// rehomeSession moves the server session with the ID and the user to the
+// underlay, after the client has migrated it. The session is either parked
+// or still attached to the old underlay, if the server has not noticed the
+// old underlay is broken. It returns nil if there is no such session, or
+// the token doesn't match the resume token of the session.
+func (m *Mux) rehomeSession(t *TCPUnderlay, id uint32, user string, token []byte) *Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := parkedSession{id: id, user: user}
+	s, old := m.parked[key], migratableUnderlay(nil)
+	if s == nil {
+		for _, underlay := range m.underlays {
+			src, ok := underlay.(migratableUnderlay)
+			if !ok {
+				continue
+			}
+			for _, session := range src.sessions() {
+				if session.id == id && session.User() == user && session.underlay() != t {
+					s, old = session, src
+					break
+				}
+			}
+			if s != nil {
+				break
+			}
+		}
+	}
+	if s == nil || !s.canResume() {
+		return nil
+	}
+	want := binary.BigEndian.AppendUint64(nil, s.resumeToken.Load())
+	if subtle.ConstantTimeCompare(token, want) != 1 {
+		m.logf(log.DebugLevel, "Refused to migrate %v to %v: resume token doesn't match", s, t)
+		return nil
+	}
+	if err := t.adoptSession(s); err != nil {
+		m.logf(log.DebugLevel, "Can't migrate %v to %v: %v", s, t, err)
+		return nil
+	}
+	delete(m.parked, key)
+	if old != nil {
+		old.detachSession(s)
+	}
+	s.setUnderlay(t)
+	m.logf(log.DebugLevel, "Migrated %v to %v", s, t)
+	return s
+}
+
+// closeParkedSessions closes the sessions waiting to be migrated.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) closeParkedSessions() {
+	for key, s := range m.parked {
+		delete(m.parked, key)
+		go s.Close()
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func newTestDataSegment(seq uint32, size int) *segment {
+	return &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{
+				protocol: uint8(dataClientToServer),
+			},
+			seq: seq,
+		},
+		payload: make([]byte, size),
+	}
+}
+
+func TestResendBufferAck(t *testing.T) {
+	r := newResendBuffer(1024)
+	for i := uint32(0); i < 4; i++ {
+		r.add(newTestDataSegment(i, 100))
+	}
+	r.add(&segment{
+		metadata: &sessionStruct{
+			baseStruct: baseStruct{
+				protocol: uint8(closeSessionRequest),
+			},
+		},
+	})
+	if got := len(r.pending()); got != 4 {
+		t.Fatalf("got %d pending segments, want %d", got, 4)
+	}
+
+	r.ack(2)
+	pending := r.pending()
+	if len(pending) != 2 {
+		t.Fatalf("got %d pending segments, want %d", len(pending), 2)
+	}
+	if seq, _ := pending[0].Seq(); seq != 2 {
+		t.Errorf("first pending segment has seq %d, want %d", seq, 2)
+	}
+	if r.bytes != 200 {
+		t.Errorf("buffer has %d bytes, want %d", r.bytes, 200)
+	}
+	if !r.isAcked(1) || r.isAcked(2) {
+		t.Errorf("isAcked() returns unexpected result")
+	}
+
+	// An older ACK doesn't change anything.
+	r.ack(1)
+	if got := len(r.pending()); got != 2 {
+		t.Errorf("got %d pending segments, want %d", got, 2)
+	}
+	if !r.complete() {
+		t.Errorf("complete() = false, want true")
+	}
+}
+
+func TestResendBufferLost(t *testing.T) {
+	r := newResendBuffer(250)
+	for i := uint32(0); i < 4; i++ {
+		r.add(newTestDataSegment(i, 100))
+	}
+	if got := len(r.pending()); got != 2 {
+		t.Fatalf("got %d pending segments, want %d", got, 2)
+	}
+	if r.complete() {
+		t.Errorf("complete() = true, want false")
+	}
+
+	// The buffer is complete again after the peer has received the
+	// dropped segments.
+	r.ack(2)
+	if !r.complete() {
+		t.Errorf("complete() = false, want true")
+	}
+}
+
+func TestSeqBefore(t *testing.T) {
+	testcases := []struct {
+		a, b uint32
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{1, 1, false},
+		{math.MaxUint32, 0, true},
+		{0, math.MaxUint32, false},
+	}
+	for _, tc := range testcases {
+		if got := seqBefore(tc.a, tc.b); got != tc.want {
+			t.Errorf("seqBefore(%d, %d) = %v, want %v", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestRehomeSessionToken(t *testing.T) {
+	m := NewMux(false)
+	s := NewSession(1, false, 1500)
+	s.resend = newResendBuffer(1024)
+	s.resumeToken.Store(0x0123456789abcdef)
+	user := "alice"
+	s.userName.Store(&user)
+	key := parkedSession{id: s.id, user: user}
+	m.parked = map[parkedSession]*Session{key: s}
+	dst := &TCPUnderlay{baseUnderlay: *newBaseUnderlay(false, 1500)}
+
+	token := binary.BigEndian.AppendUint64(nil, s.resumeToken.Load())
+	wrong := binary.BigEndian.AppendUint64(nil, s.resumeToken.Load()+1)
+	for _, bad := range [][]byte{nil, token[:4], wrong} {
+		if got := m.rehomeSession(dst, s.id, user, bad); got != nil {
+			t.Fatalf("rehomeSession() with token %x migrated %v", bad, got)
+		}
+		if m.parked[key] != s {
+			t.Fatalf("session is not parked after rehomeSession() with token %x", bad)
+		}
+	}
+	if got := m.rehomeSession(dst, s.id, "bob", token); got != nil {
+		t.Fatalf("rehomeSession() of another user migrated %v", got)
+	}
+
+	if got := m.rehomeSession(dst, s.id, user, token); got != s {
+		t.Fatalf("rehomeSession() = %v, want %v", got, s)
+	}
+	if _, ok := m.parked[key]; ok {
+		t.Errorf("session is still parked after it is migrated")
+	}
+	if s.underlay() != dst {
+		t.Errorf("session is not attached to the new underlay")
+	}
+}
@@ -35,6 +35,7 @@ type ScheduleController struct {
 	lastScheduleTime time.Time
 	disable          bool // if scheduling to the underlay is disabled
 	disableTime      time.Time
+	onDisable        func() // nil if there is no callback
 	mu               sync.Mutex
 }
 
@@ -62,6 +63,13 @@ func (c *ScheduleController) DecPending() (ok bool) {
 	return true
 }
 
+// Pending returns the number of pending sessions.
+func (c *ScheduleController) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending
+}
+
 // IsDisabled returns true if scheduling new sessions to the underlay is disabled.
 func (c *ScheduleController) IsDisabled() bool {
 	c.mu.Lock()
@@ -76,23 +84,39 @@ func (c *ScheduleController) Idle() bool {
 	return c.disable && time.Since(c.disableTime) > scheduleIdleTime
 }
 
+// SetOnDisable sets the function called when scheduling new sessions
+// becomes disabled. The function is called at most once, without holding
+// the lock of the controller.
+func (c *ScheduleController) SetOnDisable(f func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onDisable = f
+}
+
 // TryDisable tries to disable scheduling new sessions.
 func (c *ScheduleController) TryDisable() (ok bool) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	if c.pending > 0 {
+		c.mu.Unlock()
 		return false
 	}
 	if util.IsZeroTime(c.lastScheduleTime) {
 		c.lastScheduleTime = time.Now()
 	}
 	if time.Since(c.lastScheduleTime) < scheduleIdleTime {
+		c.mu.Unlock()
 		return false
 	}
 	if c.disable {
+		c.mu.Unlock()
 		return true
 	}
 	c.disable = true
 	c.disableTime = time.Now()
+	onDisable := c.onDisable
+	c.mu.Unlock()
+	if onDisable != nil {
+		onDisable()
+	}
 	return true
 }
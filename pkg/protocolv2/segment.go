@@ -39,9 +39,21 @@ const (
 	segmentTimeFormat = "15:04:05.999"
 )
 
+// isStreamTransport returns true if the transport protocol is carried by TCP
+// or by a QUIC stream, so segments are not fragmented.
+func isStreamTransport(transport util.TransportProtocol) bool {
+	return transport == util.TCPTransport || transport == util.WebSocketTransport || transport == util.TLSTransport || transport == util.QUICTransport
+}
+
+// isUDPCarried returns true if the transport protocol is carried by UDP,
+// so it doesn't work when UDP is blocked.
+func isUDPCarried(transport util.TransportProtocol) bool {
+	return transport == util.UDPTransport || transport == util.QUICTransport
+}
+
 // MaxFragmentSize returns the maximum payload size in a fragment.
 func MaxFragmentSize(mtu int, ipVersion util.IPVersion, transport util.TransportProtocol) int {
-	if transport == util.TCPTransport {
+	if isStreamTransport(transport) {
 		// No fragment needed.
 		return maxPDU
 	}
@@ -60,9 +72,23 @@ func MaxFragmentSize(mtu int, ipVersion util.IPVersion, transport util.Transport
 	return mathext.Max(0, res)
 }
 
+// MinMTU returns the minimum viable MTU of a underlay. Each UDP segment has
+// an overhead of the IP and UDP headers, plus the nonce, metadata and
+// authentication tags of the protocol. The remaining space must fit an open
+// session request with MaxSessionOpenPayload bytes of payload, which is
+// never fragmented. TCP, WebSocket and TLS underlays don't depend on the MTU
+// and return 0.
+func MinMTU(ipVersion util.IPVersion, transport util.TransportProtocol) int {
+	if isStreamTransport(transport) {
+		return 0
+	}
+	overhead := maxUDPPathMTU - MaxFragmentSize(maxUDPPathMTU, ipVersion, transport)
+	return MaxSessionOpenPayload + overhead
+}
+
 // MaxPaddingSize returns the maximum padding size of a segment.
 func MaxPaddingSize(mtu int, ipVersion util.IPVersion, transport util.TransportProtocol, fragmentSize int, existingPaddingSize int) int {
-	if transport == util.TCPTransport {
+	if isStreamTransport(transport) {
 		// No limit.
 		return 255
 	}
@@ -93,6 +119,7 @@ type segment struct {
 	txTime    time.Time              // most recent tx time
 	txTimeout time.Duration          // need to receive ACK within this duration
 	block     cipher.BlockCipher     // cipher block to encrypt or decrypt the payload
+	priority  SessionPriority        // priority to write the segment to the underlay
 }
 
 // Protocol returns the protocol of the segment.
@@ -165,13 +192,15 @@ type segmentIterator func(*segment) bool
 
 // segmentTree is a B-tree to store multiple Segment in order.
 type segmentTree struct {
-	tr  *btree.BTreeG[*segment]
-	cap int
+	tr    *btree.BTreeG[*segment]
+	cap   int
+	bytes int // total payload size of the segments in the tree
 
 	mu                sync.Mutex
 	notFull           sync.Cond
 	chanEmptyEvent    chan struct{}
 	chanNotEmptyEvent chan struct{}
+	chanDeleteEvent   chan struct{}
 }
 
 func newSegmentTree(capacity int) *segmentTree {
@@ -185,6 +214,7 @@ func newSegmentTree(capacity int) *segmentTree {
 	st.notFull = *sync.NewCond(&st.mu)
 	st.chanEmptyEvent = make(chan struct{}, 1)
 	st.chanNotEmptyEvent = make(chan struct{}, 1)
+	st.chanDeleteEvent = make(chan struct{}, 1)
 	return st
 }
 
@@ -202,7 +232,9 @@ func (t *segmentTree) Insert(seg *segment) (ok bool) {
 		return false
 	}
 	prev, replace := t.tr.ReplaceOrInsert(seg)
+	t.bytes += len(seg.payload)
 	if replace {
+		t.bytes -= len(prev.payload)
 		if log.IsLevelEnabled(log.TraceLevel) {
 			log.Tracef("%v is replaced by %v", prev, seg)
 		}
@@ -225,7 +257,9 @@ func (t *segmentTree) InsertBlocking(seg *segment) {
 		t.notFull.Wait()
 	}
 	prev, replace := t.tr.ReplaceOrInsert(seg)
+	t.bytes += len(seg.payload)
 	if replace {
+		t.bytes -= len(prev.payload)
 		if log.IsLevelEnabled(log.TraceLevel) {
 			log.Tracef("%v is replaced by %v", prev, seg)
 		}
@@ -240,7 +274,7 @@ func (t *segmentTree) DeleteMin() (*segment, bool) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	if t.Len() == 0 {
+	if t.tr.Len() == 0 {
 		return nil, false
 	}
 	seg, ok := t.tr.DeleteMin()
@@ -250,8 +284,10 @@ func (t *segmentTree) DeleteMin() (*segment, bool) {
 	if seg == nil {
 		panic("segmentTree.DeleteMin() return nil")
 	}
+	t.bytes -= len(seg.payload)
 	t.notFull.Broadcast()
-	if t.Len() > 0 {
+	t.notifyDelete()
+	if t.tr.Len() > 0 {
 		t.notifyNotEmpty()
 	} else {
 		t.notifyEmpty()
@@ -266,7 +302,7 @@ func (t *segmentTree) DeleteMinIf(si segmentIterator) (*segment, bool) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	if t.Len() == 0 {
+	if t.tr.Len() == 0 {
 		return nil, false
 	}
 	seg, ok := t.tr.Min()
@@ -285,9 +321,11 @@ func (t *segmentTree) DeleteMinIf(si segmentIterator) (*segment, bool) {
 		if seg == nil {
 			panic("segmentTree.DeleteMin() return nil")
 		}
+		t.bytes -= len(seg.payload)
 		t.notFull.Broadcast()
+		t.notifyDelete()
 	}
-	if t.Len() > 0 {
+	if t.tr.Len() > 0 {
 		t.notifyNotEmpty()
 	} else {
 		t.notifyEmpty()
@@ -327,11 +365,22 @@ func (t *segmentTree) MaxSeq() (uint32, error) {
 
 // Len returns the current size of the tree.
 func (t *segmentTree) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.tr.Len()
 }
 
+// Bytes returns the total payload size of the segments in the tree.
+func (t *segmentTree) Bytes() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.bytes
+}
+
 // Remaining returns the remaining space of the tree before it is full.
 func (t *segmentTree) Remaining() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	return t.cap - t.tr.Len()
 }
 
@@ -342,6 +391,13 @@ func (t *segmentTree) notifyEmpty() {
 	}
 }
 
+func (t *segmentTree) notifyDelete() {
+	select {
+	case t.chanDeleteEvent <- struct{}{}:
+	default:
+	}
+}
+
 func (t *segmentTree) notifyNotEmpty() {
 	select {
 	case t.chanNotEmptyEvent <- struct{}{}:
@@ -0,0 +1,197 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// UnderlaySelector decides if a new client session should reuse
+// an existing underlay.
+type UnderlaySelector interface {
+	// Select returns one of the active underlays to schedule a new session,
+	// or nil if a new underlay should be created. Active underlays are not
+	// closed and can accept new sessions. The slice is never empty.
+	Select(active []Underlay) Underlay
+}
+
+// ReuseEstimator is implemented by an UnderlaySelector that can tell how
+// likely it reuses an existing underlay, which is reported by
+// Mux.ReuseProbability.
+type ReuseEstimator interface {
+	// ReuseProbability returns the probability in [0, 1] that Select
+	// returns an existing underlay, given the number of active underlays.
+	ReuseProbability(active int) float64
+}
+
+// MultiplexFactorSelector is the default UnderlaySelector.
+// With N active underlays, an existing underlay is reused with probability
+// Factor * N / (Factor * N + 1). If Factor is 0, a new underlay is always
+// created.
+type MultiplexFactorSelector struct {
+	Factor int
+
+	rand *randSource // if nil, the global source of math/rand is used
+}
+
+var (
+	_ UnderlaySelector = MultiplexFactorSelector{}
+	_ ReuseEstimator   = MultiplexFactorSelector{}
+)
+
+func (s MultiplexFactorSelector) Select(active []Underlay) Underlay {
+	if s.Factor <= 0 {
+		return nil
+	}
+	reuseUnderlayFactor := len(active) * s.Factor
+	n := s.rand.Intn(reuseUnderlayFactor + 1)
+	if n < reuseUnderlayFactor {
+		return active[n/s.Factor]
+	}
+	return nil
+}
+
+// ReuseProbability implements ReuseEstimator.
+func (s MultiplexFactorSelector) ReuseProbability(active int) float64 {
+	if s.Factor <= 0 || active <= 0 {
+		return 0
+	}
+	f := float64(active * s.Factor)
+	return f / (f + 1)
+}
+
+// FixedProbabilitySelector reuses a random existing underlay with
+// probability P, regardless of how many underlays are active. It is easier
+// to tune than MultiplexFactorSelector: the expected number of sessions per
+// underlay is 1 / (1 - P). If P is 0 or less, a new underlay is always
+// created. If P is 1 or more, an existing underlay is always reused.
+type FixedProbabilitySelector struct {
+	P float64
+
+	rand *randSource // if nil, the global source of math/rand is used
+}
+
+var (
+	_ UnderlaySelector = FixedProbabilitySelector{}
+	_ ReuseEstimator   = FixedProbabilitySelector{}
+)
+
+func (s FixedProbabilitySelector) Select(active []Underlay) Underlay {
+	if s.P <= 0 || s.rand.Float64() >= s.P {
+		return nil
+	}
+	return active[s.rand.Intn(len(active))]
+}
+
+// ReuseProbability implements ReuseEstimator.
+func (s FixedProbabilitySelector) ReuseProbability(active int) float64 {
+	if active <= 0 {
+		return 0
+	}
+	return math.Max(0, math.Min(1, s.P))
+}
+
+// LeastPendingSelector reuses the underlay with the fewest pending sessions.
+// Ties are broken by the number of attached sessions. If MaxSessions
+// is positive and the selected underlay already has that many sessions,
+// a new underlay is created.
+type LeastPendingSelector struct {
+	MaxSessions int
+}
+
+var _ UnderlaySelector = LeastPendingSelector{}
+
+func (s LeastPendingSelector) Select(active []Underlay) Underlay {
+	var best Underlay
+	bestPending, bestSessions := 0, 0
+	for _, underlay := range active {
+		pending := underlay.Scheduler().Pending()
+		sessions := sessionCount(underlay)
+		if best == nil || pending < bestPending || (pending == bestPending && sessions < bestSessions) {
+			best = underlay
+			bestPending = pending
+			bestSessions = sessions
+		}
+	}
+	if best != nil && s.MaxSessions > 0 && bestSessions >= s.MaxSessions {
+		return nil
+	}
+	return best
+}
+
+func (m *Mux) SetUnderlaySelector(selector UnderlaySelector) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set underlay selector in server mux")
+	}
+	if m.used {
+		panic("Can't set underlay selector after mux is used")
+	}
+	m.selector = selector
+	return m
+}
+
+func (m *Mux) SetReuseProbability(p float64) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set reuse probability in server mux")
+	}
+	if math.IsNaN(p) || p < 0 || p > 1 {
+		panic(fmt.Sprintf("Reuse probability %v is not in [0, 1]", p))
+	}
+	if m.used {
+		panic("Can't set reuse probability after mux is used")
+	}
+	m.selector = FixedProbabilitySelector{P: p, rand: &m.rand}
+	m.logf(log.InfoLevel, "Mux reuse probability is set to %v", p)
+	return m
+}
+
+// ReuseProbability returns the probability that the next DialContext
+// reuses an existing underlay, given the current underlays. With the
+// default selector and N active underlays that can accept a new session,
+// it is F * N / (F * N + 1), where F is the multiplex factor. It is 0
+// without any such underlay, and 1 when the maximum number of underlays
+// is reached or the mux is under memory pressure. It returns -1 if the
+// underlay selector doesn't implement ReuseEstimator. It is always 0
+// for a server mux.
+func (m *Mux) ReuseProbability() float64 {
+	if !m.isClient {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	active := len(m.schedulableUnderlays(nil))
+	if active == 0 {
+		return 0
+	}
+	if m.isMaxUnderlaysReached() || m.underMemoryPressure() {
+		return 1
+	}
+	var selector UnderlaySelector = MultiplexFactorSelector{Factor: m.multiplexFactor}
+	if m.selector != nil {
+		selector = m.selector
+	}
+	if estimator, ok := selector.(ReuseEstimator); ok {
+		return estimator.ReuseProbability(active)
+	}
+	return -1
+}
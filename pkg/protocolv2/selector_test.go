@@ -0,0 +1,182 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"math"
+	mrand "math/rand"
+	"testing"
+)
+
+func TestMultiplexFactorSelector(t *testing.T) {
+	active := []Underlay{newFakeUnderlay(true), newFakeUnderlay(true)}
+	if got := (MultiplexFactorSelector{Factor: 0}).Select(active); got != nil {
+		t.Errorf("Select() with factor 0 returned %v, want nil", got)
+	}
+	reused := 0
+	for i := 0; i < 1000; i++ {
+		if (MultiplexFactorSelector{Factor: 2}).Select(active) != nil {
+			reused++
+		}
+	}
+	// Expected reuse probability is 4 / 5.
+	if reused < 700 || reused > 900 {
+		t.Errorf("underlay is reused %d times out of 1000, want about 800", reused)
+	}
+}
+
+func TestLeastPendingSelector(t *testing.T) {
+	a, b, c := newFakeUnderlay(true), newFakeUnderlay(true), newFakeUnderlay(true)
+	a.Scheduler().IncPending()
+	a.Scheduler().IncPending()
+	b.Scheduler().IncPending()
+	c.Scheduler().IncPending()
+	if err := c.AddSession(NewSession(1, true, 1500), nil); err != nil {
+		t.Fatalf("AddSession() failed: %v", err)
+	}
+	active := []Underlay{a, b, c}
+
+	if got := (LeastPendingSelector{}).Select(active); got != b {
+		t.Errorf("Select() returned %v, want %v", got, b)
+	}
+	b.Scheduler().IncPending()
+	b.Scheduler().IncPending()
+	if got := (LeastPendingSelector{}).Select(active); got != c {
+		t.Errorf("Select() returned %v, want %v", got, c)
+	}
+	if got := (LeastPendingSelector{MaxSessions: 1}).Select(active); got != nil {
+		t.Errorf("Select() with MaxSessions returned %v, want nil", got)
+	}
+}
+
+func TestMuxUnderlaySelector(t *testing.T) {
+	mux := NewMux(true).SetUnderlaySelector(LeastPendingSelector{})
+	defer mux.Close()
+	a, b := newFakeUnderlay(true), newFakeUnderlay(true)
+	a.Scheduler().IncPending()
+	closed := newFakeUnderlay(true)
+	close(closed.done)
+	mux.underlays = []Underlay{closed, a, b}
+	UnderlayCurrEstablished.Add(2)
+	if got := mux.maybePickExistingUnderlay(nil); got != b {
+		t.Errorf("maybePickExistingUnderlay() returned %v, want %v", got, b)
+	}
+}
+
+func TestMultiplexFactorReuseProbability(t *testing.T) {
+	for factor := 0; factor <= 3; factor++ {
+		for n := 0; n <= 4; n++ {
+			want := 0.0
+			if factor*n > 0 {
+				want = float64(factor*n) / float64(factor*n+1)
+			}
+			s := MultiplexFactorSelector{Factor: factor}
+			if got := s.ReuseProbability(n); math.Abs(got-want) > 1e-9 {
+				t.Errorf("ReuseProbability(%d) with factor %d = %v, want %v", n, factor, got, want)
+			}
+			if n == 0 {
+				continue
+			}
+
+			// The probability matches how often Select reuses an underlay.
+			active := make([]Underlay, n)
+			for i := range active {
+				active[i] = newFakeUnderlay(true)
+			}
+			s.rand = &randSource{}
+			s.rand.set(mrand.NewSource(int64(factor*10 + n)))
+			reused := 0
+			for i := 0; i < 2000; i++ {
+				if s.Select(active) != nil {
+					reused++
+				}
+			}
+			if got := float64(reused) / 2000; math.Abs(got-want) > 0.05 {
+				t.Errorf("underlay is reused with frequency %v with factor %d and %d underlays, want %v", got, factor, n, want)
+			}
+		}
+	}
+}
+
+func TestFixedProbabilitySelector(t *testing.T) {
+	active := []Underlay{newFakeUnderlay(true), newFakeUnderlay(true), newFakeUnderlay(true)}
+	for _, p := range []float64{0, 0.25, 0.5, 0.9, 1} {
+		s := FixedProbabilitySelector{P: p, rand: &randSource{}}
+		s.rand.set(mrand.NewSource(1))
+		if got := s.ReuseProbability(len(active)); got != p {
+			t.Errorf("ReuseProbability() = %v, want %v", got, p)
+		}
+		reused := 0
+		for i := 0; i < 2000; i++ {
+			if s.Select(active) != nil {
+				reused++
+			}
+		}
+		if got := float64(reused) / 2000; math.Abs(got-p) > 0.05 {
+			t.Errorf("underlay is reused with frequency %v, want %v", got, p)
+		}
+	}
+	if got := (FixedProbabilitySelector{P: 0.5}).ReuseProbability(0); got != 0 {
+		t.Errorf("ReuseProbability(0) = %v, want 0", got)
+	}
+}
+
+func TestMuxReuseProbability(t *testing.T) {
+	mux := NewMux(true).SetClientMultiplexFactor(2)
+	defer mux.Close()
+	if got := mux.ReuseProbability(); got != 0 {
+		t.Errorf("ReuseProbability() without underlay = %v, want 0", got)
+	}
+	for n := 1; n <= 3; n++ {
+		mux.underlays = append(mux.underlays, newFakeUnderlay(true))
+		UnderlayCurrEstablished.Add(1)
+		want := float64(2*n) / float64(2*n+1)
+		if got := mux.ReuseProbability(); math.Abs(got-want) > 1e-9 {
+			t.Errorf("ReuseProbability() with %d underlays = %v, want %v", n, got, want)
+		}
+	}
+
+	// The maximum number of underlays is reached.
+	mux.maxUnderlays = 3
+	if got := mux.ReuseProbability(); got != 1 {
+		t.Errorf("ReuseProbability() at maximum underlays = %v, want 1", got)
+	}
+	mux.maxUnderlays = 0
+
+	mux.selector = FixedProbabilitySelector{P: 0.3}
+	if got := mux.ReuseProbability(); got != 0.3 {
+		t.Errorf("ReuseProbability() with fixed probability = %v, want 0.3", got)
+	}
+	mux.selector = LeastPendingSelector{}
+	if got := mux.ReuseProbability(); got != -1 {
+		t.Errorf("ReuseProbability() with a selector that doesn't estimate = %v, want -1", got)
+	}
+}
+
+func TestSetReuseProbability(t *testing.T) {
+	mux := NewMux(true).SetReuseProbability(0.75)
+	defer mux.Close()
+	s, ok := mux.selector.(FixedProbabilitySelector)
+	if !ok || s.P != 0.75 {
+		t.Errorf("selector is %v, want FixedProbabilitySelector with P 0.75", mux.selector)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("SetReuseProbability(1.5) didn't panic")
+		}
+	}()
+	NewMux(true).SetReuseProbability(1.5)
+}
@@ -17,11 +17,14 @@ package protocolv2
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/enfein/mieru/pkg/appctl/appctlpb"
@@ -34,6 +37,10 @@ import (
 	"github.com/enfein/mieru/pkg/util"
 )
 
+// DefaultSessionWriteBuffer is the default number of bytes a session can
+// queue before they are handed to the underlay.
+const DefaultSessionWriteBuffer = 4 * 1024 * 1024
+
 const (
 	segmentTreeCapacity = 64 * 1024
 	segmentChanCapacity = 1024
@@ -74,23 +81,58 @@ func (ss sessionState) String() string {
 }
 
 type Session struct {
-	conn  Underlay           // underlay connection
+	// conn is the underlay connection. It is replaced when the session
+	// migrates, so it is accessed via underlay() and setUnderlay().
+	conn atomic.Pointer[underlayRef]
+
 	block cipher.BlockCipher // cipher to encrypt and decrypt data
 
-	id         uint32       // session ID number
-	isClient   bool         // if this session is owned by client
-	mtu        int          // L2 maxinum transmission unit
-	remoteAddr net.Addr     // specify remote network address, used by UDP
-	state      sessionState // session state
-	status     statusCode   // session status
-	users      map[string]*appctlpb.User
-
-	ready         chan struct{} // indicate the session is ready to use
-	done          chan struct{} // indicate the session is complete
-	readDeadline  time.Time     // read deadline
-	writeDeadline time.Time     // write deadline
-	inputErr      chan error    // input error
-	outputErr     chan error    // output error
+	id           uint32       // session ID number
+	isClient     bool         // if this session is owned by client
+	mtu          int          // L2 maxinum transmission unit
+	remoteAddr   net.Addr     // specify remote network address, used by UDP
+	state        sessionState // session state
+	status       statusCode   // session status
+	closeErr     error        // the error that caused the session to close
+	users        map[string]*appctlpb.User
+	limiter      *userConnLimiter // nil if the number of sessions is unlimited
+	traffic      *userTrafficTable
+	userTraffic  atomic.Pointer[trafficCounter] // traffic of the user of this session
+	label        string                         // label from the client, empty if not set
+	writeBuffer  int                            // maximum number of bytes in the send queue
+	priority     atomic.Int32                   // SessionPriority of the segments to send
+	capabilities capability                     // offered by the client or supported by the server
+	negotiated   atomic.Pointer[capability]     // capabilities accepted by both peers, nil before they are known
+	resumeToken  atomic.Uint64                  // proves ownership of the session when it migrates, 0 if not resumable
+	createTime   time.Time                      // time the session is created
+	userName     atomic.Pointer[string]         // user of the session, known by the server
+	movedAddr    atomic.Pointer[net.UDPAddr]    // nil if the UDP session is never migrated
+	inBytes      atomic.Int64                   // number of bytes read by the application
+	outBytes     atomic.Int64                   // number of bytes written by the application
+	lastActive   atomic.Int64                   // Unix nanoseconds of the last Read or Write with data, zero if none
+
+	// blockCtx is the block context of the user, known by the server.
+	blockCtx atomic.Pointer[cipher.BlockContext]
+
+	// path validates a new client address before a UDP session moves to it.
+	path pathValidation
+
+	readRate  *byteRateLimiter // protected by rLock, nil if the rate is unlimited
+	writeRate *byteRateLimiter // protected by wLock, nil if the rate is unlimited
+
+	// resend keeps the segments sent over TCP, so the session can be
+	// migrated after it has sent data. It is nil if this is not enabled.
+	resend  *resendBuffer
+	recvSeq atomic.Uint32 // next sequence number to receive over TCP
+
+	ready          chan struct{} // indicate the session is ready to use
+	done           chan struct{} // indicate the session is complete
+	readDeadline   time.Time     // read deadline set by application
+	writeDeadline  time.Time     // write deadline set by application
+	respDeadline   time.Time     // deadline for client to receive a response from server
+	deadlineChange chan struct{} // notify the blocked Read that read deadline is changed
+	inputErr       chan error    // input error
+	outputErr      chan error    // output error
 
 	sendQueue *segmentTree  // segments waiting to send
 	sendBuf   *segmentTree  // segments sent but not acknowledged
@@ -98,11 +140,20 @@ type Session struct {
 	recvQueue *segmentTree  // segments waiting to be read by application
 	recvChan  chan *segment // channel to receive segments from underlay
 
-	nextSend   uint32    // next sequence number to send a segment
-	nextRecv   uint32    // next sequence number to receive
-	lastRXTime time.Time // last timestamp when a segment is received
-	lastTXTime time.Time // last timestamp when a segment is sent
-	unreadBuf  []byte    // payload removed from the recvQueue that haven't been read by application
+	// inputPool processes the segments from recvChan instead of the input
+	// goroutine of the session. It is nil if the session has the goroutine.
+	inputPool      *inputPool
+	inputScheduled atomic.Bool // the session is in the ready queue of inputPool
+	inputStalled   atomic.Bool // inputPool waits for the application to read recvQueue
+	inputFinished  sync.Once   // the input is finished with inputPool
+
+	nextSend   uint32       // next sequence number to send a segment
+	nextRecv   uint32       // next sequence number to receive
+	lastRXTime atomic.Int64 // Unix nanoseconds when a segment is last received
+	lastTXTime atomic.Int64 // Unix nanoseconds when a segment is last sent
+	unreadBuf  []byte       // payload removed from the recvQueue that haven't been read by application
+	readEOF    bool         // the peer has closed the write side, protected by rLock
+	writeEOF   bool         // the write side is closed by CloseWrite, protected by wLock
 
 	readBytes  metrics.Metric // number of bytes delivered to the application
 	writeBytes metrics.Metric // number of bytes sent from the application
@@ -115,28 +166,48 @@ type Session struct {
 	rLock sync.Mutex
 	wLock sync.Mutex
 	sLock sync.Mutex
+	dLock sync.Mutex // protect deadlines
+	fLock sync.Mutex // protect remoteWindowSize
+	cLock sync.Mutex // protect block
 }
 
 // Session must implement net.Conn interface.
 var _ net.Conn = &Session{}
 
+// SessionInfo is a snapshot of the status of a session.
+type SessionInfo struct {
+	ID                uint32
+	IsClient          bool
+	User              string    // empty if the user is unknown, e.g. on the client
+	Label             string    // label set by the client with DialContextWithLabel
+	CreateTime        time.Time // time the session is created; the age is time.Since(CreateTime)
+	InBytes           int64     // number of bytes read by the application
+	OutBytes          int64     // number of bytes written by the application
+	LocalAddr         net.Addr  // local address of the underlay
+	RemoteAddr        net.Addr  // remote address of the peer
+	TransportProtocol util.TransportProtocol
+}
+
 // NewSession creates a new session.
 func NewSession(id uint32, isClient bool, mtu int) *Session {
 	rttStat := congestion.NewRTTStats()
 	rttStat.SetMaxAckDelay(segmentAckDelay)
 	rttStat.SetRTOMultiplier(1.5)
-	return &Session{
-		conn:             nil,
+	s := &Session{
 		block:            nil,
 		id:               id,
 		isClient:         isClient,
 		mtu:              mtu,
+		writeBuffer:      DefaultSessionWriteBuffer,
+		createTime:       time.Now(),
 		state:            sessionInit,
 		status:           statusOK,
 		ready:            make(chan struct{}),
 		done:             make(chan struct{}),
 		readDeadline:     util.ZeroTime(),
 		writeDeadline:    util.ZeroTime(),
+		respDeadline:     util.ZeroTime(),
+		deadlineChange:   make(chan struct{}, 1),
 		inputErr:         make(chan error, 2), // allow nested
 		outputErr:        make(chan error, 2), // allow nested
 		sendQueue:        newSegmentTree(segmentTreeCapacity),
@@ -144,16 +215,18 @@ func NewSession(id uint32, isClient bool, mtu int) *Session {
 		recvBuf:          newSegmentTree(segmentTreeCapacity),
 		recvQueue:        newSegmentTree(segmentTreeCapacity),
 		recvChan:         make(chan *segment, segmentChanCapacity),
-		lastRXTime:       time.Now(),
-		lastTXTime:       time.Now(),
 		rttStat:          rttStat,
 		sendAlgorithm:    congestion.NewCubicSendAlgorithm(minWindowSize, maxWindowSize),
 		remoteWindowSize: minWindowSize,
 	}
+	now := time.Now().UnixNano()
+	s.lastRXTime.Store(now)
+	s.lastTXTime.Store(now)
+	return s
 }
 
 func (s *Session) String() string {
-	if s.conn == nil {
+	if s.underlay() == nil {
 		return fmt.Sprintf("Session{id=%v}", s.id)
 	}
 	return fmt.Sprintf("Session{id=%v, local=%v, remote=%v}", s.id, s.LocalAddr(), s.RemoteAddr())
@@ -163,22 +236,70 @@ func (s *Session) String() string {
 func (s *Session) Read(b []byte) (n int, err error) {
 	s.rLock.Lock()
 	defer s.rLock.Unlock()
+	if log.IsLevelEnabled(log.TraceLevel) {
+		log.Tracef("%v trying to read %d bytes", s, len(b))
+	}
+	return s.readLocked(func(p []byte) int {
+		return copy(b, p)
+	})
+}
+
+// WriteTo implements io.WriterTo. The received payload is written to w
+// directly, without copying it to an intermediate buffer. It returns when
+// the session is closed by the peer, or when reading the session or
+// writing to w fails.
+func (s *Session) WriteTo(w io.Writer) (n int64, err error) {
+	s.rLock.Lock()
+	defer s.rLock.Unlock()
+	for {
+		var writeErr error
+		nr, err := s.readLocked(func(p []byte) int {
+			nw, err := w.Write(p)
+			if err == nil && nw < len(p) {
+				err = io.ErrShortWrite
+			}
+			writeErr = err
+			return nw
+		})
+		n += int64(nr)
+		if writeErr != nil {
+			return n, writeErr
+		}
+		if err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+	}
+}
+
+// readLocked waits for the received payload and passes it to consume,
+// which returns the number of bytes it takes. The rest is kept for the
+// next read. The caller must hold the rLock.
+func (s *Session) readLocked(consume func([]byte) int) (n int, err error) {
 	if s.isStateBefore(sessionAttached, false) {
 		return 0, fmt.Errorf("%v is not ready for Read()", s)
 	}
 	if s.isStateAfter(sessionClosed, true) {
+		if err := s.rejectError(); err != nil {
+			return 0, err
+		}
 		return 0, io.ErrClosedPipe
 	}
 	defer func() {
-		s.readDeadline = util.ZeroTime()
+		// The server has responded, or the application has given up.
+		s.dLock.Lock()
+		s.respDeadline = util.ZeroTime()
+		s.dLock.Unlock()
 	}()
-	if log.IsLevelEnabled(log.TraceLevel) {
-		log.Tracef("%v trying to read %d bytes", s, len(b))
+	if s.isDeadlineExceeded(true) {
+		return 0, os.ErrDeadlineExceeded
 	}
 
 	// Read remaining data that application failed to read last time.
 	if len(s.unreadBuf) > 0 {
-		n = copy(b, s.unreadBuf)
+		n = consume(s.unreadBuf)
 		if n == len(s.unreadBuf) {
 			s.unreadBuf = nil
 		} else {
@@ -190,13 +311,17 @@ func (s *Session) Read(b []byte) (n int, err error) {
 		if s.readBytes != nil {
 			s.readBytes.Add(int64(n))
 		}
+		if c := s.userTraffic.Load(); c != nil {
+			c.inBytes.Add(int64(n))
+		}
+		s.inBytes.Add(int64(n))
+		s.touch()
+		// The data is already consumed. A deadline fails the next Read.
+		s.throttle(s.readRate, n, true)
 		return n, nil
 	}
-
-	// Stop reading when deadline is reached.
-	var timeC <-chan time.Time
-	if !util.IsZeroTime(s.readDeadline) {
-		timeC = time.After(time.Until(s.readDeadline))
+	if s.readEOF {
+		return 0, io.EOF
 	}
 
 	for {
@@ -210,30 +335,54 @@ func (s *Session) Read(b []byte) (n int, err error) {
 				if s.isClient && seg.metadata.Protocol() == openSessionResponse && s.isState(sessionAttached) {
 					s.forwardStateTo(sessionEstablished)
 				}
+				if das, ok := seg.metadata.(*dataAckStruct); ok && das.flags&dataFlagFIN != 0 && s.hasCapability(capHalfClose) {
+					s.readEOF = true
+				}
 				if s.unreadBuf == nil {
 					s.unreadBuf = make([]byte, 0)
 				}
 				s.unreadBuf = append(s.unreadBuf, seg.payload...)
 			}
+			if s.inputStalled.CompareAndSwap(true, false) {
+				s.wakeInput()
+			}
 			if len(s.unreadBuf) > 0 {
 				break
 			}
+			if s.readEOF {
+				return 0, io.EOF
+			}
 		} else {
 			// Wait for incoming segments.
+			// Stop reading when deadline is reached.
+			timer, timeErr := s.readTimer()
+			var timeC <-chan time.Time
+			if timer != nil {
+				timeC = timer.C
+			}
 			select {
 			case <-s.done:
+				stopTimer(timer)
+				if err := s.rejectError(); err != nil {
+					return 0, err
+				}
 				return 0, io.EOF
 			case <-s.inputErr:
+				stopTimer(timer)
 				return 0, io.ErrUnexpectedEOF
 			case <-timeC:
-				return 0, stderror.ErrTimeout
+				return 0, timeErr
+			case <-s.deadlineChange:
+				// Read deadline is changed. Restart the timer.
+				stopTimer(timer)
 			case <-s.recvQueue.chanNotEmptyEvent:
 				// New segments are ready to read.
+				stopTimer(timer)
 			}
 		}
 	}
 
-	n = copy(b, s.unreadBuf)
+	n = consume(s.unreadBuf)
 	if n == len(s.unreadBuf) {
 		s.unreadBuf = nil
 	} else {
@@ -245,10 +394,21 @@ func (s *Session) Read(b []byte) (n int, err error) {
 	if s.readBytes != nil {
 		s.readBytes.Add(int64(n))
 	}
+	if c := s.userTraffic.Load(); c != nil {
+		c.inBytes.Add(int64(n))
+	}
+	s.inBytes.Add(int64(n))
+	s.touch()
+	// The data is already consumed. A deadline fails the next Read.
+	s.throttle(s.readRate, n, true)
 	return n, nil
 }
 
-// Write stores the data to send queue.
+// Write stores the data to send queue. It blocks when the send queue holds
+// more bytes than the write buffer of the session, until the underlay
+// takes them. If the session is closed or the write deadline is reached
+// while blocked, Write returns the number of bytes that are queued and
+// will be delivered, together with the error.
 func (s *Session) Write(b []byte) (n int, err error) {
 	s.wLock.Lock()
 	defer s.wLock.Unlock()
@@ -256,48 +416,36 @@ func (s *Session) Write(b []byte) (n int, err error) {
 		return 0, fmt.Errorf("%v is not ready for Write()", s)
 	}
 	if s.isStateAfter(sessionClosed, true) {
+		if err := s.rejectError(); err != nil {
+			return 0, err
+		}
+		return 0, io.ErrClosedPipe
+	}
+	if s.isDeadlineExceeded(false) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if s.writeEOF {
 		return 0, io.ErrClosedPipe
 	}
-	defer func() {
-		s.writeDeadline = util.ZeroTime()
-	}()
 
-	if s.isClient && s.isState(sessionAttached) {
-		// Before the first write, client needs to send open session request.
-		seg := &segment{
-			metadata: &sessionStruct{
-				baseStruct: baseStruct{
-					protocol: uint8(openSessionRequest),
-				},
-				sessionID: s.id,
-				seq:       s.nextSend,
-			},
-			transport: s.conn.TransportProtocol(),
-		}
-		s.nextSend++
-		if len(b) <= MaxSessionOpenPayload {
-			seg.metadata.(*sessionStruct).payloadLen = uint16(len(b))
-			seg.payload = make([]byte, len(b))
-			copy(seg.payload, b)
-		}
-		if log.IsLevelEnabled(log.TraceLevel) {
-			log.Tracef("%v writing %d bytes with open session request", s, len(seg.payload))
-		}
-		s.sendQueue.InsertBlocking(seg)
-		if len(seg.payload) > 0 {
-			return len(seg.payload), nil
+	if s.isClient && s.isState(sessionAttached) && s.nextSend == 0 {
+		if n := s.writeOpenSessionRequest(b); n > 0 {
+			return n, nil
 		}
 	}
 
-	n = len(b)
 	if log.IsLevelEnabled(log.TraceLevel) {
-		log.Tracef("%v writing %d bytes", s, n)
+		log.Tracef("%v writing %d bytes", s, len(b))
 	}
 	for len(b) > 0 {
 		sizeToSend := mathext.Min(len(b), maxPDU)
+		if err = s.throttle(s.writeRate, sizeToSend, false); err != nil {
+			break
+		}
 		if _, err = s.writeChunk(b[:sizeToSend]); err != nil {
-			return 0, err
+			break
 		}
+		n += sizeToSend
 		b = b[sizeToSend:]
 	}
 	if log.IsLevelEnabled(log.TraceLevel) {
@@ -306,7 +454,168 @@ func (s *Session) Write(b []byte) (n int, err error) {
 	if s.writeBytes != nil {
 		s.writeBytes.Add(int64(n))
 	}
-	return n, nil
+	if c := s.userTraffic.Load(); c != nil {
+		c.outBytes.Add(int64(n))
+	}
+	s.outBytes.Add(int64(n))
+	s.touch()
+	return n, err
+}
+
+// CloseWrite closes the write side of the session. The peer reads EOF
+// after it has read all the data written before, and it can still write
+// to the session. Write returns an error after CloseWrite is called.
+// Close must still be called to release the session.
+//
+// It returns an error if the peer doesn't support half-close, which is
+// known after the open session request and response are exchanged.
+// Before that, the client closes the write side anyway. Peers without
+// the support read the request as an empty data segment and ignore it.
+func (s *Session) CloseWrite() error {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	if s.isStateBefore(sessionAttached, false) {
+		return fmt.Errorf("%v is not ready for CloseWrite()", s)
+	}
+	if s.isStateAfter(sessionClosed, true) {
+		return io.ErrClosedPipe
+	}
+	if s.writeEOF {
+		return nil
+	}
+	if s.negotiated.Load() != nil && !s.hasCapability(capHalfClose) {
+		return fmt.Errorf("peer doesn't support CloseWrite(): %w", stderror.ErrUnsupported)
+	}
+	if s.isClient && s.isState(sessionAttached) && s.nextSend == 0 {
+		s.writeOpenSessionRequest(nil)
+	}
+	var protocol uint8
+	if s.isClient {
+		protocol = uint8(dataClientToServer)
+	} else {
+		protocol = uint8(dataServerToClient)
+	}
+	seg := &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{
+				protocol: protocol,
+			},
+			sessionID:  s.id,
+			seq:        s.nextSend,
+			unAckSeq:   s.nextRecv,
+			windowSize: uint16(mathext.Max(0, int(s.sendAlgorithm.CongestionWindowSize())-s.recvBuf.Len())),
+			flags:      dataFlagFIN,
+		},
+		transport: s.underlay().TransportProtocol(),
+	}
+	s.nextSend++
+	if log.IsLevelEnabled(log.TraceLevel) {
+		log.Tracef("%v closing write side", s)
+	}
+	s.sendQueue.InsertBlocking(seg)
+	s.writeEOF = true
+	return nil
+}
+
+// writeOpenSessionRequest sends the open session request before the first
+// write of the client. Later writes before the response is received send
+// data segments. The data is sent with the request if it is small enough,
+// and the number of bytes sent this way is returned.
+// The caller must hold the wLock.
+func (s *Session) writeOpenSessionRequest(b []byte) int {
+	seg := &segment{
+		metadata: &sessionStruct{
+			baseStruct: baseStruct{
+				protocol:     uint8(openSessionRequest),
+				capabilities: uint8(s.capabilities),
+			},
+			sessionID: s.id,
+			seq:       s.nextSend,
+			labelLen:  uint8(len(s.label)),
+			label:     []byte(s.label),
+		},
+		transport: s.underlay().TransportProtocol(),
+	}
+	s.nextSend++
+	if len(b) <= MaxSessionOpenPayload {
+		seg.metadata.(*sessionStruct).payloadLen = uint16(len(b))
+		seg.payload = make([]byte, len(b))
+		copy(seg.payload, b)
+	}
+	if log.IsLevelEnabled(log.TraceLevel) {
+		log.Tracef("%v writing %d bytes with open session request", s, len(seg.payload))
+	}
+	s.sendQueue.InsertBlocking(seg)
+	s.outBytes.Add(int64(len(seg.payload)))
+	return len(seg.payload)
+}
+
+// ReadFrom implements io.ReaderFrom. Data is read from r in chunks of up
+// to the maximum PDU size into a single buffer, and each chunk is copied
+// into the payload of the segments, so a short read doesn't hold a whole
+// PDU in the send queue. It returns when r reaches EOF, or when reading r
+// or writing the session fails.
+func (s *Session) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, maxPDU)
+	for {
+		nr, readErr := r.Read(buf)
+		if nr > 0 {
+			nw, err := s.Write(buf[:nr])
+			n += int64(nw)
+			if err != nil {
+				return n, err
+			}
+		}
+		if readErr != nil {
+			if readErr == io.EOF {
+				return n, nil
+			}
+			return n, readErr
+		}
+	}
+}
+
+// Flush blocks until all the data stored in the send queue is handed to
+// the underlay. It wakes up the output loop immediately rather than waiting
+// for the next tick, which helps latency-sensitive request / response
+// traffic.
+//
+// Each flushed write goes out as its own segment, so calling Flush after
+// every small write produces many short segments. They are padded by the
+// underlay like any other segment, but the padding overhead is higher and
+// the segment sizes follow the application writes more closely.
+func (s *Session) Flush() error {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	if s.isStateBefore(sessionAttached, false) {
+		return fmt.Errorf("%v is not ready for Flush()", s)
+	}
+	if s.isStateAfter(sessionClosed, true) {
+		if err := s.rejectError(); err != nil {
+			return err
+		}
+		return io.ErrClosedPipe
+	}
+
+	timeC := s.writeDeadlineC()
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	s.sendQueue.notifyNotEmpty()
+	for s.sendQueue.Len() > 0 {
+		select {
+		case <-s.done:
+			return io.EOF
+		case <-s.outputErr:
+			return io.ErrClosedPipe
+		case <-timeC:
+			return os.ErrDeadlineExceeded
+		case <-s.sendQueue.chanEmptyEvent:
+		case <-ticker.C:
+		}
+	}
+	// Give back the empty event that may be consumed above, Close waits for it.
+	s.sendQueue.notifyEmpty()
+	return nil
 }
 
 // Close terminates the session.
@@ -334,10 +643,10 @@ func (s *Session) Close() error {
 				seq:        s.nextSend,
 				statusCode: uint8(s.status),
 			},
-			transport: s.conn.TransportProtocol(),
+			transport: s.underlay().TransportProtocol(),
 		}
 		s.nextSend++
-		switch s.conn.TransportProtocol() {
+		switch s.underlay().TransportProtocol() {
 		case util.TCPTransport:
 			s.sendQueue.InsertBlocking(seg)
 		case util.UDPTransport:
@@ -345,7 +654,7 @@ func (s *Session) Close() error {
 				log.Debugf("output() failed: %v", err)
 			}
 		default:
-			log.Debugf("Unsupported transport protocol %v", s.conn.TransportProtocol())
+			log.Debugf("Unsupported transport protocol %v", s.underlay().TransportProtocol())
 		}
 	}
 
@@ -358,40 +667,372 @@ func (s *Session) Close() error {
 
 	s.forwardStateTo(sessionClosed)
 	close(s.done)
+	s.wakeInput()
 	metrics.CurrEstablished.Add(-1)
 	return nil
 }
 
+// touch records that the application has read or written data.
+func (s *Session) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+// idleTime returns the time since the application last read or wrote data.
+func (s *Session) idleTime() time.Duration {
+	if last := s.lastActive.Load(); last != 0 {
+		return time.Since(time.Unix(0, last))
+	}
+	return time.Since(s.createTime)
+}
+
+// closeWhenIdle closes the session after the application doesn't read or
+// write any data for d, even if the underlay of the session is still busy.
+// The close is logged with logf, which is the logf of the mux.
+func (s *Session) closeWhenIdle(d time.Duration, logf func(level log.Level, format string, args ...any)) {
+	go func() {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-timer.C:
+			}
+			idle := s.idleTime()
+			if idle >= d {
+				logf(log.DebugLevel, "Closing %v idle for %v", s, idle)
+				s.closeWithError(fmt.Errorf("session is idle for %v: %w", idle, stderror.ErrTimeout))
+				return
+			}
+			timer.Reset(d - idle)
+		}
+	}()
+}
+
+// closeWithError records the error that caused the session to close,
+// and then terminates the session.
+func (s *Session) closeWithError(err error) error {
+	s.setCloseError(err)
+	return s.Close()
+}
+
+// setCloseError records the error that causes the session to close,
+// if there isn't one.
+func (s *Session) setCloseError(err error) {
+	s.sLock.Lock()
+	defer s.sLock.Unlock()
+	if s.closeErr == nil {
+		s.closeErr = err
+	}
+}
+
+// reject closes the server session, and tells the client the reason.
+func (s *Session) reject(code statusCode) error {
+	s.wLock.Lock()
+	s.status = code
+	s.wLock.Unlock()
+	return s.Close()
+}
+
+// rejectError returns the error to report to the application if the
+// session is rejected by the server, or nil otherwise.
+func (s *Session) rejectError() error {
+	var rejectErr *RejectError
+	if err := s.closeError(); errors.As(err, &rejectErr) {
+		return rejectErr
+	}
+	return nil
+}
+
+// closeError returns the error that caused the session to close,
+// or nil if the session is closed normally.
+func (s *Session) closeError() error {
+	s.sLock.Lock()
+	defer s.sLock.Unlock()
+	return s.closeErr
+}
+
+// underlayRef wraps an Underlay so it can be stored in an atomic pointer.
+type underlayRef struct {
+	Underlay
+}
+
+// underlay returns the underlay of the session, or nil if the session
+// is not attached to an underlay.
+func (s *Session) underlay() Underlay {
+	if ref := s.conn.Load(); ref != nil {
+		return ref.Underlay
+	}
+	return nil
+}
+
+// setUnderlay attaches the session to the underlay, or detaches it if the
+// underlay is nil.
+func (s *Session) setUnderlay(u Underlay) {
+	if u == nil {
+		s.conn.Store(nil)
+		return
+	}
+	s.conn.Store(&underlayRef{u})
+}
+
+// ID returns the session ID.
+func (s *Session) ID() uint32 {
+	return s.id
+}
+
+// User returns the name of the user authenticated by the server, e.g. for
+// authorization and logging. It is known when the session is accepted.
+// It returns an empty string in the client.
+func (s *Session) User() string {
+	if name := s.userName.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+// setUser records the user of a server session from the block cipher that
+// decrypted its segment, if the user is not known yet.
+func (s *Session) setUser(block cipher.BlockCipher) {
+	if block == nil || s.userName.Load() != nil {
+		return
+	}
+	bc := block.BlockContext()
+	if bc.UserName == "" {
+		return
+	}
+	name := bc.UserName
+	s.blockCtx.Store(&bc)
+	s.userName.Store(&name)
+}
+
+// BlockContext returns the block context of the user authenticated by the
+// server, including the values set by the function of SetBlockContextFunc.
+// It returns a zero value before the user is known, and in the client.
+func (s *Session) BlockContext() cipher.BlockContext {
+	if bc := s.blockCtx.Load(); bc != nil {
+		return *bc
+	}
+	return cipher.BlockContext{}
+}
+
+// Label returns the label set by the client with DialContextWithLabel.
+// It is empty if the client didn't set a label.
+func (s *Session) Label() string {
+	return s.label
+}
+
+// TransportProtocol returns the transport protocol of the underlay that
+// carries the session, e.g. for logging or policy on the server. It
+// returns UnknownTransport if the session is not attached to an underlay.
+func (s *Session) TransportProtocol() util.TransportProtocol {
+	conn := s.underlay()
+	if conn == nil {
+		return util.UnknownTransport
+	}
+	return underlayTransport(conn)
+}
+
+// underlayTransport returns the transport protocol of the underlay,
+// including the TLS or WebSocket wrapper of a TCP underlay.
+func underlayTransport(u Underlay) util.TransportProtocol {
+	if t, ok := u.(*TCPUnderlay); ok && t.wrapper != util.UnknownTransport {
+		return t.wrapper
+	}
+	return u.TransportProtocol()
+}
+
+// info returns a snapshot of the session attached to the underlay.
+func (s *Session) info(u Underlay) SessionInfo {
+	info := SessionInfo{
+		ID:                s.id,
+		IsClient:          s.isClient,
+		Label:             s.label,
+		CreateTime:        s.createTime,
+		InBytes:           s.inBytes.Load(),
+		OutBytes:          s.outBytes.Load(),
+		LocalAddr:         u.LocalAddr(),
+		RemoteAddr:        u.RemoteAddr(),
+		TransportProtocol: underlayTransport(u),
+	}
+	if name := s.userName.Load(); name != nil {
+		info.User = *name
+	}
+	if s.remoteAddr != nil {
+		info.RemoteAddr = s.RemoteAddr()
+	}
+	return info
+}
+
+// Priority returns the priority of the session.
+func (s *Session) Priority() SessionPriority {
+	return SessionPriority(s.priority.Load())
+}
+
+// SetPriority sets the priority of the session. It can be changed at any
+// time, and it applies to the segments sent after the call. The default
+// is PriorityNormal.
+func (s *Session) SetPriority(p SessionPriority) error {
+	if !p.isValid() {
+		return fmt.Errorf("invalid session priority %d: %w", p, stderror.ErrInvalidArgument)
+	}
+	s.priority.Store(int32(p))
+	return nil
+}
+
+// Compression returns the compression algorithm negotiated with the peer.
+// It is CompressionNone before the open session response is exchanged,
+// or if the peer doesn't support the offered algorithm.
+func (s *Session) Compression() Compression {
+	if s.hasCapability(capZstd) {
+		return CompressionZstd
+	}
+	return CompressionNone
+}
+
+// setWriteBuffer sets the maximum number of bytes in the send queue.
+func (s *Session) setWriteBuffer(n int) {
+	s.wLock.Lock()
+	defer s.wLock.Unlock()
+	s.writeBuffer = n
+}
+
+// BlockedOnFlowControl returns true if the data written to the session
+// can't be sent now, because the send queue is full, or the peer doesn't
+// accept more data. In this state a Write is likely to block, so a proxy
+// may stop reading from the origin until the flag is cleared.
+func (s *Session) BlockedOnFlowControl() bool {
+	if s.sendQueue.Remaining() == 0 {
+		return true
+	}
+	if conn := s.underlay(); conn == nil || conn.TransportProtocol() != util.UDPTransport || s.sendQueue.Len() == 0 {
+		// TCP applies the backpressure by blocking the output.
+		return false
+	}
+	// The output loop can't move segments from sendQueue to sendBuf.
+	return s.getRemoteWindowSize() == 0 || s.sendBuf.Remaining() == 0
+}
+
+// getBlock returns the cipher of the session, or nil if it is not known yet.
+func (s *Session) getBlock() cipher.BlockCipher {
+	s.cLock.Lock()
+	defer s.cLock.Unlock()
+	return s.block
+}
+
+// setBlock sets the cipher of the session.
+func (s *Session) setBlock(block cipher.BlockCipher) {
+	s.cLock.Lock()
+	defer s.cLock.Unlock()
+	s.block = block
+}
+
+// getRemoteWindowSize returns the last window size received from the peer.
+func (s *Session) getRemoteWindowSize() uint16 {
+	s.fLock.Lock()
+	defer s.fLock.Unlock()
+	return s.remoteWindowSize
+}
+
+// setRemoteWindowSize records the window size received from the peer.
+func (s *Session) setRemoteWindowSize(size uint16) {
+	s.fLock.Lock()
+	defer s.fLock.Unlock()
+	s.remoteWindowSize = size
+}
+
 func (s *Session) LocalAddr() net.Addr {
-	return s.conn.LocalAddr()
+	return s.underlay().LocalAddr()
 }
 
 func (s *Session) RemoteAddr() net.Addr {
+	if addr := s.movedAddr.Load(); addr != nil {
+		return addr
+	}
 	if !util.IsNilNetAddr(s.remoteAddr) {
 		return s.remoteAddr
 	}
-	return s.conn.RemoteAddr()
+	return s.underlay().RemoteAddr()
 }
 
 // SetDeadline implements net.Conn.
 func (s *Session) SetDeadline(t time.Time) error {
-	s.readDeadline = t
-	s.writeDeadline = t
+	s.SetReadDeadline(t)
+	s.SetWriteDeadline(t)
 	return nil
 }
 
 // SetReadDeadline implements net.Conn.
+// A blocked Read returns os.ErrDeadlineExceeded when the deadline is reached.
+// The deadline applies to all future Read calls until it is changed.
 func (s *Session) SetReadDeadline(t time.Time) error {
+	s.dLock.Lock()
 	s.readDeadline = t
+	s.dLock.Unlock()
+	select {
+	case s.deadlineChange <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
 // SetWriteDeadline implements net.Conn.
+// Write returns os.ErrDeadlineExceeded when the deadline is reached.
+// The deadline applies to all future Write calls until it is changed.
 func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.dLock.Lock()
 	s.writeDeadline = t
+	s.dLock.Unlock()
 	return nil
 }
 
+// isDeadlineExceeded returns true if the read or write deadline
+// set by application is reached.
+func (s *Session) isDeadlineExceeded(read bool) bool {
+	s.dLock.Lock()
+	defer s.dLock.Unlock()
+	deadline := s.writeDeadline
+	if read {
+		deadline = s.readDeadline
+	}
+	return !util.IsZeroTime(deadline) && !time.Now().Before(deadline)
+}
+
+// readTimer returns a timer that fires at the earliest read deadline,
+// and the error to return when it fires. The timer is nil if there is
+// no read deadline.
+func (s *Session) readTimer() (*time.Timer, error) {
+	s.dLock.Lock()
+	defer s.dLock.Unlock()
+	deadline := s.readDeadline
+	timeErr := os.ErrDeadlineExceeded
+	if !util.IsZeroTime(s.respDeadline) && (util.IsZeroTime(deadline) || s.respDeadline.Before(deadline)) {
+		deadline = s.respDeadline
+		timeErr = stderror.ErrTimeout
+	}
+	if util.IsZeroTime(deadline) {
+		return nil, nil
+	}
+	return time.NewTimer(time.Until(deadline)), timeErr
+}
+
+// writeDeadlineC returns a channel that fires at the write deadline,
+// or nil if there is no write deadline.
+func (s *Session) writeDeadlineC() <-chan time.Time {
+	s.dLock.Lock()
+	defer s.dLock.Unlock()
+	if util.IsZeroTime(s.writeDeadline) {
+		return nil
+	}
+	return time.After(time.Until(s.writeDeadline))
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
 func (s *Session) isState(target sessionState) bool {
 	s.sLock.Lock()
 	defer s.sLock.Unlock()
@@ -430,19 +1071,50 @@ func (s *Session) forwardStateTo(new sessionState) {
 	s.state = new
 }
 
+// canMigrate returns true if the session can be moved to another underlay.
+// A client session that hasn't sent the open session request can always be
+// migrated. Otherwise, the segments in flight of the old underlay must be
+// kept by the resend buffer. The caller must hold the wLock.
+func (s *Session) canMigrate() bool {
+	if !s.isClient {
+		return false
+	}
+	if s.isState(sessionAttached) && s.nextSend == 0 {
+		return true
+	}
+	return s.canResume()
+}
+
 func (s *Session) writeChunk(b []byte) (n int, err error) {
 	if len(b) > maxPDU {
 		return 0, io.ErrShortWrite
 	}
 
 	// Stop writing when deadline is reached.
-	var timeC <-chan time.Time
-	if !util.IsZeroTime(s.writeDeadline) {
-		timeC = time.After(time.Until(s.writeDeadline))
+	timeC := s.writeDeadlineC()
+
+	// Wait until the whole chunk fits in the write buffer, so a chunk is
+	// never partially queued. An empty send queue always takes a chunk.
+	for {
+		queued := s.sendQueue.Bytes()
+		if queued == 0 || queued+len(b) <= s.writeBuffer {
+			break
+		}
+		select {
+		case <-s.done:
+			return 0, io.EOF
+		case <-s.outputErr:
+			return 0, io.ErrClosedPipe
+		case <-timeC:
+			return 0, os.ErrDeadlineExceeded
+		case <-s.sendQueue.chanDeleteEvent:
+		}
 	}
 
 	nFragment := 1
-	fragmentSize := MaxFragmentSize(s.mtu, s.conn.IPVersion(), s.conn.TransportProtocol())
+	// The MTU of underlay may be changed by path MTU discovery.
+	conn := s.underlay()
+	fragmentSize := MaxFragmentSize(conn.MTU(), conn.IPVersion(), conn.TransportProtocol())
 	if len(b) > fragmentSize {
 		nFragment = (len(b)-1)/fragmentSize + 1
 	}
@@ -455,7 +1127,7 @@ func (s *Session) writeChunk(b []byte) (n int, err error) {
 		case <-s.outputErr:
 			return 0, io.ErrClosedPipe
 		case <-timeC:
-			return 0, stderror.ErrTimeout
+			return 0, os.ErrDeadlineExceeded
 		default:
 		}
 		var protocol uint8
@@ -466,6 +1138,15 @@ func (s *Session) writeChunk(b []byte) (n int, err error) {
 		}
 		partLen := mathext.Min(fragmentSize, len(ptr))
 		part := ptr[:partLen]
+		var flags uint8
+		copied := true
+		if c := s.Compression(); c != CompressionNone {
+			if cb, ok := compress(c, part); ok {
+				flags = dataFlagCompressed
+				part = cb
+				copied = false
+			}
+		}
 		seg := &segment{
 			metadata: &dataAckStruct{
 				baseStruct: baseStruct{
@@ -476,19 +1157,25 @@ func (s *Session) writeChunk(b []byte) (n int, err error) {
 				unAckSeq:   s.nextRecv,
 				windowSize: uint16(mathext.Max(0, int(s.sendAlgorithm.CongestionWindowSize())-s.recvBuf.Len())),
 				fragment:   uint8(i),
-				payloadLen: uint16(partLen),
+				payloadLen: uint16(len(part)),
+				flags:      flags,
 			},
-			payload:   make([]byte, partLen),
-			transport: s.conn.TransportProtocol(),
+			payload:   part,
+			transport: s.underlay().TransportProtocol(),
+		}
+		if copied {
+			seg.payload = make([]byte, len(part))
+			copy(seg.payload, part)
 		}
-		copy(seg.payload, part)
 		s.nextSend++
 		s.sendQueue.InsertBlocking(seg)
 		ptr = ptr[partLen:]
 	}
 
 	if s.isClient {
-		s.readDeadline = time.Now().Add(serverRespTimeout)
+		s.dLock.Lock()
+		s.respDeadline = time.Now().Add(serverRespTimeout)
+		s.dLock.Unlock()
 	}
 	return len(b), nil
 }
@@ -501,20 +1188,62 @@ func (s *Session) runInputLoop(ctx context.Context) error {
 		case <-s.done:
 			return nil
 		case seg := <-s.recvChan:
-			if err := s.input(seg); err != nil {
-				err = fmt.Errorf("input() failed: %w", err)
-				log.Debugf("%v %v", s, err)
-				s.inputErr <- err
-				s.Close()
+			if err := s.handleInput(seg); err != nil {
 				return err
 			}
 		}
 	}
 }
 
+// handleInput processes a segment from the underlay. The session is
+// closed if the segment can't be processed.
+func (s *Session) handleInput(seg *segment) error {
+	if err := s.input(seg); err != nil {
+		err = fmt.Errorf("input() failed: %w", err)
+		log.Debugf("%v %v", s, err)
+		s.inputErr <- err
+		s.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// deliver passes a segment from the underlay to the input of the session.
+func (s *Session) deliver(seg *segment) {
+	s.recvChan <- seg
+	s.wakeInput()
+}
+
+// wakeInput schedules the input pool to process the session, if the
+// session uses one.
+func (s *Session) wakeInput() {
+	if s.inputPool != nil {
+		s.inputPool.wake(s)
+	}
+}
+
+// inputFull returns true if processing the next segment may block,
+// because recvQueue has no space for the segments that can be moved
+// into it.
+func (s *Session) inputFull() bool {
+	return s.recvQueue.Len()+s.recvBuf.Len() >= s.recvQueue.cap
+}
+
+// finishInput marks the input of the session with the input pool done,
+// like the input goroutine of the session returns.
+func (s *Session) finishInput() {
+	s.inputFinished.Do(s.wg.Done)
+}
+
 func (s *Session) runOutputLoop(ctx context.Context) error {
 	ticker := time.NewTicker(10 * time.Millisecond)
 	defer ticker.Stop()
+
+	// The TCP underlay that the segments were sent to, and the one that
+	// failed to send them, which is nil if it didn't fail.
+	var sentConn, stalledConn Underlay
+	var stalledTime, ackTime time.Time
+	var ackedSeq uint32
 	for {
 		select {
 		case <-ctx.Done():
@@ -525,20 +1254,50 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 		case <-s.sendQueue.chanNotEmptyEvent:
 		}
 
-		switch s.conn.TransportProtocol() {
+		switch s.underlay().TransportProtocol() {
 		case util.TCPTransport:
-			for {
+			conn := s.underlay()
+			if conn == stalledConn {
+				// Wait for the session to be migrated.
+				if time.Since(stalledTime) > migrationTimeout {
+					err := fmt.Errorf("session is not migrated in %v: %w", migrationTimeout, stderror.ErrTimeout)
+					log.Debugf("%v %v", s, err)
+					s.outputErr <- err
+					s.closeWithError(err)
+				}
+				continue
+			}
+			stalledConn = nil
+			var err error
+			if s.resend != nil && sentConn != nil && conn != sentConn {
+				err = s.resendTo(conn)
+				ackTime, ackedSeq = time.Now(), s.recvSeq.Load()
+			}
+			sentConn = conn
+			for err == nil {
 				seg, ok := s.sendQueue.DeleteMin()
 				if !ok {
 					break
 				}
-				if err := s.output(seg, nil); err != nil {
-					err = fmt.Errorf("output() failed: %w", err)
-					log.Debugf("%v %v", s, err)
-					s.outputErr <- err
-					s.Close()
-					break
+				if s.resend != nil {
+					s.resend.add(seg)
+				}
+				err = s.outputTo(conn, seg, nil)
+			}
+			if err == nil && s.resend != nil && s.recvSeq.Load() != ackedSeq && time.Since(ackTime) >= migrationAckInterval {
+				ackTime, ackedSeq = time.Now(), s.recvSeq.Load()
+				err = s.outputTo(conn, s.ackSegment(ackedSeq), nil)
+			}
+			if err != nil {
+				if s.canResume() {
+					log.Debugf("%v output() failed: %v. Waiting to be migrated.", s, err)
+					stalledConn, stalledTime = conn, time.Now()
+					continue
 				}
+				err = fmt.Errorf("output() failed: %w", err)
+				log.Debugf("%v %v", s, err)
+				s.outputErr <- err
+				s.closeWithError(err)
 			}
 		case util.UDPTransport:
 			hasTimeout := false
@@ -549,7 +1308,7 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 					err := fmt.Errorf("too many retransmission of %v", iter)
 					log.Debugf("%v is unhealthy: %v", s, err)
 					s.outputErr <- err
-					s.Close()
+					s.closeWithError(err)
 					return false
 				}
 				if time.Since(iter.txTime) > iter.txTimeout {
@@ -561,7 +1320,7 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 						err = fmt.Errorf("output() failed: %w", err)
 						log.Debugf("%v %v", s, err)
 						s.outputErr <- err
-						s.Close()
+						s.closeWithError(err)
 						return false
 					}
 					return true
@@ -577,7 +1336,7 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 			if s.sendQueue.Len() > 0 {
 				maxSegmentToMove := mathext.Min(s.sendQueue.Len(), s.sendBuf.Remaining())
 				maxSegmentToMove = mathext.Min(maxSegmentToMove, int(s.sendAlgorithm.CongestionWindowSize()))
-				maxSegmentToMove = mathext.Min(maxSegmentToMove, int(s.remoteWindowSize))
+				maxSegmentToMove = mathext.Min(maxSegmentToMove, int(s.getRemoteWindowSize()))
 				for {
 					seg, deleted := s.sendQueue.DeleteMinIf(func(iter *segment) bool {
 						if segmentMoved >= maxSegmentToMove {
@@ -597,7 +1356,7 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 						err = fmt.Errorf("output() failed: %w", err)
 						log.Debugf("%v %v", s, err)
 						s.outputErr <- err
-						s.Close()
+						s.closeWithError(err)
 						break
 					}
 				}
@@ -605,7 +1364,8 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 
 			// Send ACK or heartbeat if needed.
 			if !hasTimeout && segmentMoved == 0 {
-				if (s.recvBuf.Len() > 0 && time.Since(s.lastTXTime) > segmentAckDelay) || time.Since(s.lastTXTime) > sessionHeartbeatInterval {
+				sinceTX := time.Since(time.Unix(0, s.lastTXTime.Load()))
+				if (s.recvBuf.Len() > 0 && sinceTX > segmentAckDelay) || sinceTX > sessionHeartbeatInterval {
 					baseStruct := baseStruct{}
 					if s.isClient {
 						baseStruct.protocol = uint8(ackClientToServer)
@@ -620,21 +1380,21 @@ func (s *Session) runOutputLoop(ctx context.Context) error {
 							unAckSeq:   s.nextRecv,
 							windowSize: uint16(mathext.Max(0, int(s.sendAlgorithm.CongestionWindowSize())-s.recvBuf.Len())),
 						},
-						transport: s.conn.TransportProtocol(),
+						transport: s.underlay().TransportProtocol(),
 					}
 					if err := s.output(ackSeg, s.RemoteAddr()); err != nil {
 						err = fmt.Errorf("output() failed: %w", err)
 						log.Debugf("%v %v", s, err)
 						s.outputErr <- err
-						s.Close()
+						s.closeWithError(err)
 					}
 				}
 			}
 		default:
-			err := fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
+			err := fmt.Errorf("unsupported transport protocol %v", s.underlay().TransportProtocol())
 			log.Debugf("%v %v", s, err)
 			s.outputErr <- err
-			s.Close()
+			s.closeWithError(err)
 		}
 	}
 }
@@ -652,16 +1412,20 @@ func (s *Session) input(seg *segment) error {
 			return stderror.ErrInvalidArgument
 		}
 	}
-	if seg.block != nil {
-		s.block = seg.block
-		if s.readBytes == nil && s.block.BlockContext().UserName != "" {
-			s.readBytes = metrics.RegisterMetric(fmt.Sprintf(metrics.UserMetricGroupFormat, s.block.BlockContext().UserName), metrics.UserMetricReadBytes, metrics.COUNTER_TIME_SERIES)
+	if block := seg.block; block != nil {
+		s.setBlock(block)
+		if s.readBytes == nil && block.BlockContext().UserName != "" {
+			s.readBytes = metrics.RegisterMetric(fmt.Sprintf(metrics.UserMetricGroupFormat, block.BlockContext().UserName), metrics.UserMetricReadBytes, metrics.COUNTER_TIME_SERIES)
 		}
-		if s.writeBytes == nil && s.block.BlockContext().UserName != "" {
-			s.writeBytes = metrics.RegisterMetric(fmt.Sprintf(metrics.UserMetricGroupFormat, s.block.BlockContext().UserName), metrics.UserMetricWriteBytes, metrics.COUNTER_TIME_SERIES)
+		if s.writeBytes == nil && block.BlockContext().UserName != "" {
+			s.writeBytes = metrics.RegisterMetric(fmt.Sprintf(metrics.UserMetricGroupFormat, block.BlockContext().UserName), metrics.UserMetricWriteBytes, metrics.COUNTER_TIME_SERIES)
+		}
+		s.setUser(block)
+		if s.traffic != nil && s.userTraffic.Load() == nil && block.BlockContext().UserName != "" {
+			s.userTraffic.Store(s.traffic.counter(block.BlockContext().UserName))
 		}
 	}
-	s.lastRXTime = time.Now()
+	s.lastRXTime.Store(time.Now().UnixNano())
 	if protocol == openSessionRequest || protocol == openSessionResponse || protocol == dataServerToClient || protocol == dataClientToServer {
 		return s.inputData(seg)
 	} else if protocol == ackServerToClient || protocol == ackClientToServer {
@@ -673,8 +1437,23 @@ func (s *Session) input(seg *segment) error {
 }
 
 func (s *Session) inputData(seg *segment) error {
-	switch s.conn.TransportProtocol() {
+	if err := s.inputCapabilities(seg); err != nil {
+		return err
+	}
+	switch s.underlay().TransportProtocol() {
 	case util.TCPTransport:
+		if seq, err := seg.Seq(); err == nil {
+			if seqBefore(seq, s.recvSeq.Load()) {
+				// The peer sent it again after the session is migrated.
+				return nil
+			}
+			s.recvSeq.Store(seq + 1)
+		}
+		if s.isClient && s.resend != nil {
+			// The server has received the open session request
+			// if it sends anything.
+			s.resend.ack(1)
+		}
 		// Deliver the segment directly to recvQueue.
 		s.recvQueue.InsertBlocking(seg)
 	case util.UDPTransport:
@@ -693,7 +1472,7 @@ func (s *Session) inputData(seg *segment) error {
 				s.rttStat.UpdateRTT(time.Since(seg2.txTime))
 				s.sendAlgorithm.OnAck()
 			}
-			s.remoteWindowSize = das.windowSize
+			s.setRemoteWindowSize(das.windowSize)
 		}
 
 		// Deliver the segment to recvBuf.
@@ -714,12 +1493,12 @@ func (s *Session) inputData(seg *segment) error {
 				s.nextRecv++
 				das, ok := seg3.metadata.(*dataAckStruct)
 				if ok {
-					s.remoteWindowSize = das.windowSize
+					s.setRemoteWindowSize(das.windowSize)
 				}
 			}
 		}
 	default:
-		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
+		return fmt.Errorf("unsupported transport protocol %v", s.underlay().TransportProtocol())
 	}
 
 	if !s.isClient && seg.metadata.Protocol() == openSessionRequest {
@@ -730,8 +1509,8 @@ func (s *Session) inputData(seg *segment) error {
 			var userName string
 			if seg.block != nil && seg.block.BlockContext().UserName != "" {
 				userName = seg.block.BlockContext().UserName
-			} else if s.block != nil && s.block.BlockContext().UserName != "" {
-				userName = s.block.BlockContext().UserName
+			} else if block := s.getBlock(); block != nil && block.BlockContext().UserName != "" {
+				userName = block.BlockContext().UserName
 			}
 			if userName != "" {
 				quotaOK, err := s.checkQuota(userName)
@@ -745,16 +1524,45 @@ func (s *Session) inputData(seg *segment) error {
 					s.Close()
 					return nil
 				}
+				if s.limiter != nil {
+					if !s.limiter.acquire(userName) {
+						s.status = statusConnLimitReached
+						log.Debugf("Closing %v because user %s reached the connection limit", s, userName)
+						s.wLock.Unlock()
+						s.closeWithError(fmt.Errorf("user %s reached the connection limit", userName))
+						return nil
+					}
+					go func(limiter *userConnLimiter) {
+						<-s.done
+						limiter.release(userName)
+					}(s.limiter)
+				}
+			}
+			var accepted capability
+			if ss, ok := seg.metadata.(*sessionStruct); ok {
+				accepted = s.negotiate(capability(ss.capabilities))
+			}
+			var token uint64
+			if accepted&capResume != 0 {
+				var err error
+				if token, err = newResumeToken(); err != nil {
+					log.Debugf("%v failed to generate resume token: %v", s, err)
+					accepted &^= capResume
+					s.negotiated.Store(&accepted)
+				}
+				s.resumeToken.Store(token)
 			}
 			seg4 := &segment{
 				metadata: &sessionStruct{
 					baseStruct: baseStruct{
-						protocol: uint8(openSessionResponse),
+						protocol:     uint8(openSessionResponse),
+						capabilities: uint8(accepted),
 					},
 					sessionID: s.id,
 					seq:       s.nextSend,
+					token:     token,
 				},
-				transport: s.conn.TransportProtocol(),
+				transport: s.underlay().TransportProtocol(),
 			}
 			s.nextSend++
 			if log.IsLevelEnabled(log.TraceLevel) {
@@ -768,10 +1576,42 @@ func (s *Session) inputData(seg *segment) error {
 	return nil
 }
 
+// inputCapabilities records the capabilities accepted by the server and
+// the resume token of the session, and decompresses the payload of a compressed data segment. Segments may
+// arrive before the open session response, so the data is checked against
+// the capabilities of this side.
+func (s *Session) inputCapabilities(seg *segment) error {
+	switch md := seg.metadata.(type) {
+	case *sessionStruct:
+		if s.isClient && md.Protocol() == openSessionResponse {
+			if s.negotiate(capability(md.capabilities))&capResume != 0 {
+				s.resumeToken.Store(md.token)
+			}
+		}
+	case *dataAckStruct:
+		if md.flags&dataFlagCompressed == 0 {
+			return nil
+		}
+		if s.capabilities&capZstd == 0 {
+			return fmt.Errorf("received compressed data, but compression is not negotiated: %w", stderror.ErrInvalidArgument)
+		}
+		payload, err := decompress(CompressionZstd, seg.payload)
+		if err != nil {
+			return err
+		}
+		seg.payload = payload
+		md.flags &^= dataFlagCompressed
+	}
+	return nil
+}
+
 func (s *Session) inputAck(seg *segment) error {
-	switch s.conn.TransportProtocol() {
+	switch s.underlay().TransportProtocol() {
 	case util.TCPTransport:
-		// Do nothing when receive ACK from TCP protocol.
+		// TCP is reliable, so the ACK only releases the resend buffer.
+		if s.resend != nil {
+			s.resend.ack(seg.metadata.(*dataAckStruct).unAckSeq)
+		}
 		return nil
 	case util.UDPTransport:
 		// Delete all previous acknowledged segments from sendBuf.
@@ -788,10 +1628,10 @@ func (s *Session) inputAck(seg *segment) error {
 			s.rttStat.UpdateRTT(time.Since(seg2.txTime))
 			s.sendAlgorithm.OnAck()
 		}
-		s.remoteWindowSize = das.windowSize
+		s.setRemoteWindowSize(das.windowSize)
 		return nil
 	default:
-		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
+		return fmt.Errorf("unsupported transport protocol %v", s.underlay().TransportProtocol())
 	}
 }
 
@@ -810,7 +1650,7 @@ func (s *Session) inputClose(seg *segment) error {
 				statusCode: uint8(statusOK),
 				payloadLen: 0,
 			},
-			transport: s.conn.TransportProtocol(),
+			transport: s.underlay().TransportProtocol(),
 		}
 		s.nextSend++
 		// The response will not retry if it is not delivered.
@@ -818,8 +1658,9 @@ func (s *Session) inputClose(seg *segment) error {
 			return fmt.Errorf("output() failed: %v", err)
 		}
 		// Immediately shutdown event loop.
-		if seg.metadata.(*sessionStruct).statusCode == uint8(statusQuotaExhausted) {
-			log.Infof("Remote requested to shut down the session because user has exhausted quota")
+		if rejectErr := rejectErrorOf(statusCode(seg.metadata.(*sessionStruct).statusCode)); rejectErr != nil {
+			log.Infof("Remote requested to shut down the session because %v", rejectErr.Reason)
+			s.setCloseError(rejectErr)
 		} else {
 			log.Debugf("Remote requested to shut down %v", s)
 		}
@@ -845,13 +1686,19 @@ func (s *Session) inputClose(seg *segment) error {
 }
 
 func (s *Session) output(seg *segment, remoteAddr net.Addr) error {
-	switch s.conn.TransportProtocol() {
+	return s.outputTo(s.underlay(), seg, remoteAddr)
+}
+
+// outputTo sends the segment with the given underlay of the session.
+func (s *Session) outputTo(conn Underlay, seg *segment, remoteAddr net.Addr) error {
+	seg.priority = s.Priority()
+	switch conn.TransportProtocol() {
 	case util.TCPTransport:
-		if err := s.conn.(*TCPUnderlay).writeOneSegment(seg); err != nil {
+		if err := conn.(*TCPUnderlay).writeOneSegment(seg); err != nil {
 			return fmt.Errorf("TCPUnderlay.writeOneSegment() failed: %v", err)
 		}
 	case util.UDPTransport:
-		err := s.conn.(*UDPUnderlay).writeOneSegment(seg, remoteAddr.(*net.UDPAddr))
+		err := conn.(*UDPUnderlay).writeOneSegment(seg, remoteAddr.(*net.UDPAddr))
 		if err != nil {
 			if !stderror.ShouldRetry(err) {
 				return fmt.Errorf("UDPUnderlay.writeOneSegment() failed: %v", err)
@@ -862,9 +1709,9 @@ func (s *Session) output(seg *segment, remoteAddr net.Addr) error {
 			return nil
 		}
 	default:
-		return fmt.Errorf("unsupported transport protocol %v", s.conn.TransportProtocol())
+		return fmt.Errorf("unsupported transport protocol %v", conn.TransportProtocol())
 	}
-	s.lastTXTime = time.Now()
+	s.lastTXTime.Store(time.Now().UnixNano())
 	return nil
 }
 
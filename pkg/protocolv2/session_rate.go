@@ -0,0 +1,131 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/mathext"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// sessionRateBurst is the time of traffic that a session rate limiter
+// allows to pass at once.
+const sessionRateBurst = 100 * time.Millisecond
+
+// byteRateLimiter is a token bucket that shapes the bytes of one direction
+// of a session. A transfer larger than the available tokens is allowed,
+// and the following transfers wait until the debt is paid.
+type byteRateLimiter struct {
+	mu       sync.Mutex
+	rate     float64 // bytes added per second
+	burst    float64 // maximum number of bytes
+	tokens   float64 // negative if the last transfer is not paid yet
+	lastTime time.Time
+}
+
+func newByteRateLimiter(bytesPerSec int) *byteRateLimiter {
+	burst := float64(bytesPerSec) * sessionRateBurst.Seconds()
+	return &byteRateLimiter{
+		rate:     float64(bytesPerSec),
+		burst:    burst,
+		tokens:   burst,
+		lastTime: time.Now(),
+	}
+}
+
+// reserve takes n bytes and returns the time to wait before they can be
+// transferred.
+func (l *byteRateLimiter) reserve(n int) time.Duration {
+	return l.reserveAt(time.Now(), n)
+}
+
+func (l *byteRateLimiter) reserveAt(now time.Time, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if elapsed := now.Sub(l.lastTime); elapsed > 0 {
+		l.tokens = mathext.Min(l.tokens+elapsed.Seconds()*l.rate, l.burst)
+		l.lastTime = now
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+func (m *Mux) SetSessionRateLimit(bytesPerSec int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set session rate limit after mux is used")
+	}
+	m.sessionRate = mathext.Max(bytesPerSec, 0)
+	m.logf(log.InfoLevel, "Mux session rate limit is set to %d bytes per second", m.sessionRate)
+	return m
+}
+
+// setRateLimit sets the speed limit of both directions of the session.
+func (s *Session) setRateLimit(bytesPerSec int) {
+	s.rLock.Lock()
+	s.readRate = newByteRateLimiter(bytesPerSec)
+	s.rLock.Unlock()
+	s.wLock.Lock()
+	s.writeRate = newByteRateLimiter(bytesPerSec)
+	s.wLock.Unlock()
+}
+
+// throttle waits until n bytes can be transferred under the limit l.
+// It returns io.ErrClosedPipe if the session is closed while waiting,
+// and os.ErrDeadlineExceeded if the read or write deadline of the session
+// is reached first. The bytes are taken from the limit in any case.
+func (s *Session) throttle(l *byteRateLimiter, n int, read bool) error {
+	if l == nil {
+		return nil
+	}
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+	s.dLock.Lock()
+	deadline := s.writeDeadline
+	if read {
+		deadline = s.readDeadline
+	}
+	s.dLock.Unlock()
+	var err error
+	if !util.IsZeroTime(deadline) {
+		if untilDeadline := time.Until(deadline); untilDeadline < wait {
+			wait = untilDeadline
+			err = os.ErrDeadlineExceeded
+		}
+	}
+	if wait <= 0 {
+		return err
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return err
+	case <-s.done:
+		return io.ErrClosedPipe
+	}
+}
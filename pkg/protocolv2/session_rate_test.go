@@ -0,0 +1,119 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestSessionRateLimit(t *testing.T) {
+	rate := 256 * 1024
+	setRate := func(m *Mux) { m.SetSessionRateLimit(rate) }
+	serverMux, endpoint := startTestMux(t, util.TCPTransport, setRate)
+	clientMux := newTestClient(endpoint)
+	setRate(clientMux)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	serverConn := acceptTestSession(t, serverMux, conn)
+	if _, err := io.ReadFull(serverConn, make([]byte, 5)); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v", err)
+	}
+
+	// Writing the payload takes about 1 second in each direction, minus
+	// the burst. All the data is received by the peer.
+	for _, tc := range []struct {
+		name         string
+		writer, peer net.Conn
+	}{
+		{"client", conn, serverConn},
+		{"server", serverConn, conn},
+	} {
+		received := make(chan error, 1)
+		go func() {
+			_, err := io.ReadFull(tc.peer, make([]byte, rate))
+			received <- err
+		}()
+		start := time.Now()
+		if _, err := tc.writer.Write(make([]byte, rate)); err != nil {
+			t.Fatalf("%s Write() failed: %v", tc.name, err)
+		}
+		if elapsed := time.Since(start); elapsed < 800*time.Millisecond {
+			t.Errorf("%s wrote %d bytes in %v under %d bytes per second", tc.name, rate, elapsed, rate)
+		}
+		if err := <-received; err != nil {
+			t.Errorf("%s peer io.ReadFull() failed: %v", tc.name, err)
+		}
+	}
+}
+
+func TestSessionRateLimitWriteDeadline(t *testing.T) {
+	rate := 256 * 1024
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint).SetSessionRateLimit(rate)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Writing 4 times the rate takes about 4 seconds, but the deadline
+	// stops the wait of the rate limit.
+	start := time.Now()
+	conn.SetWriteDeadline(start.Add(300 * time.Millisecond))
+	n, err := conn.Write(make([]byte, 4*rate))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Write() returned after %v, want the deadline", elapsed)
+	}
+	if n <= 0 || n >= 4*rate {
+		t.Errorf("Write() wrote %d bytes, want some of %d bytes", n, 4*rate)
+	}
+}
+
+func TestByteRateLimiter(t *testing.T) {
+	l := newByteRateLimiter(1000)
+	now := l.lastTime
+	// The burst is 100 bytes.
+	if wait := l.reserveAt(now, 100); wait != 0 {
+		t.Errorf("reserveAt() within burst = %v, want 0", wait)
+	}
+	if wait := l.reserveAt(now, 500); wait != 500*time.Millisecond {
+		t.Errorf("reserveAt() over burst = %v, want 500ms", wait)
+	}
+	// The debt is paid after 500 milliseconds.
+	if wait := l.reserveAt(now.Add(600*time.Millisecond), 100); wait != 0 {
+		t.Errorf("reserveAt() after refill = %v, want 0", wait)
+	}
+	// Tokens don't exceed the burst.
+	if wait := l.reserveAt(now.Add(time.Hour), 200); wait != 100*time.Millisecond {
+		t.Errorf("reserveAt() after long idle = %v, want 100ms", wait)
+	}
+}
@@ -0,0 +1,750 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/testtool"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestSessionReadDeadline(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	serverSession := acceptTestSession(t, serverMux, conn)
+
+	// Deadline is reached while Read is blocked.
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Read() error %v is not a timeout net.Error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Read() returned after %v, before the deadline", elapsed)
+	}
+
+	// Deadline persists for future Read.
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() after deadline returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// Setting a deadline unblocks a Read that is already waiting.
+	conn.SetReadDeadline(time.Time{})
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Read() returned %v, want %v", err, os.ErrDeadlineExceeded)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Read() is not unblocked by the new deadline")
+	}
+
+	// The session is still usable after the deadline is cleared.
+	conn.SetReadDeadline(time.Time{})
+	if _, err := serverSession.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("io.ReadFull() got %q, %v, want %q", buf, err, "hello")
+	}
+}
+
+func TestSessionWriteDeadline(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := conn.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	// Only the data written after the deadline is cleared is sent.
+	conn.SetWriteDeadline(time.Time{})
+	serverSession := acceptTestSession(t, serverMux, conn)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(serverSession, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("io.ReadFull() got %q, %v, want %q", buf, err, "hello")
+	}
+}
+
+func TestSessionFlush(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport)
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			serverSession := acceptTestSession(t, serverMux, conn)
+			if _, err := io.ReadFull(serverSession, make([]byte, 5)); err != nil {
+				t.Fatalf("io.ReadFull() failed: %v", err)
+			}
+
+			s := conn.(*Session)
+			payload := testtool.TestHelperGenRot13Input(4096)
+			if _, err := s.Write(payload); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			if err := s.Flush(); err != nil {
+				t.Fatalf("Flush() failed: %v", err)
+			}
+			if n := s.sendQueue.Len(); n != 0 {
+				t.Errorf("send queue has %d segments after Flush()", n)
+			}
+			// The flushed data is already with the peer.
+			serverSession.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(serverSession, make([]byte, len(payload))); err != nil {
+				t.Fatalf("io.ReadFull() failed: %v", err)
+			}
+
+			conn.Close()
+			if err := s.Flush(); !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("Flush() after Close() returned %v, want %v", err, io.ErrClosedPipe)
+			}
+		})
+	}
+}
+
+func TestSessionWriteBuffer(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport)
+			clientMux := newTestClient(endpoint).SetSessionWriteBuffer(8 * 1024)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			if got := conn.(*Session).writeBuffer; got != 8*1024 {
+				t.Errorf("session write buffer is %d, want %d", got, 8*1024)
+			}
+			serverSession := acceptTestSession(t, serverMux, conn)
+			if _, err := io.ReadFull(serverSession, make([]byte, 5)); err != nil {
+				t.Fatalf("io.ReadFull() failed: %v", err)
+			}
+
+			// A payload much larger than the write buffer is received intact.
+			payload := testtool.TestHelperGenRot13Input(32 * 1024)
+			go conn.Write(payload)
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(serverSession, got); err != nil {
+				t.Fatalf("io.ReadFull() failed: %v", err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Errorf("server received unexpected data")
+			}
+		})
+	}
+}
+
+func TestSessionWriteBufferFull(t *testing.T) {
+	s := newFlowControlTestSession(t, util.TCPTransport)
+	s.setWriteBuffer(maxPDU)
+
+	// Nothing is sent, so only the first chunk is queued.
+	s.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := s.Write(make([]byte, 3*maxPDU))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() returned %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if n != maxPDU {
+		t.Errorf("Write() returned %d bytes, want %d", n, maxPDU)
+	}
+	if got := s.sendQueue.Bytes(); got != n {
+		t.Errorf("send queue has %d bytes, want %d", got, n)
+	}
+}
+
+func TestSessionTransportProtocol(t *testing.T) {
+	log.SetOutputToTest(t)
+	cert, pool := newTestCertificate(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport, util.TLSTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			var addr net.Addr
+			if transport == util.UDPTransport {
+				port, err := util.UnusedUDPPort()
+				if err != nil {
+					t.Fatalf("util.UnusedUDPPort() failed: %v", err)
+				}
+				addr = &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+			} else {
+				port, err := util.UnusedTCPPort()
+				if err != nil {
+					t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+				}
+				addr = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+			}
+			serverMux := NewMux(false).
+				SetServerUsers(users).
+				SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}).
+				SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, transport, addr, nil)})
+			if err := serverMux.Start(); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+			defer serverMux.Close()
+			clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, transport, nil, addr)).
+				SetTLSConfig(&tls.Config{RootCAs: pool})
+			defer clientMux.Close()
+
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			if got := conn.(*Session).TransportProtocol(); got != transport {
+				t.Errorf("client session transport is %v, want %v", got, transport)
+			}
+			accepted, err := serverMux.Accept()
+			if err != nil {
+				t.Fatalf("Accept() failed: %v", err)
+			}
+			defer accepted.Close()
+			if got := accepted.(*Session).TransportProtocol(); got != transport {
+				t.Errorf("server session transport is %v, want %v", got, transport)
+			}
+		})
+	}
+
+	if got := NewSession(1, false, 1500).TransportProtocol(); got != util.UnknownTransport {
+		t.Errorf("detached session transport is %v, want %v", got, util.UnknownTransport)
+	}
+}
+
+// transportTestUnderlay is a fake underlay with the given transport protocol.
+type transportTestUnderlay struct {
+	*fakeUnderlay
+	transport util.TransportProtocol
+}
+
+func (u *transportTestUnderlay) TransportProtocol() util.TransportProtocol {
+	return u.transport
+}
+
+func newFlowControlTestSession(t *testing.T, transport util.TransportProtocol) *Session {
+	t.Helper()
+	s := NewSession(1, false, 1500)
+	s.setUnderlay(&transportTestUnderlay{fakeUnderlay: newFakeUnderlay(false), transport: transport})
+	s.forwardStateTo(sessionAttached)
+	if s.BlockedOnFlowControl() {
+		t.Fatalf("new session is blocked on flow control")
+	}
+	return s
+}
+
+func TestSessionBlockedOnFlowControlUDP(t *testing.T) {
+	s := newFlowControlTestSession(t, util.UDPTransport)
+	if _, err := s.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if s.BlockedOnFlowControl() {
+		t.Errorf("session is blocked while the remote window is open")
+	}
+
+	ack := func(windowSize uint16) {
+		seg := &segment{
+			metadata: &dataAckStruct{
+				baseStruct: baseStruct{protocol: uint8(ackClientToServer)},
+				sessionID:  s.id,
+				windowSize: windowSize,
+			},
+		}
+		if err := s.inputAck(seg); err != nil {
+			t.Fatalf("inputAck() failed: %v", err)
+		}
+	}
+	// The peer isn't reading and closes the window.
+	ack(0)
+	if !s.BlockedOnFlowControl() {
+		t.Errorf("session is not blocked when the remote window is closed")
+	}
+	// The peer drains the data and opens the window.
+	ack(32)
+	if s.BlockedOnFlowControl() {
+		t.Errorf("session is still blocked after the remote window is open")
+	}
+}
+
+func TestSessionBlockedOnFlowControlTCP(t *testing.T) {
+	s := newFlowControlTestSession(t, util.TCPTransport)
+	// Nothing is sent, so the send queue fills up.
+	for i := 0; i < segmentTreeCapacity; i++ {
+		if _, err := s.Write([]byte{byte(i)}); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+	}
+	if !s.BlockedOnFlowControl() {
+		t.Errorf("session is not blocked when the send queue is full")
+	}
+	if _, ok := s.sendQueue.DeleteMin(); !ok {
+		t.Fatalf("DeleteMin() failed")
+	}
+	if s.BlockedOnFlowControl() {
+		t.Errorf("session is still blocked after the send queue is drained")
+	}
+}
+
+func TestSessionFragmentSizeFollowsUnderlayMTU(t *testing.T) {
+	// The session is created while the path MTU is still probed.
+	s := NewSession(1, false, 1280)
+	u := &transportTestUnderlay{fakeUnderlay: newFakeUnderlay(false), transport: util.UDPTransport}
+	s.setUnderlay(u)
+	s.forwardStateTo(sessionAttached)
+
+	// The underlay has found a larger MTU.
+	size := MaxFragmentSize(u.MTU(), u.IPVersion(), util.UDPTransport)
+	if _, err := s.Write(make([]byte, size)); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if got := s.sendQueue.Len(); got != 1 {
+		t.Errorf("got %d segments, want 1", got)
+	}
+}
+
+// readerOnly and writerOnly hide the ReadFrom and WriteTo methods from
+// io.Copy, so it uses the generic copy with a buffer.
+type readerOnly struct{ io.Reader }
+
+type writerOnly struct{ io.Writer }
+
+// errCopyDone is returned by fullWriter when it has all the bytes.
+var errCopyDone = errors.New("copy done")
+
+// fullWriter collects bytes until it has want bytes.
+type fullWriter struct {
+	buf  bytes.Buffer
+	want int
+}
+
+func (w *fullWriter) Write(b []byte) (int, error) {
+	n, _ := w.buf.Write(b)
+	if w.buf.Len() >= w.want {
+		return n, errCopyDone
+	}
+	return n, nil
+}
+
+// copyRoundTrip sends the payload to the ROT13 server and returns the
+// response, with the fast path or the generic copy.
+func copyRoundTrip(tb testing.TB, conn net.Conn, payload []byte, fastPath bool) []byte {
+	resp := &fullWriter{want: len(payload)}
+	var n int64
+	var err error
+	if fastPath {
+		n, err = conn.(io.ReaderFrom).ReadFrom(readerOnly{bytes.NewReader(payload)})
+	} else {
+		n, err = io.Copy(writerOnly{conn}, readerOnly{bytes.NewReader(payload)})
+	}
+	if err != nil || n != int64(len(payload)) {
+		tb.Fatalf("copy to session wrote %d bytes with error %v, want %d bytes", n, err, len(payload))
+	}
+	if fastPath {
+		n, err = conn.(io.WriterTo).WriteTo(resp)
+	} else {
+		n, err = io.Copy(resp, readerOnly{conn})
+	}
+	if !errors.Is(err, errCopyDone) || n != int64(len(payload)) {
+		tb.Fatalf("copy from session read %d bytes with error %v, want %d bytes", n, err, len(payload))
+	}
+	return resp.buf.Bytes()
+}
+
+func TestSessionReadFromWriteTo(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			_, endpoint := startTestServer(t, transport)
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+
+			payload := testtool.TestHelperGenRot13Input(256 * 1024)
+			fast := copyRoundTrip(t, conn, payload, true)
+			generic := copyRoundTrip(t, conn, payload, false)
+			if !bytes.Equal(fast, generic) {
+				t.Fatalf("fast path and generic copy got different responses")
+			}
+			rot13, err := testtool.TestHelperRot13(fast)
+			if err != nil {
+				t.Fatalf("TestHelperRot13() failed: %v", err)
+			}
+			if !bytes.Equal(payload, rot13) {
+				t.Fatalf("Received unexpected response")
+			}
+		})
+	}
+}
+
+func TestSessionWriteToEOF(t *testing.T) {
+	s := newFlowControlTestSession(t, util.TCPTransport)
+	seg := &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{protocol: uint8(dataClientToServer)},
+			sessionID:  s.id,
+		},
+		payload:   []byte("hello"),
+		transport: util.TCPTransport,
+	}
+	s.recvQueue.InsertBlocking(seg)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.Close()
+	}()
+	var buf bytes.Buffer
+	n, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Errorf("WriteTo() returned error %v, want nil at EOF", err)
+	}
+	if n != 5 || buf.String() != "hello" {
+		t.Errorf("WriteTo() wrote %q (%d bytes), want %q", buf.String(), n, "hello")
+	}
+}
+
+func BenchmarkSessionCopy(b *testing.B) {
+	b.Run("generic", func(b *testing.B) {
+		benchmarkSessionCopy(b, false)
+	})
+	b.Run("fast", func(b *testing.B) {
+		benchmarkSessionCopy(b, true)
+	})
+}
+
+func benchmarkSessionCopy(b *testing.B, fastPath bool) {
+	_, endpoint := startTestServer(b, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		b.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	payload := testtool.TestHelperGenRot13Input(1024 * 1024)
+	b.SetBytes(int64(len(payload)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copyRoundTrip(b, conn, payload, fastPath)
+	}
+}
+
+// chunkReader returns at most size bytes from each Read.
+type chunkReader struct {
+	r    io.Reader
+	size int
+}
+
+func (c *chunkReader) Read(b []byte) (int, error) {
+	if len(b) > c.size {
+		b = b[:c.size]
+	}
+	return c.r.Read(b)
+}
+
+func BenchmarkSessionReadFrom(b *testing.B) {
+	for _, size := range []int{1024, maxPDU} {
+		b.Run(fmt.Sprintf("read%d", size), func(b *testing.B) {
+			_, endpoint := startTestServer(b, util.TCPTransport)
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				b.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			payload := testtool.TestHelperGenRot13Input(1024 * 1024)
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				r := &chunkReader{r: bytes.NewReader(payload), size: size}
+				if n, err := conn.(io.ReaderFrom).ReadFrom(r); err != nil || n != int64(len(payload)) {
+					b.Fatalf("ReadFrom() wrote %d bytes with error %v, want %d bytes", n, err, len(payload))
+				}
+				resp := &fullWriter{want: len(payload)}
+				if n, err := conn.(io.WriterTo).WriteTo(resp); !errors.Is(err, errCopyDone) || n != int64(len(payload)) {
+					b.Fatalf("WriteTo() read %d bytes with error %v, want %d bytes", n, err, len(payload))
+				}
+			}
+		})
+	}
+}
+
+func TestSessionCloseWrite(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport)
+			// The server reads the request until EOF, then writes the
+			// response back with the other direction of the session.
+			// It keeps the session open until the client has the response.
+			clientDone := make(chan struct{})
+			defer close(clientDone)
+			go func() {
+				conn, err := serverMux.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				req, err := io.ReadAll(conn)
+				if err != nil {
+					t.Errorf("server io.ReadAll() failed: %v", err)
+					return
+				}
+				resp, err := testtool.TestHelperRot13(req)
+				if err != nil {
+					t.Errorf("TestHelperRot13() failed: %v", err)
+					return
+				}
+				if _, err := conn.Write(resp); err != nil {
+					t.Errorf("server Write() failed: %v", err)
+				}
+				<-clientDone
+			}()
+
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			payload := testtool.TestHelperGenRot13Input(64 * 1024)
+			if _, err := conn.Write(payload); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+			if err := conn.(*Session).CloseWrite(); err != nil {
+				t.Fatalf("CloseWrite() failed: %v", err)
+			}
+			if _, err := conn.Write([]byte("late")); !errors.Is(err, io.ErrClosedPipe) {
+				t.Errorf("Write() after CloseWrite() returned %v, want %v", err, io.ErrClosedPipe)
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				t.Fatalf("io.ReadFull() failed: %v", err)
+			}
+			rot13, err := testtool.TestHelperRot13(resp)
+			if err != nil {
+				t.Fatalf("TestHelperRot13() failed: %v", err)
+			}
+			if !bytes.Equal(payload, rot13) {
+				t.Fatalf("Received unexpected response of %d bytes", len(resp))
+			}
+		})
+	}
+}
+
+func TestSessionCloseWriteNegotiation(t *testing.T) {
+	// oldRequest is an open session request of a client that doesn't
+	// support capabilities. Byte 1 is zero.
+	oldRequest := make([]byte, MetadataLength)
+	oldRequest[0] = uint8(openSessionRequest)
+	binary.BigEndian.PutUint32(oldRequest[2:], uint32(time.Now().Unix()/60))
+	binary.BigEndian.PutUint32(oldRequest[6:], 1)
+	newRequest := (&sessionStruct{
+		baseStruct: baseStruct{
+			protocol:     uint8(openSessionRequest),
+			capabilities: uint8(capHalfClose),
+		},
+		sessionID: 1,
+	}).Marshal()
+
+	for _, tc := range []struct {
+		name    string
+		request []byte
+		wantErr error
+	}{
+		{"OldClient", oldRequest, stderror.ErrUnsupported},
+		{"NewClient", newRequest, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newFlowControlTestSession(t, util.TCPTransport)
+			s.capabilities = capHalfClose
+			md := &sessionStruct{}
+			if err := md.Unmarshal(tc.request); err != nil {
+				t.Fatalf("Unmarshal() failed: %v", err)
+			}
+			if err := s.input(&segment{metadata: md, transport: util.TCPTransport}); err != nil {
+				t.Fatalf("input() failed: %v", err)
+			}
+			if err := s.CloseWrite(); !errors.Is(err, tc.wantErr) {
+				t.Errorf("CloseWrite() returned %v, want %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestSessionWritesBeforeOpenSessionResponse(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			_, endpoint := startTestServer(t, transport)
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+
+			// Only the first write sends the open session request. The
+			// following writes are queued before the response is received
+			// and must be sent as data segments.
+			payload := testtool.TestHelperGenRot13Input(8 * 16)
+			for i := 0; i < len(payload); i += 16 {
+				if _, err := conn.Write(payload[i : i+16]); err != nil {
+					t.Fatalf("Write() failed: %v", err)
+				}
+			}
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			resp := make([]byte, len(payload))
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				t.Fatalf("io.ReadFull() failed: %v", err)
+			}
+			rot13, err := testtool.TestHelperRot13(resp)
+			if err != nil {
+				t.Fatalf("TestHelperRot13() failed: %v", err)
+			}
+			if !bytes.Equal(payload, rot13) {
+				t.Fatalf("Received unexpected response")
+			}
+		})
+	}
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint).SetMaxUnderlays(1).SetSessionIdleTimeout(300 * time.Millisecond)
+	defer clientMux.Close()
+
+	active, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer active.Close()
+	idle, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer idle.Close()
+	if active.(*Session).underlay() != idle.(*Session).underlay() {
+		t.Fatalf("sessions are not in the same underlay")
+	}
+	if _, err := idle.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := active.Write([]byte("hello")); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-idle.(*Session).done:
+	default:
+		t.Errorf("idle session is not closed")
+	}
+	if err := idle.(*Session).closeError(); !errors.Is(err, stderror.ErrTimeout) {
+		t.Errorf("close error of idle session = %v, want %v", err, stderror.ErrTimeout)
+	}
+	select {
+	case <-active.(*Session).done:
+		t.Errorf("active session is closed")
+	default:
+	}
+}
+
+func TestSessionUser(t *testing.T) {
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport)
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("hello")); err != nil {
+				t.Fatalf("Write() failed: %v", err)
+			}
+
+			// The user is known without reading from the session.
+			accepted, err := serverMux.Accept()
+			if err != nil {
+				t.Fatalf("Accept() failed: %v", err)
+			}
+			defer accepted.Close()
+			if got := accepted.(*Session).User(); got != "xiaochitang" {
+				t.Errorf("User() = %q, want %q", got, "xiaochitang")
+			}
+			if got := conn.(*Session).User(); got != "" {
+				t.Errorf("User() of client session = %q, want empty", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util/sockopts"
+)
+
+// applySocketBuffers sets the socket buffer sizes of the mux to the
+// connection, and logs the sizes applied by the kernel. The connection
+// is still used if the sizes can't be set.
+func (m *Mux) applySocketBuffers(conn net.Conn) {
+	if m.sockReadBuffer == 0 && m.sockWriteBuffer == 0 {
+		return
+	}
+	var readBytes, writeBytes int
+	err := controlConn(conn, func(fd uintptr) error {
+		if err := sockopts.SocketBufferRawErr(m.sockReadBuffer, m.sockWriteBuffer)(fd); err != nil {
+			return err
+		}
+		var err error
+		readBytes, writeBytes, err = sockopts.SocketBufferSizes(fd)
+		return err
+	})
+	if err != nil {
+		m.logf(log.DebugLevel, "Unable to set socket buffers on connection to %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	m.logf(log.DebugLevel, "Socket buffers of connection to %v are read %d bytes and write %d bytes", conn.RemoteAddr(), readBytes, writeBytes)
+}
+
+func (m *Mux) SetSocketBuffers(readBytes, writeBytes int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if readBytes < 0 || writeBytes < 0 {
+		panic(fmt.Sprintf("Socket buffer sizes (%d, %d) are negative", readBytes, writeBytes))
+	}
+	if m.used {
+		panic("Can't set socket buffers after mux is used")
+	}
+	if maxRead, maxWrite, err := sockopts.MaxSocketBuffers(); err == nil {
+		if readBytes > maxRead {
+			m.logf(log.WarnLevel, "Socket read buffer %d is larger than the system maximum %d", readBytes, maxRead)
+		}
+		if writeBytes > maxWrite {
+			m.logf(log.WarnLevel, "Socket write buffer %d is larger than the system maximum %d", writeBytes, maxWrite)
+		}
+	}
+	m.sockReadBuffer = readBytes
+	m.sockWriteBuffer = writeBytes
+	m.logf(log.InfoLevel, "Mux socket buffers are set to read %d bytes and write %d bytes", readBytes, writeBytes)
+	return m
+}
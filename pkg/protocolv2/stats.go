@@ -0,0 +1,76 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"sort"
+)
+
+// Stats returns a snapshot of the status of each live underlay.
+func (m *Mux) Stats() []UnderlayStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make([]UnderlayStats, 0, len(m.underlays))
+	for _, underlay := range m.underlays {
+		select {
+		case <-underlay.Done():
+			continue
+		default:
+		}
+		stat := UnderlayStats{
+			LocalAddr:         underlay.LocalAddr(),
+			RemoteAddr:        underlay.RemoteAddr(),
+			TransportProtocol: underlay.TransportProtocol(),
+			Pending:           underlay.Scheduler().Pending(),
+		}
+		if c, ok := underlay.(underlayCounter); ok {
+			stat.Sessions = c.SessionCount()
+			stat.InBytes = c.InBytes()
+			stat.OutBytes = c.OutBytes()
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// Sessions returns a snapshot of the sessions attached to the underlays,
+// ordered by the underlays as in Stats() and then by the session IDs.
+// The sessions that are being created or removed at the same time may
+// not be included.
+func (m *Mux) Sessions() []SessionInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	infos := make([]SessionInfo, 0)
+	for _, underlay := range m.underlays {
+		select {
+		case <-underlay.Done():
+			continue
+		default:
+		}
+		u, ok := underlay.(migratableUnderlay)
+		if !ok {
+			continue
+		}
+		sessions := u.sessions()
+		sort.Slice(sessions, func(i, j int) bool {
+			return sessions[i].id < sessions[j].id
+		})
+		for _, s := range sessions {
+			infos = append(infos, s.info(underlay))
+		}
+	}
+	return infos
+}
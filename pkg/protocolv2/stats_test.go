@@ -0,0 +1,122 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestMuxStats(t *testing.T) {
+	log.SetOutputToTest(t)
+	_, endpoint := startTestServer(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	rot13RoundTrip(t, conn, 1024)
+
+	stats := clientMux.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("got %d underlay stats, want 1", len(stats))
+	}
+	s := stats[0]
+	if s.TransportProtocol != util.TCPTransport {
+		t.Errorf("TransportProtocol = %v, want %v", s.TransportProtocol, util.TCPTransport)
+	}
+	if s.RemoteAddr.String() != endpoint.RemoteAddr().String() {
+		t.Errorf("RemoteAddr = %v, want %v", s.RemoteAddr, endpoint.RemoteAddr())
+	}
+	if s.Sessions != 1 {
+		t.Errorf("Sessions = %d, want 1", s.Sessions)
+	}
+	if s.InBytes <= 1024 || s.OutBytes <= 1024 {
+		t.Errorf("InBytes = %d, OutBytes = %d, want both greater than 1024", s.InBytes, s.OutBytes)
+	}
+}
+
+func TestMuxSessions(t *testing.T) {
+	log.SetOutputToTest(t)
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestServer(t, transport)
+			clientMux := newTestClient(endpoint)
+			defer clientMux.Close()
+
+			start := time.Now()
+			sizes := []int{100, 200}
+			ids := make(map[uint32]int)
+			for i, size := range sizes {
+				conn, err := clientMux.DialContextWithLabel(context.Background(), fmt.Sprintf("label-%d", i))
+				if err != nil {
+					t.Fatalf("DialContextWithLabel() failed: %v", err)
+				}
+				defer conn.Close()
+				rot13RoundTrip(t, conn, size)
+				ids[conn.(*Session).ID()] = i
+			}
+
+			clientInfos := clientMux.Sessions()
+			if len(clientInfos) != len(sizes) {
+				t.Fatalf("client Sessions() returned %d sessions, want %d", len(clientInfos), len(sizes))
+			}
+			for _, info := range clientInfos {
+				i, ok := ids[info.ID]
+				if !ok {
+					t.Fatalf("client session %d is unknown", info.ID)
+				}
+				if !info.IsClient || info.User != "" || info.Label != fmt.Sprintf("label-%d", i) {
+					t.Errorf("got client session %+v, want label-%d", info, i)
+				}
+				if info.InBytes != int64(sizes[i]) || info.OutBytes != int64(sizes[i]) {
+					t.Errorf("InBytes = %d, OutBytes = %d, want %d", info.InBytes, info.OutBytes, sizes[i])
+				}
+				if info.CreateTime.Before(start) || info.CreateTime.After(time.Now()) {
+					t.Errorf("CreateTime %v is not between %v and now", info.CreateTime, start)
+				}
+				if info.TransportProtocol != transport || info.RemoteAddr.String() != endpoint.RemoteAddr().String() {
+					t.Errorf("got underlay %v %v, want %v %v", info.TransportProtocol, info.RemoteAddr, transport, endpoint.RemoteAddr())
+				}
+			}
+
+			serverInfos := serverMux.Sessions()
+			if len(serverInfos) != len(sizes) {
+				t.Fatalf("server Sessions() returned %d sessions, want %d", len(serverInfos), len(sizes))
+			}
+			for _, info := range serverInfos {
+				i, ok := ids[info.ID]
+				if !ok {
+					t.Fatalf("server session %d is unknown", info.ID)
+				}
+				if info.IsClient || info.User != "xiaochitang" || info.Label != fmt.Sprintf("label-%d", i) {
+					t.Errorf("got server session %+v, want user xiaochitang and label-%d", info, i)
+				}
+				if info.RemoteAddr == nil {
+					t.Errorf("server session %d has no remote address", info.ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/mathext"
+)
+
+// UDPBufferPolicy determines what a UDP underlay does when the receive
+// buffer of a session is full.
+type UDPBufferPolicy uint8
+
+const (
+	// UDPBufferBackpressure makes the underlay wait until the session reads
+	// from the buffer. Other sessions of the same underlay are blocked
+	// in the meantime.
+	UDPBufferBackpressure UDPBufferPolicy = iota
+
+	// UDPBufferDrop drops the data and ack segments that don't fit in the
+	// buffer, so a slow session doesn't block the other sessions. The dropped
+	// segments are retransmitted by the peer.
+	UDPBufferDrop
+)
+
+func (p UDPBufferPolicy) String() string {
+	switch p {
+	case UDPBufferBackpressure:
+		return "BACKPRESSURE"
+	case UDPBufferDrop:
+		return "DROP"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+func (m *Mux) SetUDPSessionBuffer(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set UDP session buffer after mux is used")
+	}
+	m.udpSessionBuffer = mathext.Max(n, 0)
+	m.logf(log.InfoLevel, "Mux UDP session buffer is set to %d", m.udpSessionBuffer)
+	return m
+}
+
+func (m *Mux) SetUDPSessionBufferPolicy(p UDPBufferPolicy) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set UDP session buffer policy after mux is used")
+	}
+	m.udpBufferPolicy = p
+	m.logf(log.InfoLevel, "Mux UDP session buffer policy is set to %v", p)
+	return m
+}
+
+// deliverData forwards a data or ack segment to the session, following
+// the buffer policy of the underlay.
+func (u *UDPUnderlay) deliverData(s *Session, seg *segment) {
+	if u.bufferPolicy != UDPBufferDrop {
+		s.deliver(seg)
+		return
+	}
+	select {
+	case s.recvChan <- seg:
+		s.wakeInput()
+	default:
+		UDPUnderlaySessionBufferDrops.Add(1)
+		if log.IsLevelEnabled(log.TraceLevel) {
+			log.Tracef("%v dropped segment of %v because the session buffer is full", u, s)
+		}
+	}
+}
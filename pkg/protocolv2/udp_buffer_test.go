@@ -0,0 +1,90 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestUDPSessionBuffer(t *testing.T) {
+	// A session that never reads from its buffer.
+	newSlowSession := func(u *UDPUnderlay) *Session {
+		s := NewSession(1, true, 1500)
+		if u.sessionBuffer > 0 {
+			s.recvChan = make(chan *segment, u.sessionBuffer)
+		}
+		return s
+	}
+	burst := 5
+
+	dropUnderlay := &UDPUnderlay{sessionBuffer: 2, bufferPolicy: UDPBufferDrop}
+	s := newSlowSession(dropUnderlay)
+	before := UDPUnderlaySessionBufferDrops.Load()
+	for i := 0; i < burst; i++ {
+		dropUnderlay.deliverData(s, &segment{})
+	}
+	if got := len(s.recvChan); got != 2 {
+		t.Errorf("got %d buffered segments, want 2", got)
+	}
+	if got := UDPUnderlaySessionBufferDrops.Load() - before; got != int64(burst-2) {
+		t.Errorf("got %d dropped segments, want %d", got, burst-2)
+	}
+
+	blockUnderlay := &UDPUnderlay{sessionBuffer: 2, bufferPolicy: UDPBufferBackpressure}
+	s = newSlowSession(blockUnderlay)
+	delivered := make(chan struct{})
+	go func() {
+		for i := 0; i < burst; i++ {
+			blockUnderlay.deliverData(s, &segment{})
+		}
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+		t.Fatalf("burst is delivered without backpressure")
+	case <-time.After(100 * time.Millisecond):
+	}
+	for i := 0; i < burst; i++ {
+		<-s.recvChan
+	}
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Fatalf("burst is not delivered after the session reads")
+	}
+
+	// Dropped segments are recovered by retransmission.
+	setBuffer := func(m *Mux) {
+		m.SetUDPSessionBuffer(4).SetUDPSessionBufferPolicy(UDPBufferDrop)
+	}
+	_, endpoint := startTestServer(t, util.UDPTransport, setBuffer)
+	clientMux := newTestClient(endpoint)
+	setBuffer(clientMux)
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if got := cap(conn.(*Session).recvChan); got != 4 {
+		t.Errorf("session buffer capacity is %d, want 4", got)
+	}
+	rot13RoundTrip(t, conn, 64*1024)
+}
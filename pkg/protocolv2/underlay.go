@@ -17,9 +17,12 @@ package protocolv2
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"time"
 
 	"github.com/enfein/mieru/pkg/metrics"
+	"github.com/enfein/mieru/pkg/replay"
 	"github.com/enfein/mieru/pkg/util"
 )
 
@@ -30,8 +33,84 @@ var (
 	UnderlayCurrEstablished = metrics.RegisterMetric("underlay", "CurrEstablished", metrics.GAUGE)
 	UnderlayMalformedUDP    = metrics.RegisterMetric("underlay", "UnderlayMalformedUDP", metrics.COUNTER)
 	UnderlayUnsolicitedUDP  = metrics.RegisterMetric("underlay", "UnsolicitedUDP", metrics.COUNTER)
+	UnderlayReplayDropped   = metrics.RegisterMetric("underlay", "ReplayDropped", metrics.COUNTER)
+	UnderlayRateLimited     = metrics.RegisterMetric("underlay", "RateLimitedConns", metrics.COUNTER)
+	UnderlayBadProxyHeader  = metrics.RegisterMetric("underlay", "BadProxyHeader", metrics.COUNTER)
+	UnderlayMemoryPressure  = metrics.RegisterMetric("underlay", "MemoryPressureDropped", metrics.COUNTER)
+	UnderlayBlockedByACL    = metrics.RegisterMetric("underlay", "BlockedByACL", metrics.COUNTER)
+
+	// Client failures to create a session or underlay, by cause.
+	UnderlayDialNoEndpoint   = metrics.RegisterMetric("underlay", "DialNoEndpoint", metrics.COUNTER)
+	UnderlayDialCipherError  = metrics.RegisterMetric("underlay", "DialCipherError", metrics.COUNTER)
+	UnderlayDialNetworkError = metrics.RegisterMetric("underlay", "DialNetworkError", metrics.COUNTER)
+	UnderlayAddSessionError  = metrics.RegisterMetric("underlay", "AddSessionError", metrics.COUNTER)
+
+	// Server authentications of the fallback user.
+	UnderlayFallbackAuth = metrics.RegisterMetric("underlay", "FallbackAuth", metrics.COUNTER)
+
+	TCPUnderlayActiveOpens     = metrics.RegisterMetric("TCP underlay", "ActiveOpens", metrics.COUNTER)
+	TCPUnderlayPassiveOpens    = metrics.RegisterMetric("TCP underlay", "PassiveOpens", metrics.COUNTER)
+	TCPUnderlayCurrEstablished = metrics.RegisterMetric("TCP underlay", "CurrEstablished", metrics.GAUGE)
+
+	UDPUnderlayActiveOpens     = metrics.RegisterMetric("UDP underlay", "ActiveOpens", metrics.COUNTER)
+	UDPUnderlayPassiveOpens    = metrics.RegisterMetric("UDP underlay", "PassiveOpens", metrics.COUNTER)
+	UDPUnderlayCurrEstablished = metrics.RegisterMetric("UDP underlay", "CurrEstablished", metrics.GAUGE)
+
+	// Data and ack segments dropped because the session buffer is full.
+	UDPUnderlaySessionBufferDrops = metrics.RegisterMetric("UDP underlay", "SessionBufferDrops", metrics.COUNTER)
+
+	// Client socket rebinds and server session address changes.
+	UDPUnderlayMigrations = metrics.RegisterMetric("UDP underlay", "Migrations", metrics.COUNTER)
 )
 
+const (
+	// replayCacheCapacity is the maximum number of entries in a replay cache.
+	replayCacheCapacity = 4 * 1024 * 1024
+
+	// defaultReplayWindow is the default time to remember the received
+	// packets to detect replay attacks.
+	defaultReplayWindow = 2 * time.Minute
+)
+
+// replayCaches are the replay caches of a mux.
+// If a cache is nil, the cache shared by all the underlays is used.
+type replayCaches struct {
+	tcp *replay.ReplayCache
+	udp *replay.ReplayCache
+}
+
+// onUnderlayOpen updates the metrics when a underlay is created.
+func onUnderlayOpen(transport util.TransportProtocol, isClient bool) {
+	if isClient {
+		UnderlayActiveOpens.Add(1)
+	} else {
+		UnderlayPassiveOpens.Add(1)
+	}
+	currEst := UnderlayCurrEstablished.Add(1)
+	maxConn := UnderlayMaxConn.Load()
+	if currEst > maxConn {
+		UnderlayMaxConn.Store(currEst)
+	}
+
+	switch transport {
+	case util.TCPTransport, util.WebSocketTransport, util.TLSTransport, util.QUICTransport:
+		// WebSocket, TLS and QUIC underlays are counted as TCP underlays.
+		if isClient {
+			TCPUnderlayActiveOpens.Add(1)
+		} else {
+			TCPUnderlayPassiveOpens.Add(1)
+		}
+		TCPUnderlayCurrEstablished.Add(1)
+	case util.UDPTransport:
+		if isClient {
+			UDPUnderlayActiveOpens.Add(1)
+		} else {
+			UDPUnderlayPassiveOpens.Add(1)
+		}
+		UDPUnderlayCurrEstablished.Add(1)
+	}
+}
+
 // UnderlayProperties defines network properties of a underlay.
 type UnderlayProperties interface {
 	// Layer 2 MTU of this network connection.
@@ -50,6 +129,42 @@ type UnderlayProperties interface {
 	RemoteAddr() net.Addr
 }
 
+// UnderlayOptions contains optional settings of a underlay.
+// A zero value means the system default is used.
+type UnderlayOptions struct {
+	// TCPKeepAlive is the idle time before TCP keep-alive probes are sent.
+	// A negative value disables TCP keep-alive.
+	TCPKeepAlive time.Duration
+
+	// TCPUserTimeout is the maximum time transmitted data may remain
+	// unacknowledged before the TCP connection is closed.
+	// It is only supported on Linux and Android.
+	TCPUserTimeout time.Duration
+
+	// UDPPathMTUDiscovery enables path MTU discovery on client UDP underlays.
+	// The underlay starts with a conservative MTU and probes upward until
+	// the configured MTU is reached. It is only supported on Linux and Android.
+	UDPPathMTUDiscovery bool
+
+	// WebSocket configures WebSocket underlays.
+	WebSocket WebSocketConfig
+}
+
+// WebSocketConfig contains settings of WebSocket underlays.
+type WebSocketConfig struct {
+	// Path is the HTTP request path of the WebSocket upgrade.
+	// The default value is "/". Server accepts any path if it is empty.
+	Path string
+
+	// Host is the HTTP Host header sent by client. If it is empty,
+	// the remote address of the endpoint is used.
+	Host string
+
+	// TLSConfig enables WebSocket over TLS. If it is nil, WebSocket is
+	// used without TLS. Server must provide the certificates.
+	TLSConfig *tls.Config
+}
+
 // Underlay contains methods implemented by a underlay network connection.
 type Underlay interface {
 	// Accept incoming sessions.
@@ -78,6 +193,39 @@ type Underlay interface {
 	Done() chan struct{}
 }
 
+// underlayCounter is implemented by the underlays that count their
+// sessions and traffic, like the underlays of this package.
+type underlayCounter interface {
+	// Return the number of sessions attached to the underlay.
+	SessionCount() int
+
+	// Return the number of bytes received from the network connection.
+	InBytes() int64
+
+	// Return the number of bytes sent to the network connection.
+	OutBytes() int64
+}
+
+// sessionCount returns the number of sessions attached to the underlay,
+// or 0 if the underlay doesn't count them.
+func sessionCount(u Underlay) int {
+	if c, ok := u.(underlayCounter); ok {
+		return c.SessionCount()
+	}
+	return 0
+}
+
+// UnderlayStats is a snapshot of the status of a underlay.
+type UnderlayStats struct {
+	LocalAddr         net.Addr
+	RemoteAddr        net.Addr
+	TransportProtocol util.TransportProtocol
+	Sessions          int   // number of sessions attached to the underlay
+	InBytes           int64 // number of bytes received from the network
+	OutBytes          int64 // number of bytes sent to the network
+	Pending           int   // number of pending sessions going to be scheduled
+}
+
 // underlayDescriptor implements UnderlayProperties.
 type underlayDescriptor struct {
 	mtu               int
@@ -85,6 +233,7 @@ type underlayDescriptor struct {
 	transportProtocol util.TransportProtocol
 	localAddr         net.Addr
 	remoteAddr        net.Addr
+	options           UnderlayOptions
 }
 
 var _ UnderlayProperties = &underlayDescriptor{}
@@ -109,14 +258,30 @@ func (d *underlayDescriptor) RemoteAddr() net.Addr {
 	return d.remoteAddr
 }
 
+// underlayOptions returns the optional settings of the underlay properties.
+// Only the properties created by NewUnderlayPropertiesWithOptions have them.
+func underlayOptions(p UnderlayProperties) UnderlayOptions {
+	if d, ok := p.(*underlayDescriptor); ok {
+		return d.options
+	}
+	return UnderlayOptions{}
+}
+
 // NewUnderlayProperties creates a new instance of UnderlayProperties.
 func NewUnderlayProperties(mtu int, ipVersion util.IPVersion, transportProtocol util.TransportProtocol, localAddr net.Addr, remoteAddr net.Addr) UnderlayProperties {
+	return NewUnderlayPropertiesWithOptions(mtu, ipVersion, transportProtocol, localAddr, remoteAddr, UnderlayOptions{})
+}
+
+// NewUnderlayPropertiesWithOptions creates a new instance of UnderlayProperties
+// with optional settings.
+func NewUnderlayPropertiesWithOptions(mtu int, ipVersion util.IPVersion, transportProtocol util.TransportProtocol, localAddr net.Addr, remoteAddr net.Addr, options UnderlayOptions) UnderlayProperties {
 	d := &underlayDescriptor{
 		mtu:               mtu,
 		ipVersion:         ipVersion,
 		transportProtocol: transportProtocol,
 		localAddr:         localAddr,
 		remoteAddr:        remoteAddr,
+		options:           options,
 	}
 	if localAddr == nil {
 		d.localAddr = util.NilNetAddr()
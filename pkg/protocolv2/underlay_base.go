@@ -21,7 +21,10 @@ import (
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/enfein/mieru/pkg/log"
 	"github.com/enfein/mieru/pkg/metrics"
 	"github.com/enfein/mieru/pkg/stderror"
 	"github.com/enfein/mieru/pkg/util"
@@ -29,21 +32,34 @@ import (
 
 const sessionChanCapacity = 64
 
+// underlaySeq generates the IDs of underlays.
+var underlaySeq atomic.Uint64
+
 // baseUnderlay contains a partial implementation of underlay.
 type baseUnderlay struct {
+	id        uint64 // increases with the creation order of underlays
 	isClient  bool
 	mtu       int
 	ipVersion util.IPVersion
+	options   UnderlayOptions
 	done      chan struct{} // if the underlay is closed
 
 	sessionMap    sync.Map      // Map<sessionID, *Session>
 	readySessions chan *Session // sessions that completed handshake and ready for consume
+	inputPool     *inputPool    // nil if each session has its own input goroutine
+
+	sendMutex  prioritySendLock // protect writing data to the connection
+	closeMutex sync.Mutex       // protect closing the connection
+
+	inBytes  atomic.Int64 // number of bytes received from the connection
+	outBytes atomic.Int64 // number of bytes sent to the connection
 
-	sendMutex  sync.Mutex // protect writing data to the connection
-	closeMutex sync.Mutex // protect closing the connection
+	lastActive atomic.Int64 // Unix nanoseconds when a session was last added or removed
 
 	// ---- client fields ----
-	scheduler *ScheduleController
+	scheduler    *ScheduleController
+	received     chan struct{} // closed when a segment is received from the server
+	receivedOnce sync.Once
 }
 
 var (
@@ -51,14 +67,74 @@ var (
 )
 
 func newBaseUnderlay(isClient bool, mtu int) *baseUnderlay {
-	return &baseUnderlay{
+	b := &baseUnderlay{
+		id:            underlaySeq.Add(1),
 		isClient:      isClient,
 		mtu:           mtu,
 		ipVersion:     util.IPVersionUnknown,
 		done:          make(chan struct{}),
 		readySessions: make(chan *Session, sessionChanCapacity),
 		scheduler:     &ScheduleController{},
+		received:      make(chan struct{}),
+	}
+	b.lastActive.Store(time.Now().UnixNano())
+	return b
+}
+
+// idleTime returns how long the underlay has had no session.
+// It returns 0 if the underlay has a session.
+func (b *baseUnderlay) idleTime() time.Duration {
+	if b.SessionCount() > 0 {
+		return 0
 	}
+	return time.Since(time.Unix(0, b.lastActive.Load()))
+}
+
+// underlayID returns the ID of the underlay. A underlay created
+// later has a larger ID.
+func (b *baseUnderlay) underlayID() uint64 {
+	return b.id
+}
+
+// markReceived records that a segment is decrypted from the peer.
+func (b *baseUnderlay) markReceived() {
+	b.receivedOnce.Do(func() {
+		close(b.received)
+	})
+}
+
+// receivedSegment returns a channel that is closed after a segment
+// is decrypted from the peer.
+func (b *baseUnderlay) receivedSegment() <-chan struct{} {
+	return b.received
+}
+
+// shareReadySessions delivers the accepted sessions to ch instead of Accept.
+// It must be called before the event loop is started.
+func (b *baseUnderlay) shareReadySessions(ch chan *Session) {
+	b.readySessions = ch
+}
+
+// shareInputPool processes the segments of the sessions with the pool.
+// It must be called before the event loop is started.
+func (b *baseUnderlay) shareInputPool(p *inputPool) {
+	b.inputPool = p
+}
+
+// startInputLoop processes the segments delivered to the session, with
+// the input pool if there is one, or with a new goroutine otherwise.
+// The caller must add the input to the wait group of the session.
+func (b *baseUnderlay) startInputLoop(s *Session) {
+	if b.inputPool != nil {
+		b.inputPool.attach(s)
+		return
+	}
+	go func() {
+		if err := s.runInputLoop(context.Background()); err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
+			log.Debugf("%v runInputLoop(): %v", s, err)
+		}
+		s.wg.Done()
+	}()
 }
 
 // Accept implements net.Listener interface.
@@ -79,12 +155,14 @@ func (b *baseUnderlay) Close() error {
 	default:
 	}
 
+	// Delete the sessions one by one instead of replacing the map, because
+	// sessions may still look up the map while the underlay is closed.
 	b.sessionMap.Range(func(k, v any) bool {
 		s := v.(*Session)
 		s.Close()
+		b.sessionMap.Delete(k)
 		return true
 	})
-	b.sessionMap = sync.Map{}
 	close(b.done)
 	UnderlayCurrEstablished.Add(-1)
 	return nil
@@ -134,7 +212,8 @@ func (b *baseUnderlay) AddSession(s *Session, remoteAddr net.Addr) error {
 	if _, loaded := b.sessionMap.LoadOrStore(s.id, s); loaded {
 		return stderror.ErrAlreadyExist
 	}
-	s.conn = b
+	b.lastActive.Store(time.Now().UnixNano())
+	s.setUnderlay(b)
 	s.remoteAddr = remoteAddr
 	s.forwardStateTo(sessionAttached)
 
@@ -160,8 +239,9 @@ func (b *baseUnderlay) RemoveSession(s *Session) error {
 	}
 
 	b.sessionMap.Delete(s.id)
+	b.lastActive.Store(time.Now().UnixNano())
 	s.Close()
-	s.conn = nil
+	s.setUnderlay(nil)
 
 	if b.isClient {
 		// May disable scheduling if the underlay has no session.
@@ -178,6 +258,53 @@ func (b *baseUnderlay) RemoveSession(s *Session) error {
 	return nil
 }
 
+// sessions returns the sessions attached to the underlay.
+func (b *baseUnderlay) sessions() []*Session {
+	res := make([]*Session, 0)
+	b.sessionMap.Range(func(k, v any) bool {
+		res = append(res, v.(*Session))
+		return true
+	})
+	return res
+}
+
+// adoptSession attaches a session migrated from another underlay.
+// The input and output loops of the session keep running.
+func (b *baseUnderlay) adoptSession(s *Session) error {
+	if _, loaded := b.sessionMap.LoadOrStore(s.id, s); loaded {
+		return stderror.ErrAlreadyExist
+	}
+	b.lastActive.Store(time.Now().UnixNano())
+	return nil
+}
+
+// detachSession removes a migrated session from the underlay
+// without closing it.
+func (b *baseUnderlay) detachSession(s *Session) {
+	b.sessionMap.Delete(s.id)
+	b.lastActive.Store(time.Now().UnixNano())
+	if b.isClient && b.SessionCount() == 0 {
+		b.scheduler.TryDisable()
+	}
+}
+
+func (b *baseUnderlay) SessionCount() int {
+	n := 0
+	b.sessionMap.Range(func(k, v any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func (b *baseUnderlay) InBytes() int64 {
+	return b.inBytes.Load()
+}
+
+func (b *baseUnderlay) OutBytes() int64 {
+	return b.outBytes.Load()
+}
+
 func (b *baseUnderlay) RunEventLoop(ctx context.Context) error {
 	return stderror.ErrUnsupported
 }
@@ -0,0 +1,364 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/enfein/mieru/pkg/appctl/appctlpb"
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+	"google.golang.org/protobuf/proto"
+)
+
+// MemoryNetwork is the network name of in-memory connections. An endpoint
+// with a MemoryAddr uses TCP underlays that never touch the OS network
+// stack. The server listens to the address in the same process, and
+// clients dial the address like a TCP address.
+const MemoryNetwork = "memory"
+
+// inMemoryMTU is the MTU of the endpoints created by NewInMemoryMuxPair.
+const inMemoryMTU = 1500
+
+// MemoryAddr is the address of an in-memory listener.
+type MemoryAddr string
+
+var _ net.Addr = MemoryAddr("")
+
+func (a MemoryAddr) Network() string {
+	return MemoryNetwork
+}
+
+func (a MemoryAddr) String() string {
+	return string(a)
+}
+
+var (
+	memListenersMu sync.Mutex
+	memListeners   = make(map[string]*memListener)
+
+	// memAddrSeq generates unique in-memory addresses.
+	memAddrSeq atomic.Uint64
+)
+
+// NewInMemoryMuxPair creates a server mux and a client mux that are
+// connected by in-memory connections, so tests of the code using a mux
+// don't need real sockets. The user name and password are registered in
+// the server and used by the client.
+//
+// The server mux is started and must be closed by the caller. The client
+// mux is not used yet, so it can still be configured before the first dial.
+func NewInMemoryMuxPair(username, password string) (client, server *Mux, err error) {
+	addr := MemoryAddr(fmt.Sprintf("mux-pair-%d", memAddrSeq.Add(1)))
+	server = NewMux(false).
+		SetServerUsers(map[string]*appctlpb.User{
+			username: {
+				Name:     proto.String(username),
+				Password: proto.String(password),
+			},
+		}).
+		SetEndpoints([]UnderlayProperties{
+			NewUnderlayProperties(inMemoryMTU, util.IPVersionUnknown, util.TCPTransport, addr, nil),
+		})
+	if err := server.Start(); err != nil {
+		server.Close()
+		return nil, nil, fmt.Errorf("Start() failed: %w", err)
+	}
+	client = NewMux(true).
+		SetClientPassword(cipher.HashPassword([]byte(password), []byte(username))).
+		SetEndpoints([]UnderlayProperties{
+			NewUnderlayProperties(inMemoryMTU, util.IPVersionUnknown, util.TCPTransport, nil, addr),
+		})
+	return client, server, nil
+}
+
+// listenMemory creates an in-memory listener with the address.
+func listenMemory(addr string) (*memListener, error) {
+	memListenersMu.Lock()
+	defer memListenersMu.Unlock()
+	if _, found := memListeners[addr]; found {
+		return nil, fmt.Errorf("in-memory address %s is in use: %w", addr, stderror.ErrAlreadyExist)
+	}
+	l := &memListener{
+		addr:  MemoryAddr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	memListeners[addr] = l
+	return l, nil
+}
+
+// dialMemory connects to the in-memory listener with the address.
+func dialMemory(ctx context.Context, addr string) (net.Conn, error) {
+	memListenersMu.Lock()
+	l, found := memListeners[addr]
+	memListenersMu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("in-memory address %s has no listener: %w", addr, stderror.ErrNotFound)
+	}
+	clientAddr := MemoryAddr(fmt.Sprintf("%s-client-%d", addr, memAddrSeq.Add(1)))
+	clientConn, serverConn := newMemConnPair(clientAddr, l.addr)
+	select {
+	case l.conns <- serverConn:
+		return clientConn, nil
+	case <-l.done:
+		return nil, fmt.Errorf("in-memory listener %s is closed", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// memListener is an in-memory net.Listener.
+type memListener struct {
+	addr      MemoryAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Listener = (*memListener)(nil)
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		memListenersMu.Lock()
+		delete(memListeners, string(l.addr))
+		memListenersMu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memBuffer holds the bytes written to one direction of a memConn.
+// Unlike net.Pipe, a write doesn't wait for the peer to read, so both
+// ends can write at the same time like a TCP connection.
+type memBuffer struct {
+	mu     sync.Mutex
+	data   []byte
+	closed bool
+
+	// notify is signaled when data is added or the buffer is closed.
+	notify chan struct{}
+}
+
+func newMemBuffer() *memBuffer {
+	return &memBuffer{notify: make(chan struct{}, 1)}
+}
+
+// read copies the buffered data to b. It returns false if there is no
+// data to read and the buffer is not closed.
+func (b *memBuffer) read(p []byte) (int, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.data) > 0 {
+		n := copy(p, b.data)
+		b.data = b.data[n:]
+		if len(b.data) > 0 {
+			// Wake up other readers.
+			b.signal()
+		}
+		return n, true, nil
+	}
+	if b.closed {
+		return 0, true, io.EOF
+	}
+	return 0, false, nil
+}
+
+func (b *memBuffer) write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+	b.data = append(b.data, p...)
+	b.signal()
+	return len(p), nil
+}
+
+func (b *memBuffer) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.signal()
+}
+
+// signal MUST be called only when holding the mu lock.
+func (b *memBuffer) signal() {
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+}
+
+// memConn is one end of an in-memory connection.
+type memConn struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	rx         *memBuffer // data sent by the peer
+	tx         *memBuffer // data sent to the peer
+
+	mu             sync.Mutex
+	readDeadline   time.Time
+	writeDeadline  time.Time
+	deadlineChange chan struct{} // closed and replaced when a deadline changes
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+var _ net.Conn = (*memConn)(nil)
+
+// newMemConnPair returns the two ends of an in-memory connection.
+func newMemConnPair(addr1, addr2 net.Addr) (*memConn, *memConn) {
+	b1 := newMemBuffer()
+	b2 := newMemBuffer()
+	c1 := &memConn{
+		localAddr:      addr1,
+		remoteAddr:     addr2,
+		rx:             b1,
+		tx:             b2,
+		deadlineChange: make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	c2 := &memConn{
+		localAddr:      addr2,
+		remoteAddr:     addr1,
+		rx:             b2,
+		tx:             b1,
+		deadlineChange: make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	return c1, c2
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.done:
+			return 0, net.ErrClosed
+		default:
+		}
+		if n, ok, err := c.rx.read(b); ok {
+			return n, err
+		}
+
+		c.mu.Lock()
+		deadline := c.readDeadline
+		deadlineChange := c.deadlineChange
+		c.mu.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		select {
+		case <-c.rx.notify:
+		case <-deadlineChange:
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			stopTimer(timer)
+			return 0, net.ErrClosed
+		}
+		stopTimer(timer)
+	}
+}
+
+func (c *memConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.tx.write(b)
+}
+
+func (c *memConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.tx.close()
+		c.rx.close()
+	})
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	c.setDeadlines(t, t, true, true)
+	return nil
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.setDeadlines(t, time.Time{}, true, false)
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	c.setDeadlines(time.Time{}, t, false, true)
+	return nil
+}
+
+func (c *memConn) setDeadlines(read, write time.Time, setRead, setWrite bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if setRead {
+		c.readDeadline = read
+	}
+	if setWrite {
+		c.writeDeadline = write
+	}
+	close(c.deadlineChange)
+	c.deadlineChange = make(chan struct{})
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/testtool"
+)
+
+func TestInMemoryMuxPair(t *testing.T) {
+	clientMux, serverMux, err := NewInMemoryMuxPair("xiaochitang", "kuiranbudong")
+	if err != nil {
+		t.Fatalf("NewInMemoryMuxPair() failed: %v", err)
+	}
+	testServer := testtool.NewTestHelperServer()
+	go testServer.Serve(serverMux)
+	defer func() {
+		testServer.Close()
+		serverMux.Close()
+	}()
+	clientMux.SetClientMultiplexFactor(2)
+	defer clientMux.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Errorf("DialContext() failed: %v", err)
+				return
+			}
+			defer conn.Close()
+			for j := 0; j < 10; j++ {
+				rot13RoundTrip(t, conn, 64*1024)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInMemoryDialNoListener(t *testing.T) {
+	if _, err := dialMemory(context.Background(), "no-listener"); err == nil {
+		t.Errorf("dialMemory() succeeded without a listener")
+	}
+}
+
+func TestMemConnReadDeadline(t *testing.T) {
+	c1, c2 := newMemConnPair(MemoryAddr("a"), MemoryAddr("b"))
+	defer c1.Close()
+	defer c2.Close()
+
+	c1.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 16)
+	if _, err := c1.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	c1.SetReadDeadline(time.Time{})
+	if _, err := c2.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	c2.Close()
+	n, err := c1.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read() = %q, %v, want %q", buf[:n], err, "hello")
+	}
+	if _, err := c1.Read(buf); err == nil {
+		t.Errorf("Read() succeeded after the peer is closed")
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// quicALPN is the application protocol negotiated by QUIC underlays.
+	quicALPN = "mieru"
+
+	// quicHandshakeTimeout is the maximum time to finish the QUIC handshake.
+	quicHandshakeTimeout = 10 * time.Second
+
+	// quicKeepAlivePeriod is the interval to send a keep alive packet,
+	// so an idle QUIC underlay is not closed by the idle timeout of QUIC
+	// or by a NAT.
+	quicKeepAlivePeriod = 15 * time.Second
+)
+
+// QUICUnderlay carries the TCP underlay protocol inside a bidirectional
+// stream of a QUIC connection. Sessions are multiplexed in the same way
+// as TCP underlay. QUIC provides the TLS encryption, the reliable delivery
+// and the congestion control of the stream over UDP.
+type QUICUnderlay struct {
+	*TCPUnderlay
+}
+
+var _ Underlay = &QUICUnderlay{}
+
+// newQUICUnderlay performs a QUIC handshake with "config" to the remote
+// address "raddr" over the UDP socket "conn", and opens the stream of the
+// underlay. The socket is closed with the underlay, or if this fails.
+// If the server name of "config" is empty, the host of "serverName" is used.
+// "block" is the block encryption algorithm to encrypt packets.
+func newQUICUnderlay(ctx context.Context, conn *net.UDPConn, raddr, serverName string, mtu int, block cipher.BlockCipher, config *tls.Config, options UnderlayOptions) (*QUICUnderlay, error) {
+	if block.IsStateless() {
+		conn.Close()
+		return nil, fmt.Errorf("QUIC block cipher must not be stateless")
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ResolveUDPAddr() failed: %w", err)
+	}
+	tlsConfig := quicTLSConfig(config)
+	if tlsConfig.ServerName == "" {
+		if h, _, err := net.SplitHostPort(serverName); err == nil {
+			tlsConfig.ServerName = h
+		} else {
+			tlsConfig.ServerName = serverName
+		}
+	}
+	quicConn, err := quic.Dial(ctx, conn, remoteAddr, tlsConfig, newQUICConfig())
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("QUIC handshake failed: %w", err)
+	}
+	stream, err := quicConn.OpenStreamSync(ctx)
+	if err != nil {
+		quicConn.CloseWithError(0, "")
+		conn.Close()
+		return nil, fmt.Errorf("OpenStreamSync() failed: %w", err)
+	}
+
+	q := &QUICUnderlay{
+		TCPUnderlay: &TCPUnderlay{
+			baseUnderlay: *newBaseUnderlay(true, mtu),
+			conn:         &quicStreamConn{conn: quicConn, socket: conn, stream: stream},
+			candidates:   []cipher.BlockCipher{block},
+		},
+	}
+	q.options = options
+	q.wrapper = util.QUICTransport
+	log.Debugf("Created new client QUIC underlay %v", q)
+	return q, nil
+}
+
+// listenUDPClient creates the UDP socket of a client QUIC underlay.
+// If "laddr" is empty, an automatic address is used.
+func listenUDPClient(network, laddr string) (*net.UDPConn, error) {
+	var localAddr *net.UDPAddr
+	if laddr != "" {
+		var err error
+		if localAddr, err = net.ResolveUDPAddr(network, laddr); err != nil {
+			return nil, fmt.Errorf("ResolveUDPAddr() failed: %w", err)
+		}
+	}
+	return net.ListenUDP(network, localAddr)
+}
+
+func (q *QUICUnderlay) String() string {
+	if q.conn == nil {
+		return "QUICUnderlay{}"
+	}
+	return fmt.Sprintf("QUICUnderlay{local=%v, remote=%v, mtu=%v, ipVersion=%v}", q.conn.LocalAddr(), q.conn.RemoteAddr(), q.mtu, q.IPVersion())
+}
+
+func (q *QUICUnderlay) TransportProtocol() util.TransportProtocol {
+	return util.QUICTransport
+}
+
+// acceptQUICUnderlays accepts QUIC connections from the UDP socket of
+// a server endpoint until the mux stops accepting. Each connection is
+// a server QUIC underlay.
+func (m *Mux) acceptQUICUnderlays(b boundEndpoint) {
+	m.markDSCP(b.udpConn)
+	m.applySocketBuffers(b.udpConn)
+	m.mu.Lock()
+	config := quicTLSConfig(m.tlsConfig)
+	m.mu.Unlock()
+	tr := &quic.Transport{Conn: b.udpConn}
+	ql, err := tr.Listen(config, newQUICConfig())
+	if err != nil {
+		b.udpConn.Close()
+		m.onAcceptLoopError(fmt.Errorf("Listen() QUIC failed: %w", err))
+		return
+	}
+	// Draining the mux closes the listener. The accepted underlays share
+	// the UDP socket, so it is closed with the mux.
+	go func() {
+		<-m.done
+		tr.Close()
+		b.udpConn.Close()
+	}()
+	l := quicListener{Listener: ql}
+	if !m.addListener(l) {
+		return
+	}
+	m.acceptHandshakeUnderlays(l, b.properties, m.serverWrapQUICConn)
+}
+
+// serverWrapQUICConn returns the server QUIC underlay of an accepted
+// QUIC connection. The QUIC handshake is finished by the listener.
+func (m *Mux) serverWrapQUICConn(rawConn net.Conn, properties UnderlayProperties) (Underlay, error) {
+	m.mu.Lock()
+	users := m.users
+	m.mu.Unlock()
+	q := &QUICUnderlay{
+		TCPUnderlay: m.serverWrapTCPConn(rawConn, properties.MTU(), users).(*TCPUnderlay),
+	}
+	q.options = underlayOptions(properties)
+	q.wrapper = util.QUICTransport
+	return q, nil
+}
+
+// quicTLSConfig returns a copy of the TLS config that negotiates the
+// application protocol of QUIC underlays.
+func quicTLSConfig(config *tls.Config) *tls.Config {
+	var tlsConfig *tls.Config
+	if config != nil {
+		tlsConfig = config.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig.NextProtos = []string{quicALPN}
+	return tlsConfig
+}
+
+// newQUICConfig returns the QUIC config of the underlays.
+func newQUICConfig() *quic.Config {
+	return &quic.Config{
+		HandshakeIdleTimeout: quicHandshakeTimeout,
+		KeepAlivePeriod:      quicKeepAlivePeriod,
+	}
+}
+
+// quicListener accepts QUIC connections as net.Conn, so they are accepted
+// in the same way as the connections of TLS and WebSocket.
+type quicListener struct {
+	*quic.Listener
+}
+
+// Accept implements net.Listener interface.
+func (l quicListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return &quicStreamConn{conn: conn}, nil
+}
+
+// quicStreamConn is a net.Conn over the bidirectional stream of a QUIC
+// connection. The client opens the stream. The server accepts it when the
+// conn is first used, because the stream is not sent to the peer before
+// it has data. Until then, the methods of the server conn that use the
+// stream are blocked.
+type quicStreamConn struct {
+	conn   quic.Connection
+	socket io.Closer // UDP socket owned by the client, nil on the server
+
+	once   sync.Once
+	stream quic.Stream
+	err    error
+}
+
+var _ net.Conn = &quicStreamConn{}
+
+// getStream returns the stream of the connection. The server accepts it
+// if it is not accepted yet.
+func (c *quicStreamConn) getStream() (quic.Stream, error) {
+	c.once.Do(func() {
+		if c.stream == nil {
+			c.stream, c.err = c.conn.AcceptStream(c.conn.Context())
+		}
+	})
+	return c.stream, c.err
+}
+
+func (c *quicStreamConn) Read(b []byte) (int, error) {
+	stream, err := c.getStream()
+	if err != nil {
+		return 0, quicConnError(err)
+	}
+	n, err := stream.Read(b)
+	return n, quicConnError(err)
+}
+
+func (c *quicStreamConn) Write(b []byte) (int, error) {
+	stream, err := c.getStream()
+	if err != nil {
+		return 0, quicConnError(err)
+	}
+	n, err := stream.Write(b)
+	return n, quicConnError(err)
+}
+
+// Close closes the QUIC connection, and the UDP socket of the client.
+func (c *quicStreamConn) Close() error {
+	err := c.conn.CloseWithError(0, "")
+	if c.socket != nil {
+		c.socket.Close()
+	}
+	return err
+}
+
+func (c *quicStreamConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *quicStreamConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *quicStreamConn) SetDeadline(t time.Time) error {
+	stream, err := c.getStream()
+	if err != nil {
+		return quicConnError(err)
+	}
+	return stream.SetDeadline(t)
+}
+
+func (c *quicStreamConn) SetReadDeadline(t time.Time) error {
+	stream, err := c.getStream()
+	if err != nil {
+		return quicConnError(err)
+	}
+	return stream.SetReadDeadline(t)
+}
+
+func (c *quicStreamConn) SetWriteDeadline(t time.Time) error {
+	stream, err := c.getStream()
+	if err != nil {
+		return quicConnError(err)
+	}
+	return stream.SetWriteDeadline(t)
+}
+
+// quicConnError converts the error of a QUIC connection closed without an
+// error code to the error of a closed TCP connection: io.EOF if the peer
+// closed it, or net.ErrClosed if it is closed locally.
+func quicConnError(err error) error {
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || appErr.ErrorCode != 0 {
+		return err
+	}
+	if appErr.Remote {
+		return io.EOF
+	}
+	return net.ErrClosed
+}
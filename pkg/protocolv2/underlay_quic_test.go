@@ -0,0 +1,192 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/testtool"
+	"github.com/enfein/mieru/pkg/util"
+	"github.com/quic-go/quic-go"
+)
+
+// startQUICTestServer starts a server mux with a QUIC endpoint and the
+// other endpoints, without serving the accepted sessions. It returns the
+// mux, the client endpoint of QUIC, and the pool that trusts the server
+// certificate.
+func startQUICTestServer(t *testing.T, others ...UnderlayProperties) (*Mux, UnderlayProperties, *x509.CertPool) {
+	t.Helper()
+	cert, pool := newTestCertificate(t)
+	port, err := util.UnusedUDPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedUDPPort() failed: %v", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	endpoints := append([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.QUICTransport, addr, nil)}, others...)
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}).
+		SetEndpoints(endpoints)
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		serverMux.Close()
+	})
+	return serverMux, NewUnderlayProperties(1500, util.IPVersion4, util.QUICTransport, nil, addr), pool
+}
+
+func TestQUICUnderlay(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint, pool := startQUICTestServer(t)
+	clientMux := newTestClient(endpoint).SetTLSConfig(&tls.Config{RootCAs: pool})
+	defer clientMux.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		serverSession := acceptTestSession(t, serverMux, conn)
+		if _, err := io.ReadFull(serverSession, make([]byte, 5)); err != nil {
+			t.Fatalf("io.ReadFull() failed: %v", err)
+		}
+		for _, s := range []*Session{conn.(*Session), serverSession} {
+			if got := s.TransportProtocol(); got != util.QUICTransport {
+				t.Errorf("TransportProtocol() = %v, want %v", got, util.QUICTransport)
+			}
+		}
+
+		// The data of many segments is carried by the stream in order.
+		payload := testtool.TestHelperGenRot13Input(64 * 1024)
+		go serverSession.Write(payload)
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("io.ReadFull() failed: %v", err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Errorf("client received unexpected data")
+		}
+		conn.Close()
+	}
+	underlays := clientMux.Underlays()
+	if len(underlays) == 0 {
+		t.Fatalf("client has no underlay")
+	}
+	for _, underlay := range underlays {
+		if _, ok := underlay.(*QUICUnderlay); !ok {
+			t.Errorf("client underlay is %T, want *QUICUnderlay", underlay)
+		}
+	}
+}
+
+func TestQUICUnderlayWithTCPAndUDP(t *testing.T) {
+	log.SetOutputToTest(t)
+	tcpPort, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	udpPort, err := util.UnusedUDPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedUDPPort() failed: %v", err)
+	}
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: tcpPort}
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: udpPort}
+	serverMux, quicEndpoint, pool := startQUICTestServer(t,
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, tcpAddr, nil),
+		NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, udpAddr, nil))
+
+	// The same server accepts the sessions of all the transports.
+	for _, endpoint := range []UnderlayProperties{
+		quicEndpoint,
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, tcpAddr),
+		NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, nil, udpAddr),
+	} {
+		want := endpoint.TransportProtocol()
+		clientMux := newTestClient(endpoint).SetTLSConfig(&tls.Config{RootCAs: pool})
+		defer clientMux.Close()
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() with %s failed: %v", transportName(want), err)
+		}
+		defer conn.Close()
+		if got := acceptTestSession(t, serverMux, conn).TransportProtocol(); got != want {
+			t.Errorf("server session transport is %s, want %s", transportName(got), transportName(want))
+		}
+	}
+}
+
+func TestQUICUnderlayUntrustedCertificate(t *testing.T) {
+	_, endpoint, _ := startQUICTestServer(t)
+	clientMux := newTestClient(endpoint).SetDialRetry(1, 0)
+	defer clientMux.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := clientMux.DialContext(ctx); err == nil {
+		t.Errorf("DialContext() succeeded with an untrusted certificate")
+	}
+}
+
+func TestQUICEndpointValidation(t *testing.T) {
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.QUICTransport, udpAddr, nil)})
+	defer serverMux.Close()
+	if err := serverMux.Start(); err == nil {
+		t.Errorf("Start() succeeded without a TLS certificate")
+	}
+
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	if err := validateEndpointAddr(tcpAddr, util.QUICTransport, false); err == nil {
+		t.Errorf("validateEndpointAddr() accepted a TCP address for QUIC transport")
+	}
+	if err := validateEndpointAddr(udpAddr, util.QUICTransport, false); err != nil {
+		t.Errorf("validateEndpointAddr() failed: %v", err)
+	}
+}
+
+func TestQUICConnError(t *testing.T) {
+	other := errors.New("other")
+	testcases := []struct {
+		err  error
+		want error
+	}{
+		{&quic.ApplicationError{Remote: true}, io.EOF},
+		{&quic.ApplicationError{Remote: false}, net.ErrClosed},
+		{&quic.ApplicationError{Remote: true, ErrorCode: 1}, nil},
+		{other, other},
+	}
+	for _, tc := range testcases {
+		got := quicConnError(tc.err)
+		if tc.want == nil {
+			if got != tc.err {
+				t.Errorf("quicConnError(%v) = %v, want the same error", tc.err, got)
+			}
+		} else if !errors.Is(got, tc.want) {
+			t.Errorf("quicConnError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/enfein/mieru/pkg/appctl/appctlpb"
@@ -36,7 +37,7 @@ import (
 
 type TCPUnderlay struct {
 	baseUnderlay
-	conn *net.TCPConn
+	conn net.Conn
 
 	send cipher.BlockCipher
 	recv cipher.BlockCipher
@@ -45,50 +46,128 @@ type TCPUnderlay struct {
 	// When isClient is true, there must be exactly 1 element in the slice.
 	candidates []cipher.BlockCipher
 
+	// fallback are block ciphers of the server fallback user, which are
+	// tried only after all the candidates fail to decrypt.
+	fallback []cipher.BlockCipher
+
+	// replays detects replay attacks. If nil, tcpReplayCache is used.
+	replays *replay.ReplayCache
+
+	// wrapper is the transport protocol of the TLS or WebSocket underlay
+	// that carries this underlay, or UnknownTransport if there is none.
+	wrapper util.TransportProtocol
+
+	// localIPVersion caches the IP version of the local address, because
+	// IPVersion is called by the sessions concurrently.
+	localIPVersion atomic.Uint32
+
 	// ---- server fields ----
-	users map[string]*appctlpb.User
+	users   map[string]*appctlpb.User
+	limiter *userConnLimiter
+	traffic *userTrafficTable
+	onAuth  func(userName string, remoteAddr net.Addr) // nil if not set
+
+	// capabilities are supported by the server for new sessions.
+	capabilities capability
+
+	// resendLimit is the size of the resend buffer of new sessions,
+	// zero if the sessions can't be migrated after they have sent data.
+	resendLimit int
+
+	// rehome finds the session that a client has migrated to the underlay.
+	// It is nil if sessions are not migrated.
+	rehome func(t *TCPUnderlay, sessionID uint32, userName string, token []byte) *Session
 }
 
 var _ Underlay = &TCPUnderlay{}
 
-var tcpReplayCache = replay.NewCache(4*1024*1024, 2*time.Minute)
+var tcpReplayCache = replay.NewCache(replayCacheCapacity, defaultReplayWindow)
 
-// NewTCPUnderlay connects to the remote address "raddr" on the network "tcp"
-// with packet encryption. If "laddr" is empty, an automatic address is used.
+// replayCache returns the replay cache used by the underlay.
+func (t *TCPUnderlay) replayCache() *replay.ReplayCache {
+	if t.replays != nil {
+		return t.replays
+	}
+	return tcpReplayCache
+}
+
+// NewTCPUnderlay connects to the remote address "raddr" on the network "tcp",
+// "unix" or MemoryNetwork with packet encryption. If "laddr" is empty, an automatic address is used.
 // "block" is the block encryption algorithm to encrypt packets.
 func NewTCPUnderlay(ctx context.Context, network, laddr, raddr string, mtu int, block cipher.BlockCipher) (*TCPUnderlay, error) {
+	return newTCPUnderlay(ctx, nil, network, laddr, raddr, mtu, block)
+}
+
+// newTCPUnderlay is like NewTCPUnderlay, but the connection is created by
+// dial. If dial is nil, the default network stack is used.
+func newTCPUnderlay(ctx context.Context, dial DialFunc, network, laddr, raddr string, mtu int, block cipher.BlockCipher) (*TCPUnderlay, error) {
 	switch network {
-	case "tcp", "tcp4", "tcp6":
+	case "tcp", "tcp4", "tcp6", "unix", MemoryNetwork:
 	default:
 		return nil, fmt.Errorf("network %s is not supported by TCP underlay", network)
 	}
 	if block.IsStateless() {
 		return nil, fmt.Errorf("TCP block cipher must not be stateless")
 	}
-	dialer := net.Dialer{
-		Control: sockopts.ReuseAddrPort(),
-	}
-	if laddr != "" {
-		tcpLocalAddr, err := net.ResolveTCPAddr(network, laddr)
-		if err != nil {
-			return nil, fmt.Errorf("net.ResolveTCPAddr() failed: %w", err)
-		}
-		dialer.LocalAddr = tcpLocalAddr
+	if dial == nil {
+		dial = defaultDial
 	}
 
-	conn, err := dialer.DialContext(ctx, network, raddr)
+	conn, err := dial(ctx, network, laddr, raddr)
 	if err != nil {
 		return nil, fmt.Errorf("DialContext() failed: %w", err)
 	}
 	t := &TCPUnderlay{
 		baseUnderlay: *newBaseUnderlay(true, mtu),
-		conn:         conn.(*net.TCPConn),
+		conn:         conn,
 		candidates:   []cipher.BlockCipher{block},
 	}
 	log.Debugf("Created new client TCP underlay %v", t)
 	return t, nil
 }
 
+// applyOptions applies the optional settings to the TCP connection.
+// The socket options are not applied if the connection is created by
+// a custom dialer and it is not a *net.TCPConn.
+func (t *TCPUnderlay) applyOptions(options UnderlayOptions) error {
+	t.options = options
+	return applyTCPOptions(t.conn, options)
+}
+
+// applyTCPOptions applies the TCP socket options to the connection,
+// if it is a *net.TCPConn.
+func applyTCPOptions(c net.Conn, options UnderlayOptions) error {
+	if p, ok := c.(*proxyProtocolConn); ok {
+		c = p.Conn
+	}
+	conn, ok := c.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if options.TCPKeepAlive < 0 {
+		if err := conn.SetKeepAlive(false); err != nil {
+			return fmt.Errorf("SetKeepAlive() failed: %w", err)
+		}
+	} else if options.TCPKeepAlive > 0 {
+		if err := conn.SetKeepAlive(true); err != nil {
+			return fmt.Errorf("SetKeepAlive() failed: %w", err)
+		}
+		if err := conn.SetKeepAlivePeriod(options.TCPKeepAlive); err != nil {
+			return fmt.Errorf("SetKeepAlivePeriod() failed: %w", err)
+		}
+	}
+	if options.TCPUserTimeout > 0 {
+		rawConn, err := conn.SyscallConn()
+		if err != nil {
+			return fmt.Errorf("SyscallConn() failed: %w", err)
+		}
+		if err := sockopts.TCPUserTimeout(options.TCPUserTimeout)("", "", rawConn); err != nil {
+			return fmt.Errorf("set TCP user timeout failed: %w", err)
+		}
+	}
+	return nil
+}
+
 func (t *TCPUnderlay) String() string {
 	if t.conn == nil {
 		return "TCPUnderlay{}"
@@ -106,6 +185,7 @@ func (t *TCPUnderlay) Close() error {
 	}
 
 	log.Debugf("Closing %v", t)
+	TCPUnderlayCurrEstablished.Add(-1)
 	t.baseUnderlay.Close()
 	return t.conn.Close()
 }
@@ -118,10 +198,16 @@ func (t *TCPUnderlay) IPVersion() util.IPVersion {
 	if t.conn == nil {
 		return util.IPVersionUnknown
 	}
-	if t.ipVersion == util.IPVersionUnknown {
-		t.ipVersion = util.GetIPVersion(t.conn.LocalAddr().String())
+	if v := util.IPVersion(t.localIPVersion.Load()); v != util.IPVersionUnknown {
+		return v
+	}
+	// Don't cache the result if the address is not an IP address,
+	// e.g. an in-memory address.
+	v := util.GetIPVersion(t.conn.LocalAddr().String())
+	if v != util.IPVersionUnknown {
+		t.localIPVersion.Store(uint32(v))
 	}
-	return t.ipVersion
+	return v
 }
 
 func (t *TCPUnderlay) TransportProtocol() util.TransportProtocol {
@@ -146,17 +232,12 @@ func (t *TCPUnderlay) AddSession(s *Session, remoteAddr net.Addr) error {
 	if err := t.baseUnderlay.AddSession(s, remoteAddr); err != nil {
 		return err
 	}
-	s.conn = t // override base underlay
+	s.setUnderlay(t) // override base underlay
 	close(s.ready)
 	log.Debugf("Adding session %d to %v", s.id, t)
 
 	s.wg.Add(2)
-	go func() {
-		if err := s.runInputLoop(context.Background()); err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
-			log.Debugf("%v runInputLoop(): %v", s, err)
-		}
-		s.wg.Done()
-	}()
+	t.startInputLoop(s)
 	go func() {
 		if err := s.runOutputLoop(context.Background()); err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
 			log.Debugf("%v runOutputLoop(): %v", s, err)
@@ -186,6 +267,7 @@ func (t *TCPUnderlay) RunEventLoop(ctx context.Context) error {
 			}
 			return fmt.Errorf("readOneSegment() failed: %w", err)
 		}
+		t.markReceived()
 		if log.IsLevelEnabled(log.TraceLevel) {
 			log.Tracef("%v received %v", t, seg)
 		}
@@ -208,6 +290,17 @@ func (t *TCPUnderlay) RunEventLoop(ctx context.Context) error {
 			}
 		} else if isDataAckProtocol(seg.metadata.Protocol()) {
 			das, _ := toDataAckStruct(seg.metadata)
+			if das.flags&dataFlagResume != 0 {
+				// The resume token is only used to find the session.
+				if _, ok := t.sessionMap.Load(das.sessionID); ok {
+					continue
+				}
+				if das.Protocol() == ackClientToServer && t.rehome != nil && t.resendLimit > 0 && seg.block != nil {
+					if s := t.rehome(t, das.sessionID, seg.block.BlockContext().UserName, seg.payload); s != nil {
+						continue
+					}
+				}
+			}
 			session, ok := t.sessionMap.Load(das.sessionID)
 			if !ok {
 				log.Debugf("Session %d is not registered to %v", das.sessionID, t)
@@ -229,7 +322,7 @@ func (t *TCPUnderlay) RunEventLoop(ctx context.Context) error {
 				}
 				continue
 			}
-			session.(*Session).recvChan <- seg
+			session.(*Session).deliver(seg)
 		} else {
 			log.Debugf("Ignore unknown protocol %d", seg.metadata.Protocol())
 		}
@@ -252,9 +345,19 @@ func (t *TCPUnderlay) onOpenSessionRequest(seg *segment) error {
 		return fmt.Errorf("%v received open session request, but session ID %d is already used", t, sessionID)
 	}
 	session := NewSession(sessionID, false, t.MTU())
+	session.label = string(seg.metadata.(*sessionStruct).label)
 	session.users = t.users
+	session.limiter = t.limiter
+	session.traffic = t.traffic
+	session.capabilities = t.capabilities
+	// Negotiate before the underlay delivers any data segment to the session.
+	session.negotiate(capability(seg.metadata.(*sessionStruct).capabilities))
+	if t.resendLimit > 0 {
+		session.resend = newResendBuffer(t.resendLimit)
+	}
+	session.setUser(seg.block)
 	t.AddSession(session, nil)
-	session.recvChan <- seg
+	session.deliver(seg)
 	t.readySessions <- session
 	return nil
 }
@@ -269,7 +372,7 @@ func (t *TCPUnderlay) onOpenSessionResponse(seg *segment) error {
 	if !found {
 		return fmt.Errorf("session ID %d is not found", sessionID)
 	}
-	session.(*Session).recvChan <- seg
+	session.(*Session).deliver(seg)
 	return nil
 }
 
@@ -282,7 +385,7 @@ func (t *TCPUnderlay) onCloseSession(seg *segment) error {
 		return nil
 	}
 	s := session.(*Session)
-	s.recvChan <- seg
+	s.deliver(seg)
 	s.wg.Wait()
 	t.RemoveSession(s)
 	return nil
@@ -304,9 +407,11 @@ func (t *TCPUnderlay) readOneSegment() (*segment, error, stderror.ErrorType) {
 		return nil, fmt.Errorf("metadata: read %d bytes from TCPUnderlay failed: %w", readLen, err), stderror.NETWORK_ERROR
 	}
 	metrics.InBytes.Add(int64(len(encryptedMeta)))
-	if tcpReplayCache.IsDuplicate(encryptedMeta[:cipher.DefaultOverhead], replay.EmptyTag) {
+	t.inBytes.Add(int64(len(encryptedMeta)))
+	if t.replayCache().IsDuplicate(encryptedMeta[:cipher.DefaultOverhead], replay.EmptyTag) {
 		if firstRead {
 			replay.NewSession.Add(1)
+			UnderlayReplayDropped.Add(1)
 			return nil, fmt.Errorf("found possible replay attack in %v", t), stderror.REPLAY_ERROR
 		} else {
 			replay.KnownSession.Add(1)
@@ -322,11 +427,21 @@ func (t *TCPUnderlay) readOneSegment() (*segment, error, stderror.ErrorType) {
 		var peerBlock cipher.BlockCipher
 		peerBlock, decryptedMeta, err = cipher.SelectDecrypt(encryptedMeta, cipher.CloneBlockCiphers(t.candidates))
 		cipher.ServerIterateDecrypt.Add(1)
+		if err != nil && len(t.fallback) > 0 {
+			peerBlock, decryptedMeta, err = cipher.SelectDecrypt(encryptedMeta, cipher.CloneBlockCiphers(t.fallback))
+			if err == nil {
+				UnderlayFallbackAuth.Add(1)
+				log.Warnf("%v authenticated fallback user %q", t, peerBlock.BlockContext().UserName)
+			}
+		}
 		if err != nil {
 			cipher.ServerFailedIterateDecrypt.Add(1)
 			return nil, fmt.Errorf("cipher.SelectDecrypt() failed: %w", err), stderror.CRYPTO_ERROR
 		}
 		t.recv = peerBlock.Clone()
+		if t.onAuth != nil {
+			t.onAuth(peerBlock.BlockContext().UserName, t.RemoteAddr())
+		}
 	} else {
 		decryptedMeta, err = t.recv.Decrypt(encryptedMeta)
 		if t.isClient {
@@ -375,7 +490,8 @@ func (t *TCPUnderlay) readSessionSegment(ss *sessionStruct) (*segment, error, st
 			return nil, fmt.Errorf("payload: read %d bytes from TCPUnderlay failed: %w", ss.payloadLen+cipher.DefaultOverhead, err), stderror.NETWORK_ERROR
 		}
 		metrics.InBytes.Add(int64(len(encryptedPayload)))
-		if tcpReplayCache.IsDuplicate(encryptedPayload[:cipher.DefaultOverhead], replay.EmptyTag) {
+		t.inBytes.Add(int64(len(encryptedPayload)))
+		if t.replayCache().IsDuplicate(encryptedPayload[:cipher.DefaultOverhead], replay.EmptyTag) {
 			replay.KnownSession.Add(1)
 		}
 		decryptedPayload, err = t.recv.Decrypt(encryptedPayload)
@@ -399,6 +515,7 @@ func (t *TCPUnderlay) readSessionSegment(ss *sessionStruct) (*segment, error, st
 			return nil, fmt.Errorf("padding: read %d bytes from TCPUnderlay failed: %w", ss.suffixLen, err), stderror.NETWORK_ERROR
 		}
 		metrics.InBytes.Add(int64(len(padding)))
+		t.inBytes.Add(int64(len(padding)))
 	}
 
 	return &segment{
@@ -419,6 +536,7 @@ func (t *TCPUnderlay) readDataAckSegment(das *dataAckStruct) (*segment, error, s
 			return nil, fmt.Errorf("padding: read %d bytes from TCPUnderlay failed: %w", das.prefixLen, err), stderror.NETWORK_ERROR
 		}
 		metrics.InBytes.Add(int64(len(padding1)))
+		t.inBytes.Add(int64(len(padding1)))
 	}
 	if das.payloadLen > 0 {
 		encryptedPayload := make([]byte, das.payloadLen+cipher.DefaultOverhead)
@@ -426,7 +544,8 @@ func (t *TCPUnderlay) readDataAckSegment(das *dataAckStruct) (*segment, error, s
 			return nil, fmt.Errorf("payload: read %d bytes from TCPUnderlay failed: %w", das.payloadLen+cipher.DefaultOverhead, err), stderror.NETWORK_ERROR
 		}
 		metrics.InBytes.Add(int64(len(encryptedPayload)))
-		if tcpReplayCache.IsDuplicate(encryptedPayload[:cipher.DefaultOverhead], replay.EmptyTag) {
+		t.inBytes.Add(int64(len(encryptedPayload)))
+		if t.replayCache().IsDuplicate(encryptedPayload[:cipher.DefaultOverhead], replay.EmptyTag) {
 			replay.KnownSession.Add(1)
 		}
 		decryptedPayload, err = t.recv.Decrypt(encryptedPayload)
@@ -450,6 +569,7 @@ func (t *TCPUnderlay) readDataAckSegment(das *dataAckStruct) (*segment, error, s
 			return nil, fmt.Errorf("padding: read %d bytes from TCPUnderlay failed: %w", das.suffixLen, err), stderror.NETWORK_ERROR
 		}
 		metrics.InBytes.Add(int64(len(padding2)))
+		t.inBytes.Add(int64(len(padding2)))
 	}
 
 	return &segment{
@@ -465,7 +585,7 @@ func (t *TCPUnderlay) writeOneSegment(seg *segment) error {
 		return stderror.ErrNullPointer
 	}
 
-	t.sendMutex.Lock()
+	t.sendMutex.lockWithPriority(seg.priority)
 	defer t.sendMutex.Unlock()
 
 	if ss, ok := toSessionStruct(seg.metadata); ok {
@@ -500,6 +620,7 @@ func (t *TCPUnderlay) writeOneSegment(seg *segment) error {
 			return fmt.Errorf("Write() failed: %w", err)
 		}
 		metrics.OutBytes.Add(int64(len(dataToSend)))
+		t.outBytes.Add(int64(len(dataToSend)))
 		metrics.OutPaddingBytes.Add(int64(len(padding)))
 	} else if das, ok := toDataAckStruct(seg.metadata); ok {
 		padding1 := newPadding(paddingOpts{
@@ -535,6 +656,7 @@ func (t *TCPUnderlay) writeOneSegment(seg *segment) error {
 			return fmt.Errorf("Write() failed: %w", err)
 		}
 		metrics.OutBytes.Add(int64(len(dataToSend)))
+		t.outBytes.Add(int64(len(dataToSend)))
 		metrics.OutPaddingBytes.Add(int64(len(padding1)))
 		metrics.OutPaddingBytes.Add(int64(len(padding2)))
 	} else {
@@ -0,0 +1,180 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/mathext"
+	"github.com/enfein/mieru/pkg/util"
+	"github.com/enfein/mieru/pkg/util/sockopts"
+	"golang.org/x/sys/unix"
+)
+
+func TestTCPUnderlayOptions(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	options := UnderlayOptions{
+		TCPKeepAlive:   10 * time.Second,
+		TCPUserTimeout: 3 * time.Second,
+	}
+	endpoint = NewUnderlayPropertiesWithOptions(endpoint.MTU(), endpoint.IPVersion(), endpoint.TransportProtocol(), nil, endpoint.RemoteAddr(), options)
+	clientMux := newTestClient(endpoint)
+	defer clientMux.Close()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+
+	clientMux.mu.Lock()
+	underlay := clientMux.underlays[0].(*TCPUnderlay)
+	clientMux.mu.Unlock()
+	if underlay.options != options {
+		t.Errorf("options = %+v, want %+v", underlay.options, options)
+	}
+	rawConn, err := underlay.conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() failed: %v", err)
+	}
+	var userTimeout, keepAliveIdle int
+	var sockErr error
+	rawConn.Control(func(fd uintptr) {
+		userTimeout, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+		if sockErr != nil {
+			return
+		}
+		keepAliveIdle, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+	})
+	if sockErr != nil {
+		t.Fatalf("GetsockoptInt() failed: %v", sockErr)
+	}
+	if userTimeout != 3000 {
+		t.Errorf("TCP_USER_TIMEOUT = %d, want 3000", userTimeout)
+	}
+	if keepAliveIdle != 10 {
+		t.Errorf("TCP_KEEPIDLE = %d, want 10", keepAliveIdle)
+	}
+}
+
+func TestSetDSCP(t *testing.T) {
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport, func(m *Mux) {
+				m.SetDSCP(46)
+			})
+			clientMux := newTestClient(endpoint).SetDSCP(46)
+			defer clientMux.Close()
+
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			acceptTestSession(t, serverMux, conn)
+
+			clientMux.mu.Lock()
+			clientUnderlay := clientMux.underlays[0]
+			clientMux.mu.Unlock()
+			serverMux.mu.Lock()
+			serverUnderlay := serverMux.underlays[0]
+			serverMux.mu.Unlock()
+			for _, underlay := range []Underlay{clientUnderlay, serverUnderlay} {
+				rawConn := underlayRawConn(t, underlay)
+				var tos int
+				var sockErr error
+				rawConn.Control(func(fd uintptr) {
+					tos, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS)
+				})
+				if sockErr != nil {
+					t.Fatalf("GetsockoptInt() failed: %v", sockErr)
+				}
+				if tos != 46<<2 {
+					t.Errorf("IP_TOS of %v = %d, want %d", underlay, tos, 46<<2)
+				}
+			}
+		})
+	}
+}
+
+// underlayRawConn returns the raw socket of a TCP or UDP underlay.
+func underlayRawConn(t *testing.T, underlay Underlay) syscall.RawConn {
+	t.Helper()
+	var sc syscall.Conn
+	switch u := underlay.(type) {
+	case *TCPUnderlay:
+		sc = u.conn.(*net.TCPConn)
+	case *UDPUnderlay:
+		sc = u.conn
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn() failed: %v", err)
+	}
+	return rawConn
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	const size = 256 * 1024
+	maxRead, maxWrite, err := sockopts.MaxSocketBuffers()
+	if err != nil {
+		t.Fatalf("MaxSocketBuffers() failed: %v", err)
+	}
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		t.Run(transportName(transport), func(t *testing.T) {
+			serverMux, endpoint := startTestMux(t, transport, func(m *Mux) {
+				m.SetSocketBuffers(size, size)
+			})
+			clientMux := newTestClient(endpoint).SetSocketBuffers(size, size)
+			defer clientMux.Close()
+
+			conn, err := clientMux.DialContext(context.Background())
+			if err != nil {
+				t.Fatalf("DialContext() failed: %v", err)
+			}
+			defer conn.Close()
+			acceptTestSession(t, serverMux, conn)
+
+			clientMux.mu.Lock()
+			clientUnderlay := clientMux.underlays[0]
+			clientMux.mu.Unlock()
+			serverMux.mu.Lock()
+			serverUnderlay := serverMux.underlays[0]
+			serverMux.mu.Unlock()
+			for _, underlay := range []Underlay{clientUnderlay, serverUnderlay} {
+				var readBytes, writeBytes int
+				var sockErr error
+				underlayRawConn(t, underlay).Control(func(fd uintptr) {
+					readBytes, writeBytes, sockErr = sockopts.SocketBufferSizes(fd)
+				})
+				if sockErr != nil {
+					t.Fatalf("SocketBufferSizes() failed: %v", sockErr)
+				}
+				// The kernel doubles the size set, up to the system maximum.
+				if want := 2 * mathext.Min(size, maxRead); readBytes != want {
+					t.Errorf("SO_RCVBUF of %v = %d, want %d", underlay, readBytes, want)
+				}
+				if want := 2 * mathext.Min(size, maxWrite); writeBytes != want {
+					t.Errorf("SO_SNDBUF of %v = %d, want %d", underlay, writeBytes, want)
+				}
+			}
+		})
+	}
+}
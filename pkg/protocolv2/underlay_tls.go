@@ -0,0 +1,160 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// tlsHandshakeTimeout is the maximum time to finish the TLS handshake
+// of an accepted connection.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSUnderlay carries the TCP underlay protocol inside a TLS connection,
+// so the traffic looks like HTTPS. Sessions are multiplexed in the same
+// way as TCP underlay.
+type TLSUnderlay struct {
+	*TCPUnderlay
+}
+
+var _ Underlay = &TLSUnderlay{}
+
+// newTLSUnderlay connects to the remote address "raddr" on the network
+// "tcp", and performs a TLS handshake with "config". If the server name
+// of "config" is empty, the host of "serverName" is used.
+// If "laddr" is empty, an automatic address is used.
+// "block" is the block encryption algorithm to encrypt packets.
+// If dial is nil, the default network stack is used.
+func newTLSUnderlay(ctx context.Context, dial DialFunc, network, laddr, raddr, serverName string, mtu int, block cipher.BlockCipher, config *tls.Config, options UnderlayOptions) (*TLSUnderlay, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix", MemoryNetwork:
+	default:
+		return nil, fmt.Errorf("network %s is not supported by TLS underlay", network)
+	}
+	if block.IsStateless() {
+		return nil, fmt.Errorf("TLS block cipher must not be stateless")
+	}
+	if dial == nil {
+		dial = defaultDial
+	}
+
+	rawConn, err := dial(ctx, network, laddr, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("DialContext() failed: %w", err)
+	}
+	if err := applyTCPOptions(rawConn, options); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("applyTCPOptions() failed: %w", err)
+	}
+	var tlsConfig *tls.Config
+	if config != nil {
+		tlsConfig = config.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		if h, _, err := net.SplitHostPort(serverName); err == nil {
+			tlsConfig.ServerName = h
+		} else {
+			tlsConfig.ServerName = serverName
+		}
+	}
+	tlsConn := tls.Client(rawConn, tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	t := &TLSUnderlay{
+		TCPUnderlay: &TCPUnderlay{
+			baseUnderlay: *newBaseUnderlay(true, mtu),
+			conn:         tlsConn,
+			candidates:   []cipher.BlockCipher{block},
+		},
+	}
+	t.options = options
+	t.wrapper = util.TLSTransport
+	log.Debugf("Created new client TLS underlay %v", t)
+	return t, nil
+}
+
+func (t *TLSUnderlay) String() string {
+	if t.conn == nil {
+		return "TLSUnderlay{}"
+	}
+	return fmt.Sprintf("TLSUnderlay{local=%v, remote=%v, mtu=%v, ipVersion=%v}", t.conn.LocalAddr(), t.conn.RemoteAddr(), t.mtu, t.IPVersion())
+}
+
+func (t *TLSUnderlay) TransportProtocol() util.TransportProtocol {
+	return util.TLSTransport
+}
+
+// serverWrapTLSConn performs the TLS handshake of an accepted connection,
+// and returns the server TLS underlay.
+func (m *Mux) serverWrapTLSConn(rawConn net.Conn, properties UnderlayProperties) (Underlay, error) {
+	options := underlayOptions(properties)
+	if err := applyTCPOptions(rawConn, options); err != nil {
+		return nil, fmt.Errorf("applyTCPOptions() failed: %w", err)
+	}
+	m.mu.Lock()
+	config := m.tlsConfig
+	users := m.users
+	m.mu.Unlock()
+	tlsConn := tls.Server(rawConn, config)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %w", err)
+	}
+
+	t := &TLSUnderlay{
+		TCPUnderlay: m.serverWrapTCPConn(tlsConn, properties.MTU(), users).(*TCPUnderlay),
+	}
+	t.options = options
+	t.wrapper = util.TLSTransport
+	return t, nil
+}
+
+// hasTLSCertificate returns true if the server can present a certificate
+// with the TLS config.
+func hasTLSCertificate(config *tls.Config) bool {
+	if config == nil {
+		return false
+	}
+	return len(config.Certificates) > 0 || config.GetCertificate != nil || config.GetConfigForClient != nil
+}
+
+func (m *Mux) SetTLSConfig(config *tls.Config) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.used {
+		panic("Can't set TLS config after mux is used")
+	}
+	if !m.isClient && !hasTLSCertificate(config) {
+		panic("Server TLS config has no certificate")
+	}
+	m.tlsConfig = config
+	m.logf(log.InfoLevel, "Mux TLS config is set")
+	return m
+}
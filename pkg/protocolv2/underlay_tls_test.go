@@ -0,0 +1,169 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/testtool"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestTLSUnderlay(t *testing.T) {
+	log.SetOutputToTest(t)
+	cert, pool := newTestCertificate(t)
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.TLSTransport, addr, nil)})
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	testServer := testtool.NewTestHelperServer()
+	go testServer.Serve(serverMux)
+	defer func() {
+		testServer.Close()
+		serverMux.Close()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TLSTransport, nil, addr)).
+		SetTLSConfig(&tls.Config{RootCAs: pool})
+	defer clientMux.Close()
+	for i := 0; i < 2; i++ {
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		rot13RoundTrip(t, conn, 64*1024)
+		conn.Close()
+	}
+
+	stats := serverMux.Stats()
+	if len(stats) == 0 {
+		t.Errorf("server has no underlay")
+	}
+	for _, s := range stats {
+		if s.TransportProtocol != util.TLSTransport {
+			t.Errorf("server underlay transport is %v, want %v", s.TransportProtocol, util.TLSTransport)
+		}
+	}
+}
+
+func TestTLSUnderlayMigrateSession(t *testing.T) {
+	log.SetOutputToTest(t)
+	cert, pool := newTestCertificate(t)
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.TLSTransport, addr, nil)})
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	testServer := testtool.NewTestHelperServer()
+	go testServer.Serve(serverMux)
+	defer func() {
+		testServer.Close()
+		serverMux.Close()
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TLSTransport, nil, addr)).
+		SetTLSConfig(&tls.Config{RootCAs: pool})
+	defer clientMux.Close()
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	session := conn.(*Session)
+	if err := clientMux.Warmup(context.Background(), 2); err != nil {
+		t.Fatalf("Warmup() failed: %v", err)
+	}
+	var target Underlay
+	for _, underlay := range clientMux.Underlays() {
+		if sessionUnderlay(underlay) != session.underlay() {
+			target = underlay
+		}
+	}
+	if target == nil {
+		t.Fatalf("Underlays() doesn't return the warmed underlay")
+	}
+
+	if err := clientMux.MigrateSession(session, target); err != nil {
+		t.Fatalf("MigrateSession() failed: %v", err)
+	}
+	if session.underlay() != sessionUnderlay(target) {
+		t.Errorf("session is not attached to the new underlay")
+	}
+	if got := session.TransportProtocol(); got != util.TLSTransport {
+		t.Errorf("TransportProtocol() = %v, want %v", got, util.TLSTransport)
+	}
+	rot13RoundTrip(t, conn, 64*1024)
+}
+
+func TestTLSUnderlayUntrustedCertificate(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.TLSTransport, addr, nil)})
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer serverMux.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TLSTransport, nil, addr)).
+		SetDialRetry(1, 0)
+	defer clientMux.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := clientMux.DialContext(ctx); err == nil {
+		t.Errorf("DialContext() succeeded with an untrusted certificate")
+	}
+}
+
+func TestTLSEndpointRequiresCertificate(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1500, util.IPVersion4, util.TLSTransport, addr, nil)})
+	defer serverMux.Close()
+	if err := serverMux.Start(); err == nil {
+		t.Errorf("Start() succeeded without a TLS certificate")
+	}
+}
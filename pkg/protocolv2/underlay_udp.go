@@ -17,10 +17,13 @@ package protocolv2
 
 import (
 	"context"
-	"encoding/hex"
+	crand "crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/enfein/mieru/pkg/appctl/appctlpb"
@@ -42,21 +45,63 @@ const (
 	idleSessionTimeout        = time.Minute
 )
 
-var udpReplayCache = replay.NewCache(4*1024*1024, 2*time.Minute)
+var udpReplayCache = replay.NewCache(replayCacheCapacity, defaultReplayWindow)
+
+// replayCache returns the replay cache used by the underlay.
+func (u *UDPUnderlay) replayCache() *replay.ReplayCache {
+	if u.replays != nil {
+		return u.replays
+	}
+	return udpReplayCache
+}
 
 type UDPUnderlay struct {
 	// ---- common fields ----
 	baseUnderlay
-	conn *net.UDPConn
+	conn   *net.UDPConn
+	connMu sync.RWMutex // protects conn, which is replaced by rebind
 
 	idleSessionTicker *time.Ticker
 
+	// sessionBuffer is the capacity of the receive channel of each session.
+	// It is zero if the default capacity is used.
+	sessionBuffer int
+	bufferPolicy  UDPBufferPolicy
+
 	// ---- client fields ----
 	serverAddr *net.UDPAddr
 	block      cipher.BlockCipher
+	pmtud      *pathMTUDiscovery // nil if path MTU discovery is disabled
+
+	// redial creates a new socket to the server. It is nil if connection
+	// migration is disabled.
+	redial func() (*net.UDPConn, error)
 
 	// ---- server fields ----
-	users map[string]*appctlpb.User
+	users   map[string]*appctlpb.User
+	usersMu sync.Mutex
+	ciphers CipherFactory // if nil, DefaultCipherFactory is used
+	limiter *userConnLimiter
+	traffic *userTrafficTable
+	replays *replay.ReplayCache                        // if nil, udpReplayCache is used
+	onAuth  func(userName string, remoteAddr net.Addr) // nil if not set
+
+	// fallbackUser is tried after all the users fail to decrypt a new
+	// session. It is nil if not set.
+	fallbackUser *appctlpb.User
+
+	// capabilities are supported by the server for new sessions.
+	capabilities capability
+
+	// acl drops the packets from source addresses that are not allowed.
+	acl *addressACL
+
+	// migration is true if sessions can move to a new client address.
+	migration bool
+
+	// blockContext creates the block context of a user. It is nil if the
+	// block context only has the user name.
+	blockContext BlockContextFunc
 }
 
 var _ Underlay = &UDPUnderlay{}
@@ -65,6 +110,12 @@ var _ Underlay = &UDPUnderlay{}
 // with packet encryption. If "laddr" is empty, an automatic address is used.
 // "block" is the block encryption algorithm to encrypt packets.
 func NewUDPUnderlay(ctx context.Context, network, laddr, raddr string, mtu int, block cipher.BlockCipher) (*UDPUnderlay, error) {
+	return newUDPUnderlay(ctx, nil, network, laddr, raddr, mtu, block)
+}
+
+// newUDPUnderlay is like NewUDPUnderlay, but the connection is created by
+// dial. If dial is nil, the default network stack is used.
+func newUDPUnderlay(ctx context.Context, dial DialFunc, network, laddr, raddr string, mtu int, block cipher.BlockCipher) (*UDPUnderlay, error) {
 	switch network {
 	case "udp", "udp4", "udp6":
 	default:
@@ -73,28 +124,23 @@ func NewUDPUnderlay(ctx context.Context, network, laddr, raddr string, mtu int,
 	if !block.IsStateless() {
 		return nil, fmt.Errorf("UDP block cipher must be stateless")
 	}
-	var localAddr *net.UDPAddr
-	var err error
-	if laddr != "" {
-		localAddr, err = net.ResolveUDPAddr("udp", laddr)
-		if err != nil {
-			return nil, fmt.Errorf("net.ResolveUDPAddr() failed: %w", err)
-		}
-	}
 	remoteAddr, err := net.ResolveUDPAddr("udp", raddr)
 	if err != nil {
 		return nil, fmt.Errorf("net.ResolveUDPAddr() failed: %w", err)
 	}
+	if dial == nil {
+		dial = defaultDial
+	}
 
-	conn, err := net.ListenUDP(network, localAddr)
+	rawConn, err := dial(ctx, network, laddr, raddr)
 	if err != nil {
-		return nil, fmt.Errorf("net.ListenUDP() failed: %w", err)
+		return nil, fmt.Errorf("dial UDP failed: %w", err)
 	}
-	rawConn, err := conn.SyscallConn()
-	if err != nil {
-		return nil, fmt.Errorf("SyscallConn() failed: %w", err)
+	conn, ok := rawConn.(*net.UDPConn)
+	if !ok {
+		rawConn.Close()
+		return nil, fmt.Errorf("dialer returned %T, want *net.UDPConn", rawConn)
 	}
-	rawConn.Control(sockopts.ReuseAddrPortRaw())
 	u := &UDPUnderlay{
 		baseUnderlay:      *newBaseUnderlay(true, mtu),
 		conn:              conn,
@@ -127,17 +173,63 @@ func (u *UDPUnderlay) Close() error {
 	}
 
 	log.Debugf("Closing %v", u)
+	UDPUnderlayCurrEstablished.Add(-1)
 	u.idleSessionTicker.Stop()
 	u.baseUnderlay.Close()
-	return u.conn.Close()
+	return u.udpConn().Close()
+}
+
+// MTU returns the MTU used to send segments.
+func (u *UDPUnderlay) MTU() int {
+	return u.PathMTU()
+}
+
+// PathMTU returns the path MTU discovered by the client underlay.
+// If path MTU discovery is disabled, the configured MTU is returned.
+func (u *UDPUnderlay) PathMTU() int {
+	if u.pmtud != nil {
+		return u.pmtud.mtu()
+	}
+	return u.mtu
+}
+
+// applyOptions applies the optional settings to the UDP connection.
+// It must be called before the event loop is started.
+func (u *UDPUnderlay) applyOptions(options UnderlayOptions) error {
+	u.options = options
+	if !options.UDPPathMTUDiscovery || !u.isClient {
+		return nil
+	}
+	if dfErr := setDontFragment(u.conn); dfErr != nil {
+		// Without the don't fragment bit, probes are meaningless.
+		// Fall back to the configured MTU.
+		log.Debugf("%v path MTU discovery is disabled: %v", u, dfErr)
+		return nil
+	}
+	u.pmtud = newPathMTUDiscovery(u.mtu)
+	return nil
+}
+
+// setDontFragment sets the don't fragment bit of the UDP socket.
+func setDontFragment(conn *net.UDPConn) error {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("SyscallConn() failed: %w", err)
+	}
+	var dfErr error
+	if err := rawConn.Control(func(fd uintptr) { dfErr = sockopts.DontFragmentRawErr()(fd) }); err != nil {
+		return fmt.Errorf("Control() failed: %w", err)
+	}
+	return dfErr
 }
 
 func (u *UDPUnderlay) IPVersion() util.IPVersion {
-	if u.conn == nil {
+	conn := u.udpConn()
+	if conn == nil {
 		return util.IPVersionUnknown
 	}
 	if u.ipVersion == util.IPVersionUnknown {
-		u.ipVersion = util.GetIPVersion(u.conn.LocalAddr().String())
+		u.ipVersion = util.GetIPVersion(conn.LocalAddr().String())
 	}
 	return u.ipVersion
 }
@@ -147,7 +239,7 @@ func (u *UDPUnderlay) TransportProtocol() util.TransportProtocol {
 }
 
 func (u *UDPUnderlay) LocalAddr() net.Addr {
-	return u.conn.LocalAddr()
+	return u.udpConn().LocalAddr()
 }
 
 func (u *UDPUnderlay) RemoteAddr() net.Addr {
@@ -158,20 +250,19 @@ func (u *UDPUnderlay) RemoteAddr() net.Addr {
 }
 
 func (u *UDPUnderlay) AddSession(s *Session, remoteAddr net.Addr) error {
+	if u.sessionBuffer > 0 {
+		// The session is not visible to the read path yet.
+		s.recvChan = make(chan *segment, u.sessionBuffer)
+	}
 	if err := u.baseUnderlay.AddSession(s, remoteAddr); err != nil {
 		return err
 	}
-	s.conn = u // override base underlay
+	s.setUnderlay(u) // override base underlay
 	close(s.ready)
 	log.Debugf("Adding session %d to %v", s.id, u)
 
 	s.wg.Add(2)
-	go func() {
-		if err := s.runInputLoop(context.Background()); err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
-			log.Debugf("%v runInputLoop(): %v", s, err)
-		}
-		s.wg.Done()
-	}()
+	u.startInputLoop(s)
 	go func() {
 		if err := s.runOutputLoop(context.Background()); err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
 			log.Debugf("%v runOutputLoop(): %v", s, err)
@@ -185,6 +276,9 @@ func (u *UDPUnderlay) RunEventLoop(ctx context.Context) error {
 	if u.conn == nil {
 		return stderror.ErrNullPointer
 	}
+	if u.pmtud != nil {
+		go u.runPathMTUDiscovery(ctx)
+	}
 
 	for {
 		select {
@@ -196,7 +290,7 @@ func (u *UDPUnderlay) RunEventLoop(ctx context.Context) error {
 			// Close idle sessions.
 			u.sessionMap.Range(func(k, v any) bool {
 				session := v.(*Session)
-				if time.Since(session.lastRXTime) > idleSessionTimeout {
+				if time.Since(time.Unix(0, session.lastRXTime.Load())) > idleSessionTimeout {
 					log.Debugf("Found idle %v", session)
 					if err := session.Close(); err != nil && !stderror.IsEOF(err) && !stderror.IsClosed(err) {
 						log.Debugf("%v Close() failed: %v", session, err)
@@ -214,6 +308,7 @@ func (u *UDPUnderlay) RunEventLoop(ctx context.Context) error {
 		if err != nil {
 			return fmt.Errorf("readOneSegment() failed: %w", err)
 		}
+		u.markReceived()
 		if log.IsLevelEnabled(log.TraceLevel) {
 			log.Tracef("%v received %v from peer %v", u, seg, addr)
 		}
@@ -260,7 +355,19 @@ func (u *UDPUnderlay) RunEventLoop(ctx context.Context) error {
 				}
 				continue
 			}
-			session.(*Session).recvChan <- seg
+			if u.maybeMigrate(session.(*Session), seg, addr) {
+				continue
+			}
+			if u.isClient && das.flags&dataFlagPathChallenge != 0 {
+				if !session.(*Session).hasCapability(capPathValidation) {
+					continue
+				}
+				if err := u.answerPathChallenge(das, seg, addr); err != nil {
+					log.Debugf("%v answerPathChallenge() failed: %v", u, err)
+				}
+				continue
+			}
+			u.deliverData(session.(*Session), seg)
 		} else {
 			log.Debugf("Ignore unknown protocol %d", seg.metadata.Protocol())
 		}
@@ -283,14 +390,47 @@ func (u *UDPUnderlay) onOpenSessionRequest(seg *segment, remoteAddr net.Addr) er
 		log.Debugf("%v received open session request, but session ID %d is already used", u, sessionID)
 		return nil
 	}
+	if u.onAuth != nil && seg.block != nil {
+		u.onAuth(seg.block.BlockContext().UserName, remoteAddr)
+	}
 	session := NewSession(sessionID, false, u.MTU())
-	session.users = u.users
+	session.label = string(seg.metadata.(*sessionStruct).label)
+	session.users = u.getUsers()
+	session.limiter = u.limiter
+	session.traffic = u.traffic
+	session.capabilities = u.capabilities
+	// Negotiate before the underlay delivers any data segment to the session.
+	session.negotiate(capability(seg.metadata.(*sessionStruct).capabilities))
+	session.setUser(seg.block)
 	u.AddSession(session, remoteAddr)
-	session.recvChan <- seg
+	session.deliver(seg)
 	u.readySessions <- session
 	return nil
 }
 
+// cipherFactory returns the factory to create block ciphers of users.
+func (u *UDPUnderlay) cipherFactory() CipherFactory {
+	if u.ciphers == nil {
+		return DefaultCipherFactory{}
+	}
+	return u.ciphers
+}
+
+// getUsers returns the registered users of the server underlay.
+func (u *UDPUnderlay) getUsers() map[string]*appctlpb.User {
+	u.usersMu.Lock()
+	defer u.usersMu.Unlock()
+	return u.users
+}
+
+// setUsers replaces the registered users of the server underlay.
+// Existing sessions are not affected.
+func (u *UDPUnderlay) setUsers(users map[string]*appctlpb.User) {
+	u.usersMu.Lock()
+	defer u.usersMu.Unlock()
+	u.users = users
+}
+
 func (u *UDPUnderlay) onOpenSessionResponse(seg *segment) error {
 	if !u.isClient {
 		return stderror.ErrInvalidOperation
@@ -301,20 +441,26 @@ func (u *UDPUnderlay) onOpenSessionResponse(seg *segment) error {
 	if !found {
 		return fmt.Errorf("session ID %d is not found", sessionID)
 	}
-	session.(*Session).recvChan <- seg
+	session.(*Session).deliver(seg)
 	return nil
 }
 
 func (u *UDPUnderlay) onCloseSession(seg *segment) error {
 	ss := seg.metadata.(*sessionStruct)
 	sessionID := ss.sessionID
+	if u.pmtud != nil && u.pmtud.onProbeResponse(sessionID) {
+		if log.IsLevelEnabled(log.TraceLevel) {
+			log.Tracef("%v path MTU is %d", u, u.pmtud.mtu())
+		}
+		return nil
+	}
 	session, found := u.sessionMap.Load(sessionID)
 	if !found {
 		log.Debugf("%v received close session request or response, but session ID %d is not found", u, sessionID)
 		return nil
 	}
 	s := session.(*Session)
-	s.recvChan <- seg
+	s.deliver(seg)
 	s.wg.Wait()
 	u.RemoveSession(s)
 	return nil
@@ -334,8 +480,13 @@ func (u *UDPUnderlay) readOneSegment() (*segment, *net.UDPAddr, error) {
 		// Peer may select a different MTU.
 		// Use the largest possible value here to avoid error.
 		b := make([]byte, 1500)
-		n, addr, err = u.conn.ReadFromUDP(b)
+		conn := u.udpConn()
+		n, addr, err = conn.ReadFromUDP(b)
 		if err != nil {
+			if conn != u.udpConn() {
+				// The socket is replaced by rebind.
+				continue
+			}
 			return nil, nil, fmt.Errorf("ReadFromUDP() failed: %w", err)
 		}
 		if u.isClient && addr.String() != u.serverAddr.String() {
@@ -345,6 +496,13 @@ func (u *UDPUnderlay) readOneSegment() (*segment, *net.UDPAddr, error) {
 			}
 			continue
 		}
+		if !u.isClient && !u.acl.permits(addr) {
+			UnderlayBlockedByACL.Add(1)
+			if log.IsLevelEnabled(log.TraceLevel) {
+				log.Tracef("%v dropped UDP packet from %v blocked by ACL", u, addr)
+			}
+			continue
+		}
 		if n < udpNonHeaderPosition {
 			UnderlayMalformedUDP.Add(1)
 			if log.IsLevelEnabled(log.TraceLevel) {
@@ -354,11 +512,13 @@ func (u *UDPUnderlay) readOneSegment() (*segment, *net.UDPAddr, error) {
 		}
 		b = b[:n]
 		metrics.InBytes.Add(int64(n))
+		u.inBytes.Add(int64(n))
 
 		// Read encrypted metadata.
 		encryptedMeta := b[:udpNonHeaderPosition]
-		if udpReplayCache.IsDuplicate(encryptedMeta[:cipher.DefaultOverhead], addr.String()) {
+		if u.replayCache().IsDuplicate(encryptedMeta[:cipher.DefaultOverhead], addr.String()) {
 			replay.NewSession.Add(1)
+			UnderlayReplayDropped.Add(1)
 			return nil, nil, fmt.Errorf("found possible replay attack in %v from %v", u, addr)
 		}
 		nonce := encryptedMeta[:cipher.DefaultNonceSize]
@@ -383,38 +543,46 @@ func (u *UDPUnderlay) readOneSegment() (*segment, *net.UDPAddr, error) {
 			cipher.ServerIterateDecrypt.Add(1)
 			u.sessionMap.Range(func(k, v any) bool {
 				session := v.(*Session)
-				if session.block != nil && session.RemoteAddr().String() == addr.String() {
-					decryptedMeta, err = session.block.Decrypt(encryptedMeta)
+				if block := session.getBlock(); block != nil && session.RemoteAddr().String() == addr.String() {
+					decryptedMeta, err = block.Decrypt(encryptedMeta)
 					if err == nil {
 						decrypted = true
-						blockCipher = session.block
+						blockCipher = block
 						return false
 					}
 				}
 				return true
 			})
+			tryUser := func(user *appctlpb.User) bool {
+				blocks, err := userBlockCiphers(u.cipherFactory(), user, true)
+				if err != nil {
+					log.Debugf("%v", err)
+					return false
+				}
+				blockCipher, decryptedMeta, err = cipher.SelectDecrypt(encryptedMeta, blocks)
+				if err != nil {
+					return false
+				}
+				// The cached block cipher is shared, so the context is set
+				// to a copy of it.
+				blockCipher = blockCipher.Clone()
+				blockCipher.SetBlockContext(userBlockContext(user, u.blockContext))
+				return true
+			}
 			if !decrypted {
 				// This is a new session. Try all registered users.
-				for _, user := range u.users {
-					var password []byte
-					password, err = hex.DecodeString(user.GetHashedPassword())
-					if err != nil {
-						log.Debugf("Unable to decode hashed password %q from user %q", user.GetHashedPassword(), user.GetName())
-						continue
-					}
-					if len(password) == 0 {
-						password = cipher.HashPassword([]byte(user.GetPassword()), []byte(user.GetName()))
-					}
-					blockCipher, decryptedMeta, err = cipher.TryDecrypt(encryptedMeta, password, true)
-					if err == nil {
+				for _, user := range u.getUsers() {
+					if tryUser(user) {
 						decrypted = true
-						blockCipher.SetBlockContext(cipher.BlockContext{
-							UserName: user.GetName(),
-						})
 						break
 					}
 				}
 			}
+			if !decrypted && u.fallbackUser != nil && tryUser(u.fallbackUser) {
+				decrypted = true
+				UnderlayFallbackAuth.Add(1)
+				log.Warnf("%v authenticated fallback user %q from %v", u, u.fallbackUser.GetName(), addr)
+			}
 			if !decrypted {
 				cipher.ServerFailedIterateDecrypt.Add(1)
 				if log.IsLevelEnabled(log.TraceLevel) {
@@ -568,7 +736,7 @@ func (u *UDPUnderlay) writeOneSegment(seg *segment, addr *net.UDPAddr) error {
 		return fmt.Errorf("can't write to %v, UDP server address is %v", addr, u.serverAddr)
 	}
 
-	u.sendMutex.Lock()
+	u.sendMutex.lockWithPriority(seg.priority)
 	defer u.sendMutex.Unlock()
 
 	var blockCipher cipher.BlockCipher
@@ -591,17 +759,18 @@ func (u *UDPUnderlay) writeOneSegment(seg *segment, addr *net.UDPAddr) error {
 				return fmt.Errorf("session %d not found", sessionID)
 			}
 			s := session.(*Session)
-			if s.block == nil {
+			block := s.getBlock()
+			if block == nil {
 				// stderror.ErrNotReady is needed to trigger stderror.ShouldRetry.
 				return fmt.Errorf("%v cipher block is not ready, please try again later: %w", s, stderror.ErrNotReady)
 			} else {
-				blockCipher = s.block
+				blockCipher = block
 			}
 		}
 	}
 
 	if ss, ok := toSessionStruct(seg.metadata); ok {
-		maxPaddingSize := MaxPaddingSize(u.mtu, u.IPVersion(), u.TransportProtocol(), int(ss.payloadLen), 0)
+		maxPaddingSize := MaxPaddingSize(u.MTU(), u.IPVersion(), u.TransportProtocol(), int(ss.payloadLen), 0)
 		padding := newPadding(paddingOpts{
 			maxLen:                 maxPaddingSize,
 			minConsecutiveASCIILen: mathext.Max(maxPaddingSize, recommendedConsecutiveASCIILen),
@@ -626,17 +795,18 @@ func (u *UDPUnderlay) writeOneSegment(seg *segment, addr *net.UDPAddr) error {
 			dataToSend = append(dataToSend, encryptedPayload...)
 		}
 		dataToSend = append(dataToSend, padding...)
-		if _, err := u.conn.WriteToUDP(dataToSend, addr); err != nil {
-			return fmt.Errorf("WriteToUDP() failed: %w", err)
+		if err := u.writeToUDP(dataToSend, addr); err != nil {
+			return err
 		}
 		metrics.OutBytes.Add(int64(len(dataToSend)))
+		u.outBytes.Add(int64(len(dataToSend)))
 		metrics.OutPaddingBytes.Add(int64(len(padding)))
 	} else if das, ok := toDataAckStruct(seg.metadata); ok {
 		padding1 := newPadding(paddingOpts{
-			maxLen: MaxPaddingSize(u.mtu, u.IPVersion(), u.TransportProtocol(), int(das.payloadLen), 0),
+			maxLen: MaxPaddingSize(u.MTU(), u.IPVersion(), u.TransportProtocol(), int(das.payloadLen), 0),
 		})
 		padding2 := newPadding(paddingOpts{
-			maxLen: MaxPaddingSize(u.mtu, u.IPVersion(), u.TransportProtocol(), int(das.payloadLen), len(padding1)),
+			maxLen: MaxPaddingSize(u.MTU(), u.IPVersion(), u.TransportProtocol(), int(das.payloadLen), len(padding1)),
 		})
 		das.prefixLen = uint8(len(padding1))
 		das.suffixLen = uint8(len(padding2))
@@ -659,10 +829,11 @@ func (u *UDPUnderlay) writeOneSegment(seg *segment, addr *net.UDPAddr) error {
 			dataToSend = append(dataToSend, encryptedPayload...)
 		}
 		dataToSend = append(dataToSend, padding2...)
-		if _, err := u.conn.WriteToUDP(dataToSend, addr); err != nil {
-			return fmt.Errorf("WriteToUDP() failed: %w", err)
+		if err := u.writeToUDP(dataToSend, addr); err != nil {
+			return err
 		}
 		metrics.OutBytes.Add(int64(len(dataToSend)))
+		u.outBytes.Add(int64(len(dataToSend)))
 		metrics.OutPaddingBytes.Add(int64(len(padding1)))
 		metrics.OutPaddingBytes.Add(int64(len(padding2)))
 	} else {
@@ -670,3 +841,108 @@ func (u *UDPUnderlay) writeOneSegment(seg *segment, addr *net.UDPAddr) error {
 	}
 	return nil
 }
+
+// writeToUDP writes a packet to the network connection. If the packet is
+// larger than the path MTU, the path MTU is reduced and the caller
+// should try again later.
+func (u *UDPUnderlay) writeToUDP(b []byte, addr *net.UDPAddr) error {
+	conn := u.udpConn()
+	if _, err := conn.WriteToUDP(b, addr); err != nil {
+		if u.pmtud != nil && errors.Is(err, syscall.EMSGSIZE) {
+			u.pmtud.onMessageTooLong(len(b) + u.ipAndUDPHeaderSize())
+			return fmt.Errorf("WriteToUDP() failed: %w: %w", err, stderror.ErrNotReady)
+		}
+		if u.redial == nil {
+			return fmt.Errorf("WriteToUDP() failed: %w", err)
+		}
+		select {
+		case <-u.done:
+			return fmt.Errorf("WriteToUDP() failed: %w", err)
+		default:
+		}
+		// The local address may be gone. Resend with a new socket.
+		if rerr := u.rebind(conn); rerr != nil {
+			return fmt.Errorf("WriteToUDP() failed: %w", errors.Join(err, rerr))
+		}
+		if _, err := u.udpConn().WriteToUDP(b, addr); err != nil {
+			return fmt.Errorf("WriteToUDP() failed after migration: %w", err)
+		}
+	}
+	return nil
+}
+
+// runPathMTUDiscovery sends probes to the server until the underlay is closed.
+func (u *UDPUnderlay) runPathMTUDiscovery(ctx context.Context) {
+	ticker := time.NewTicker(pathMTUProbeInterval)
+	defer ticker.Stop()
+	isUsed := func(id uint32) bool {
+		_, found := u.sessionMap.Load(id)
+		return found
+	}
+	for {
+		id, mtu := u.pmtud.nextProbe(time.Now(), isUsed)
+		if mtu != 0 {
+			if err := u.writeProbe(id, mtu); err != nil {
+				if !stderror.ShouldRetry(err) {
+					log.Debugf("%v writeProbe() failed: %v", u, err)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// writeProbe sends a data segment that fills the given MTU.
+func (u *UDPUnderlay) writeProbe(sessionID uint32, mtu int) error {
+	payload := make([]byte, MaxFragmentSize(mtu, u.IPVersion(), u.TransportProtocol()))
+	if _, err := crand.Read(payload); err != nil {
+		return fmt.Errorf("rand.Read() failed: %w", err)
+	}
+	seg := &segment{
+		metadata: &dataAckStruct{
+			baseStruct: baseStruct{
+				protocol: uint8(dataClientToServer),
+			},
+			sessionID:  sessionID,
+			payloadLen: uint16(len(payload)),
+		},
+		payload:   payload,
+		transport: u.TransportProtocol(),
+	}
+	if log.IsLevelEnabled(log.TraceLevel) {
+		log.Tracef("%v is sending path MTU probe of size %d", u, mtu)
+	}
+
+	u.sendMutex.Lock()
+	defer u.sendMutex.Unlock()
+	encryptedMetadata, err := u.block.Encrypt(seg.metadata.Marshal())
+	if err != nil {
+		return fmt.Errorf("Encrypt() failed: %w", err)
+	}
+	nonce := encryptedMetadata[:cipher.DefaultNonceSize]
+	encryptedPayload, err := u.block.EncryptWithNonce(seg.payload, nonce)
+	if err != nil {
+		return fmt.Errorf("EncryptWithNonce() failed: %w", err)
+	}
+	dataToSend := append(encryptedMetadata, encryptedPayload...)
+	if err := u.writeToUDP(dataToSend, u.serverAddr); err != nil {
+		return err
+	}
+	metrics.OutBytes.Add(int64(len(dataToSend)))
+	u.outBytes.Add(int64(len(dataToSend)))
+	return nil
+}
+
+// ipAndUDPHeaderSize returns the size of IP and UDP headers of a packet.
+func (u *UDPUnderlay) ipAndUDPHeaderSize() int {
+	if u.IPVersion() == util.IPVersion4 {
+		return 20 + 8
+	}
+	return 40 + 8
+}
@@ -0,0 +1,154 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// WebSocketUnderlay carries the TCP underlay protocol in WebSocket binary
+// frames, optionally over TLS. It can pass networks that only allow
+// HTTP and HTTPS traffic. Sessions are multiplexed in the same way as
+// TCP underlay.
+type WebSocketUnderlay struct {
+	*TCPUnderlay
+}
+
+var _ Underlay = &WebSocketUnderlay{}
+
+// NewWebSocketUnderlay connects to the remote address "raddr" on the network
+// "tcp", and upgrades the connection to WebSocket as specified by "config".
+// If "laddr" is empty, an automatic address is used.
+// "block" is the block encryption algorithm to encrypt packets.
+func NewWebSocketUnderlay(ctx context.Context, network, laddr, raddr string, mtu int, block cipher.BlockCipher, config WebSocketConfig) (*WebSocketUnderlay, error) {
+	return newWebSocketUnderlay(ctx, nil, network, laddr, raddr, mtu, block, UnderlayOptions{WebSocket: config})
+}
+
+// newWebSocketUnderlay is like NewWebSocketUnderlay, but the connection is
+// created by dial, and the TCP options are applied to the connection.
+// If dial is nil, the default network stack is used.
+func newWebSocketUnderlay(ctx context.Context, dial DialFunc, network, laddr, raddr string, mtu int, block cipher.BlockCipher, options UnderlayOptions) (*WebSocketUnderlay, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix", MemoryNetwork:
+	default:
+		return nil, fmt.Errorf("network %s is not supported by WebSocket underlay", network)
+	}
+	if block.IsStateless() {
+		return nil, fmt.Errorf("WebSocket block cipher must not be stateless")
+	}
+	if dial == nil {
+		dial = defaultDial
+	}
+	config := options.WebSocket
+	host := config.Host
+	if host == "" {
+		host = raddr
+	}
+
+	rawConn, err := dial(ctx, network, laddr, raddr)
+	if err != nil {
+		return nil, fmt.Errorf("DialContext() failed: %w", err)
+	}
+	if err := applyTCPOptions(rawConn, options); err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("applyTCPOptions() failed: %w", err)
+	}
+	conn := rawConn
+	if config.TLSConfig != nil {
+		tlsConfig := config.TLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				tlsConfig.ServerName = h
+			} else {
+				tlsConfig.ServerName = host
+			}
+		}
+		tlsConn := tls.Client(rawConn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			rawConn.Close()
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	ws, err := clientWebSocketHandshake(ctx, conn, host, config.Path)
+	if err != nil {
+		rawConn.Close()
+		return nil, fmt.Errorf("clientWebSocketHandshake() failed: %w", err)
+	}
+
+	w := &WebSocketUnderlay{
+		TCPUnderlay: &TCPUnderlay{
+			baseUnderlay: *newBaseUnderlay(true, mtu),
+			conn:         ws,
+			candidates:   []cipher.BlockCipher{block},
+		},
+	}
+	w.options = options
+	w.wrapper = util.WebSocketTransport
+	log.Debugf("Created new client WebSocket underlay %v", w)
+	return w, nil
+}
+
+func (w *WebSocketUnderlay) String() string {
+	if w.conn == nil {
+		return "WebSocketUnderlay{}"
+	}
+	return fmt.Sprintf("WebSocketUnderlay{local=%v, remote=%v, mtu=%v, ipVersion=%v}", w.conn.LocalAddr(), w.conn.RemoteAddr(), w.mtu, w.IPVersion())
+}
+
+func (w *WebSocketUnderlay) TransportProtocol() util.TransportProtocol {
+	return util.WebSocketTransport
+}
+
+// serverWrapWebSocketConn performs the TLS and WebSocket handshakes of an
+// accepted connection, and returns the server WebSocket underlay.
+func (m *Mux) serverWrapWebSocketConn(rawConn net.Conn, properties UnderlayProperties) (Underlay, error) {
+	options := underlayOptions(properties)
+	if err := applyTCPOptions(rawConn, options); err != nil {
+		return nil, fmt.Errorf("applyTCPOptions() failed: %w", err)
+	}
+	conn := rawConn
+	if options.WebSocket.TLSConfig != nil {
+		tlsConn := tls.Server(rawConn, options.WebSocket.TLSConfig)
+		ctx, cancel := context.WithTimeout(context.Background(), webSocketHandshakeTimeout)
+		defer cancel()
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, fmt.Errorf("TLS handshake failed: %w", err)
+		}
+		conn = tlsConn
+	}
+	ws, err := serverWebSocketHandshake(conn, options.WebSocket.Path)
+	if err != nil {
+		return nil, fmt.Errorf("serverWebSocketHandshake() failed: %w", err)
+	}
+
+	m.mu.Lock()
+	users := m.users
+	m.mu.Unlock()
+	w := &WebSocketUnderlay{
+		TCPUnderlay: m.serverWrapTCPConn(ws, properties.MTU(), users).(*TCPUnderlay),
+	}
+	w.options = options
+	w.wrapper = util.WebSocketTransport
+	return w, nil
+}
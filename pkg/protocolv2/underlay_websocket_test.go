@@ -0,0 +1,112 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/testtool"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// newTestCertificate returns a self-signed certificate of 127.0.0.1.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() failed: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mieru test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate() failed: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate() failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func runWebSocketUnderlayTest(t *testing.T, serverConfig, clientConfig WebSocketConfig) {
+	port, err := util.UnusedTCPPort()
+	if err != nil {
+		t.Fatalf("util.UnusedTCPPort() failed: %v", err)
+	}
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	serverProperties := NewUnderlayPropertiesWithOptions(1500, util.IPVersion4, util.WebSocketTransport, addr, nil, UnderlayOptions{WebSocket: serverConfig})
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{serverProperties})
+	testServer := testtool.NewTestHelperServer()
+	if err := serverMux.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	go testServer.Serve(serverMux)
+	defer testServer.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	clientProperties := NewUnderlayPropertiesWithOptions(1500, util.IPVersion4, util.WebSocketTransport, nil, addr, UnderlayOptions{WebSocket: clientConfig})
+	runClient(t, clientProperties, []byte("xiaochitang"), []byte("kuiranbudong"), 4)
+
+	stats := serverMux.Stats()
+	if len(stats) == 0 {
+		t.Errorf("server has no underlay")
+	}
+	for _, s := range stats {
+		if s.TransportProtocol != util.WebSocketTransport {
+			t.Errorf("server underlay transport is %v, want %v", s.TransportProtocol, util.WebSocketTransport)
+		}
+	}
+	if err := serverMux.Close(); err != nil {
+		t.Errorf("Server mux close failed: %v", err)
+	}
+}
+
+func TestWebSocketUnderlay(t *testing.T) {
+	log.SetOutputToTest(t)
+	runWebSocketUnderlayTest(t, WebSocketConfig{Path: "/ws"}, WebSocketConfig{Path: "/ws"})
+}
+
+func TestWebSocketTLSUnderlay(t *testing.T) {
+	log.SetOutputToTest(t)
+	cert, pool := newTestCertificate(t)
+	runWebSocketUnderlayTest(t,
+		WebSocketConfig{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}},
+		WebSocketConfig{TLSConfig: &tls.Config{RootCAs: pool}},
+	)
+}
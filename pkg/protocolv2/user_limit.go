@@ -0,0 +1,94 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"sync"
+
+	"github.com/enfein/mieru/pkg/log"
+)
+
+// userConnLimiter caps the number of concurrent sessions of each user.
+type userConnLimiter struct {
+	mu     sync.Mutex
+	limits map[string]int
+	counts map[string]int
+}
+
+func newUserConnLimiter(limits map[string]int) *userConnLimiter {
+	l := &userConnLimiter{
+		limits: make(map[string]int),
+		counts: make(map[string]int),
+	}
+	for user, limit := range limits {
+		if limit > 0 {
+			l.limits[user] = limit
+		}
+	}
+	return l
+}
+
+// acquire returns true if the user can open one more session.
+// If true is returned, release must be called when the session is closed.
+func (l *userConnLimiter) acquire(user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limit, found := l.limits[user]
+	if !found {
+		return true
+	}
+	if l.counts[user] >= limit {
+		return false
+	}
+	l.counts[user]++
+	return true
+}
+
+// release decreases the number of sessions of the user.
+func (l *userConnLimiter) release(user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, found := l.limits[user]; !found {
+		return
+	}
+	if l.counts[user] > 0 {
+		l.counts[user]--
+	}
+	if l.counts[user] == 0 {
+		delete(l.counts, user)
+	}
+}
+
+// count returns the number of sessions of the user that are counted.
+func (l *userConnLimiter) count(user string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.counts[user]
+}
+
+func (m *Mux) SetUserConnLimit(limits map[string]int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isClient {
+		panic("Can't set user connection limit in client mux")
+	}
+	if m.used {
+		panic("Can't set user connection limit after mux is used")
+	}
+	m.limiter = newUserConnLimiter(limits)
+	m.logf(log.InfoLevel, "Mux user connection limit is set for %d users", len(m.limiter.limits))
+	return m
+}
@@ -0,0 +1,76 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/testtool"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestUserConnLimit(t *testing.T) {
+	for _, transport := range []util.TransportProtocol{util.TCPTransport, util.UDPTransport} {
+		serverMux, endpoint := startTestMux(t, transport, func(m *Mux) {
+			m.SetUserConnLimit(map[string]int{"xiaochitang": 1})
+		})
+		clientMux := newTestClient(endpoint)
+
+		first, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		acceptTestSession(t, serverMux, first)
+
+		// The second session is rejected.
+		second, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		second.Write(testtool.TestHelperGenRot13Input(1024))
+		second.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := second.Read(make([]byte, 1024)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Read() returned %v, want the session to be rejected with transport %v", err, transport)
+		}
+		if err := second.(*Session).closeError(); err == nil {
+			t.Errorf("rejected session has no close error")
+		}
+		second.Close()
+		if got := serverMux.limiter.count("xiaochitang"); got != 1 {
+			t.Errorf("user has %d counted sessions, want 1", got)
+		}
+
+		// The limit is released after the first session is closed.
+		first.Close()
+		for i := 0; i < 100 && serverMux.limiter.count("xiaochitang") != 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := serverMux.limiter.count("xiaochitang"); got != 0 {
+			t.Fatalf("user has %d counted sessions after close, want 0", got)
+		}
+		third, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		acceptTestSession(t, serverMux, third)
+		third.Close()
+		clientMux.Close()
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// TrafficStats is the amount of data transferred by a user.
+type TrafficStats struct {
+	InBytes  int64 // number of bytes received from the user
+	OutBytes int64 // number of bytes sent to the user
+}
+
+// trafficCounter counts the data transferred by a user.
+type trafficCounter struct {
+	inBytes  atomic.Int64
+	outBytes atomic.Int64
+}
+
+// userTrafficTable stores the traffic counter of each user.
+type userTrafficTable struct {
+	counters sync.Map // Map<userName, *trafficCounter>
+}
+
+// counter returns the traffic counter of the user.
+func (t *userTrafficTable) counter(user string) *trafficCounter {
+	if c, found := t.counters.Load(user); found {
+		return c.(*trafficCounter)
+	}
+	c, _ := t.counters.LoadOrStore(user, &trafficCounter{})
+	return c.(*trafficCounter)
+}
+
+// snapshot returns the traffic of all the users.
+func (t *userTrafficTable) snapshot() map[string]TrafficStats {
+	res := make(map[string]TrafficStats)
+	t.counters.Range(func(k, v any) bool {
+		c := v.(*trafficCounter)
+		res[k.(string)] = TrafficStats{
+			InBytes:  c.inBytes.Load(),
+			OutBytes: c.outBytes.Load(),
+		}
+		return true
+	})
+	return res
+}
+
+// UserTraffic returns the amount of data transferred by each user
+// through the server. The counters never decrease.
+func (m *Mux) UserTraffic() map[string]TrafficStats {
+	return m.traffic.snapshot()
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"testing"
+
+	"github.com/enfein/mieru/pkg/appctl/appctlpb"
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/util"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUserTraffic(t *testing.T) {
+	log.SetOutputToTest(t)
+	serverMux, endpoint := startTestServer(t, util.TCPTransport, func(m *Mux) {
+		m.SetServerUsers(map[string]*appctlpb.User{
+			"xiaochitang": users["xiaochitang"],
+			"dahuangya": {
+				Name:     proto.String("dahuangya"),
+				Password: proto.String("yanjingbufang"),
+			},
+		})
+	})
+	clients := []struct {
+		name     string
+		password string
+		size     int
+	}{
+		{name: "xiaochitang", password: "kuiranbudong", size: 1024},
+		{name: "dahuangya", password: "yanjingbufang", size: 3000},
+	}
+	for _, c := range clients {
+		clientMux := NewMux(true).
+			SetClientPassword(cipher.HashPassword([]byte(c.password), []byte(c.name))).
+			SetEndpoints([]UnderlayProperties{endpoint})
+		conn, err := clientMux.DialContext(context.Background())
+		if err != nil {
+			t.Fatalf("DialContext() failed: %v", err)
+		}
+		rot13RoundTrip(t, conn, c.size)
+		rot13RoundTrip(t, conn, c.size)
+		conn.Close()
+		clientMux.Close()
+	}
+
+	traffic := serverMux.UserTraffic()
+	if len(traffic) != len(clients) {
+		t.Fatalf("got traffic of %d users, want %d", len(traffic), len(clients))
+	}
+	for _, c := range clients {
+		want := TrafficStats{InBytes: int64(2 * c.size), OutBytes: int64(2 * c.size)}
+		if got := traffic[c.name]; got != want {
+			t.Errorf("traffic of user %s = %+v, want %+v", c.name, got, want)
+		}
+	}
+}
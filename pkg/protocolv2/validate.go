@@ -0,0 +1,207 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+// ValidateConfig checks the configuration of the mux without binding or
+// dialing any endpoint, so tools can verify it when it is loaded. All the
+// problems found are returned together. The checks are the same as those
+// of Start in a server mux and DialContext in a client mux, and so is the
+// warning about the MTUs of the endpoints.
+func (m *Mux) ValidateConfig() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkConfig()
+}
+
+// checkConfig returns the problems of the configuration together.
+// If there is none, it prints a warning once if the MTUs of the UDP
+// endpoints differ too much.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) checkConfig() error {
+	errs := m.configErrors()
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if warning, _ := validateEndpointMTUs(m.endpoints); warning != "" && !m.mtuWarned {
+		m.logf(log.WarnLevel, "%s", warning)
+		m.mtuWarned = true
+	}
+	return nil
+}
+
+// configErrors returns the problems of the configuration for the role
+// of the mux.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) configErrors() []error {
+	var errs []error
+	if m.isClient {
+		if len(m.password) == 0 {
+			errs = append(errs, fmt.Errorf("client password is not set"))
+		}
+		if len(m.endpoints) == 0 {
+			errs = append(errs, fmt.Errorf("no server endpoint found"))
+		}
+	} else {
+		if len(m.users) == 0 {
+			errs = append(errs, fmt.Errorf("no user found"))
+		}
+		if len(m.endpoints) == 0 {
+			errs = append(errs, fmt.Errorf("no server listening endpoint found"))
+		}
+	}
+	for i, p := range m.endpoints {
+		for _, err := range m.validateEndpoint(p) {
+			errs = append(errs, fmt.Errorf("endpoint %d: %w", i, err))
+		}
+	}
+	if _, err := validateEndpointMTUs(m.endpoints); err != nil {
+		errs = append(errs, err)
+	}
+	if !m.isClient {
+		if err := m.checkPreBoundListeners(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// validateEndpoint returns the problems of an endpoint for the role of
+// the mux.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) validateEndpoint(p UnderlayProperties) []error {
+	var errs []error
+	transport := p.TransportProtocol()
+	switch transport {
+	case util.TCPTransport, util.UDPTransport, util.WebSocketTransport:
+	case util.TLSTransport, util.QUICTransport:
+		if !m.isClient && !hasTLSCertificate(m.tlsConfig) {
+			errs = append(errs, fmt.Errorf("%s endpoint requires a TLS config with a certificate", strings.ToUpper(transportName(transport))))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unsupport transport protocol %v", transport))
+	}
+	addr, name := p.RemoteAddr(), "remote"
+	if !m.isClient {
+		addr, name = p.LocalAddr(), "local"
+	}
+	if util.IsNilNetAddr(addr) {
+		return append(errs, fmt.Errorf("endpoint %s address is not set", name))
+	}
+	if err := validateEndpointAddr(addr, transport, !m.isClient); err != nil {
+		errs = append(errs, fmt.Errorf("invalid %s address %q: %w", name, addr.String(), err))
+	}
+	return errs
+}
+
+// validateEndpointAddr checks if the address can be used by the transport.
+// Port 0 is only valid for a listening address, which binds a random port.
+func validateEndpointAddr(addr net.Addr, transport util.TransportProtocol, listening bool) error {
+	network := addr.Network()
+	switch network {
+	case "udp", "udp4", "udp6":
+		if !isUDPCarried(transport) {
+			return fmt.Errorf("network %s can't be used by %s transport", network, transportName(transport))
+		}
+	case "tcp", "tcp4", "tcp6", "unix", MemoryNetwork:
+		if isUDPCarried(transport) {
+			return fmt.Errorf("network %s can't be used by %s transport", network, strings.ToUpper(transportName(transport)))
+		}
+	default:
+		return fmt.Errorf("network %s is not supported", network)
+	}
+	if !isIPNetwork(network) {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 || (n == 0 && !listening) {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// maxEndpointMTUDifference is the maximum difference of MTUs between UDP
+// endpoints before a warning is printed.
+const maxEndpointMTUDifference = 100
+
+// EffectiveMTU returns the smallest MTU of the endpoints. A session can
+// rely on it no matter which underlay it is attached to. It returns 0 if
+// no endpoint is set.
+func (m *Mux) EffectiveMTU() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mtu := 0
+	for _, p := range m.endpoints {
+		if mtu == 0 || p.MTU() < mtu {
+			mtu = p.MTU()
+		}
+	}
+	return mtu
+}
+
+// validateEndpointMTUs checks the MTU of the endpoints. It returns an
+// error if a MTU is smaller than MinMTU, or a warning if the UDP endpoints
+// have MTUs that differ by more than maxEndpointMTUDifference bytes.
+// TCP endpoints are not compared because TCP doesn't depend on the MTU.
+func validateEndpointMTUs(endpoints []UnderlayProperties) (warning string, err error) {
+	minMTU, maxMTU := 0, 0
+	for i, p := range endpoints {
+		if p.TransportProtocol() != util.UDPTransport {
+			continue
+		}
+		if floor := MinMTU(p.IPVersion(), p.TransportProtocol()); p.MTU() < floor {
+			return "", fmt.Errorf("MTU %d of endpoint %d is smaller than the minimum viable MTU %d", p.MTU(), i, floor)
+		}
+		if minMTU == 0 || p.MTU() < minMTU {
+			minMTU = p.MTU()
+		}
+		if p.MTU() > maxMTU {
+			maxMTU = p.MTU()
+		}
+	}
+	if maxMTU-minMTU > maxEndpointMTUDifference {
+		return fmt.Sprintf("MTU of UDP endpoints ranges from %d to %d. Sessions may behave differently depending on the underlay they use", minMTU, maxMTU), nil
+	}
+	return "", nil
+}
+
+// checkClientConfig returns an error if the client can't create underlays.
+func (m *Mux) checkClientConfig() error {
+	if !m.isClient {
+		return stderror.ErrInvalidOperation
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.endpoints) == 0 {
+		UnderlayDialNoEndpoint.Add(1)
+	}
+	return m.checkConfig()
+}
@@ -0,0 +1,177 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/enfein/mieru/pkg/cipher"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8964}
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8964}
+	clientMux := NewMux(true).SetEndpoints([]UnderlayProperties{
+		NewUnderlayProperties(100, util.IPVersion4, util.UDPTransport, nil, udpAddr),
+		NewUnderlayProperties(1500, util.IPVersion4, util.TransportProtocol(99), nil, udpAddr),
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, nil),
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, util.NetAddr{Net: "tcp", Str: "no-port"}),
+		NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, nil, tcpAddr),
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}),
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, tcpAddr),
+	})
+	defer clientMux.Close()
+	err := clientMux.ValidateConfig()
+	if err == nil {
+		t.Fatalf("ValidateConfig() succeeded with malformed endpoints")
+	}
+	for _, want := range []string{
+		"client password is not set",
+		"MTU 100 of endpoint 0 is smaller than the minimum viable MTU",
+		"endpoint 1: unsupport transport protocol",
+		"endpoint 2: endpoint remote address is not set",
+		"endpoint 3: invalid remote address \"no-port\"",
+		"endpoint 4: invalid remote address \"127.0.0.1:8964\": network tcp can't be used by UDP transport",
+		"endpoint 5: invalid remote address \"127.0.0.1:0\": invalid port \"0\"",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ValidateConfig() error doesn't contain %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "endpoint 6") {
+		t.Errorf("ValidateConfig() reports the valid endpoint 6:\n%v", err)
+	}
+
+	serverMux := NewMux(false).SetEndpoints([]UnderlayProperties{
+		NewUnderlayProperties(1500, util.IPVersion4, util.TLSTransport, tcpAddr, nil),
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, tcpAddr),
+		NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil),
+	})
+	defer serverMux.Close()
+	err = serverMux.ValidateConfig()
+	if err == nil {
+		t.Fatalf("ValidateConfig() succeeded with malformed endpoints")
+	}
+	for _, want := range []string{
+		"no user found",
+		"endpoint 0: TLS endpoint requires a TLS config with a certificate",
+		"endpoint 1: endpoint local address is not set",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("ValidateConfig() error doesn't contain %q:\n%v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "endpoint 2") {
+		t.Errorf("ValidateConfig() reports the valid endpoint 2:\n%v", err)
+	}
+
+	validMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.TCPTransport, nil, tcpAddr))
+	defer validMux.Close()
+	if err := validMux.ValidateConfig(); err != nil {
+		t.Errorf("ValidateConfig() failed: %v", err)
+	}
+	if err := serverMux.Start(); err == nil || err.Error() != serverMux.ValidateConfig().Error() {
+		t.Errorf("Start() error = %v, want the error of ValidateConfig()", err)
+	}
+}
+
+func TestValidateConfigEndpointMTUs(t *testing.T) {
+	udpAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 8964}
+	clientMux := newTestClient(NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, nil, udpAddr)).
+		SetEndpoints([]UnderlayProperties{
+			NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, nil, udpAddr),
+			NewUnderlayProperties(1280, util.IPVersion4, util.UDPTransport, nil, udpAddr),
+		})
+	defer clientMux.Close()
+
+	// Like DialContext, MTUs that differ too much are only warned.
+	if err := clientMux.ValidateConfig(); err != nil {
+		t.Errorf("ValidateConfig() failed: %v", err)
+	}
+	clientMux.mu.Lock()
+	warned := clientMux.mtuWarned
+	clientMux.mu.Unlock()
+	if !warned {
+		t.Errorf("ValidateConfig() doesn't warn about the MTUs")
+	}
+
+	clientMux.SetEndpoints([]UnderlayProperties{
+		NewUnderlayProperties(1500, util.IPVersion4, util.UDPTransport, nil, udpAddr),
+		NewUnderlayProperties(MinMTU(util.IPVersion4, util.UDPTransport)-1, util.IPVersion4, util.UDPTransport, nil, udpAddr),
+	})
+	err := clientMux.ValidateConfig()
+	if err == nil || !strings.Contains(err.Error(), "MTU") {
+		t.Errorf("ValidateConfig() error = %v, want the MTU error", err)
+	}
+	if _, dialErr := clientMux.DialContext(context.Background()); dialErr == nil || dialErr.Error() != err.Error() {
+		t.Errorf("DialContext() error = %v, want the error of ValidateConfig()", dialErr)
+	}
+}
+
+func TestEndpointMTUValidation(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}
+	udp := func(mtu int) UnderlayProperties {
+		return NewUnderlayProperties(mtu, util.IPVersion4, util.UDPTransport, nil, addr)
+	}
+	tcp := func(mtu int) UnderlayProperties {
+		return NewUnderlayProperties(mtu, util.IPVersion4, util.TCPTransport, nil, addr)
+	}
+	minMTU := MinMTU(util.IPVersion4, util.UDPTransport)
+	if got := MaxFragmentSize(minMTU, util.IPVersion4, util.UDPTransport); got != MaxSessionOpenPayload {
+		t.Errorf("MaxFragmentSize() of minimum MTU = %d, want %d", got, MaxSessionOpenPayload)
+	}
+
+	testCases := []struct {
+		name        string
+		endpoints   []UnderlayProperties
+		wantWarning bool
+		wantErr     bool
+	}{
+		{name: "consistent", endpoints: []UnderlayProperties{udp(1400), udp(1420), tcp(1500)}},
+		{name: "tcp ignored", endpoints: []UnderlayProperties{udp(1500), tcp(400)}},
+		{name: "mismatch", endpoints: []UnderlayProperties{udp(1500), udp(1280)}, wantWarning: true},
+		{name: "too small", endpoints: []UnderlayProperties{udp(1500), udp(minMTU - 1)}, wantErr: true},
+	}
+	for _, tc := range testCases {
+		warning, err := validateEndpointMTUs(tc.endpoints)
+		if (warning != "") != tc.wantWarning {
+			t.Errorf("%s: got warning %q, want warning %v", tc.name, warning, tc.wantWarning)
+		}
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tc.name, err, tc.wantErr)
+		}
+	}
+
+	clientMux := NewMux(true).
+		SetClientPassword(cipher.HashPassword([]byte("kuiranbudong"), []byte("xiaochitang"))).
+		SetEndpoints([]UnderlayProperties{udp(1500), udp(1000)})
+	if got := clientMux.EffectiveMTU(); got != 1000 {
+		t.Errorf("EffectiveMTU() = %d, want 1000", got)
+	}
+	if _, err := clientMux.DialContext(context.Background()); err == nil {
+		t.Errorf("DialContext() succeeded with a endpoint MTU smaller than the minimum")
+	}
+	serverMux := NewMux(false).
+		SetServerUsers(users).
+		SetEndpoints([]UnderlayProperties{NewUnderlayProperties(1000, util.IPVersion4, util.UDPTransport, addr, nil)})
+	if err := serverMux.Start(); err == nil {
+		t.Errorf("Start() succeeded with a endpoint MTU smaller than the minimum")
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/enfein/mieru/pkg/log"
+	"github.com/enfein/mieru/pkg/mathext"
+)
+
+const (
+	// warmCheckInterval is the maximum time between two checks of the
+	// number of warm underlays.
+	warmCheckInterval = 30 * time.Second
+
+	// warmDialTimeout is the maximum time to create a warm underlay.
+	warmDialTimeout = 10 * time.Second
+
+	// minWarmBackoff is the initial wait time after a warm underlay
+	// can't be created.
+	minWarmBackoff = 500 * time.Millisecond
+
+	// maxWarmBackoff is the maximum wait time after warm underlays
+	// can't be created.
+	maxWarmBackoff = time.Minute
+)
+
+func (m *Mux) SetMinWarmUnderlays(n int) *Mux {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.isClient {
+		panic("Can't set min warm underlays in server mux")
+	}
+	if m.used {
+		panic("Can't set min warm underlays after mux is used")
+	}
+	m.minWarm = mathext.Max(n, 0)
+	if m.minWarm > 0 {
+		m.warmWake = make(chan struct{}, 1)
+	} else {
+		m.warmWake = nil
+	}
+	m.logf(log.InfoLevel, "Mux min warm underlays is set to %d", m.minWarm)
+	return m
+}
+
+// startWarmKeeper starts the goroutine that keeps the warm underlays,
+// if it is enabled.
+// This method MUST be called only when holding the mu lock.
+func (m *Mux) startWarmKeeper() {
+	if !m.isClient || m.minWarm <= 0 {
+		return
+	}
+	go m.runWarmKeeper(m.minWarm)
+}
+
+// runWarmKeeper creates underlays until n of them are warm, every time
+// a underlay exits and periodically, until the mux is closed.
+func (m *Mux) runWarmKeeper(n int) {
+	backoff := minWarmBackoff
+	for {
+		if m.isStopped() {
+			return
+		}
+		wait := warmCheckInterval
+		ctx, cancel := context.WithTimeout(context.Background(), warmDialTimeout)
+		err := m.Warmup(ctx, n)
+		cancel()
+		if err != nil {
+			if m.isStopped() {
+				return
+			}
+			wait = backoff/2 + time.Duration(m.rand.Float64()*float64(backoff/2))
+			m.logf(log.DebugLevel, "Keep %d warm underlays failed: %v. Retry in %v", n, err, wait)
+			backoff = mathext.Min(backoff*2, maxWarmBackoff)
+		} else {
+			backoff = minWarmBackoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-m.done:
+			timer.Stop()
+			return
+		case <-m.warmWake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// wakeWarmKeeper asks the warm underlay keeper to check the number of
+// warm underlays now. It doesn't block.
+func (m *Mux) wakeWarmKeeper() {
+	if m.warmWake == nil {
+		return
+	}
+	select {
+	case m.warmWake <- struct{}{}:
+	default:
+	}
+}
+
+// Warmup creates client underlays in advance until at least n of them
+// can accept new sessions, so the following DialContext calls may reuse
+// them without waiting for a new connection. It stops early if the maximum
+// number of underlays is reached. At most n underlays are created, and an
+// error is returned if fewer than n can accept new sessions after that.
+// The context only limits the time to connect; warmed underlays that are
+// not used are closed by the idle cleaner.
+func (m *Mux) Warmup(ctx context.Context, n int) error {
+	if err := m.checkClientConfig(); err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		m.mu.Lock()
+		m.markUsed()
+		m.cleanUnderlay()
+		active := len(m.activeUnderlays(nil))
+		if active >= n || m.isMaxUnderlaysReached() {
+			m.mu.Unlock()
+			return nil
+		}
+		if attempt >= n {
+			m.mu.Unlock()
+			return fmt.Errorf("warm up underlay failed: %d of %d underlays can accept new sessions", active, n)
+		}
+		opts := &dialOptions{
+			endpoint:        -1,
+			failedEndpoints: make(map[int]bool),
+			loopCtx:         context.Background(),
+		}
+		underlay, err := m.newUnderlay(ctx, opts)
+		if err == nil {
+			if m.warmUnderlays == nil {
+				m.warmUnderlays = make(map[Underlay]bool)
+			}
+			m.warmUnderlays[underlay] = true
+			m.logEvent(log.DebugLevel, EventUnderlayOpen, underlayFields(underlay), "Created warm underlay %v", underlay)
+		}
+		m.mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("warm up underlay failed: %w", err)
+		}
+	}
+}
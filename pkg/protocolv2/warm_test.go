@@ -0,0 +1,152 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/enfein/mieru/pkg/stderror"
+	"github.com/enfein/mieru/pkg/util"
+)
+
+func TestWarmup(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint).SetUnderlaySelector(LeastPendingSelector{})
+	defer clientMux.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := clientMux.Warmup(ctx, 2); err != nil {
+		t.Fatalf("Warmup() failed: %v", err)
+	}
+	// Warmed underlays don't depend on the context of Warmup.
+	cancel()
+	if active, total := clientMux.UnderlayCount(); active != 2 || total != 2 {
+		t.Fatalf("UnderlayCount() = (%d, %d), want (2, 2)", active, total)
+	}
+	clientMux.mu.Lock()
+	warmed := append([]Underlay{}, clientMux.underlays...)
+	clientMux.mu.Unlock()
+
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	if s := conn.(*Session); s.underlay() != warmed[0] && s.underlay() != warmed[1] {
+		t.Errorf("session is not scheduled to a warmed underlay")
+	}
+	if _, total := clientMux.UnderlayCount(); total != 2 {
+		t.Errorf("got %d underlays after dial, want 2", total)
+	}
+
+	// The unused underlay is disabled by the idle cleaner.
+	var unused Underlay
+	for _, underlay := range warmed {
+		if sessionCount(underlay) == 0 {
+			unused = underlay
+		}
+	}
+	if unused == nil {
+		t.Fatalf("no unused warmed underlay")
+	}
+	unused.Scheduler().mu.Lock()
+	unused.Scheduler().lastScheduleTime = time.Now().Add(-scheduleIdleTime - time.Second)
+	unused.Scheduler().mu.Unlock()
+	clientMux.mu.Lock()
+	clientMux.cleanUnderlay()
+	clientMux.mu.Unlock()
+	if !unused.Scheduler().IsDisabled() {
+		t.Errorf("unused warmed underlay is not disabled")
+	}
+	if active, _ := clientMux.UnderlayCount(); active != 1 {
+		t.Errorf("got %d active underlays after clean, want 1", active)
+	}
+	// The used underlay is left to the session close.
+	clientMux.mu.Lock()
+	tracked := clientMux.warmUnderlays[conn.(*Session).underlay()]
+	clientMux.mu.Unlock()
+	if tracked {
+		t.Errorf("used underlay is still cleaned as a warm underlay")
+	}
+
+	if err := NewMux(false).Warmup(context.Background(), 1); !errors.Is(err, stderror.ErrInvalidOperation) {
+		t.Errorf("Warmup() on server returned %v, want %v", err, stderror.ErrInvalidOperation)
+	}
+}
+
+func TestMinWarmUnderlays(t *testing.T) {
+	_, endpoint := startTestMux(t, util.TCPTransport)
+	clientMux := newTestClient(endpoint).SetMinWarmUnderlays(2)
+	defer clientMux.Close()
+
+	// The warm underlays are created after the mux is used.
+	conn, err := clientMux.DialContext(context.Background())
+	if err != nil {
+		t.Fatalf("DialContext() failed: %v", err)
+	}
+	defer conn.Close()
+	waitActive := func(want int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			active, _ := clientMux.UnderlayCount()
+			if active >= want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d active underlays, want %d", active, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitActive(2)
+
+	// A dropped warm underlay is replaced.
+	var dropped Underlay
+	clientMux.mu.Lock()
+	for _, underlay := range clientMux.underlays {
+		if sessionCount(underlay) == 0 {
+			dropped = underlay
+		}
+	}
+	clientMux.mu.Unlock()
+	if dropped == nil {
+		t.Fatalf("no unused warm underlay")
+	}
+	dropped.Close()
+	waitActive(2)
+	clientMux.mu.Lock()
+	for _, underlay := range clientMux.activeUnderlays(nil) {
+		if underlay == dropped {
+			t.Errorf("dropped underlay is still active")
+		}
+	}
+
+	// The idle cleaner keeps the warm underlays.
+	for _, underlay := range clientMux.underlays {
+		underlay.Scheduler().mu.Lock()
+		underlay.Scheduler().lastScheduleTime = time.Now().Add(-scheduleIdleTime - time.Second)
+		underlay.Scheduler().mu.Unlock()
+	}
+	clientMux.cleanUnderlay()
+	if active := len(clientMux.activeUnderlays(nil)); active != 2 {
+		t.Errorf("got %d active underlays after clean, want 2", active)
+	}
+	clientMux.mu.Unlock()
+}
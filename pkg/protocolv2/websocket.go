@@ -0,0 +1,366 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bufio"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/enfein/mieru/pkg/stderror"
+)
+
+const (
+	// webSocketGUID is used to compute Sec-WebSocket-Accept. See RFC 6455.
+	webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// webSocketHandshakeTimeout is the maximum time to finish the opening
+	// handshake of WebSocket.
+	webSocketHandshakeTimeout = 10 * time.Second
+
+	// maxWebSocketControlPayload is the maximum payload size of a
+	// WebSocket control frame.
+	maxWebSocketControlPayload = 125
+
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+)
+
+// webSocketAccept returns the Sec-WebSocket-Accept value of the key.
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// webSocketKey returns a random Sec-WebSocket-Key value.
+func webSocketKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// wsConn carries a byte stream in WebSocket binary frames.
+// Each Write sends one frame. Read returns the payload of data frames
+// as a continuous stream, and handles control frames internally.
+type wsConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	isClient bool
+
+	// Remaining payload bytes of the current data frame.
+	remaining int64
+	mask      [4]byte
+	masked    bool
+	maskPos   int
+	rLock     sync.Mutex
+
+	wLock sync.Mutex
+}
+
+var _ net.Conn = &wsConn{}
+
+// clientWebSocketHandshake sends the opening handshake to the server
+// and returns the WebSocket connection.
+func clientWebSocketHandshake(ctx context.Context, conn net.Conn, host, path string) (*wsConn, error) {
+	if path == "" {
+		path = "/"
+	}
+	key, err := webSocketKey()
+	if err != nil {
+		return nil, fmt.Errorf("webSocketKey() failed: %w", err)
+	}
+	deadline := time.Now().Add(webSocketHandshakeTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest() failed: %w", err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("write WebSocket request failed: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, fmt.Errorf("read WebSocket response failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket upgrade is rejected with status %q", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return nil, fmt.Errorf("WebSocket response has invalid Upgrade header %q", resp.Header.Get("Upgrade"))
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, fmt.Errorf("WebSocket response has invalid Sec-WebSocket-Accept header")
+	}
+	return &wsConn{Conn: conn, reader: reader, isClient: true}, nil
+}
+
+// serverWebSocketHandshake reads the opening handshake from the client
+// and returns the WebSocket connection. If path is not empty, the request
+// must use that path.
+func serverWebSocketHandshake(conn net.Conn, path string) (*wsConn, error) {
+	conn.SetDeadline(time.Now().Add(webSocketHandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read WebSocket request failed: %w", err)
+	}
+	req.Body.Close()
+	reject := func(status int, reason string) error {
+		resp := &http.Response{
+			StatusCode: status,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+		}
+		resp.Header.Set("Connection", "close")
+		resp.Write(conn)
+		return fmt.Errorf("WebSocket upgrade is rejected: %s", reason)
+	}
+	if req.Method != http.MethodGet {
+		return nil, reject(http.StatusMethodNotAllowed, "method is "+req.Method)
+	}
+	if path != "" && req.URL.Path != path {
+		return nil, reject(http.StatusNotFound, "path is "+req.URL.Path)
+	}
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || !headerContainsToken(req.Header, "Connection", "upgrade") {
+		return nil, reject(http.StatusBadRequest, "not a WebSocket upgrade request")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, reject(http.StatusBadRequest, "unsupported WebSocket version "+req.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, reject(http.StatusBadRequest, "Sec-WebSocket-Key is missing")
+	}
+
+	resp := &http.Response{
+		StatusCode: http.StatusSwitchingProtocols,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	resp.Header.Set("Upgrade", "websocket")
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Sec-WebSocket-Accept", webSocketAccept(key))
+	if err := resp.Write(conn); err != nil {
+		return nil, fmt.Errorf("write WebSocket response failed: %w", err)
+	}
+	return &wsConn{Conn: conn, reader: reader, isClient: false}, nil
+}
+
+// headerContainsToken returns true if the comma separated header value
+// contains the token, ignoring case.
+func headerContainsToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read implements net.Conn interface.
+func (c *wsConn) Read(b []byte) (int, error) {
+	c.rLock.Lock()
+	defer c.rLock.Unlock()
+	for c.remaining == 0 {
+		if err := c.nextDataFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			b[i] ^= c.mask[c.maskPos]
+			c.maskPos = (c.maskPos + 1) % 4
+		}
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// Write implements net.Conn interface. The data is sent in a binary frame.
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(wsOpBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close implements net.Conn interface. It sends a close frame
+// before closing the network connection.
+func (c *wsConn) Close() error {
+	c.Conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	c.writeFrame(wsOpClose, nil)
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		// The close frame already ends the stream. Skip the TLS close
+		// notify alert, which fails if the peer is gone.
+		return tlsConn.NetConn().Close()
+	}
+	return c.Conn.Close()
+}
+
+// nextDataFrame reads frames until the header of a data frame with payload
+// is read. Control frames are handled. The caller must hold the rLock.
+func (c *wsConn) nextDataFrame() error {
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+		length := int64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+				return err
+			}
+			length = int64(binary.BigEndian.Uint64(ext[:]))
+			if length < 0 {
+				return fmt.Errorf("invalid WebSocket frame length")
+			}
+		}
+		// Client must mask the frames, and server must not.
+		if masked == c.isClient {
+			return fmt.Errorf("WebSocket frame masking is invalid: %w", stderror.ErrInvalidArgument)
+		}
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+				return err
+			}
+		}
+
+		switch opcode {
+		case wsOpBinary, wsOpContinuation:
+			c.remaining = length
+			c.mask = mask
+			c.masked = masked
+			c.maskPos = 0
+			if length > 0 {
+				return nil
+			}
+		case wsOpClose, wsOpPing, wsOpPong:
+			if length > maxWebSocketControlPayload {
+				return fmt.Errorf("WebSocket control frame is too large")
+			}
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(c.reader, payload); err != nil {
+				return err
+			}
+			if masked {
+				for i := range payload {
+					payload[i] ^= mask[i%4]
+				}
+			}
+			switch opcode {
+			case wsOpClose:
+				return io.EOF
+			case wsOpPing:
+				if err := c.writeFrame(wsOpPong, payload); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("unsupported WebSocket opcode %d", opcode)
+		}
+	}
+}
+
+// writeFrame sends a single frame with FIN bit set.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.wLock.Lock()
+	defer c.wLock.Unlock()
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if c.isClient {
+		var mask [4]byte
+		if _, err := crand.Read(mask[:]); err != nil {
+			return fmt.Errorf("generate WebSocket mask failed: %w", err)
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := start; i < len(frame); i++ {
+			frame[i] ^= mask[(i-start)%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	if _, err := c.Conn.Write(frame); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package protocolv2
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/enfein/mieru/pkg/testtool"
+)
+
+// webSocketPipe returns a pair of connected WebSocket connections.
+func webSocketPipe(t *testing.T, clientPath, serverPath string) (client, server *wsConn, serverErr error) {
+	t.Helper()
+	c, s := net.Pipe()
+	type result struct {
+		conn *wsConn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := serverWebSocketHandshake(s, serverPath)
+		if err != nil {
+			s.Close()
+		}
+		ch <- result{conn, err}
+	}()
+	client, err := clientWebSocketHandshake(context.Background(), c, "example.com", clientPath)
+	res := <-ch
+	if err != nil {
+		c.Close()
+		return nil, nil, res.err
+	}
+	return client, res.conn, res.err
+}
+
+func TestWebSocketConn(t *testing.T) {
+	client, server, err := webSocketPipe(t, "/chat", "/chat")
+	if err != nil {
+		t.Fatalf("WebSocket handshake failed: %v", err)
+	}
+	defer client.Close()
+	defer server.Close()
+
+	// Payload sizes that use the 7 bits, 16 bits and 64 bits length.
+	for _, size := range []int{1, 125, 126, 4096, 70000} {
+		payload := testtool.TestHelperGenRot13Input(size)
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := client.Write(payload)
+			errCh <- err
+		}()
+		got := make([]byte, size)
+		if _, err := io.ReadFull(server, got); err != nil {
+			t.Fatalf("io.ReadFull() failed: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		if !bytes.Equal(payload, got) {
+			t.Errorf("server received unexpected payload of size %d", size)
+		}
+
+		go func() {
+			_, err := server.Write(payload)
+			errCh <- err
+		}()
+		if _, err := io.ReadFull(client, got); err != nil {
+			t.Fatalf("io.ReadFull() failed: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		if !bytes.Equal(payload, got) {
+			t.Errorf("client received unexpected payload of size %d", size)
+		}
+	}
+
+	// The close frame ends the stream.
+	go client.Close()
+	if _, err := server.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Read() after close returned %v, want %v", err, io.EOF)
+	}
+}
+
+func TestWebSocketHandshakeWrongPath(t *testing.T) {
+	if _, _, err := webSocketPipe(t, "/other", "/chat"); err == nil {
+		t.Errorf("WebSocket handshake succeeded with a wrong path")
+	}
+}
@@ -93,6 +93,7 @@ func GetIPVersion(addr string) IPVersion {
 		// Assume there is no port.
 		host = addr
 	}
+	host, _ = SplitIPZone(host)
 	ip := net.ParseIP(host)
 	if ip == nil {
 		return IPVersionUnknown
@@ -104,6 +105,16 @@ func GetIPVersion(addr string) IPVersion {
 	return IPVersion6
 }
 
+// SplitIPZone splits an IPv6 address with a zone identifier,
+// e.g. "fe80::1%eth0", into the address and the zone.
+// If there is no zone, the host is returned with an empty zone.
+func SplitIPZone(host string) (ip, zone string) {
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		return host[:i], host[i+1:]
+	}
+	return host, ""
+}
+
 // MaybeDecorateIPv6 adds [ and ] before and after an IPv6 address. If the
 // input string is a IPv4 address or not a valid IP address (e.g. is a domain),
 // the same string is returned.
@@ -27,6 +27,8 @@ func TestGetIPVersion(t *testing.T) {
 		{"google.com", IPVersionUnknown},
 		{"127.0.0.1", IPVersion4},
 		{"1234::0", IPVersion6},
+		{"fe80::1%eth0", IPVersion6},
+		{"[fe80::1%eth0]:8964", IPVersion6},
 	}
 
 	for _, tc := range testcases {
@@ -36,6 +38,25 @@ func TestGetIPVersion(t *testing.T) {
 	}
 }
 
+func TestSplitIPZone(t *testing.T) {
+	testcases := []struct {
+		input string
+		ip    string
+		zone  string
+	}{
+		{"127.0.0.1", "127.0.0.1", ""},
+		{"fe80::1", "fe80::1", ""},
+		{"fe80::1%eth0", "fe80::1", "eth0"},
+		{"fe80::1%2", "fe80::1", "2"},
+	}
+
+	for _, tc := range testcases {
+		if ip, zone := SplitIPZone(tc.input); ip != tc.ip || zone != tc.zone {
+			t.Errorf("SplitIPZone(%q) = %q, %q, want %q, %q", tc.input, ip, zone, tc.ip, tc.zone)
+		}
+	}
+}
+
 func TestMaybeDecorateIPv6(t *testing.T) {
 	testcases := []struct {
 		input string
@@ -0,0 +1,39 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build !(android || linux)
+
+package sockopts
+
+import (
+	"errors"
+)
+
+// SocketBufferRawErr returns an error outside Android and Linux platform.
+func SocketBufferRawErr(readBytes, writeBytes int) RawControlErr {
+	return func(fd uintptr) error {
+		return errors.New("socket buffer size is not supported on this platform")
+	}
+}
+
+// SocketBufferSizes returns an error outside Android and Linux platform.
+func SocketBufferSizes(fd uintptr) (readBytes, writeBytes int, err error) {
+	return 0, 0, errors.New("socket buffer size is not supported on this platform")
+}
+
+// MaxSocketBuffers returns an error outside Android and Linux platform.
+func MaxSocketBuffers() (readBytes, writeBytes int, err error) {
+	return 0, 0, errors.New("socket buffer size is not supported on this platform")
+}
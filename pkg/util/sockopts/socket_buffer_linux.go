@@ -0,0 +1,85 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build android || linux
+
+package sockopts
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// SocketBufferRawErr sets the receive and send buffer sizes of the socket.
+// A size that is not positive is not changed. The kernel doubles the value
+// to allow space for bookkeeping, and caps it by the system maximum.
+func SocketBufferRawErr(readBytes, writeBytes int) RawControlErr {
+	return func(fd uintptr) error {
+		if readBytes > 0 {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, readBytes); err != nil {
+				return fmt.Errorf("set SO_RCVBUF failed: %w", err)
+			}
+		}
+		if writeBytes > 0 {
+			if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, writeBytes); err != nil {
+				return fmt.Errorf("set SO_SNDBUF failed: %w", err)
+			}
+		}
+		return nil
+	}
+}
+
+// SocketBufferSizes returns the receive and send buffer sizes of the socket.
+func SocketBufferSizes(fd uintptr) (readBytes, writeBytes int, err error) {
+	readBytes, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get SO_RCVBUF failed: %w", err)
+	}
+	writeBytes, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	if err != nil {
+		return 0, 0, fmt.Errorf("get SO_SNDBUF failed: %w", err)
+	}
+	return readBytes, writeBytes, nil
+}
+
+// MaxSocketBuffers returns the maximum receive and send buffer sizes
+// that an unprivileged process can set.
+func MaxSocketBuffers() (readBytes, writeBytes int, err error) {
+	readBytes, err = readProcInt("/proc/sys/net/core/rmem_max")
+	if err != nil {
+		return 0, 0, err
+	}
+	writeBytes, err = readProcInt("/proc/sys/net/core/wmem_max")
+	if err != nil {
+		return 0, 0, err
+	}
+	return readBytes, writeBytes, nil
+}
+
+func readProcInt(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid content of %s: %w", path, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,36 @@
+// Copyright (C) 2023  mieru authors
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build android || linux
+
+package sockopts
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// TrafficClassRawErr sets the type of service byte of outgoing IPv4 packets
+// and the traffic class of outgoing IPv6 packets to tos. It returns an error
+// only if neither option can be set.
+func TrafficClassRawErr(tos int) RawControlErr {
+	return func(fd uintptr) error {
+		err4 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+		err6 := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		if err4 != nil && err6 != nil {
+			return err4
+		}
+		return nil
+	}
+}
@@ -21,4 +21,7 @@ const (
 	UnknownTransport TransportProtocol = iota
 	UDPTransport
 	TCPTransport
+	WebSocketTransport
+	TLSTransport
+	QUICTransport
 )